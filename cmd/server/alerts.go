@@ -0,0 +1,573 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firestore collections of the alert rules and the alerts they triggered
+const (
+	AlertRulesCollection = "alertRules"
+	AlertsCollection     = "alerts"
+)
+
+// Baselines a condition can measure a change against
+const (
+	AlertBaselinePrevious = "previous" // The product as stored before this update
+	AlertBaselineAvg30    = "avg30"    // 30-day buy box average, buyBoxPrice only
+	AlertBaselineAvg90    = "avg90"    // 90-day buy box average, buyBoxPrice only
+)
+
+// Stock transitions a condition can test, see stockTransition
+const (
+	AlertStockOut  = "outOfStock"  // The product went out of stock since it was last stored
+	AlertStockBack = "backInStock" // The product is back in stock since it was last stored
+)
+
+// maxAlerts caps the alerts returned by GET /alerts/triggered
+const maxAlerts = 500
+
+// AlertCondition tests one product metric. With Op the metric is compared with Value,
+// e.g. salesRank < 1000. With Change it must have dropped or risen by at least Percent
+// against Baseline, e.g. buyBoxPrice drop 15% vs avg90. With Stock, instead of a
+// metric, the product must have gone out of stock or come back in stock.
+type AlertCondition struct {
+	Metric   string  `json:"metric,omitempty" firestore:"metric"`
+	Op       string  `json:"op,omitempty" firestore:"op"` // "<", "<=", ">", ">=", "==", "!="
+	Value    float64 `json:"value,omitempty" firestore:"value"`
+	Change   string  `json:"change,omitempty" firestore:"change"` // "drop" or "rise"
+	Percent  float64 `json:"percent,omitempty" firestore:"percent"`
+	Baseline string  `json:"baseline,omitempty" firestore:"baseline"`
+	Stock    string  `json:"stock,omitempty" firestore:"stock"` // "outOfStock" or "backInStock"
+}
+
+// AlertRule triggers an alert when a product it selects is stored with data meeting
+// all of its conditions. Products are selected by ASIN or by a finder query, of which
+// brand, categories_include and categories_exclude are matched.
+type AlertRule struct {
+	ID         string           `json:"id" firestore:"-"`
+	Name       string           `json:"name,omitempty" firestore:"name"`
+	ASINs      []string         `json:"asins,omitempty" firestore:"asins"`
+	Domain     string           `json:"domain,omitempty" firestore:"domain"` // Only products of this Keepa domain, any when empty
+	Query      *FinderQuery     `json:"query,omitempty" firestore:"-"`
+	QueryJSON  string           `json:"-" firestore:"query"` // Query encoded, the ranges are not mapped by Firestore
+	Conditions []AlertCondition `json:"conditions" firestore:"conditions"`
+	Enabled    bool             `json:"enabled" firestore:"enabled"`
+	CreatedAt  time.Time        `json:"createdAt" firestore:"createdAt"`
+}
+
+// Alert is a triggered rule for one product. It stays open until acknowledged; while
+// open, further matches only update it, so a product does not alert on every fetch.
+type Alert struct {
+	ID              string     `json:"id" firestore:"-"`
+	RuleID          string     `json:"ruleId" firestore:"ruleId"`
+	RuleName        string     `json:"ruleName,omitempty" firestore:"ruleName"`
+	ASIN            string     `json:"asin" firestore:"asin"`
+	Domain          string     `json:"domain,omitempty" firestore:"domain"`
+	Title           string     `json:"title,omitempty" firestore:"title"`
+	Message         string     `json:"message" firestore:"message"` // The conditions that held, with the values seen
+	TaskID          string     `json:"taskId,omitempty" firestore:"taskId"`
+	TriggeredAt     time.Time  `json:"triggeredAt" firestore:"triggeredAt"`
+	LastTriggeredAt time.Time  `json:"lastTriggeredAt" firestore:"lastTriggeredAt"`
+	Count           int        `json:"count" firestore:"count"` // Matches since the alert opened
+	Acknowledged    bool       `json:"acknowledged" firestore:"acknowledged"`
+	AcknowledgedAt  *time.Time `json:"acknowledgedAt,omitempty" firestore:"acknowledgedAt"`
+}
+
+// alertMetrics are the product metrics conditions can test; false means no data
+var alertMetrics = map[string]func(p *SimplifiedProduct) (float64, bool){
+	"buyBoxPrice": func(p *SimplifiedProduct) (float64, bool) { return float64(p.BuyBoxPrice), p.BuyBoxPrice > 0 },
+	"salesRank": func(p *SimplifiedProduct) (float64, bool) {
+		rank, ok := latestSalesRank(p.SalesRanks)
+		return float64(rank), ok && rank > 0
+	},
+	"offerCount": func(p *SimplifiedProduct) (float64, bool) {
+		return float64(p.OfferCountFBA + p.OfferCountFBM), p.OfferCountFBA+p.OfferCountFBM > 0
+	},
+	"monthlySold": func(p *SimplifiedProduct) (float64, bool) { return float64(p.MonthlySold), p.MonthlySold > 0 },
+	"rating":      func(p *SimplifiedProduct) (float64, bool) { return p.Rating, p.Rating > 0 },
+	"reviewCount": func(p *SimplifiedProduct) (float64, bool) { return float64(p.ReviewCount), p.ReviewCount > 0 },
+}
+
+// validate checks the metric, operator or change, and baseline of a condition
+func (cond *AlertCondition) validate() error {
+	if cond.Stock != "" {
+		if cond.Metric != "" || cond.Op != "" || cond.Change != "" {
+			return fmt.Errorf("use either stock or metric")
+		}
+		if cond.Stock != AlertStockOut && cond.Stock != AlertStockBack {
+			return fmt.Errorf("stock must be %s or %s", AlertStockOut, AlertStockBack)
+		}
+		return nil
+	}
+	if _, ok := alertMetrics[cond.Metric]; !ok {
+		return fmt.Errorf("unknown metric %q", cond.Metric)
+	}
+	if cond.Change == "" {
+		_, err := compareMetric(0, cond.Op, 0)
+		return err
+	}
+	if cond.Op != "" {
+		return fmt.Errorf("use either op or change")
+	}
+	if cond.Change != "drop" && cond.Change != "rise" {
+		return fmt.Errorf("change must be drop or rise")
+	}
+	if cond.Percent <= 0 {
+		return fmt.Errorf("percent must be positive")
+	}
+	switch cond.Baseline {
+	case AlertBaselinePrevious:
+	case AlertBaselineAvg30, AlertBaselineAvg90:
+		if cond.Metric != "buyBoxPrice" {
+			return fmt.Errorf("baseline %s is only available for buyBoxPrice", cond.Baseline)
+		}
+	default:
+		return fmt.Errorf("baseline must be previous, avg30 or avg90")
+	}
+	return nil
+}
+
+// evaluate tests the condition, returning a description of the values when it holds
+func (cond *AlertCondition) evaluate(previous, current *SimplifiedProduct) (string, bool) {
+	if cond.Stock != "" {
+		switch transition := stockTransition(previous, current); {
+		case cond.Stock == AlertStockOut && transition == EventProductOutOfStock:
+			return "went out of stock", true
+		case cond.Stock == AlertStockBack && transition == EventProductBackInStock:
+			return "is back in stock", true
+		}
+		return "", false
+	}
+	value, ok := alertMetrics[cond.Metric](current)
+	if !ok {
+		return "", false
+	}
+	if cond.Change == "" {
+		holds, _ := compareMetric(value, cond.Op, cond.Value)
+		return fmt.Sprintf("%s %g %s %g", cond.Metric, value, cond.Op, cond.Value), holds
+	}
+
+	var baseline float64
+	switch cond.Baseline {
+	case AlertBaselineAvg30:
+		baseline = float64(current.BuyBoxAvg30)
+	case AlertBaselineAvg90:
+		baseline = float64(current.BuyBoxAvg90)
+	case AlertBaselinePrevious:
+		if previous != nil {
+			baseline, _ = alertMetrics[cond.Metric](previous)
+		}
+	}
+	if baseline <= 0 {
+		return "", false
+	}
+	change := (value - baseline) / baseline * 100
+	holds := (cond.Change == "drop" && -change >= cond.Percent) || (cond.Change == "rise" && change >= cond.Percent)
+	return fmt.Sprintf("%s %g is %.1f%% vs %s %g", cond.Metric, value, change, cond.Baseline, baseline), holds
+}
+
+// validate checks the selection and conditions of a rule
+func (rule *AlertRule) validate() error {
+	if len(rule.ASINs) == 0 && rule.Query == nil {
+		return fmt.Errorf("asins or query is required")
+	}
+	if len(rule.ASINs) > 0 && rule.Query != nil {
+		return fmt.Errorf("use either asins or query")
+	}
+	if rule.Query != nil {
+		// Only what a stored product records can be matched
+		matched := *rule.Query
+		matched.Brand, matched.CategoriesInclude, matched.CategoriesExclude = nil, nil, nil
+		if len(matched.Ranges) > 0 || !reflect.DeepEqual(matched.finderQueryFields, finderQueryFields{}) {
+			return fmt.Errorf("query can only select by brand, categories_include and categories_exclude")
+		}
+	}
+	if len(rule.Conditions) == 0 {
+		return fmt.Errorf("at least one condition is required")
+	}
+	for i := range rule.Conditions {
+		if err := rule.Conditions[i].validate(); err != nil {
+			return fmt.Errorf("condition %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// selects reports whether the rule applies to a product
+func (rule *AlertRule) selects(product *SimplifiedProduct) bool {
+	if len(rule.ASINs) > 0 {
+		return containsString(rule.ASINs, product.Asin)
+	}
+	query := rule.Query
+	if len(query.Brand) > 0 && !containsFold(query.Brand, product.Brand) {
+		return false
+	}
+	if len(query.CategoriesInclude) > 0 && !sharesCategory(query.CategoriesInclude, product.Categories) {
+		return false
+	}
+	return !sharesCategory(query.CategoriesExclude, product.Categories)
+}
+
+// evaluate returns the message of an alert when all conditions hold for a product
+func (rule *AlertRule) evaluate(previous, current *SimplifiedProduct) (string, bool) {
+	descriptions := make([]string, 0, len(rule.Conditions))
+	for i := range rule.Conditions {
+		description, holds := rule.Conditions[i].evaluate(previous, current)
+		if !holds {
+			return "", false
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ", "), true
+}
+
+// containsFold reports whether list holds value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesCategory reports whether the lists have a category in common
+func sharesCategory(selected, categories []int64) bool {
+	for _, category := range categories {
+		for _, id := range selected {
+			if category == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// alertRuleCache holds the enabled rules of a tenant, reloaded from Firestore every
+// ALERT_RULES_REFRESH (1m) so rules created on other instances apply soon
+type alertRuleCache struct {
+	mu       sync.Mutex
+	rules    []*AlertRule
+	loadedAt time.Time
+}
+
+// alertRuleCaches holds the rule cache of every tenant, keyed by tenant ID
+type alertRuleCaches struct {
+	mu     sync.Mutex
+	caches map[string]*alertRuleCache
+}
+
+// alertRules is the process-wide rule cache
+var alertRules = &alertRuleCaches{caches: make(map[string]*alertRuleCache)}
+
+// forContext returns the rule cache of the tenant of ctx
+func (c *alertRuleCaches) forContext(ctx context.Context) *alertRuleCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cache, ok := c.caches[tenantID(ctx)]
+	if !ok {
+		cache = &alertRuleCache{}
+		c.caches[tenantID(ctx)] = cache
+	}
+	return cache
+}
+
+// current returns the enabled rules of the tenant of ctx
+func (c *alertRuleCaches) current(ctx context.Context) []*AlertRule {
+	return c.forContext(ctx).current(ctx)
+}
+
+// invalidate makes the next evaluation reload the rules of the tenant of ctx
+func (c *alertRuleCaches) invalidate(ctx context.Context) {
+	c.forContext(ctx).invalidate()
+}
+
+// current returns the enabled rules, reloading them when the cache expired. A failed
+// reload keeps the previous rules.
+func (c *alertRuleCache) current(ctx context.Context) []*AlertRule {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.loadedAt) < envDuration("ALERT_RULES_REFRESH", time.Minute) {
+		return c.rules
+	}
+	c.loadedAt = time.Now()
+	rules, err := loadAlertRules(ctx, true)
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to reload alert rules", "error", err)
+		return c.rules
+	}
+	c.rules = rules
+	return rules
+}
+
+// invalidate makes the next evaluation reload the rules
+func (c *alertRuleCache) invalidate() {
+	c.mu.Lock()
+	c.loadedAt = time.Time{}
+	c.mu.Unlock()
+}
+
+// loadAlertRules reads the rules of the tenant of ctx from Firestore, only the enabled
+// ones if requested
+func loadAlertRules(ctx context.Context, enabledOnly bool) ([]*AlertRule, error) {
+	query := tenantCollection(ctx, AlertRulesCollection).Query
+	if enabledOnly {
+		query = query.Where("enabled", "==", true)
+	}
+	snapshots, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert rules: %v", err)
+	}
+	rules := make([]*AlertRule, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var rule AlertRule
+		if err := snapshot.DataTo(&rule); err != nil {
+			logger.WarnContext(ctx, "Skipping undecodable alert rule", "rule_id", snapshot.Ref.ID, "error", err)
+			continue
+		}
+		rule.ID = snapshot.Ref.ID
+		if rule.QueryJSON != "" {
+			rule.Query = &FinderQuery{}
+			if err := json.Unmarshal([]byte(rule.QueryJSON), rule.Query); err != nil {
+				logger.WarnContext(ctx, "Skipping alert rule with an undecodable query", "rule_id", rule.ID, "error", err)
+				continue
+			}
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, nil
+}
+
+// evaluateAlertRules tests the rules against freshly stored products. previous holds
+// the products as stored before, nil for new products. Triggered alerts are written
+// in the background.
+func evaluateAlertRules(ctx context.Context, taskID, domain string, previous, current *SimplifiedResponse) {
+	rules := alertRules.current(ctx)
+	if len(rules) == 0 {
+		return
+	}
+	before := make(map[string]*SimplifiedProduct)
+	if previous != nil {
+		for i := range previous.Products {
+			before[previous.Products[i].Asin] = &previous.Products[i]
+		}
+	}
+	for i := range current.Products {
+		product := &current.Products[i]
+		for _, rule := range rules {
+			if (rule.Domain != "" && rule.Domain != domain) || !rule.selects(product) {
+				continue
+			}
+			if message, holds := rule.evaluate(before[product.Asin], product); holds {
+				go triggerAlert(context.WithoutCancel(ctx), rule, domain, product, taskID, message)
+			}
+		}
+	}
+}
+
+// alertID identifies the alert of a rule and product, so each pair has at most one
+func alertID(ruleID, domain, asin string) string {
+	return ruleID + "_" + productDocID(domain, asin)
+}
+
+// triggerAlert opens an alert, or updates the open alert of the rule and product
+func triggerAlert(ctx context.Context, rule *AlertRule, domain string, product *SimplifiedProduct, taskID, message string) {
+	ref := tenantCollection(ctx, AlertsCollection).Doc(alertID(rule.ID, domain, product.Asin))
+	now := time.Now().UTC()
+	opened := false
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		var existing Alert
+		if err == nil {
+			if err := snapshot.DataTo(&existing); err != nil {
+				return err
+			}
+		}
+		opened = err != nil || existing.Acknowledged
+		if !opened {
+			return tx.Update(ref, []firestore.Update{
+				{Path: "message", Value: message},
+				{Path: "taskId", Value: taskID},
+				{Path: "lastTriggeredAt", Value: now},
+				{Path: "count", Value: firestore.Increment(1)},
+			})
+		}
+		return tx.Set(ref, Alert{
+			RuleID:          rule.ID,
+			RuleName:        rule.Name,
+			ASIN:            product.Asin,
+			Domain:          domain,
+			Title:           product.Title,
+			Message:         message,
+			TaskID:          taskID,
+			TriggeredAt:     now,
+			LastTriggeredAt: now,
+			Count:           1,
+		})
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to record alert", "rule_id", rule.ID, LogKeyASIN, product.Asin, "error", err)
+		return
+	}
+	if opened {
+		logger.InfoContext(ctx, "Alert triggered", "rule_id", rule.ID, LogKeyASIN, product.Asin, "message", message)
+		go sendNotification("alert_triggered", "info", fmt.Sprintf("%s: %s %s", alertRuleLabel(rule), product.Asin, message), map[string]interface{}{
+			"alert_id": alertID(rule.ID, domain, product.Asin),
+			"rule_id":  rule.ID,
+			"asin":     product.Asin,
+			"domain":   domain,
+			"title":    product.Title,
+			"task_id":  taskID,
+		})
+	}
+}
+
+// alertRuleLabel names a rule in notifications, by its name or else its ID
+func alertRuleLabel(rule *AlertRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return "Alert rule " + rule.ID
+}
+
+// AlertRuleRequest is the body of POST /alerts
+type AlertRuleRequest struct {
+	Name       string           `json:"name"`
+	ASINs      []string         `json:"asins"`
+	Domain     string           `json:"domain"` // Keepa domain ID or marketplace, any when empty
+	Query      *FinderQuery     `json:"query"`
+	Conditions []AlertCondition `json:"conditions"`
+	Enabled    *bool            `json:"enabled"` // true when omitted
+}
+
+// handleCreateAlertRule stores an alert rule, which applies to products stored from then on
+func handleCreateAlertRule(c *gin.Context) {
+	var req AlertRuleRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	rule := AlertRule{
+		Name:       req.Name,
+		ASINs:      req.ASINs,
+		Query:      req.Query,
+		Conditions: req.Conditions,
+		Enabled:    req.Enabled == nil || *req.Enabled,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if rule.Query != nil {
+		rule.Query.normalize()
+	}
+	if req.Domain != "" {
+		domain, err := parseDomain(req.Domain)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid alert rule: %v", err))
+			return
+		}
+		rule.Domain = domain
+	}
+	if err := rule.validate(); err != nil {
+		respondProblem(c, http.StatusBadRequest, CodeInvalidQuery, fmt.Sprintf("Invalid alert rule: %v", err))
+		return
+	}
+	if rule.Query != nil {
+		data, _ := json.Marshal(rule.Query)
+		rule.QueryJSON = string(data)
+	}
+
+	ref, _, err := tenantCollection(c.Request.Context(), AlertRulesCollection).Add(c.Request.Context(), rule)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to store alert rule: %v", err))
+		return
+	}
+	rule.ID = ref.ID
+	alertRules.invalidate(c.Request.Context())
+	c.JSON(http.StatusCreated, rule)
+}
+
+// handleListAlertRules returns all alert rules
+func handleListAlertRules(c *gin.Context) {
+	rules, err := loadAlertRules(c.Request.Context(), false)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "count": len(rules)})
+}
+
+// handleDeleteAlertRule deletes an alert rule; its alerts are kept
+func handleDeleteAlertRule(c *gin.Context) {
+	ref := tenantCollection(c.Request.Context(), AlertRulesCollection).Doc(c.Param("id"))
+	if _, err := ref.Delete(c.Request.Context(), firestore.Exists); err != nil {
+		if status.Code(err) == codes.NotFound {
+			respondError(c, http.StatusNotFound, "Alert rule not found")
+			return
+		}
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to delete alert rule: %v", err))
+		return
+	}
+	alertRules.invalidate(c.Request.Context())
+	c.JSON(http.StatusOK, gin.H{"id": ref.ID, "deleted": true})
+}
+
+// handleListAlerts returns the triggered alerts, latest first. ?acknowledged=false
+// lists only the open ones, ?asin and ?ruleId narrow the list.
+func handleListAlerts(c *gin.Context) {
+	query := tenantCollection(c.Request.Context(), AlertsCollection).Query
+	if value := c.Query("acknowledged"); value != "" {
+		query = query.Where("acknowledged", "==", value == "true")
+	}
+	if asin := c.Query("asin"); asin != "" {
+		query = query.Where("asin", "==", asin)
+	}
+	if ruleID := c.Query("ruleId"); ruleID != "" {
+		query = query.Where("ruleId", "==", ruleID)
+	}
+	snapshots, err := query.OrderBy("lastTriggeredAt", firestore.Desc).Limit(maxAlerts).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list alerts: %v", err))
+		return
+	}
+	alerts := make([]Alert, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var alert Alert
+		if err := snapshot.DataTo(&alert); err != nil {
+			continue
+		}
+		alert.ID = snapshot.Ref.ID
+		alerts = append(alerts, alert)
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts, "count": len(alerts)})
+}
+
+// handleAcknowledgeAlert closes an alert; the next match of its rule opens it again
+func handleAcknowledgeAlert(c *gin.Context) {
+	ref := tenantCollection(c.Request.Context(), AlertsCollection).Doc(c.Param("id"))
+	now := time.Now().UTC()
+	_, err := ref.Update(c.Request.Context(), []firestore.Update{
+		{Path: "acknowledged", Value: true},
+		{Path: "acknowledgedAt", Value: now},
+	})
+	if status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Alert not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to acknowledge alert: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": ref.ID, "acknowledged": true, "acknowledgedAt": now})
+}
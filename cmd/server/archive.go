@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rawArchiveObject is one JSON payload waiting to be gzipped and uploaded
+type rawArchiveObject struct {
+	name string
+	data []byte
+}
+
+// rawArchiver keeps the raw Keepa responses in Cloud Storage, so fields we do not
+// simplify today can be backfilled later. Uploads run in the background; responses
+// arriving while the queue is full are not archived.
+type rawArchiver struct {
+	bucket *storage.BucketHandle
+	prefix string
+	queue  chan rawArchiveObject
+}
+
+// rawResponses archives to GCS_ARCHIVE_BUCKET, nil when it is unset
+var rawResponses = newRawArchiverFromEnv()
+
+// newRawArchiverFromEnv starts the archiver configured by:
+//
+//	GCS_ARCHIVE_BUCKET      bucket of the archive, archiving is disabled when empty
+//	GCS_ARCHIVE_PREFIX      object name prefix (keepa-raw)
+//	GCS_ARCHIVE_WORKERS     concurrent uploads (4)
+//	GCS_ARCHIVE_QUEUE_SIZE  objects waiting to be uploaded (500)
+func newRawArchiverFromEnv() *rawArchiver {
+	bucket := getEnv("GCS_ARCHIVE_BUCKET", "")
+	if bucket == "" {
+		return nil
+	}
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		logger.Error("Failed to create the Cloud Storage client, raw responses are not archived", "error", err)
+		return nil
+	}
+	archiver := &rawArchiver{
+		bucket: client.Bucket(bucket),
+		prefix: strings.Trim(getEnv("GCS_ARCHIVE_PREFIX", "keepa-raw"), "/"),
+		queue:  make(chan rawArchiveObject, envInt("GCS_ARCHIVE_QUEUE_SIZE", 500)),
+	}
+	for i := 0; i < envInt("GCS_ARCHIVE_WORKERS", 4); i++ {
+		go archiver.run()
+	}
+	return archiver
+}
+
+// objectName returns the date-partitioned name of an archived payload, e.g.
+// keepa-raw/product/dt=2024-05-01/B000123456/20240501T101500.123Z-1a2b3c.json.gz
+func (a *rawArchiver) objectName(endpoint, asin, requestID string, receivedAt time.Time) string {
+	parts := []string{a.prefix, strings.Trim(endpoint, "/"), "dt=" + receivedAt.Format(time.DateOnly)}
+	if asin != "" {
+		parts = append(parts, asin)
+	}
+	parts = append(parts, fmt.Sprintf("%s-%s.json.gz", receivedAt.Format("20060102T150405.000Z"), requestID))
+	if parts[0] == "" {
+		parts = parts[1:]
+	}
+	return strings.Join(parts, "/")
+}
+
+// archive queues the body of a Keepa response. Product responses are split into one
+// object per ASIN; other responses are archived whole.
+func (a *rawArchiver) archive(ctx context.Context, endpoint string, body []byte) {
+	if a == nil {
+		return
+	}
+	receivedAt := time.Now().UTC()
+	requestID := newRequestID()
+
+	var objects []rawArchiveObject
+	var response struct {
+		Products []json.RawMessage `json:"products"`
+	}
+	if json.Unmarshal(body, &response) == nil && len(response.Products) > 0 {
+		for _, product := range response.Products {
+			var key struct {
+				Asin string `json:"asin"`
+			}
+			json.Unmarshal(product, &key)
+			objects = append(objects, rawArchiveObject{name: a.objectName(endpoint, key.Asin, requestID, receivedAt), data: product})
+		}
+	} else {
+		objects = append(objects, rawArchiveObject{name: a.objectName(endpoint, "", requestID, receivedAt), data: body})
+	}
+
+	for _, object := range objects {
+		select {
+		case a.queue <- object:
+		default:
+			logger.WarnContext(ctx, "Raw archive queue full, dropping response", "object", object.name)
+		}
+	}
+}
+
+// run uploads queued objects until the process exits
+func (a *rawArchiver) run() {
+	for object := range a.queue {
+		if err := a.upload(object); err != nil {
+			logger.Error("Failed to archive raw response", "object", object.name, "error", err)
+		}
+	}
+}
+
+// upload gzips an object into the bucket
+func (a *rawArchiver) upload(object rawArchiveObject) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	writer := a.bucket.Object(object.name).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.ContentEncoding = "gzip"
+
+	compressor := gzip.NewWriter(writer)
+	_, err := compressor.Write(object.data)
+	if err == nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		// Canceling before Close discards the partial object
+		cancel()
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"firebase.google.com/go/auth"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeysCollection stores the hashed API keys, keyed by their SHA-256
+const APIKeysCollection = "apiKeys"
+
+// APIKeyHeader carries a static API key
+const APIKeyHeader = "X-API-Key"
+
+// Roles of an authenticated caller
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Authentication methods enabled by AUTH_METHODS
+const (
+	AuthMethodAPIKey   = "apikey"
+	AuthMethodFirebase = "firebase"
+)
+
+// authClient verifies Firebase Auth ID tokens, nil when it could not be created
+var authClient *auth.Client
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	ID     string `json:"id"`     // API key ID, Firebase UID or tenant ID
+	Method string `json:"method"` // AuthMethodAPIKey, AuthMethodFirebase or "tenant"
+	Role   string `json:"role"`
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller of ctx, nil when authentication is disabled
+func principalFrom(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
+
+// authMethods returns the enabled methods of AUTH_METHODS, a comma-separated list of
+// "apikey" and "firebase". Without any, the API is open except for the routes guarded
+// by requireRole.
+func authMethods() []string {
+	var methods []string
+	for _, method := range strings.Split(getEnv("AUTH_METHODS", ""), ",") {
+		if method = strings.ToLower(strings.TrimSpace(method)); method != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// APIKey is a static API key. Only the SHA-256 of the key is stored.
+type APIKey struct {
+	ID        string    `json:"id" firestore:"keyId"` // First characters of the hash, identifying the key in logs
+	Name      string    `json:"name" firestore:"name"`
+	Role      string    `json:"role" firestore:"role"`
+	Disabled  bool      `json:"disabled" firestore:"disabled"`
+	CreatedAt time.Time `json:"createdAt" firestore:"createdAt"`
+}
+
+// apiKeyID returns the ID of the key with the given hash
+func apiKeyID(hash string) string {
+	return hash[:12]
+}
+
+// staticAPIKeys parses AUTH_API_KEYS, a comma-separated list of <sha256 hex>:<role>
+// entries. It is read from Secret Manager and holds the keys that exist before any
+// is stored in Firestore, e.g. the first admin key.
+func staticAPIKeys() map[string]*APIKey {
+	keys := make(map[string]*APIKey)
+	for _, entry := range strings.Split(secret("AUTH_API_KEYS", ""), ",") {
+		hash, role, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if len(hash) != 64 {
+			continue
+		}
+		if role != RoleAdmin {
+			role = RoleUser
+		}
+		hash = strings.ToLower(hash)
+		keys[hash] = &APIKey{ID: apiKeyID(hash), Name: "AUTH_API_KEYS", Role: role}
+	}
+	return keys
+}
+
+// apiKeyRegistry caches the stored API keys by hash for API_KEY_CACHE_TTL (1m), so a
+// disabled key is rejected within that time. Unknown keys are not cached, so the cache
+// only grows with the stored keys; failedAuthLimit bounds their lookups.
+type apiKeyRegistry struct {
+	mu      sync.Mutex
+	entries map[string]apiKeyEntry
+}
+
+type apiKeyEntry struct {
+	key      *APIKey
+	loadedAt time.Time
+}
+
+// apiKeys is the process-wide API key registry
+var apiKeys = &apiKeyRegistry{entries: make(map[string]apiKeyEntry)}
+
+// lookup returns the API key of a presented key, nil when it is unknown
+func (r *apiKeyRegistry) lookup(ctx context.Context, presented string) (*APIKey, error) {
+	hash := hashAccessKey(presented)
+	for staticHash, key := range staticAPIKeys() {
+		if subtle.ConstantTimeCompare([]byte(staticHash), []byte(hash)) == 1 {
+			return key, nil
+		}
+	}
+
+	r.mu.Lock()
+	entry, ok := r.entries[hash]
+	r.mu.Unlock()
+	if ok && time.Since(entry.loadedAt) < envDuration("API_KEY_CACHE_TTL", time.Minute) {
+		return entry.key, nil
+	}
+	snapshot, err := firestoreClient.Collection(APIKeysCollection).Doc(hash).Get(ctx)
+	var key *APIKey
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return nil, fmt.Errorf("failed to read API key: %v", err)
+	default:
+		key = &APIKey{}
+		if err := snapshot.DataTo(key); err != nil {
+			return nil, fmt.Errorf("failed to decode API key: %v", err)
+		}
+	}
+	r.mu.Lock()
+	if key != nil {
+		r.entries[hash] = apiKeyEntry{key: key, loadedAt: time.Now()}
+	} else {
+		delete(r.entries, hash)
+	}
+	r.mu.Unlock()
+	return key, nil
+}
+
+// forget drops the cached entries, so changed keys apply at once on this instance
+func (r *apiKeyRegistry) forget() {
+	r.mu.Lock()
+	r.entries = make(map[string]apiKeyEntry)
+	r.mu.Unlock()
+}
+
+// authenticate resolves the caller from the APIKeyHeader or a Firebase ID token in the
+// Authorization header, read by header, using the enabled methods. It returns nil
+// without credentials or with invalid ones.
+func authenticate(ctx context.Context, header func(name string) string, methods []string) (*Principal, error) {
+	if key := header(APIKeyHeader); key != "" && containsString(methods, AuthMethodAPIKey) {
+		apiKey, err := apiKeys.lookup(ctx, key)
+		if err != nil || apiKey == nil || apiKey.Disabled {
+			return nil, err
+		}
+		return &Principal{ID: apiKey.ID, Method: AuthMethodAPIKey, Role: apiKey.Role}, nil
+	}
+	if token, ok := strings.CutPrefix(header("Authorization"), "Bearer "); ok && containsString(methods, AuthMethodFirebase) {
+		if authClient == nil {
+			return nil, fmt.Errorf("Firebase Auth is not available")
+		}
+		verified, err := authClient.VerifyIDToken(ctx, strings.TrimSpace(token))
+		if err != nil {
+			logger.InfoContext(ctx, "Rejected Firebase ID token", "error", err)
+			return nil, nil
+		}
+		role := RoleUser
+		if claim, _ := verified.Claims["role"].(string); claim == RoleAdmin {
+			role = RoleAdmin
+		}
+		return &Principal{ID: verified.UID, Method: AuthMethodFirebase, Role: role}, nil
+	}
+	return nil, nil
+}
+
+// authMiddleware rejects requests without valid credentials once AUTH_METHODS enables
+// authentication. Firebase users are admins with the custom claim role=admin. Callers
+// resolved by tenantMiddleware are authenticated by their tenant key as users. Keepa
+// notifications carry their own token and stay open.
+func authMiddleware() gin.HandlerFunc {
+	methods := authMethods()
+	if len(methods) == 0 {
+		logger.Warn("Authentication is disabled, set AUTH_METHODS to protect the API")
+		if !authDisabled() {
+			logger.Warn("Admin routes answer 401 without AUTH_METHODS, set AUTH_DISABLED=true to open them")
+		}
+	}
+	return func(c *gin.Context) {
+		switch path := c.Request.URL.Path; {
+		case len(methods) == 0, path == "/keepa/notifications", path == OpenAPIPath, path == SwaggerUIPath:
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		var principal *Principal
+		if tenant := tenantFrom(ctx); tenant != nil {
+			principal = &Principal{ID: tenant.ID, Method: "tenant", Role: RoleUser}
+		} else {
+			presented := c.GetHeader(APIKeyHeader) != "" || c.GetHeader("Authorization") != ""
+			if presented && !allowAuthAttempt(c) {
+				return
+			}
+			var err error
+			if principal, err = authenticate(ctx, c.GetHeader, methods); err != nil {
+				respondError(c, http.StatusServiceUnavailable, err.Error())
+				return
+			}
+			if presented && principal == nil {
+				recordFailedAuth(c)
+			}
+		}
+		if principal == nil {
+			c.Header("WWW-Authenticate", `Bearer realm="keepa-api"`)
+			respondError(c, http.StatusUnauthorized, "Missing or invalid credentials")
+			return
+		}
+		ctx = context.WithValue(ctx, principalKey{}, principal)
+		ctx = withLogAttrs(ctx, slog.String("principal", principal.Method+":"+principal.ID))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// allowAuthAttempt answers 429 when the client IP is past failedAuthLimit, before its
+// credentials are looked up. It reports whether the request may go on.
+func allowAuthAttempt(c *gin.Context) bool {
+	if exhausted, retryAfter := failedAuthLimit.exhausted(c.Request.Context(), "ip:"+c.ClientIP()); exhausted {
+		tooManyRequests(c, retryAfter, "Too many invalid credentials, try again later")
+		return false
+	}
+	return true
+}
+
+// recordFailedAuth books rejected credentials of the client IP on failedAuthLimit
+func recordFailedAuth(c *gin.Context) {
+	failedAuthLimit.allow(c.Request.Context(), "ip:"+c.ClientIP())
+}
+
+// authDisabled reports whether AUTH_DISABLED=true opens the routes of requireRole to
+// unauthenticated callers, for local development without AUTH_METHODS
+func authDisabled() bool {
+	return getEnv("AUTH_DISABLED", "false") == "true"
+}
+
+// requireRole rejects unauthenticated callers with 401 unless authDisabled, and callers
+// without role with 403. Admins have every role.
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := principalFrom(c.Request.Context())
+		if principal == nil {
+			if authDisabled() {
+				c.Next()
+				return
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="keepa-api"`)
+			respondError(c, http.StatusUnauthorized, fmt.Sprintf("The %s role is required, set AUTH_METHODS to authenticate", role))
+			return
+		}
+		if principal.Role != role && principal.Role != RoleAdmin {
+			respondError(c, http.StatusForbidden, fmt.Sprintf("The %s role is required", role))
+			return
+		}
+		c.Next()
+	}
+}
+
+// APIKeyRequest is the body of POST /admin/api-keys
+type APIKeyRequest struct {
+	Name string `json:"name" binding:"required"`
+	Role string `json:"role"` // RoleUser when empty
+}
+
+// handleCreateAPIKey stores a new API key and returns it. The key is only shown once.
+func handleCreateAPIKey(c *gin.Context) {
+	var req APIKeyRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleUser
+	}
+	if req.Role != RoleUser && req.Role != RoleAdmin {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("role must be %s or %s", RoleUser, RoleAdmin))
+		return
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to generate an API key: %v", err))
+		return
+	}
+	key := "ka_" + hex.EncodeToString(secret)
+	hash := hashAccessKey(key)
+	apiKey := &APIKey{ID: apiKeyID(hash), Name: strings.TrimSpace(req.Name), Role: req.Role, CreatedAt: time.Now().UTC()}
+	if _, err := firestoreClient.Collection(APIKeysCollection).Doc(hash).Create(c.Request.Context(), apiKey); err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to store API key: %v", err))
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "Created API key", "key_id", apiKey.ID, "role", apiKey.Role)
+	c.JSON(http.StatusCreated, gin.H{"apiKey": apiKey, "key": key})
+}
+
+// handleListAPIKeys returns the stored API keys without their hashes
+func handleListAPIKeys(c *gin.Context) {
+	snapshots, err := firestoreClient.Collection(APIKeysCollection).OrderBy("createdAt", firestore.Asc).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list API keys: %v", err))
+		return
+	}
+	keys := make([]APIKey, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var key APIKey
+		if err := snapshot.DataTo(&key); err != nil {
+			logger.WarnContext(c.Request.Context(), "Skipping undecodable API key", "key_id", apiKeyID(snapshot.Ref.ID), "error", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	c.JSON(http.StatusOK, gin.H{"apiKeys": keys, "count": len(keys)})
+}
+
+// handleDisableAPIKey disables the stored API key with the given ID
+func handleDisableAPIKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	snapshots, err := firestoreClient.Collection(APIKeysCollection).Where("keyId", "==", id).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to find API key: %v", err))
+		return
+	}
+	if len(snapshots) == 0 {
+		respondError(c, http.StatusNotFound, "API key not found")
+		return
+	}
+	_, err = snapshots[0].Ref.Update(ctx, []firestore.Update{{Path: "disabled", Value: true}})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to disable API key: %v", err))
+		return
+	}
+	apiKeys.forget()
+	logger.InfoContext(ctx, "Disabled API key", "key_id", id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "disabled": true})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+// BestSellers fetches the ASINs of a category's best sellers list, best ranked first
+func (client *KeepaClient) BestSellers(ctx context.Context, categoryID int64, domain string) (*keepa.BestSellers, error) {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/bestsellers?domain=%s&key=%s&category=%d", domain, apiKey, categoryID)
+
+	// A best sellers request costs 50 tokens
+	apiResp, err := client.doRequest(ctx, url, 50, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Best Sellers", LogKeyCategory, categoryID, "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	if apiResp.BestSellersList == nil {
+		return nil, fmt.Errorf("no best sellers list for category %d", categoryID)
+	}
+	return apiResp.BestSellersList, nil
+}
+
+// handleBestSellers fetches a category's best sellers and queues them for the product
+// pipeline. ?limit keeps the top entries only, ?use_cache serves cached products.
+func (client *KeepaClient) handleBestSellers(c *gin.Context) {
+	categoryID, err := strconv.ParseInt(c.Param("category"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid category")
+		return
+	}
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		respondError(c, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	useCache := c.Query("use_cache") == "true"
+
+	list, err := client.BestSellers(c.Request.Context(), categoryID, domain)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	asins := list.AsinList
+	if len(asins) > limit {
+		asins = asins[:limit]
+	}
+
+	taskID := generateTaskID()
+	client.Logger.InfoContext(c.Request.Context(), "Created best sellers task", LogKeyTaskID, taskID, "asins", len(asins), LogKeyCategory, categoryID)
+
+	tasks.create(c.Request.Context(), taskID, TaskKindASINs)
+	tasks.update(taskID, func(task *Task) {
+		task.Domain = domain
+		task.UseCache = useCache
+	})
+	tasks.addASINs(taskID, asins)
+
+	if !enqueueTask(func() { client.runASINTask(taskID, asins, useCache) }) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{
+		"task_id":     taskID,
+		"status":      "pending",
+		"category":    categoryID,
+		"domain":      domain,
+		"asins":       asins,
+		"last_update": keepatime.Key(list.LastUpdate),
+	}))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"net/http"
+	"time"
+)
+
+// productSnapshotSchema is the BigQuery table of product snapshots, one row per
+// product each time it is stored. The table is partitioned by snapshot_time.
+var productSnapshotSchema = bigquery.Schema{
+	{Name: "snapshot_time", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "asin", Type: bigquery.StringFieldType, Required: true},
+	{Name: "title", Type: bigquery.StringFieldType},
+	{Name: "brand", Type: bigquery.StringFieldType},
+	{Name: "parent_asin", Type: bigquery.StringFieldType},
+	{Name: "categories", Type: bigquery.IntegerFieldType, Repeated: true},
+	{Name: "buy_box_price", Type: bigquery.IntegerFieldType, Description: "Cents"},
+	{Name: "has_amazon_offer", Type: bigquery.BooleanFieldType},
+	{Name: "sales_rank", Type: bigquery.IntegerFieldType, Description: "Latest sales rank"},
+	{Name: "monthly_sold", Type: bigquery.IntegerFieldType},
+	{Name: "offer_count_fba", Type: bigquery.IntegerFieldType},
+	{Name: "offer_count_fbm", Type: bigquery.IntegerFieldType},
+	{Name: "rating", Type: bigquery.FloatFieldType},
+	{Name: "review_count", Type: bigquery.IntegerFieldType},
+	{Name: "velocity_score", Type: bigquery.FloatFieldType},
+	{Name: "sales_rank_drops_30", Type: bigquery.IntegerFieldType},
+	{Name: "sales_rank_drops_90", Type: bigquery.IntegerFieldType},
+	{Name: "referral_fee_percent", Type: bigquery.FloatFieldType},
+	{Name: "pick_and_pack_fee", Type: bigquery.IntegerFieldType, Description: "Cents"},
+	{Name: "fetched_at", Type: bigquery.TimestampFieldType},
+	{Name: "domain", Type: bigquery.StringFieldType, Description: "Keepa domain ID"},
+}
+
+// productSnapshotRow is the flattened row of one product. Timestamps are microseconds
+// since the Unix epoch, as the Storage Write API expects them.
+type productSnapshotRow struct {
+	SnapshotTime       int64   `json:"snapshot_time"`
+	Asin               string  `json:"asin"`
+	Title              string  `json:"title,omitempty"`
+	Brand              string  `json:"brand,omitempty"`
+	ParentAsin         string  `json:"parent_asin,omitempty"`
+	Categories         []int64 `json:"categories,omitempty"`
+	BuyBoxPrice        *int    `json:"buy_box_price,omitempty"`
+	HasAmazonOffer     bool    `json:"has_amazon_offer"`
+	SalesRank          *int    `json:"sales_rank,omitempty"`
+	MonthlySold        *int    `json:"monthly_sold,omitempty"`
+	OfferCountFBA      int     `json:"offer_count_fba"`
+	OfferCountFBM      int     `json:"offer_count_fbm"`
+	Rating             float64 `json:"rating,omitempty"`
+	ReviewCount        int     `json:"review_count,omitempty"`
+	VelocityScore      float64 `json:"velocity_score,omitempty"`
+	SalesRankDrops30   *int    `json:"sales_rank_drops_30,omitempty"`
+	SalesRankDrops90   *int    `json:"sales_rank_drops_90,omitempty"`
+	ReferralFeePercent float64 `json:"referral_fee_percent,omitempty"`
+	PickAndPackFee     int     `json:"pick_and_pack_fee,omitempty"`
+	FetchedAt          int64   `json:"fetched_at,omitempty"`
+	Domain             string  `json:"domain,omitempty"`
+}
+
+// positiveOrNil returns nil for Keepa's unknown values, which are 0 or negative
+func positiveOrNil(value int) *int {
+	if value <= 0 {
+		return nil
+	}
+	return &value
+}
+
+// newProductSnapshotRow flattens a product taken at snapshotTime
+func newProductSnapshotRow(domain string, product *SimplifiedProduct, snapshotTime time.Time) productSnapshotRow {
+	row := productSnapshotRow{
+		SnapshotTime:       snapshotTime.UnixMicro(),
+		Domain:             domain,
+		Asin:               product.Asin,
+		Title:              product.Title,
+		Brand:              product.Brand,
+		ParentAsin:         product.ParentAsin,
+		Categories:         product.Categories,
+		BuyBoxPrice:        positiveOrNil(product.BuyBoxPrice),
+		HasAmazonOffer:     product.HasAmazonOffer,
+		MonthlySold:        positiveOrNil(product.MonthlySold),
+		OfferCountFBA:      product.OfferCountFBA,
+		OfferCountFBM:      product.OfferCountFBM,
+		Rating:             product.Rating,
+		ReviewCount:        product.ReviewCount,
+		ReferralFeePercent: product.ReferralFeePercent,
+		PickAndPackFee:     product.PickAndPackFee,
+	}
+	if rank, ok := latestSalesRank(product.SalesRanks); ok {
+		row.SalesRank = positiveOrNil(rank)
+	}
+	if product.Velocity != nil {
+		row.VelocityScore = product.Velocity.Score
+		row.SalesRankDrops30 = &product.Velocity.SalesRankDrops30
+		row.SalesRankDrops90 = &product.Velocity.SalesRankDrops90
+	}
+	if !product.FetchedAt.IsZero() {
+		row.FetchedAt = product.FetchedAt.UnixMicro()
+	}
+	return row
+}
+
+// bigQueryExporter appends product snapshots to BigQuery through the Storage Write
+// API's default stream. Snapshots are queued and written in batches in the
+// background, so storing products never waits for BigQuery.
+type bigQueryExporter struct {
+	stream     *managedwriter.ManagedStream
+	descriptor protoreflect.MessageDescriptor
+	queue      chan productSnapshotRow
+	batchSize  int
+	interval   time.Duration
+}
+
+// productSnapshots exports stored products to BigQuery, nil when BIGQUERY_DATASET is unset
+var productSnapshots = newBigQueryExporterFromEnv()
+
+// newBigQueryExporterFromEnv starts the exporter configured by:
+//
+//	BIGQUERY_DATASET         dataset of the table, the export is disabled when empty
+//	BIGQUERY_PROJECT         project of the dataset (PROJECT_ID)
+//	BIGQUERY_TABLE           table, created when missing (product_snapshots)
+//	BIGQUERY_BATCH_SIZE      rows per append (500)
+//	BIGQUERY_FLUSH_INTERVAL  longest time a row waits for its batch (5s)
+//	BIGQUERY_QUEUE_SIZE      rows waiting to be written, further rows are dropped (10000)
+func newBigQueryExporterFromEnv() *bigQueryExporter {
+	dataset := getEnv("BIGQUERY_DATASET", "")
+	if dataset == "" {
+		return nil
+	}
+	project := getEnv("BIGQUERY_PROJECT", getEnv("PROJECT_ID", ""))
+	table := getEnv("BIGQUERY_TABLE", "product_snapshots")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	exporter, err := newBigQueryExporter(ctx, project, dataset, table)
+	if err != nil {
+		logger.Error("Failed to start the BigQuery export, product snapshots are not exported", "error", err)
+		return nil
+	}
+	exporter.batchSize = envInt("BIGQUERY_BATCH_SIZE", 500)
+	exporter.interval = envDuration("BIGQUERY_FLUSH_INTERVAL", 5*time.Second)
+	exporter.queue = make(chan productSnapshotRow, envInt("BIGQUERY_QUEUE_SIZE", 10000))
+	go exporter.run()
+	logger.Info("Exporting product snapshots to BigQuery", "table", fmt.Sprintf("%s.%s.%s", project, dataset, table))
+	return exporter
+}
+
+// addMissingColumns adds the columns of productSnapshotSchema that a table created by
+// an older version lacks; new columns are always nullable
+func addMissingColumns(ctx context.Context, tableRef *bigquery.Table, metadata *bigquery.TableMetadata) error {
+	existing := make(map[string]bool, len(metadata.Schema))
+	for _, field := range metadata.Schema {
+		existing[field.Name] = true
+	}
+	schema := metadata.Schema
+	for _, field := range productSnapshotSchema {
+		if !existing[field.Name] {
+			schema = append(schema, field)
+		}
+	}
+	if len(schema) == len(metadata.Schema) {
+		return nil
+	}
+	if _, err := tableRef.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, metadata.ETag); err != nil {
+		return fmt.Errorf("failed to add columns to table %s: %v", tableRef.TableID, err)
+	}
+	return nil
+}
+
+// newBigQueryExporter creates the table when it is missing and opens the write stream
+func newBigQueryExporter(ctx context.Context, project, dataset, table string) (*bigQueryExporter, error) {
+	bq, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the BigQuery client: %v", err)
+	}
+	defer bq.Close()
+	tableRef := bq.Dataset(dataset).Table(table)
+	if metadata, err := tableRef.Metadata(ctx); err == nil {
+		if err := addMissingColumns(ctx, tableRef, metadata); err != nil {
+			return nil, err
+		}
+	} else {
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+			return nil, fmt.Errorf("failed to read table %s: %v", table, err)
+		}
+		err = tableRef.Create(ctx, &bigquery.TableMetadata{
+			Schema:           productSnapshotSchema,
+			TimePartitioning: &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType, Field: "snapshot_time"},
+			Clustering:       &bigquery.Clustering{Fields: []string{"asin"}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create table %s: %v", table, err)
+		}
+	}
+
+	storageSchema, err := adapt.BQSchemaToStorageTableSchema(productSnapshotSchema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert the snapshot schema: %v", err)
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(storageSchema, "root")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the snapshot descriptor: %v", err)
+	}
+	messageDescriptor, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("snapshot descriptor is not a message")
+	}
+	descriptorProto, err := adapt.NormalizeDescriptor(messageDescriptor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize the snapshot descriptor: %v", err)
+	}
+
+	writer, err := managedwriter.NewClient(context.Background(), project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the BigQuery Storage Write client: %v", err)
+	}
+	stream, err := writer.NewManagedStream(context.Background(),
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(project, dataset, table)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(descriptorProto),
+	)
+	if err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to open the BigQuery write stream: %v", err)
+	}
+	return &bigQueryExporter{stream: stream, descriptor: messageDescriptor}, nil
+}
+
+// enqueue queues a snapshot of the products. Rows are dropped with a warning when the
+// queue is full, e.g. while BigQuery is unavailable.
+func (e *bigQueryExporter) enqueue(ctx context.Context, domain string, products []SimplifiedProduct) {
+	if e == nil {
+		return
+	}
+	snapshotTime := time.Now()
+	for i := range products {
+		select {
+		case e.queue <- newProductSnapshotRow(domain, &products[i], snapshotTime):
+		default:
+			logger.WarnContext(ctx, "BigQuery export queue full, dropping snapshot", LogKeyASIN, products[i].Asin)
+		}
+	}
+}
+
+// run writes the queued rows in batches of batchSize, or whatever arrived within interval
+func (e *bigQueryExporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	batch := make([]productSnapshotRow, 0, e.batchSize)
+	for {
+		select {
+		case row := <-e.queue:
+			batch = append(batch, row)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.write(batch); err != nil {
+			logger.Error("Failed to export product snapshots to BigQuery", "rows", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// write appends one batch and waits for BigQuery to acknowledge it
+func (e *bigQueryExporter) write(rows []productSnapshotRow) error {
+	data := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		encoded, err := e.encode(row)
+		if err != nil {
+			return fmt.Errorf("failed to encode snapshot of %s: %v", row.Asin, err)
+		}
+		data = append(data, encoded)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	result, err := e.stream.AppendRows(ctx, data)
+	if err != nil {
+		return err
+	}
+	_, err = result.GetResult(ctx)
+	return err
+}
+
+// encode serializes a row as the protocol buffer message of the table schema
+func (e *bigQueryExporter) encode(row productSnapshotRow) ([]byte, error) {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	message := dynamicpb.NewMessage(e.descriptor)
+	if err := protojson.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(message)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job priorities for the budget scheduler, lower values run first
+const (
+	PriorityHigh   = 0
+	PriorityNormal = 1
+	PriorityLow    = 2
+)
+
+// RecurringJob is a periodic job that consumes Keepa tokens
+type RecurringJob struct {
+	Name      string
+	Priority  int
+	Interval  time.Duration
+	Estimate  func() int // Projected token cost of one run
+	Run       func() error
+	nextRunAt time.Time
+	running   bool
+}
+
+// budgetScheduler splits the projected daily token budget across recurring jobs.
+// Lower priority jobs keep a larger share of the budget in reserve, so they are
+// deferred first when tokens run short.
+type budgetScheduler struct {
+	mu       sync.Mutex
+	client   *KeepaClient
+	jobs     []*RecurringJob
+	day      string
+	spent    map[string]int
+	reserves map[int]float64 // Fraction of the daily budget each priority must leave untouched
+}
+
+// consumedTokens counts all tokens reported as consumed by Keepa responses
+var consumedTokens int64
+
+// newBudgetScheduler creates the scheduler with reserves read from environment variables
+func newBudgetScheduler(client *KeepaClient) *budgetScheduler {
+	normalReserve, _ := strconv.ParseFloat(getEnv("BUDGET_RESERVE_NORMAL", "0.2"), 64)
+	lowReserve, _ := strconv.ParseFloat(getEnv("BUDGET_RESERVE_LOW", "0.5"), 64)
+	return &budgetScheduler{
+		client: client,
+		spent:  make(map[string]int),
+		reserves: map[int]float64{
+			PriorityHigh:   0,
+			PriorityNormal: normalReserve,
+			PriorityLow:    lowReserve,
+		},
+	}
+}
+
+// register adds a recurring job, due immediately
+func (s *budgetScheduler) register(job *RecurringJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.nextRunAt = time.Now()
+	s.jobs = append(s.jobs, job)
+	sort.SliceStable(s.jobs, func(i, j int) bool {
+		return s.jobs[i].Priority < s.jobs[j].Priority
+	})
+}
+
+// dailyBudget projects the tokens available for one day from the refill rate
+func (s *budgetScheduler) dailyBudget() int {
+	return int(s.client.Tokens.RefillRate() * 60 * 24)
+}
+
+// spentToday returns the tokens spent by scheduled jobs today, resetting at midnight UTC
+func (s *budgetScheduler) spentToday() int {
+	today := time.Now().UTC().Format(time.DateOnly)
+	if s.day != today {
+		s.day = today
+		s.spent = make(map[string]int)
+	}
+	total := 0
+	for _, tokens := range s.spent {
+		total += tokens
+	}
+	return total
+}
+
+// start runs the scheduling loop in the background
+func (s *budgetScheduler) start() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			s.runDueJobs()
+			<-ticker.C
+		}
+	}()
+}
+
+// runDueJobs starts every due job whose estimate fits into its priority's share
+func (s *budgetScheduler) runDueJobs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	budget := s.dailyBudget()
+	for _, job := range s.jobs {
+		if job.running || now.Before(job.nextRunAt) {
+			continue
+		}
+
+		remaining := budget - s.spentToday()
+		estimate := job.Estimate()
+		available := remaining - int(float64(budget)*s.reserves[job.Priority])
+		if estimate > available {
+			s.client.Logger.Info("Scheduler deferring job", "job", job.Name, "estimate", estimate, "available", available, "remaining", remaining)
+			continue
+		}
+
+		job.running = true
+		job.nextRunAt = now.Add(job.Interval)
+		go s.runJob(job)
+	}
+}
+
+// runJob executes a job and books the tokens consumed while it ran
+func (s *budgetScheduler) runJob(job *RecurringJob) {
+	before := atomic.LoadInt64(&consumedTokens)
+	err := job.Run()
+	spent := int(atomic.LoadInt64(&consumedTokens) - before)
+
+	s.mu.Lock()
+	s.spentToday()
+	s.spent[job.Name] += spent
+	job.running = false
+	s.mu.Unlock()
+
+	if err != nil {
+		s.client.Logger.Error("Scheduler job failed", "job", job.Name, "tokens_consumed", spent, "error", err)
+		return
+	}
+	s.client.Logger.Info("Scheduler job finished", "job", job.Name, "tokens_consumed", spent)
+}
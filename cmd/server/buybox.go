@@ -0,0 +1,150 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// BuyBoxOwnership is a period during which one seller held the buy box
+type BuyBoxOwnership struct {
+	SellerID        string    `json:"sellerId"` // "-1" means nobody held the buy box
+	Condition       int       `json:"condition,omitempty"`
+	IsAmazon        bool      `json:"isAmazon,omitempty"` // The holder is Amazon itself
+	IsFBA           bool      `json:"isFBA,omitempty"`    // The holder's offer was fulfilled by Amazon
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	DurationMinutes int       `json:"durationMinutes"`
+}
+
+// BuyBoxSellerSummary aggregates the ownership periods of one seller
+type BuyBoxSellerSummary struct {
+	SellerID     string  `json:"sellerId"`
+	Holds        int     `json:"holds"`
+	TotalMinutes int     `json:"totalMinutes"`
+	AvgMinutes   int     `json:"avgMinutes"`
+	Share        float64 `json:"share"` // Fraction of the covered period
+}
+
+// decodeBuyBoxHistory turns Keepa's flat history array into ownership periods.
+// Each entry spans stride elements starting with the Keepa time and the seller ID;
+// for the used history the third element is the offer condition.
+func decodeBuyBoxHistory(history []string, stride int, now time.Time) []BuyBoxOwnership {
+	if len(history) < stride || len(history)%stride != 0 {
+		return nil
+	}
+
+	timeline := make([]BuyBoxOwnership, 0, len(history)/stride)
+	for i := 0; i < len(history); i += stride {
+		keepaMinutes, err := strconv.Atoi(history[i])
+		if err != nil {
+			continue
+		}
+		ownership := BuyBoxOwnership{
+			SellerID: history[i+1],
+			From:     keepatime.ToTime(keepaMinutes),
+		}
+		if stride > 2 {
+			ownership.Condition, _ = strconv.Atoi(history[i+2])
+		}
+		timeline = append(timeline, ownership)
+	}
+
+	// Every period ends when the next one starts, the last one is still ongoing
+	for i := range timeline {
+		end := now.UTC()
+		if i+1 < len(timeline) {
+			end = timeline[i+1].From
+		}
+		timeline[i].To = end
+		timeline[i].DurationMinutes = int(end.Sub(timeline[i].From).Minutes())
+	}
+	return timeline
+}
+
+// annotateBuyBoxHolders marks the periods held by Amazon or an FBA offer, matching
+// the holders against the product's offers. Holders without an offer stay unmarked.
+func annotateBuyBoxHolders(timeline []BuyBoxOwnership, offers []keepa.Offer) {
+	type holder struct{ isAmazon, isFBA bool }
+	holders := make(map[string]holder, len(offers))
+	for _, offer := range offers {
+		known := holders[offer.SellerID]
+		holders[offer.SellerID] = holder{isAmazon: known.isAmazon || offer.IsAmazon, isFBA: known.isFBA || offer.IsFBA}
+	}
+	for i := range timeline {
+		if h, ok := holders[timeline[i].SellerID]; ok {
+			timeline[i].IsAmazon = h.isAmazon
+			timeline[i].IsFBA = h.isFBA
+		}
+	}
+}
+
+// includeBuyBoxHistory reports whether simplified products carry the buy box
+// timelines (KEEPA_BUYBOX_HISTORY, enabled by default)
+func includeBuyBoxHistory() bool {
+	return getEnv("KEEPA_BUYBOX_HISTORY", "true") == "true"
+}
+
+// summarizeBuyBoxOwnership totals the ownership periods per seller, longest total first
+func summarizeBuyBoxOwnership(timeline []BuyBoxOwnership) []BuyBoxSellerSummary {
+	bySeller := make(map[string]*BuyBoxSellerSummary)
+	totalMinutes := 0
+	for _, ownership := range timeline {
+		summary, ok := bySeller[ownership.SellerID]
+		if !ok {
+			summary = &BuyBoxSellerSummary{SellerID: ownership.SellerID}
+			bySeller[ownership.SellerID] = summary
+		}
+		summary.Holds++
+		summary.TotalMinutes += ownership.DurationMinutes
+		totalMinutes += ownership.DurationMinutes
+	}
+
+	summaries := make([]BuyBoxSellerSummary, 0, len(bySeller))
+	for _, summary := range bySeller {
+		summary.AvgMinutes = summary.TotalMinutes / summary.Holds
+		if totalMinutes > 0 {
+			summary.Share = float64(summary.TotalMinutes) / float64(totalMinutes)
+		}
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].TotalMinutes > summaries[j].TotalMinutes
+	})
+	return summaries
+}
+
+// handleBuyBoxHistory returns the buy box ownership timeline of a stored product.
+// Pass ?used=true for the used buy box. Products stored while KEEPA_BUYBOX_HISTORY
+// was disabled have an empty timeline. ?domain= selects the marketplace.
+func handleBuyBoxHistory(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	response, source, err := loadProduct(c.Request.Context(), domain, asin)
+	if err != nil || len(response.Products) == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+		return
+	}
+
+	product := response.Products[0]
+	timeline := product.BuyBoxHistory
+	if c.Query("used") == "true" {
+		timeline = product.BuyBoxUsedHistory
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"asin":     product.Asin,
+		"domain":   domain,
+		"source":   source,
+		"timeline": timeFormatterFor(c).buyBoxTimeline(timeline),
+		"sellers":  summarizeBuyBoxOwnership(timeline),
+	}))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// CacheKeyNamespace prefixes every Redis key of the service; flushes are limited to it
+const CacheKeyNamespace = "keepa:"
+
+// cacheFlushBatchSize is the number of keys scanned and deleted per round trip
+const cacheFlushBatchSize = 500
+
+// handleInspectCache shows the cached copies of a product: the TTL and size of the
+// Redis entry and the age of the local entry. ?payload=true includes the product,
+// ?domain= selects the marketplace.
+func handleInspectCache(c *gin.Context) {
+	ctx := c.Request.Context()
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	key := productCacheKey(ctx, domain, asin)
+
+	var ttlCmd *redis.DurationCmd
+	var sizeCmd *redis.IntCmd
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		ttlCmd = pipe.PTTL(ctx, key)
+		sizeCmd = pipe.StrLen(ctx, key)
+		return nil
+	})
+	if err != nil {
+		respondError(c, http.StatusBadGateway, fmt.Sprintf("Failed to inspect %s in Redis: %v", key, err))
+		return
+	}
+	ttl, size := ttlCmd.Val(), sizeCmd.Val()
+	localAge, local := productLocalCache.age(key)
+
+	// PTTL is -2 for a missing key and -1 for a key without expiry
+	exists := ttl != -2
+	if !exists && !local {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s is not cached", asin))
+		return
+	}
+	response := gin.H{"asin": asin, "domain": domain, "key": key, "redis": gin.H{"exists": exists}, "local": gin.H{"exists": local}}
+	if exists {
+		entry := gin.H{"exists": true, "sizeBytes": size}
+		if ttl >= 0 {
+			entry["ttlSeconds"] = int64(ttl.Seconds())
+		}
+		response["redis"] = entry
+	}
+	if local {
+		response["local"] = gin.H{"exists": true, "ageSeconds": int64(localAge.Seconds())}
+	}
+	if c.Query("payload") == "true" {
+		if product, err := getProductFromRedis(ctx, domain, asin); err == nil {
+			response["payload"] = product
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleDeleteCache removes a product from Redis and the local cache, so the next
+// lookup fetches it again. ?domain= selects the marketplace.
+func handleDeleteCache(c *gin.Context) {
+	ctx := c.Request.Context()
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	key := productCacheKey(ctx, domain, asin)
+	productLocalCache.delete(key)
+
+	var deleted int64
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		deleted, err = redisClient.Del(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		respondError(c, http.StatusBadGateway, fmt.Sprintf("Failed to delete %s from Redis: %v", key, err))
+		return
+	}
+	logger.InfoContext(ctx, "Deleted cached product", LogKeyASIN, asin, "domain", domain, "existed", deleted > 0)
+	c.JSON(http.StatusOK, gin.H{"asin": asin, "domain": domain, "key": key, "deleted": deleted > 0})
+}
+
+// handleFlushCache deletes the keys matching ?pattern, a Redis glob, or ?prefix, both
+// within the keepa: namespace. Without ?confirm=true it only counts the keys, so a
+// flush is always previewed before it runs.
+func handleFlushCache(c *gin.Context) {
+	ctx := c.Request.Context()
+	pattern := c.Query("pattern")
+	if prefix := c.Query("prefix"); prefix != "" {
+		if pattern != "" {
+			respondError(c, http.StatusBadRequest, "Use either pattern or prefix")
+			return
+		}
+		pattern = escapeRedisPattern(prefix) + "*"
+	}
+	if !strings.HasPrefix(pattern, CacheKeyNamespace) || pattern == CacheKeyNamespace+"*" {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("pattern or prefix must select keys below %s, e.g. %s*", CacheKeyNamespace, RedisKeyPrefix))
+		return
+	}
+	confirmed := c.Query("confirm") == "true"
+
+	matched, deleted, err := flushRedisKeys(ctx, pattern, !confirmed)
+	if err != nil {
+		respondProblem(c, http.StatusBadGateway, CodeServiceUnavailable, err.Error(), gin.H{"matched": matched, "deleted": deleted})
+		return
+	}
+	if confirmed {
+		localDeleted := productLocalCache.deleteMatching(func(key string) bool {
+			match, _ := path.Match(pattern, key)
+			return match
+		})
+		logger.InfoContext(ctx, "Flushed cache", "pattern", pattern, "deleted", deleted, "local_deleted", localDeleted)
+	}
+	c.JSON(http.StatusOK, gin.H{"pattern": pattern, "confirmed": confirmed, "matched": matched, "deleted": deleted})
+}
+
+// flushRedisKeys deletes the keys matching pattern, or only counts them for a dry
+// run. A cluster is scanned on every master, since SCAN only covers one node.
+func flushRedisKeys(ctx context.Context, pattern string, dryRun bool) (matched, deleted int64, err error) {
+	flush := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, pattern, cacheFlushBatchSize).Iterator()
+		var keys []string
+		deleteKeys := func() error {
+			// One UNLINK per key, keys of a batch can be in different cluster slots
+			cmds, err := node.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.Unlink(ctx, key)
+				}
+				return nil
+			})
+			for _, cmd := range cmds {
+				deleted += cmd.(*redis.IntCmd).Val()
+			}
+			keys = keys[:0]
+			return err
+		}
+		for iter.Next(ctx) {
+			matched++
+			if dryRun {
+				continue
+			}
+			keys = append(keys, iter.Val())
+			if len(keys) == cacheFlushBatchSize {
+				if err := deleteKeys(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return deleteKeys()
+		}
+		return nil
+	}
+
+	if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return flush(ctx, node)
+		})
+	} else {
+		err = flush(ctx, redisClient)
+	}
+	if err != nil {
+		return matched, deleted, fmt.Errorf("failed to flush %s: %v", pattern, err)
+	}
+	return matched, deleted, nil
+}
+
+// escapeRedisPattern escapes the glob characters of a literal key prefix
+func escapeRedisPattern(prefix string) string {
+	var escaped strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Cached data types, each with its own TTL
+const (
+	CacheTypeProduct       = "product"
+	CacheTypeSeller        = "seller"
+	CacheTypeDeal          = "deal"
+	CacheTypeLightningDeal = "lightning-deal"
+	CacheTypeSearch        = "search" // ASIN lists of keyword searches
+)
+
+// cacheTTLSetting is the variable and default of a cache type's TTL
+type cacheTTLSetting struct {
+	env        string
+	defaultTTL time.Duration
+}
+
+// cacheTTLSettings configures the TTL of every cache type. Deals change quickly, so
+// their default is much shorter than the product TTL; refetching the full lightning
+// deal list costs 500 tokens.
+var cacheTTLSettings = map[string]cacheTTLSetting{
+	CacheTypeProduct:       {env: "PRODUCT_CACHE_TTL", defaultTTL: 24 * time.Hour},
+	CacheTypeSeller:        {env: "SELLER_CACHE_TTL", defaultTTL: 24 * time.Hour},
+	CacheTypeDeal:          {env: "DEAL_CACHE_TTL", defaultTTL: 15 * time.Minute},
+	CacheTypeLightningDeal: {env: "LIGHTNING_DEAL_CACHE_TTL", defaultTTL: 10 * time.Minute},
+	CacheTypeSearch:        {env: "SEARCH_CACHE_TTL", defaultTTL: time.Hour},
+}
+
+// defaultCacheTTLJitter is the default of CACHE_TTL_JITTER in percent
+const defaultCacheTTLJitter = 10
+
+// cacheTTLBase returns the configured TTL of a cache type, without jitter
+func cacheTTLBase(cacheType string) time.Duration {
+	setting := cacheTTLSettings[cacheType]
+	return envDuration(setting.env, setting.defaultTTL)
+}
+
+// cacheTTL returns the TTL of a new entry of a cache type, varied by up to
+// ±CACHE_TTL_JITTER percent (10, 0 disables it), so entries written together, e.g.
+// by one task, do not all expire at once and trigger a burst of refreshes
+func cacheTTL(cacheType string) time.Duration {
+	ttl := cacheTTLBase(cacheType)
+	jitter, err := strconv.Atoi(getEnv("CACHE_TTL_JITTER", strconv.Itoa(defaultCacheTTLJitter)))
+	if err != nil || jitter < 0 || jitter > 50 {
+		jitter = defaultCacheTTLJitter
+	}
+	return time.Duration(float64(ttl) * (1 + float64(jitter)/100*(2*rand.Float64()-1)))
+}
+
+// productCacheKey returns the Redis key of a product of a domain cached by the tenant of
+// ctx, which namespaces the key so the marketplaces of an ASIN do not read each other's
+// products
+func productCacheKey(ctx context.Context, domain, asin string) string {
+	return tenantRedisKey(ctx, RedisKeyPrefix+domain+":"+asin)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TaskCallback is the payload posted to a task's callback_url when it finishes
+type TaskCallback struct {
+	TaskID      string         `json:"task_id"`
+	Status      string         `json:"status"`
+	Error       string         `json:"error,omitempty"`
+	Progress    int            `json:"progress"`
+	Total       int            `json:"total"`
+	ErrorCounts map[string]int `json:"error_counts,omitempty"`
+	Summary     *TaskSummary   `json:"summary,omitempty"`
+	ResultsURL  string         `json:"results_url"`
+	FinishedAt  *time.Time     `json:"finished_at,omitempty"`
+}
+
+// callbackHTTPClient delivers task callbacks. Its dialer refuses non-public addresses,
+// so a host that resolves to a private address after validation is not reached either.
+var callbackHTTPClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: refuseNonPublicDial}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// allowPrivateCallbacks reports whether CALLBACK_ALLOW_PRIVATE is "true", e.g. for
+// local development, letting callbacks reach loopback and private addresses
+func allowPrivateCallbacks() bool {
+	return getEnv("CALLBACK_ALLOW_PRIVATE", "false") == "true"
+}
+
+// isPublicIP reports whether ip is not a loopback, private, link-local (including the
+// metadata server at 169.254.169.254), multicast or unspecified address
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// refuseNonPublicDial is the dialer control of callbackHTTPClient
+func refuseNonPublicDial(network, address string, _ syscall.RawConn) error {
+	if allowPrivateCallbacks() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// validateWebhookURL accepts absolute http(s) URLs only
+func validateWebhookURL(raw string) (*url.URL, error) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("must be an absolute http or https URL")
+	}
+	return parsed, nil
+}
+
+// validateCallbackURL accepts absolute http(s) URLs whose host resolves to public
+// addresses only, so callers cannot make the service post to internal endpoints
+func validateCallbackURL(raw string) error {
+	parsed, err := validateWebhookURL(raw)
+	if err != nil || allowPrivateCallbacks() {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve host %s: %v", parsed.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("host %s resolves to non-public address %s", parsed.Hostname(), addr.IP)
+		}
+	}
+	return nil
+}
+
+// signCallback returns the hex HMAC-SHA256 of "<timestamp>.<payload>" under
+// CALLBACK_SIGNING_SECRET, or "" when no secret is configured. Signing the timestamp
+// lets receivers reject replayed callbacks.
+func signCallback(timestamp string, payload []byte) string {
+	signingSecret := secret("CALLBACK_SIGNING_SECRET", "")
+	if signingSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// taskResultsURL returns the results URL of a task below PUBLIC_BASE_URL
+func taskResultsURL(taskID string) string {
+	return strings.TrimRight(getEnv("PUBLIC_BASE_URL", ""), "/") + "/tasks/" + taskID + "/results"
+}
+
+// sendTaskCallback posts the outcome of a finished task to its callback URL. The
+// X-Timestamp header holds the Unix time of the attempt, and the timestamp and body
+// are signed in the X-Signature header as "sha256=<hex HMAC>".
+func sendTaskCallback(task Task) {
+	callback := TaskCallback{
+		TaskID:      task.ID,
+		Status:      task.Status,
+		Error:       task.Error,
+		Progress:    task.Progress,
+		Total:       task.Total,
+		ErrorCounts: task.ErrorCounts,
+		Summary:     task.Summary,
+		ResultsURL:  taskResultsURL(task.ID),
+		FinishedAt:  task.FinishedAt,
+	}
+	payload, err := json.Marshal(callback)
+	if err != nil {
+		logger.Error("Failed to marshal task callback", LogKeyTaskID, task.ID, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	err = withRetry(ctx, DependencyWebhook, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, task.CallbackURL, bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("failed to create callback request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Task-ID", task.ID)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Timestamp", timestamp)
+		if signature := signCallback(timestamp, payload); signature != "" {
+			req.Header.Set("X-Signature", "sha256="+signature)
+		}
+
+		resp, err := callbackHTTPClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("callback request failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return keepa.HTTPStatusError(resp.StatusCode, fmt.Errorf("callback returned status code %d", resp.StatusCode))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to deliver task callback", LogKeyTaskID, task.ID, "url", task.CallbackURL, "error", err)
+		return
+	}
+	logger.Info("Delivered task callback", LogKeyTaskID, task.ID, "url", task.CallbackURL)
+}
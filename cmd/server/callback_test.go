@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestValidateCallbackURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://93.184.216.34/hook", wantErr: false},
+		{url: "ftp://93.184.216.34/hook", wantErr: true},
+		{url: "/hook", wantErr: true},
+		{url: "http://127.0.0.1:8080/hook", wantErr: true},
+		{url: "http://10.0.0.5/hook", wantErr: true},
+		{url: "http://192.168.1.1/hook", wantErr: true},
+		{url: "http://169.254.169.254/computeMetadata/v1/", wantErr: true},
+		{url: "http://[::1]/hook", wantErr: true},
+		{url: "http://[fd00::1]/hook", wantErr: true},
+		{url: "http://0.0.0.0/hook", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := validateCallbackURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateCallbackURL(%q) = %v, want error %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
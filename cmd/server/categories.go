@@ -0,0 +1,311 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CategoriesCollection   = "categories"
+	CategoryRedisKeyPrefix = "keepa:categories:"
+	categoryLookupBatch    = 10 // Keepa accepts up to 10 category IDs per request
+)
+
+// registerCategorySync schedules the Keepa category tree sync of the configured
+// domains as a low priority recurring job. It is disabled unless CATEGORY_SYNC_INTERVAL is set.
+func (client *KeepaClient) registerCategorySync(scheduler *budgetScheduler) {
+	interval, err := time.ParseDuration(getEnv("CATEGORY_SYNC_INTERVAL", "0"))
+	if err != nil || interval <= 0 {
+		return
+	}
+	domains := strings.Split(getEnv("CATEGORY_SYNC_DOMAINS", getEnv("KEEPA_DOMAIN", "1")), ";")
+	maxDepth, _ := strconv.Atoi(getEnv("CATEGORY_SYNC_DEPTH", "2"))
+	estimatePerDomain, _ := strconv.Atoi(getEnv("CATEGORY_SYNC_TOKEN_ESTIMATE", "50"))
+
+	scheduler.register(&RecurringJob{
+		Name:     "category-sync",
+		Priority: PriorityLow,
+		Interval: interval,
+		Estimate: func() int { return estimatePerDomain * len(domains) },
+		Run: func() error {
+			for _, domain := range domains {
+				if err := client.syncCategoryTree(context.Background(), domain, maxDepth); err != nil {
+					return fmt.Errorf("category sync for domain %s failed: %v", domain, err)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// syncCategoryTree walks the category tree breadth-first from the root categories
+// down to maxDepth and stores every node in Firestore and Redis
+func (client *KeepaClient) syncCategoryTree(ctx context.Context, domain string, maxDepth int) error {
+	roots, err := client.CategoryLookup(ctx, domain, []int64{0})
+	if err != nil {
+		return fmt.Errorf("failed to fetch root categories: %v", err)
+	}
+
+	all := make([]keepa.Category, 0, len(roots))
+	level := make([]int64, 0)
+	for _, category := range roots {
+		all = append(all, category)
+		level = append(level, category.Children...)
+	}
+
+	for depth := 1; depth < maxDepth && len(level) > 0; depth++ {
+		var next []int64
+		for start := 0; start < len(level); start += categoryLookupBatch {
+			end := start + categoryLookupBatch
+			if end > len(level) {
+				end = len(level)
+			}
+			categories, err := client.CategoryLookup(ctx, domain, level[start:end])
+			if err != nil {
+				return fmt.Errorf("failed to fetch categories at depth %d: %v", depth, err)
+			}
+			for _, category := range categories {
+				all = append(all, category)
+				next = append(next, category.Children...)
+			}
+		}
+		level = next
+	}
+
+	storeCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	if err := saveCategories(storeCtx, domain, all); err != nil {
+		return err
+	}
+	if err := cacheCategories(storeCtx, domain, all); err != nil {
+		return err
+	}
+	client.Logger.InfoContext(ctx, "Category sync stored categories", "domain", domain, "categories", len(all))
+	return nil
+}
+
+// saveCategories stores the synced categories in Firestore and as one list in Redis
+func saveCategories(ctx context.Context, domain string, categories []keepa.Category) error {
+	if err := storeCategoryDocs(ctx, domain, categories); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(categories)
+	if err != nil {
+		return fmt.Errorf("failed to marshal categories: %v", err)
+	}
+	if err := redisClient.Set(ctx, CategoryRedisKeyPrefix+domain, data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to save categories to Redis: %v", err)
+	}
+	return nil
+}
+
+// storeCategoryDocs stores categories in Firestore, one document per domain and ID
+func storeCategoryDocs(ctx context.Context, domain string, categories []keepa.Category) error {
+	writer := firestoreClient.BulkWriter(ctx)
+	for _, category := range categories {
+		docRef := firestoreClient.Collection(CategoriesCollection).Doc(fmt.Sprintf("%s_%d", domain, category.CatID))
+		if _, err := writer.Set(docRef, category); err != nil {
+			writer.End()
+			return fmt.Errorf("failed to queue category %d for Firestore: %v", category.CatID, err)
+		}
+	}
+	writer.End()
+	return nil
+}
+
+// loadCategories reads the synced categories of a domain from Redis, falling back to Firestore
+func loadCategories(ctx context.Context, domain string) ([]keepa.Category, error) {
+	var categories []keepa.Category
+	if data, err := redisClient.Get(ctx, CategoryRedisKeyPrefix+domain).Bytes(); err == nil {
+		if err := json.Unmarshal(data, &categories); err == nil {
+			return categories, nil
+		}
+	}
+
+	domainID, err := strconv.Atoi(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain %q", domain)
+	}
+	iter := firestoreClient.Collection(CategoriesCollection).Where("domainId", "==", domainID).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read categories from Firestore: %v", err)
+		}
+		var category keepa.Category
+		if err := doc.DataTo(&category); err != nil {
+			return nil, fmt.Errorf("failed to decode category %s: %v", doc.Ref.ID, err)
+		}
+		categories = append(categories, category)
+	}
+	return categories, nil
+}
+
+// resolveCategoryNames maps category names (case-insensitive) to category IDs
+func resolveCategoryNames(ctx context.Context, domain string, names []string) ([]string, error) {
+	categories, err := loadCategories(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]int64, len(categories))
+	for _, category := range categories {
+		byName[strings.ToLower(category.Name)] = category.CatID
+	}
+
+	ids := make([]string, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown category name %q", name)
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return ids, nil
+}
+
+// parseCategoryIDs validates a list of category IDs given as numbers or numeric strings
+func parseCategoryIDs(raw interface{}) ([]string, error) {
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("expected a non-empty list of category IDs")
+	}
+	ids := make([]string, 0, len(list))
+	seen := make(map[string]bool, len(list))
+	for _, value := range list {
+		var id int64
+		switch v := value.(type) {
+		case float64:
+			id = int64(v)
+			if float64(id) != v {
+				return nil, fmt.Errorf("category ID %v is not an integer", v)
+			}
+		case string:
+			parsed, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("category ID %q is not a number", v)
+			}
+			id = parsed
+		default:
+			return nil, fmt.Errorf("category ID %v is not a number", v)
+		}
+		if id <= 0 {
+			return nil, fmt.Errorf("category ID %d must be positive", id)
+		}
+		if key := strconv.FormatInt(id, 10); !seen[key] {
+			seen[key] = true
+			ids = append(ids, key)
+		}
+	}
+	return ids, nil
+}
+
+// handleSearchCategories searches the synced category tree by name
+func handleSearchCategories(c *gin.Context) {
+	domain := c.DefaultQuery("domain", getEnv("KEEPA_DOMAIN", "1"))
+	query := strings.ToLower(c.Query("q"))
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		respondError(c, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+
+	categories, err := loadCategories(c.Request.Context(), domain)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	matches := make([]keepa.Category, 0)
+	for _, category := range categories {
+		if query == "" || strings.Contains(strings.ToLower(category.Name), query) ||
+			strings.Contains(strings.ToLower(category.ContextFreeName), query) {
+			matches = append(matches, category)
+			if len(matches) >= limit {
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"domain": domain, "categories": matches})
+}
+
+// handleKeepaCategory looks up a category and its direct children. Categories are
+// answered from the category cache unless ?refresh=true; the root categories (ID 0)
+// are always looked up on Keepa.
+func (client *KeepaClient) handleKeepaCategory(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 0 {
+		respondError(c, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	domain := c.DefaultQuery("domain", getEnv("KEEPA_DOMAIN", "1"))
+
+	if id == 0 {
+		categories, err := client.CategoryLookup(c.Request.Context(), domain, []int64{id})
+		if err != nil {
+			respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, withQuotaWarning(gin.H{"domain": domain, "categories": sortedCategories(categories)}))
+		return
+	}
+
+	categories, cached, err := client.cachedCategoryLookup(c.Request.Context(), domain, []int64{id}, c.Query("refresh") == "true")
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	category, ok := categories[strconv.FormatInt(id, 10)]
+	if !ok {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Category %d not found", id))
+		return
+	}
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"domain": domain, "category": category, "cached": cached}))
+}
+
+// handleKeepaCategorySearch searches category names on Keepa. Unlike GET /categories
+// it does not need a synced category tree.
+func (client *KeepaClient) handleKeepaCategorySearch(c *gin.Context) {
+	term := strings.TrimSpace(c.Query("q"))
+	if term == "" {
+		respondError(c, http.StatusBadRequest, "q is required")
+		return
+	}
+	domain := c.DefaultQuery("domain", getEnv("KEEPA_DOMAIN", "1"))
+
+	categories, err := client.CategorySearch(c.Request.Context(), domain, term)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"domain": domain, "categories": sortedCategories(categories)}))
+}
+
+// sortedCategories returns the categories of a lookup by descending product count
+func sortedCategories(categories map[string]keepa.Category) []keepa.Category {
+	sorted := make([]keepa.Category, 0, len(categories))
+	for _, category := range categories {
+		sorted = append(sorted, category)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ProductCount != sorted[j].ProductCount {
+			return sorted[i].ProductCount > sorted[j].ProductCount
+		}
+		return sorted[i].CatID < sorted[j].CatID
+	})
+	return sorted
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CategoryNodesRedisKeyPrefix = "keepa:category-nodes:" // Hash per domain of the known categories by ID
+	CategoryPathSeparator       = " > "                   // Joins the names of a breadcrumb
+	maxCategoryDepth            = 20                      // Bounds walks along parents, guarding against cycles
+)
+
+// cachedCategory is a category of the node cache. Partial categories were learned
+// from the category tree of a product, so only their name and parent are known.
+type cachedCategory struct {
+	keepa.Category
+	Partial bool `json:"partial,omitempty"`
+}
+
+// categoryTreePath joins the names of a product's category tree, root first
+func categoryTreePath(tree []keepa.CategoryTreeItem) string {
+	names := make([]string, 0, len(tree))
+	for _, item := range tree {
+		names = append(names, item.Name)
+	}
+	return strings.Join(names, CategoryPathSeparator)
+}
+
+// categoryPath returns the breadcrumb of a category from its ancestors in index, empty
+// when the chain up to a root category is not cached
+func categoryPath(index map[int64]cachedCategory, id int64) string {
+	var names []string
+	for depth := 0; depth < maxCategoryDepth; depth++ {
+		category, ok := index[id]
+		if !ok {
+			return ""
+		}
+		names = append(names, category.Name)
+		if category.Parent == 0 {
+			for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+				names[i], names[j] = names[j], names[i]
+			}
+			return strings.Join(names, CategoryPathSeparator)
+		}
+		id = category.Parent
+	}
+	return ""
+}
+
+// cacheCategories stores complete categories, e.g. of a Keepa /category lookup, in
+// the node cache of their domain
+func cacheCategories(ctx context.Context, domain string, categories []keepa.Category) error {
+	if len(categories) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(categories))
+	for _, category := range categories {
+		data, err := json.Marshal(cachedCategory{Category: category})
+		if err != nil {
+			return fmt.Errorf("failed to marshal category %d: %v", category.CatID, err)
+		}
+		fields[strconv.FormatInt(category.CatID, 10)] = data
+	}
+	if err := redisClient.HSet(ctx, CategoryNodesRedisKeyPrefix+domain, fields).Err(); err != nil {
+		return fmt.Errorf("failed to cache categories in Redis: %v", err)
+	}
+	return nil
+}
+
+// cacheProductCategoryTrees adds the categories named by the category trees of
+// products to the node cache, keeping categories that are already cached
+func cacheProductCategoryTrees(ctx context.Context, domain string, products []keepa.Product) error {
+	key := CategoryNodesRedisKeyPrefix + domain
+	seen := make(map[int]bool)
+	pipe := redisClient.Pipeline()
+	for _, product := range products {
+		var parent int64
+		for _, item := range product.CategoryTree {
+			if !seen[item.CatID] {
+				seen[item.CatID] = true
+				data, err := json.Marshal(cachedCategory{
+					Category: keepa.Category{DomainID: product.DomainID, CatID: int64(item.CatID), Name: item.Name, Parent: parent},
+					Partial:  true,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to marshal category %d: %v", item.CatID, err)
+				}
+				pipe.HSetNX(ctx, key, strconv.Itoa(item.CatID), data)
+			}
+			parent = int64(item.CatID)
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to cache category trees in Redis: %v", err)
+	}
+	return nil
+}
+
+// loadCachedCategories reads categories of the node cache by ID, skipping unknown ones
+func loadCachedCategories(ctx context.Context, domain string, ids []int64) (map[int64]cachedCategory, error) {
+	fields := make([]string, 0, len(ids))
+	for _, id := range ids {
+		fields = append(fields, strconv.FormatInt(id, 10))
+	}
+	values, err := redisClient.HMGet(ctx, CategoryNodesRedisKeyPrefix+domain, fields...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read categories from Redis: %v", err)
+	}
+	categories := make(map[int64]cachedCategory, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var category cachedCategory
+		if err := json.Unmarshal([]byte(data), &category); err == nil {
+			categories[ids[i]] = category
+		}
+	}
+	return categories, nil
+}
+
+// loadCategoryIndex returns the known categories of a domain by ID: the synced ones and
+// those of the node cache. Partial categories only fill gaps.
+func loadCategoryIndex(ctx context.Context, domain string) (map[int64]cachedCategory, error) {
+	synced, err := loadCategories(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[int64]cachedCategory, len(synced))
+	for _, category := range synced {
+		index[category.CatID] = cachedCategory{Category: category}
+	}
+
+	values, err := redisClient.HGetAll(ctx, CategoryNodesRedisKeyPrefix+domain).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read categories from Redis: %v", err)
+	}
+	for _, data := range values {
+		var category cachedCategory
+		if err := json.Unmarshal([]byte(data), &category); err != nil {
+			continue
+		}
+		if existing, ok := index[category.CatID]; !ok || existing.Partial || !category.Partial {
+			index[category.CatID] = category
+		}
+	}
+	return index, nil
+}
+
+// cachedCategoryLookup is CategoryLookup answering from the node cache first, so only
+// categories missing there or known partially cost tokens; refresh looks all of them
+// up. Looked up categories are cached and stored in Firestore. It reports whether all
+// categories were cached.
+func (client *KeepaClient) cachedCategoryLookup(ctx context.Context, domain string, ids []int64, refresh bool) (map[string]keepa.Category, bool, error) {
+	var cached map[int64]cachedCategory
+	if !refresh {
+		var err error
+		if cached, err = loadCachedCategories(ctx, domain, ids); err != nil {
+			client.Logger.WarnContext(ctx, "Category cache unavailable, looking categories up on Keepa", "domain", domain, "error", err)
+		}
+	}
+
+	categories := make(map[string]keepa.Category, len(ids))
+	var missing []int64
+	for _, id := range ids {
+		if category, ok := cached[id]; ok && !category.Partial {
+			categories[strconv.FormatInt(id, 10)] = category.Category
+		} else {
+			missing = append(missing, id)
+		}
+	}
+
+	var fetched []keepa.Category
+	for start := 0; start < len(missing); start += categoryLookupBatch {
+		end := min(start+categoryLookupBatch, len(missing))
+		batch, err := client.CategoryLookup(ctx, domain, missing[start:end])
+		if err != nil {
+			return nil, false, err
+		}
+		for key, category := range batch {
+			categories[key] = category
+			fetched = append(fetched, category)
+		}
+	}
+	if len(fetched) > 0 {
+		if err := storeCategoryDocs(ctx, domain, fetched); err != nil {
+			client.Logger.WarnContext(ctx, "Failed to store looked up categories", "domain", domain, "error", err)
+		}
+		if err := cacheCategories(ctx, domain, fetched); err != nil {
+			client.Logger.WarnContext(ctx, "Failed to cache looked up categories", "domain", domain, "error", err)
+		}
+	}
+	return categories, len(missing) == 0, nil
+}
+
+// resolveCategoryPaths sets the breadcrumb of products whose Keepa response had no
+// category tree from the ancestors of their first category in the node cache
+func resolveCategoryPaths(ctx context.Context, domain string, products []*SimplifiedProduct) error {
+	known := make(map[int64]cachedCategory)
+	var ids []int64
+	for _, product := range products {
+		if product.CategoryPath == "" && len(product.Categories) > 0 {
+			ids = append(ids, product.Categories[0])
+		}
+	}
+	for depth := 0; depth < maxCategoryDepth && len(ids) > 0; depth++ {
+		categories, err := loadCachedCategories(ctx, domain, ids)
+		if err != nil {
+			return err
+		}
+		ids = ids[:0]
+		for id, category := range categories {
+			known[id] = category
+			if _, ok := known[category.Parent]; category.Parent != 0 && !ok && !slices.Contains(ids, category.Parent) {
+				ids = append(ids, category.Parent)
+			}
+		}
+	}
+
+	for _, product := range products {
+		if product.CategoryPath == "" && len(product.Categories) > 0 {
+			product.CategoryPath = categoryPath(known, product.Categories[0])
+		}
+	}
+	return nil
+}
+
+// enrichCategories caches the category trees of the products of a Keepa response and
+// resolves the breadcrumbs of the simplified products Keepa sent no tree for
+func (client *KeepaClient) enrichCategories(ctx context.Context, domain string, raw []keepa.Product, products []*SimplifiedProduct) {
+	if err := cacheProductCategoryTrees(ctx, domain, raw); err != nil {
+		client.Logger.WarnContext(ctx, "Failed to cache product category trees", "domain", domain, "error", err)
+	}
+	if err := resolveCategoryPaths(ctx, domain, products); err != nil {
+		client.Logger.WarnContext(ctx, "Failed to resolve category paths", "domain", domain, "error", err)
+	}
+}
+
+// responseProducts returns pointers to the products of responses
+func responseProducts(responses map[string]*SimplifiedResponse) []*SimplifiedProduct {
+	var products []*SimplifiedProduct
+	for _, response := range responses {
+		for i := range response.Products {
+			products = append(products, &response.Products[i])
+		}
+	}
+	return products
+}
+
+// CategoryNode is a category of GET /categories/tree/:rootId with its cached subtree
+type CategoryNode struct {
+	CatID        int64          `json:"catId"`
+	Name         string         `json:"name"`
+	ProductCount int            `json:"productCount,omitempty"`
+	Children     []CategoryNode `json:"children,omitempty"`
+	MoreChildren int            `json:"moreChildren,omitempty"` // Children below ?depth or not cached
+}
+
+// categoryChildren maps category IDs to their children, from the child lists of
+// complete categories and the parents of all, by descending product count
+func categoryChildren(index map[int64]cachedCategory) map[int64][]int64 {
+	sets := make(map[int64]map[int64]bool)
+	add := func(parent, child int64) {
+		if sets[parent] == nil {
+			sets[parent] = make(map[int64]bool)
+		}
+		sets[parent][child] = true
+	}
+	for id, category := range index {
+		if id != 0 {
+			add(category.Parent, id)
+		}
+		for _, child := range category.Children {
+			add(id, child)
+		}
+	}
+
+	children := make(map[int64][]int64, len(sets))
+	for parent, set := range sets {
+		ids := make([]int64, 0, len(set))
+		for id := range set {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if index[ids[i]].ProductCount != index[ids[j]].ProductCount {
+				return index[ids[i]].ProductCount > index[ids[j]].ProductCount
+			}
+			return ids[i] < ids[j]
+		})
+		children[parent] = ids
+	}
+	return children
+}
+
+// buildCategoryNode returns the subtree of a category down to depth levels
+func buildCategoryNode(index map[int64]cachedCategory, children map[int64][]int64, id int64, depth int) (CategoryNode, int) {
+	category := index[id]
+	node := CategoryNode{CatID: id, Name: category.Name, ProductCount: category.ProductCount}
+	count := 1
+	for _, childID := range children[id] {
+		if _, ok := index[childID]; !ok || depth <= 0 {
+			node.MoreChildren++
+			continue
+		}
+		child, childCount := buildCategoryNode(index, children, childID, depth-1)
+		node.Children = append(node.Children, child)
+		count += childCount
+	}
+	return node, count
+}
+
+// handleCategoryTree serves the cached category hierarchy below a category, 0 for all
+// root categories, ?depth levels deep (default 3). It reads the synced categories and
+// those learned from lookups and products, without calling Keepa.
+func handleCategoryTree(c *gin.Context) {
+	rootID, err := strconv.ParseInt(c.Param("rootId"), 10, 64)
+	if err != nil || rootID < 0 {
+		respondError(c, http.StatusBadRequest, "Invalid category ID")
+		return
+	}
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "3"))
+	if err != nil || depth < 1 || depth > maxCategoryDepth {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("depth must be between 1 and %d", maxCategoryDepth))
+		return
+	}
+
+	index, err := loadCategoryIndex(c.Request.Context(), domain)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, ok := index[rootID]; !ok && rootID != 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Category %d is not cached, sync the category tree or look it up with GET /keepa/categories/%d", rootID, rootID))
+		return
+	}
+
+	tree, count := buildCategoryNode(index, categoryChildren(index), rootID, depth)
+	if rootID == 0 {
+		count-- // The root categories have no common parent category
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"domain":     domain,
+		"path":       categoryPath(index, rootID),
+		"tree":       tree,
+		"categories": count,
+	})
+}
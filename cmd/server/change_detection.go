@@ -0,0 +1,68 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"slices"
+	"time"
+)
+
+// productContentHash fingerprints the content of a product response. FetchedAt differs
+// on every fetch and is left out, so refetching an unchanged product gives the same
+// hash. encoding/json sorts map keys, which keeps the encoding stable.
+func productContentHash(products []SimplifiedProduct) string {
+	stable := make([]SimplifiedProduct, len(products))
+	for i, product := range products {
+		product.FetchedAt = time.Time{}
+		stable[i] = product
+	}
+	data, err := json.Marshal(stable)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// unchangedBy reports whether writing doc over the stored document would change
+// nothing but the timestamps
+func (stored *ProductDocument) unchangedBy(doc *ProductDocument) bool {
+	return stored != nil && stored.ContentHash != "" && stored.ContentHash == doc.ContentHash &&
+		slices.Equal(stored.MatchedCategories, doc.MatchedCategories)
+}
+
+// checkedAtUpdate is the only write of an unchanged product, so it still counts as
+// refreshed and loses a stale mark of the cleanup
+func checkedAtUpdate(doc *ProductDocument) []firestore.Update {
+	return []firestore.Update{
+		{Path: "checkedAt", Value: doc.CheckedAt},
+		{Path: "stale", Value: firestore.Delete},
+		{Path: "staleSince", Value: firestore.Delete},
+	}
+}
+
+// unchangedWriteCounter counts product writes skipped because the content did not change
+type unchangedWriteCounter struct {
+	skipped metric.Int64Counter
+}
+
+var unchangedWrites = newUnchangedWriteCounter()
+
+// newUnchangedWriteCounter creates the keepa.firestore.unchanged_skips counter
+func newUnchangedWriteCounter() *unchangedWriteCounter {
+	skipped, _ := otel.Meter("Keepa-api").Int64Counter("keepa.firestore.unchanged_skips",
+		metric.WithDescription("Product writes skipped because the content did not change"))
+	return &unchangedWriteCounter{skipped: skipped}
+}
+
+// record counts n skipped writes
+func (c *unchangedWriteCounter) record(ctx context.Context, n int) {
+	if n > 0 {
+		c.skipped.Add(ctx, int64(n))
+	}
+}
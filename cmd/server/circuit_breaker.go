@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // Calls pass
+	CircuitOpen     = "open"      // Calls are rejected until the cool-down has passed
+	CircuitHalfOpen = "half_open" // A single probe call decides whether to close again
+)
+
+// circuitBreaker suspends calls to a dependency whose recent calls mostly failed.
+// Failures are transport errors, timeouts and 5xx responses; rate limits are not.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	dependency  string
+	state       string
+	results     []bool // Outcomes of the most recent calls while closed, true for failures
+	window      int
+	minRequests int
+	failureRate float64
+	coolDown    time.Duration
+	openedAt    time.Time
+	probing     bool
+}
+
+// keepaBreaker guards doRequest, configured by KEEPA_CIRCUIT_FAILURE_RATE (0.5),
+// KEEPA_CIRCUIT_MIN_REQUESTS (10), KEEPA_CIRCUIT_WINDOW (20) and KEEPA_CIRCUIT_COOLDOWN (30s)
+var keepaBreaker = newCircuitBreaker(DependencyKeepa)
+
+// newCircuitBreaker creates a closed breaker configured from the KEEPA_CIRCUIT_* variables
+func newCircuitBreaker(dependency string) *circuitBreaker {
+	failureRate, err := strconv.ParseFloat(getEnv("KEEPA_CIRCUIT_FAILURE_RATE", "0.5"), 64)
+	if err != nil || failureRate <= 0 || failureRate > 1 {
+		failureRate = 0.5
+	}
+	minRequests, err := strconv.Atoi(getEnv("KEEPA_CIRCUIT_MIN_REQUESTS", "10"))
+	if err != nil || minRequests < 1 {
+		minRequests = 10
+	}
+	window, err := strconv.Atoi(getEnv("KEEPA_CIRCUIT_WINDOW", "20"))
+	if err != nil || window < minRequests {
+		window = minRequests * 2
+	}
+	coolDown, err := time.ParseDuration(getEnv("KEEPA_CIRCUIT_COOLDOWN", "30s"))
+	if err != nil || coolDown <= 0 {
+		coolDown = 30 * time.Second
+	}
+	return &circuitBreaker{
+		dependency:  dependency,
+		state:       CircuitClosed,
+		window:      window,
+		minRequests: minRequests,
+		failureRate: failureRate,
+		coolDown:    coolDown,
+	}
+}
+
+// allow reports whether a call may proceed. Once the cool-down has passed a single
+// probe is let through; otherwise the time until the next attempt is returned.
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if remaining := b.coolDown - time.Since(b.openedAt); remaining > 0 {
+			return remaining, false
+		}
+		b.state = CircuitHalfOpen
+		b.probing = true
+		return 0, true
+	case CircuitHalfOpen:
+		if b.probing {
+			return time.Second, false
+		}
+		b.probing = true
+		return 0, true
+	}
+	return 0, true
+}
+
+// record books the outcome of an allowed call
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.open("probe failed")
+			return
+		}
+		b.state = CircuitClosed
+		b.results = nil
+		go sendNotification("circuit_closed", "info", fmt.Sprintf("Calls to %s resumed", b.dependency), map[string]interface{}{
+			"dependency": b.dependency,
+		})
+		return
+	}
+
+	b.results = append(b.results, failed)
+	if len(b.results) > b.window {
+		b.results = b.results[len(b.results)-b.window:]
+	}
+	if len(b.results) < b.minRequests {
+		return
+	}
+	failures := 0
+	for _, result := range b.results {
+		if result {
+			failures++
+		}
+	}
+	if rate := float64(failures) / float64(len(b.results)); rate >= b.failureRate {
+		b.open(fmt.Sprintf("%d of the last %d calls failed", failures, len(b.results)))
+	}
+}
+
+// abandon releases the probe of an allowed call that ended without an outcome,
+// e.g. because the caller cancelled it
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+	}
+}
+
+// open suspends calls for the cool-down. The caller must hold mu.
+func (b *circuitBreaker) open(reason string) {
+	b.state = CircuitOpen
+	b.openedAt = time.Now()
+	b.results = nil
+	go sendNotification("circuit_open", "warning", fmt.Sprintf("Calls to %s suspended: %s", b.dependency, reason), map[string]interface{}{
+		"dependency": b.dependency,
+		"cool_down":  b.coolDown.String(),
+	})
+}
+
+// retryAfter returns how long callers should wait before retrying, zero unless open
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != CircuitOpen {
+		return 0
+	}
+	if remaining := b.coolDown - time.Since(b.openedAt); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// snapshot returns the state for status endpoints
+func (b *circuitBreaker) snapshot() gin.H {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return gin.H{"state": b.state, "recent_calls": len(b.results)}
+}
+
+// awaitKeepaCircuit returns once keepaBreaker allows a call. While the breaker is
+// open interactive callers fail fast; bulk work waits until ctx is done.
+func awaitKeepaCircuit(ctx context.Context, priority int) error {
+	for {
+		retryAfter, allowed := keepaBreaker.allow()
+		if allowed {
+			return nil
+		}
+		if priority != PriorityBulk {
+			return newTaskError(ErrClassCircuitOpen, fmt.Errorf("Keepa calls are suspended, retry in %v", retryAfter.Round(time.Second)))
+		}
+		if err := tokenWaits.sleepContext(ctx, WaitReasonCircuitOpen, DependencyKeepa, retryAfter); err != nil {
+			return newTaskError(ErrClassCircuitOpen, fmt.Errorf("Keepa calls are suspended: %v", err))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Cleanup modes for stale products
+const (
+	CleanupModeMark   = "mark"   // Set stale and staleSince, the product stays readable
+	CleanupModeDelete = "delete" // Delete the product document and its snapshots
+)
+
+// maxCleanupReportASINs caps the ASINs listed in a cleanup report
+const maxCleanupReportASINs = 1000
+
+// CleanupReport is the outcome of a stale product cleanup
+type CleanupReport struct {
+	DryRun    bool      `json:"dryRun"`
+	Mode      string    `json:"mode"`
+	Cutoff    time.Time `json:"cutoff"`  // Products not fetched since are stale
+	Scanned   int       `json:"scanned"` // Products not changed since the cutoff
+	Stale     int       `json:"stale"`
+	Processed int       `json:"processed"`           // Marked or deleted, 0 for a dry run
+	Failed    int       `json:"failed,omitempty"`    // Marks or deletions that failed
+	ASINs     []string  `json:"asins"`               // Stale ASINs, at most maxCleanupReportASINs
+	Truncated bool      `json:"truncated,omitempty"` // More ASINs are stale than listed
+}
+
+// isStale reports whether a product was last fetched before cutoff. Documents written
+// before checkedAt existed only have updatedAt.
+func (doc *ProductDocument) isStale(cutoff time.Time) bool {
+	return doc.UpdatedAt.Before(cutoff) && doc.CheckedAt.Before(cutoff)
+}
+
+// cleanupStaleProducts marks or deletes the products not fetched within maxAge, those
+// of the tenants included. A dry run only reports them. Marked products are not marked
+// again, and fetching a product removes its mark.
+func cleanupStaleProducts(ctx context.Context, maxAge time.Duration, mode string, dryRun bool) (*CleanupReport, error) {
+	report := &CleanupReport{DryRun: dryRun, Mode: mode, Cutoff: time.Now().UTC().Add(-maxAge), ASINs: make([]string, 0)}
+
+	// checkedAt is never before updatedAt, so every stale product matches this query.
+	// The collection group holds the top-level products and those of every tenant.
+	iter := firestoreClient.CollectionGroup(ProductsCollection).Where("updatedAt", "<", report.Cutoff).Documents(ctx)
+	defer iter.Stop()
+
+	var writer *firestore.BulkWriter
+	if !dryRun {
+		writer = firestoreClient.BulkWriter(ctx)
+	}
+	jobs := make(map[string][]*firestore.BulkWriterJob)
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			if writer != nil {
+				writer.End()
+			}
+			return nil, fmt.Errorf("failed to query stale products: %v", err)
+		}
+		report.Scanned++
+		var doc ProductDocument
+		if err := snapshot.DataTo(&doc); err != nil {
+			logger.WarnContext(ctx, "Skipping undecodable product in cleanup", LogKeyASIN, snapshot.Ref.ID, "error", err)
+			continue
+		}
+		if !doc.isStale(report.Cutoff) || (mode == CleanupModeMark && doc.Stale) {
+			continue
+		}
+		report.Stale++
+		if len(report.ASINs) < maxCleanupReportASINs {
+			report.ASINs = append(report.ASINs, snapshot.Ref.ID)
+		} else {
+			report.Truncated = true
+		}
+		if dryRun {
+			continue
+		}
+
+		queued, err := queueCleanup(ctx, writer, snapshot.Ref, mode)
+		if err != nil {
+			logger.WarnContext(ctx, "Failed to queue stale product cleanup", LogKeyASIN, snapshot.Ref.ID, "error", err)
+		}
+		// Tenants store the same product under the same ID
+		jobs[snapshot.Ref.Path] = queued
+	}
+	if writer == nil {
+		return report, nil
+	}
+	writer.End()
+
+	// A product counts as processed when all of its writes succeeded
+	for path, queued := range jobs {
+		failed := len(queued) == 0
+		for _, job := range queued {
+			if _, err := job.Results(); err != nil {
+				failed = true
+				logger.WarnContext(ctx, "Failed to clean up stale product", "path", path, "error", err)
+			}
+		}
+		if failed {
+			report.Failed++
+		} else {
+			report.Processed++
+		}
+	}
+	return report, nil
+}
+
+// queueCleanup queues the mark or the deletion of a stale product
+func queueCleanup(ctx context.Context, writer *firestore.BulkWriter, ref *firestore.DocumentRef, mode string) ([]*firestore.BulkWriterJob, error) {
+	if mode == CleanupModeMark {
+		job, err := writer.Update(ref, []firestore.Update{
+			{Path: "stale", Value: true},
+			{Path: "staleSince", Value: time.Now().UTC()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []*firestore.BulkWriterJob{job}, nil
+	}
+
+	// Subcollections survive the deletion of their parent
+	var jobs []*firestore.BulkWriterJob
+	refs, err := ref.Collection(ProductSnapshotsCollection).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	for _, snapshotRef := range append(refs, ref) {
+		job, err := writer.Delete(snapshotRef)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// cleanupSettings reads the PRODUCT_CLEANUP_MAX_AGE (720h) and PRODUCT_CLEANUP_MODE
+// (mark) defaults
+func cleanupSettings() (time.Duration, string) {
+	mode := getEnv("PRODUCT_CLEANUP_MODE", CleanupModeMark)
+	if mode != CleanupModeDelete {
+		mode = CleanupModeMark
+	}
+	return envDuration("PRODUCT_CLEANUP_MAX_AGE", 30*24*time.Hour), mode
+}
+
+// registerProductCleanup schedules the cleanup every PRODUCT_CLEANUP_INTERVAL, disabled
+// by default. The job consumes no Keepa tokens.
+func registerProductCleanup(scheduler *budgetScheduler) {
+	interval := envDuration("PRODUCT_CLEANUP_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	scheduler.register(&RecurringJob{
+		Name:     "product-cleanup",
+		Priority: PriorityLow,
+		Interval: interval,
+		Estimate: func() int { return 0 },
+		Run: func() error {
+			maxAge, mode := cleanupSettings()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			defer cancel()
+			report, err := cleanupStaleProducts(ctx, maxAge, mode, false)
+			if err != nil {
+				return err
+			}
+			logger.Info("Stale product cleanup finished", "mode", report.Mode, "stale", report.Stale,
+				"processed", report.Processed, "failed", report.Failed)
+			return nil
+		},
+	})
+}
+
+// handleProductCleanup runs the cleanup on demand. ?maxAgeDays and ?mode (mark or
+// delete) override the configured defaults; ?dryRun=true only reports the products.
+func handleProductCleanup(c *gin.Context) {
+	maxAge, mode := cleanupSettings()
+	if value := c.Query("maxAgeDays"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 {
+			respondError(c, http.StatusBadRequest, "maxAgeDays must be a positive number of days")
+			return
+		}
+		maxAge = time.Duration(days) * 24 * time.Hour
+	}
+	if value := c.Query("mode"); value != "" {
+		if value != CleanupModeMark && value != CleanupModeDelete {
+			respondError(c, http.StatusBadRequest, "mode must be mark or delete")
+			return
+		}
+		mode = value
+	}
+
+	report, err := cleanupStaleProducts(c.Request.Context(), maxAge, mode, c.Query("dryRun") == "true")
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cliCommands are the subcommands that run the pipeline once and exit instead of
+// serving the API. They write their results to stdout and log to stderr.
+var cliCommands = []string{"fetch", "product", "finder", "export"}
+
+// newRootCommand builds the command line. Without a subcommand the binary serves the
+// API, so existing deployments keep working; the subcommands suit ad-hoc pulls from a
+// workstation or a Kubernetes Job. All commands read the same configuration.
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "keepa-api",
+		Short:         "Keepa product pipeline",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		Args:          cobra.NoArgs,
+		Run:           func(cmd *cobra.Command, args []string) { runServer() },
+	}
+	root.PersistentFlags().String("tenant", "", "Act for the tenant with this ID, using its Keepa key and collections")
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Serve the REST, GraphQL and gRPC APIs (the default)",
+			Args:  cobra.NoArgs,
+			Run:   func(cmd *cobra.Command, args []string) { runServer() },
+		},
+		newFetchCommand(),
+		newProductCommand(),
+		newFinderCommand(),
+		newExportCommand(),
+	)
+	return root
+}
+
+// cliContext returns the context of a CLI command, ended by SIGINT or SIGTERM and
+// acting for the --tenant, and a Keepa client
+func cliContext(cmd *cobra.Command) (context.Context, context.CancelFunc, *KeepaClient, error) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx = withLogAttrs(ctx, slog.String(LogKeyComponent, "cli"))
+	if id, _ := cmd.Flags().GetString("tenant"); id != "" {
+		tenant, err := tenants.byID(ctx, id)
+		if err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+		if tenant == nil || tenant.Disabled {
+			cancel()
+			return nil, nil, nil, fmt.Errorf("tenant %s does not exist or is disabled", id)
+		}
+		ctx = withTenant(ctx, tenant)
+	}
+	return ctx, cancel, NewKeepaClient().forContext(ctx), nil
+}
+
+// readASINs collects ASINs from args, else from file ("-" for stdin), else from stdin.
+// ASINs are separated by whitespace or commas; duplicates are dropped and invalid
+// ones fail the command before any Keepa call.
+func readASINs(args []string, file string) ([]string, error) {
+	var reader io.Reader
+	switch {
+	case len(args) > 0:
+		reader = strings.NewReader(strings.Join(args, "\n"))
+	case file == "" || file == "-":
+		reader = os.Stdin
+	default:
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	var values []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		values = append(values, strings.FieldsFunc(scanner.Text(), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ASINs: %w", err)
+	}
+	asins, err := validateASINs(values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASINs: %w", err)
+	}
+	if len(asins) == 0 {
+		return nil, fmt.Errorf("no ASINs given")
+	}
+	return asins, nil
+}
+
+// writeJSONLine writes value to stdout as one line of JSON
+func writeJSONLine(value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+	return err
+}
+
+// FetchResult is a line of the output of the fetch command
+type FetchResult struct {
+	ASIN     string             `json:"asin"`
+	Product  *SimplifiedProduct `json:"product,omitempty"`
+	CacheHit bool               `json:"cacheHit,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// newFetchCommand runs the product pipeline for a list of ASINs
+func newFetchCommand() *cobra.Command {
+	var file, domainValue string
+	var useCache bool
+	cmd := &cobra.Command{
+		Use:   "fetch [ASIN...]",
+		Short: "Fetch products from Keepa into Redis and Firestore, printing one JSON line per ASIN",
+		Long: "Fetch runs the product pipeline for the ASINs given as arguments, read from --file or\n" +
+			"from stdin, in batches of KEEPA_BATCH_SIZE. Each ASIN is printed as a JSON line with\n" +
+			"its product or error. The command fails when any ASIN failed.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			asins, err := readASINs(args, file)
+			if err != nil {
+				return err
+			}
+			domain, err := parseDomain(domainValue)
+			if err != nil {
+				return err
+			}
+			ctx, cancel, client, err := cliContext(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			batchSize, _ := strconv.Atoi(getEnv("KEEPA_BATCH_SIZE", "10"))
+			if batchSize < 1 || batchSize > maxProductBatch {
+				batchSize = maxProductBatch
+			}
+			taskID := generateTaskID()
+			failed := 0
+			for start := 0; start < len(asins); start += batchSize {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				batch := asins[start:min(start+batchSize, len(asins))]
+				results, errs := client.processASINBatch(ctx, taskID, domain, batch, useCache, nil)
+				for i, asin := range batch {
+					line := FetchResult{ASIN: asin, CacheHit: results[i].CacheHit}
+					if product := results[i].Product; product != nil && len(product.Products) > 0 {
+						line.Product = &product.Products[0]
+					}
+					if errs[i] != nil {
+						line.Error = errs[i].Error()
+						failed++
+					}
+					if err := writeJSONLine(line); err != nil {
+						return err
+					}
+				}
+			}
+			logger.InfoContext(ctx, "Fetched products", "asins", len(asins), "failed", failed, "domain", domain)
+			if failed > 0 {
+				return fmt.Errorf("%d of %d ASINs failed", failed, len(asins))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Read ASINs from this file, - for stdin (the default without arguments)")
+	cmd.Flags().StringVar(&domainValue, "domain", "", "Keepa domain ID or marketplace, KEEPA_DOMAIN by default")
+	cmd.Flags().BoolVar(&useCache, "cache", false, "Store cached Redis products instead of calling Keepa")
+	return cmd
+}
+
+// newProductCommand prints a stored product, or fetches it with --refresh
+func newProductCommand() *cobra.Command {
+	var domainValue string
+	var refresh bool
+	cmd := &cobra.Command{
+		Use:   "product ASIN",
+		Short: "Print a stored product as JSON, like GET /products/:asin",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			domain, err := parseDomain(domainValue)
+			if err != nil {
+				return err
+			}
+			ctx, cancel, client, err := cliContext(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			response, source, err := client.getProduct(ctx, domain, strings.ToUpper(args[0]), refresh)
+			if err != nil {
+				return err
+			}
+			logger.InfoContext(ctx, "Read product", LogKeyASIN, args[0], "source", source)
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(response)
+		},
+	}
+	cmd.Flags().StringVar(&domainValue, "domain", "", "Keepa domain ID or marketplace, KEEPA_DOMAIN by default")
+	cmd.Flags().BoolVar(&refresh, "refresh", false, "Fetch the product from Keepa and store it first")
+	return cmd
+}
+
+// newFinderCommand runs a Product Finder query to completion
+func newFinderCommand() *cobra.Command {
+	var file, fields string
+	cmd := &cobra.Command{
+		Use:   "finder",
+		Short: "Run a Product Finder query and wait for its tasks, printing each finished task as a JSON line",
+		Long: "Finder reads a body of POST /keepa, a finder query or \"asins\", optionally with \"domains\",\n" +
+			"from --query or stdin. It runs the tasks in this process, storing the products in\n" +
+			"Redis and Firestore, and fails when a task failed. Export the products with export.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			reader := io.Reader(os.Stdin)
+			if file != "" && file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				reader = f
+			}
+			var body map[string]interface{}
+			if err := json.NewDecoder(reader).Decode(&body); err != nil {
+				return fmt.Errorf("invalid query: %w", err)
+			}
+			ctx, cancel, client, err := cliContext(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+
+			specs, callbackURL, err := parseFetchSpecs(ctx, body, fields)
+			if err != nil {
+				return err
+			}
+			startTaskRunners()
+			started, err := client.startFetchTasks(ctx, specs, callbackURL, "")
+			if err != nil {
+				return err
+			}
+			failed := 0
+			for _, task := range started {
+				finished, err := waitForTask(ctx, task.TaskID)
+				if err != nil {
+					return err
+				}
+				if finished.Status == "failed" {
+					failed++
+				}
+				if err := writeJSONLine(finished); err != nil {
+					return err
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d tasks failed", failed, len(started))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&file, "query", "q", "", "Read the query from this file, - for stdin (the default)")
+	cmd.Flags().StringVar(&fields, "fields", "", "Comma-separated product fields, like ?fields")
+	return cmd
+}
+
+// waitForTask blocks until a task of this process finishes, logging its progress
+func waitForTask(ctx context.Context, taskID string) (Task, error) {
+	task, events, unsubscribe, err := watchTask(ctx, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+	defer unsubscribe()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for !taskFinished(&task) {
+		select {
+		case <-ctx.Done():
+			return task, ctx.Err()
+		case <-events:
+		case <-ticker.C:
+			logger.InfoContext(ctx, "Task running", LogKeyTaskID, taskID, "progress", task.Progress, "total", task.Total)
+		}
+		if task, err = getTask(ctx, taskID); err != nil {
+			return task, err
+		}
+	}
+	return task, nil
+}
+
+// newExportCommand writes the products of a task as a spreadsheet
+func newExportCommand() *cobra.Command {
+	var format, columnNames, output string
+	cmd := &cobra.Command{
+		Use:   "export TASK_ID",
+		Short: "Write the products of a task as csv or xlsx, like GET /tasks/:id/export",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "csv" && format != "xlsx" {
+				return fmt.Errorf("format must be csv or xlsx")
+			}
+			if columnNames == "" {
+				columnNames = getEnv("EXPORT_COLUMNS", defaultExportColumns)
+			}
+			columns, err := parseExportColumns(columnNames)
+			if err != nil {
+				return err
+			}
+			ctx, cancel, _, err := cliContext(cmd)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			task, err := getTask(ctx, args[0])
+			if err != nil {
+				return err
+			}
+
+			w := io.Writer(os.Stdout)
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			buffered := bufio.NewWriter(w)
+			if err := writeTaskExport(ctx, buffered, &task, format, columns, velocityFilter{}, func() { buffered.Flush() }); err != nil {
+				return err
+			}
+			return buffered.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "csv", "csv or xlsx")
+	cmd.Flags().StringVar(&columnNames, "columns", "", "Comma-separated columns, EXPORT_COLUMNS or all by default")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Write to this file instead of stdout")
+	return cmd
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keepaFlights coalesces identical Keepa requests in flight, so concurrent lookups of
+// the same uncached ASIN or finder query pay the tokens once
+var keepaFlights singleflight.Group
+
+// coalescedRequests counts the Keepa requests answered by an identical request in flight
+var coalescedRequests, _ = otel.Meter("Keepa-api").Int64Counter("keepa.requests.coalesced",
+	metric.WithDescription("Keepa requests served by an identical request already in flight, by endpoint"))
+
+// coalesce runs fn once for concurrent calls with the same key and returns its result to
+// all of them. shared reports that another caller ran fn and paid its tokens. A caller
+// stops waiting when its own ctx ends; fn runs with the ctx of the first caller. Calls
+// of different tenants never coalesce, as each pays with its own key.
+func coalesce(ctx context.Context, endpoint, key string, fn func() (interface{}, error)) (value interface{}, shared bool, err error) {
+	leader := false
+	results := keepaFlights.DoChan(tenantID(ctx)+":"+endpoint+":"+key, func() (interface{}, error) {
+		leader = true
+		return fn()
+	})
+	select {
+	case result := <-results:
+		// leader is written before the result is sent
+		if !leader {
+			coalescedRequests.Add(ctx, 1, metric.WithAttributes(attribute.String("keepa.endpoint", endpoint)))
+			logger.DebugContext(ctx, "Coalesced Keepa request", "endpoint", endpoint)
+		}
+		return result.Val, !leader, result.Err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// productFlightKey identifies a Product Request by its domain, ASINs, fields and options
+func productFlightKey(domain string, asins []string, fields productFields, options *ProductOptions) string {
+	sorted := append([]string(nil), asins...)
+	sort.Strings(sorted)
+	params := options.params()
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	key.WriteString(domain + "|" + strings.Join(sorted, ","))
+	if fields == nil {
+		key.WriteString("|*")
+	} else {
+		key.WriteString("|" + strings.Join(fields.list(), ","))
+	}
+	for _, name := range names {
+		key.WriteString("|" + name + "=" + params[name])
+	}
+	return key.String()
+}
+
+// finderFlightKey identifies a Product Finder request by its domain and a hash of its
+// query and page size
+func finderFlightKey(domain string, queryParam map[string]interface{}, pageSize int) string {
+	// Maps are encoded with sorted keys, so equal queries hash alike
+	data, _ := json.Marshal(queryParam)
+	sum := sha256.Sum256(data)
+	return domain + ":" + hex.EncodeToString(sum[:]) + ":" + strconv.Itoa(pageSize)
+}
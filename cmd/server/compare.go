@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ComparisonEntry is one column of the product comparison
+type ComparisonEntry struct {
+	Asin          string  `json:"asin"`
+	Domain        string  `json:"domain,omitempty"`
+	Title         string  `json:"title,omitempty"`
+	Brand         string  `json:"brand,omitempty"`
+	BuyBoxPrice   int     `json:"buyBoxPrice,omitempty"`
+	SalesRank     int     `json:"salesRank,omitempty"`
+	OfferCountFBA int     `json:"offerCountFBA"`
+	OfferCountFBM int     `json:"offerCountFBM"`
+	LiveOffers    int     `json:"liveOffers"`
+	Rating        float64 `json:"rating,omitempty"`
+	ReviewCount   int     `json:"reviewCount,omitempty"`
+	MonthlySold   int     `json:"monthlySold,omitempty"`
+	Source        string  `json:"source"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// newComparisonEntry extracts the compared figures of a product
+func newComparisonEntry(product *SimplifiedProduct, source string) ComparisonEntry {
+	entry := ComparisonEntry{
+		Asin:          product.Asin,
+		Title:         product.Title,
+		Brand:         product.Brand,
+		BuyBoxPrice:   product.BuyBoxPrice,
+		OfferCountFBA: product.OfferCountFBA,
+		OfferCountFBM: product.OfferCountFBM,
+		Rating:        product.Rating,
+		ReviewCount:   product.ReviewCount,
+		MonthlySold:   product.MonthlySold,
+		Source:        source,
+	}
+	entry.SalesRank, _ = latestSalesRank(product.SalesRanks)
+	for _, offer := range product.Offers {
+		if offer.IsLive {
+			entry.LiveOffers++
+		}
+	}
+	return entry
+}
+
+// compareProducts loads the products from Redis or Firestore and fetches the missing
+// ones of the domain from Keepa, returning one entry per ASIN in request order
+func (client *KeepaClient) compareProducts(ctx context.Context, domain string, asins []string) []ComparisonEntry {
+	entries := make([]ComparisonEntry, len(asins))
+	var missing []string
+	for i, asin := range asins {
+		response, source, err := loadProduct(ctx, domain, asin)
+		if err != nil || len(response.Products) == 0 {
+			missing = append(missing, asin)
+			continue
+		}
+		entries[i] = newComparisonEntry(&response.Products[0], source)
+	}
+	if len(missing) == 0 {
+		return entries
+	}
+
+	responses, fetchErr := client.ProductRequestBatch(ctx, domain, missing, defaultProductFields, nil, PriorityInteractive)
+	requestID := generateTaskID()
+	for i, asin := range asins {
+		if entries[i].Asin != "" {
+			continue
+		}
+		response, ok := responses[asin]
+		if !ok || len(response.Products) == 0 {
+			entries[i] = ComparisonEntry{Asin: asin, Source: SourceKeepa, Error: "product not found"}
+			if fetchErr != nil {
+				entries[i].Error = fetchErr.Error()
+			}
+			continue
+		}
+		if err := client.storeProduct(ctx, requestID, domain, asin, response, nil); err != nil {
+			client.Logger.WarnContext(ctx, "Failed to store compared product", LogKeyTaskID, requestID, LogKeyASIN, asin, "error", err)
+		}
+		entries[i] = newComparisonEntry(&response.Products[0], SourceKeepa)
+	}
+	return entries
+}
+
+// handleCompareProducts compares buy box price, rank, offer counts, rating and monthly
+// sold of up to COMPARE_MAX_ASINS products of one domain side by side
+func (client *KeepaClient) handleCompareProducts(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	maxASINs, _ := strconv.Atoi(getEnv("COMPARE_MAX_ASINS", "20"))
+	var values []string
+	for _, value := range strings.Split(c.Query("asins"), ",") {
+		if strings.TrimSpace(value) != "" {
+			values = append(values, value)
+		}
+	}
+	asins, err := validateASINs(values)
+	if err != nil {
+		respondRejectedRows(c, "asins lists invalid ASINs", err.(*RejectedRowsError))
+		return
+	}
+	if len(asins) < 2 {
+		respondError(c, http.StatusBadRequest, "asins must list at least two ASINs")
+		return
+	}
+	if len(asins) > maxASINs {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("At most %d ASINs can be compared", maxASINs))
+		return
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"asins":    asins,
+		"domain":   domain,
+		"products": client.compareProducts(c.Request.Context(), domain, asins),
+	}))
+}
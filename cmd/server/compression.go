@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// incompressibleTypes are response media types gzip would not shrink or that clients
+// read incrementally
+var incompressibleTypes = []string{
+	"application/zip",
+	"application/gzip",
+	"text/event-stream",
+	xlsxContentType,
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses a response once it exceeds minSize bytes or is flushed, so
+// small answers are sent as they are and streams are compressed from the start
+type gzipWriter struct {
+	gin.ResponseWriter
+	pool    *sync.Pool
+	minSize int
+	buffer  []byte
+	gz      *gzip.Writer
+	plain   bool // Decided not to compress
+}
+
+// start decides whether to compress before the first bytes are sent
+func (w *gzipWriter) start() {
+	if w.gz != nil || w.plain {
+		return
+	}
+	header := w.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	status := w.ResponseWriter.Status()
+	if w.ResponseWriter.Written() || header.Get("Content-Encoding") != "" || containsString(incompressibleTypes, mediaType) || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.plain = true
+		return
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	w.gz = w.pool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+// Write buffers p until the response is large enough to be compressed
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.gz == nil && !w.plain {
+		if len(w.buffer)+len(p) < w.minSize {
+			w.buffer = append(w.buffer, p...)
+			return len(p), nil
+		}
+		w.start()
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// WriteString writes s like Write
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Written reports whether the response has been started, including buffered bytes
+func (w *gzipWriter) Written() bool {
+	return len(w.buffer) > 0 || w.ResponseWriter.Written()
+}
+
+// Flush sends what was written so far, compressing the rest of a streamed response
+func (w *gzipWriter) Flush() {
+	w.start()
+	if err := w.flushBuffer(); err != nil {
+		return
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// flushBuffer writes the buffered bytes through the chosen encoding
+func (w *gzipWriter) flushBuffer() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	buffer := w.buffer
+	w.buffer = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(buffer)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buffer)
+	return err
+}
+
+// finish sends a small response uncompressed or ends the gzip stream
+func (w *gzipWriter) finish() {
+	if w.gz == nil {
+		w.plain = true
+		w.flushBuffer()
+		return
+	}
+	w.gz.Close()
+	w.gz.Reset(nil)
+	w.pool.Put(w.gz)
+	w.gz = nil
+}
+
+// compressionMiddleware gzips responses for clients accepting it. Responses smaller
+// than COMPRESSION_MIN_SIZE bytes (1024) are sent uncompressed; COMPRESSION_LEVEL
+// (-2 to 9, default 6) trades CPU for size, levels outside the range fall back to the
+// default. COMPRESSION=false disables it.
+func compressionMiddleware() gin.HandlerFunc {
+	if getEnv("COMPRESSION", "true") == "false" {
+		return func(c *gin.Context) { c.Next() }
+	}
+	minSize := envInt("COMPRESSION_MIN_SIZE", 1024)
+	level, err := strconv.Atoi(getEnv("COMPRESSION_LEVEL", "6"))
+	if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		logger.Warn("Invalid COMPRESSION_LEVEL, using the default", "level", getEnv("COMPRESSION_LEVEL", ""))
+		level = gzip.DefaultCompression
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		gz, err := gzip.NewWriterLevel(nil, level)
+		if err != nil {
+			return gzip.NewWriter(nil)
+		}
+		return gz
+	}}
+
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+		writer := &gzipWriter{ResponseWriter: c.Writer, pool: pool, minSize: minSize}
+		c.Writer = writer
+		c.Next()
+		writer.finish()
+		c.Writer = writer.ResponseWriter
+	}
+}
+
+// bodyETag returns a weak entity tag of a response body. It is weak because the
+// body may be sent gzipped or not.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// stateETag returns a weak entity tag naming a state, e.g. a task and the options of
+// its export
+func stateETag(parts ...interface{}) string {
+	return bodyETag([]byte(fmt.Sprint(parts...)))
+}
+
+// etagMatches reports whether the If-None-Match header of the request names etag.
+// Weak comparison is used, as for GET requests.
+func etagMatches(c *gin.Context, etag string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header and answers 304 when the client has the current
+// representation, reporting whether it did
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if !etagMatches(c, etag) {
+		return false
+	}
+	c.AbortWithStatus(http.StatusNotModified)
+	return true
+}
+
+// etagWriter holds back a response so its entity tag can be computed. A flushed
+// response is a stream and is passed through without a tag.
+type etagWriter struct {
+	gin.ResponseWriter
+	body        bytes.Buffer
+	status      int
+	passThrough bool
+}
+
+// WriteHeader records the status until the response is sent
+func (w *etagWriter) WriteHeader(status int) {
+	if w.passThrough {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+// WriteHeaderNow is deferred like WriteHeader
+func (w *etagWriter) WriteHeaderNow() {
+	if w.passThrough {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Status returns the status written so far
+func (w *etagWriter) Status() int {
+	if w.passThrough {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+// Written reports whether the handler has written a status or body
+func (w *etagWriter) Written() bool {
+	return w.body.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// Size returns the number of body bytes written so far
+func (w *etagWriter) Size() int {
+	if w.passThrough {
+		return w.ResponseWriter.Size()
+	}
+	return w.body.Len()
+}
+
+// Write holds back p until the handler returns
+func (w *etagWriter) Write(p []byte) (int, error) {
+	if w.passThrough {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.body.Write(p)
+}
+
+// WriteString writes s like Write
+func (w *etagWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush switches to passing the response through
+func (w *etagWriter) Flush() {
+	w.send()
+	w.ResponseWriter.Flush()
+}
+
+// send writes the held back response and passes later writes through
+func (w *etagWriter) send() {
+	if w.passThrough {
+		return
+	}
+	w.passThrough = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.body.Len() > 0 {
+		w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+}
+
+// etagMiddleware tags successful GET responses with the hash of their body and
+// answers 304 Not Modified when If-None-Match names it. Streamed responses are
+// passed through untagged.
+func etagMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		// A panicking handler leaves its partial response behind for the problem
+		// answered by problemMiddleware
+		writer := &etagWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = writer
+		defer func() { c.Writer = writer.ResponseWriter }()
+		c.Next()
+
+		if writer.passThrough {
+			return
+		}
+		if writer.status == http.StatusOK && writer.Header().Get("ETag") == "" {
+			etag := bodyETag(writer.body.Bytes())
+			writer.Header().Set("ETag", etag)
+			if etagMatches(c, etag) {
+				writer.Header().Del("Content-Type")
+				writer.body.Reset()
+				writer.status = http.StatusNotModified
+			}
+		}
+		writer.send()
+	}
+}
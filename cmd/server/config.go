@@ -0,0 +1,455 @@
+package main
+
+import (
+	"Keepa-api/internal/storage"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Config is the YAML file named by CONFIG_FILE. Every setting stands for the
+// environment variable of its env tag, and a set variable overrides the file. Settings
+// tagged restart are read once at startup; the others apply on the next reload:
+//
+//	keepa:
+//	  domain: "1"
+//	  categories: [1055398, 3760901]
+//	cache:
+//	  productTTL: 12h
+//	alerts:
+//	  quotaWarningTokens: 200
+//	env:
+//	  SELLER_OFFER_SCAN_LIMIT: "500"
+type Config struct {
+	Server ServerConfig      `yaml:"server"`
+	Keepa  KeepaConfig       `yaml:"keepa"`
+	Cache  CacheConfig       `yaml:"cache"`
+	Tasks  TaskConfig        `yaml:"tasks"`
+	Alerts AlertConfig       `yaml:"alerts"`
+	Limits LimitConfig       `yaml:"limits"`
+	Redis  RedisConfig       `yaml:"redis"`
+	Env    map[string]string `yaml:"env"` // Any other variable by name
+}
+
+// ServerConfig configures the HTTP server and logging
+type ServerConfig struct {
+	Port          *string `yaml:"port" env:"PORT" restart:"true"`
+	ProjectID     *string `yaml:"projectId" env:"PROJECT_ID" restart:"true"`
+	PublicBaseURL *string `yaml:"publicBaseUrl" env:"PUBLIC_BASE_URL"`
+	LogLevel      *string `yaml:"logLevel" env:"LOG_LEVEL"`
+	// Load balancers trusted for the client IP, see configureClientIP
+	TrustedProxies  *string `yaml:"trustedProxies" env:"TRUSTED_PROXIES" restart:"true"`
+	TrustedPlatform *string `yaml:"trustedPlatform" env:"TRUSTED_PLATFORM" restart:"true"`
+}
+
+// KeepaConfig configures the Keepa requests of tasks
+type KeepaConfig struct {
+	Domain        *string        `yaml:"domain" env:"KEEPA_DOMAIN"`
+	Categories    []int64        `yaml:"categories" env:"KEEPA_CATEGORY"` // Root categories scanned by default
+	PageSize      *int           `yaml:"pageSize" env:"KEEPA_PAGE_SIZE"`
+	MaxPages      *int           `yaml:"maxPages" env:"KEEPA_MAX_PAGES"`
+	MaxPagesLimit *int           `yaml:"maxPagesLimit" env:"KEEPA_MAX_PAGES_LIMIT"` // Most pages a request may ask for
+	BatchSize     *int           `yaml:"batchSize" env:"KEEPA_BATCH_SIZE"`
+	Timeout       *time.Duration `yaml:"timeout" env:"KEEPA_HTTP_TIMEOUT" restart:"true"`
+	Mode          *string        `yaml:"mode" env:"KEEPA_MODE" restart:"true"` // "live" or "mock"
+}
+
+// CacheConfig configures the cache TTLs
+type CacheConfig struct {
+	ProductTTL       *time.Duration `yaml:"productTTL" env:"PRODUCT_CACHE_TTL"`
+	SellerTTL        *time.Duration `yaml:"sellerTTL" env:"SELLER_CACHE_TTL"`
+	DealTTL          *time.Duration `yaml:"dealTTL" env:"DEAL_CACHE_TTL"`
+	LightningDealTTL *time.Duration `yaml:"lightningDealTTL" env:"LIGHTNING_DEAL_CACHE_TTL"`
+	SearchTTL        *time.Duration `yaml:"searchTTL" env:"SEARCH_CACHE_TTL"`
+	TTLJitter        *int           `yaml:"ttlJitterPercent" env:"CACHE_TTL_JITTER"`
+	LocalTTL         *time.Duration `yaml:"localTTL" env:"LOCAL_CACHE_TTL" restart:"true"`
+}
+
+// TaskConfig configures task execution
+type TaskConfig struct {
+	Runners             *int           `yaml:"runners" env:"TASK_RUNNERS" restart:"true"`
+	QueueSize           *int           `yaml:"queueSize" env:"TASK_QUEUE_SIZE" restart:"true"`
+	WorkerConcurrency   *int           `yaml:"workerConcurrency" env:"WORKER_CONCURRENCY"`
+	CategoryConcurrency *int           `yaml:"categoryConcurrency" env:"CATEGORY_CONCURRENCY"`
+	Deadline            *time.Duration `yaml:"deadline" env:"TASK_DEADLINE"`
+}
+
+// AlertConfig configures the token alerts and the alert rule refresh
+type AlertConfig struct {
+	QuotaWarningTokens     *int           `yaml:"quotaWarningTokens" env:"QUOTA_WARNING_TOKENS"`
+	QuotaCriticalTokens    *int           `yaml:"quotaCriticalTokens" env:"QUOTA_CRITICAL_TOKENS"`
+	TokenAlertThreshold    *int           `yaml:"tokenAlertThreshold" env:"TOKEN_ALERT_THRESHOLD"`
+	TokenAlertAfterMinutes *int           `yaml:"tokenAlertAfterMinutes" env:"TOKEN_ALERT_AFTER_MINUTES"`
+	RulesRefresh           *time.Duration `yaml:"rulesRefresh" env:"ALERT_RULES_REFRESH"`
+}
+
+// LimitConfig configures the inbound limits. A rate of 0 disables the limit.
+type LimitConfig struct {
+	RatePerMinute     *int `yaml:"ratePerMinute" env:"RATE_LIMIT_PER_MINUTE"`
+	RateBurst         *int `yaml:"rateBurst" env:"RATE_LIMIT_BURST"`
+	TaskRatePerMinute *int `yaml:"taskRatePerMinute" env:"TASK_RATE_LIMIT_PER_MINUTE"`
+	TaskRateBurst     *int `yaml:"taskRateBurst" env:"TASK_RATE_LIMIT_BURST"`
+	MaxActiveTasks    *int `yaml:"maxActiveTasksPerCaller" env:"MAX_ACTIVE_TASKS_PER_CALLER"`
+	MaxJSONBodyBytes  *int `yaml:"maxJsonBodyBytes" env:"MAX_JSON_BODY_BYTES" restart:"true"`
+	MaxUploadBytes    *int `yaml:"maxUploadBytes" env:"MAX_UPLOAD_BYTES" restart:"true"`
+}
+
+// RedisConfig configures the Redis connection, see newRedisClient
+type RedisConfig struct {
+	Mode         *string `yaml:"mode" env:"REDIS_MODE" restart:"true"`
+	Addr         *string `yaml:"addr" env:"REDIS_ADDR" restart:"true"`
+	DB           *int    `yaml:"db" env:"REDIS_DB" restart:"true"`
+	PoolSize     *int    `yaml:"poolSize" env:"REDIS_POOL_SIZE" restart:"true"`
+	MinIdleConns *int    `yaml:"minIdleConns" env:"REDIS_MIN_IDLE_CONNS" restart:"true"`
+}
+
+// configSetting is a typed setting of Config
+type configSetting struct {
+	env     string
+	restart bool
+	value   reflect.Value
+}
+
+// settings lists the typed settings of c
+func (c *Config) settings() []configSetting {
+	var settings []configSetting
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		if section.Kind() != reflect.Struct {
+			continue
+		}
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			settings = append(settings, configSetting{
+				env:     field.Tag.Get("env"),
+				restart: field.Tag.Get("restart") == "true",
+				value:   section.Field(j),
+			})
+		}
+	}
+	return settings
+}
+
+// set parses an environment variable into the setting
+func (s configSetting) set(raw string) error {
+	switch target := s.value.Addr().Interface().(type) {
+	case **string:
+		*target = &raw
+	case **int:
+		value, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", s.env, raw)
+		}
+		*target = &value
+	case **time.Duration:
+		value, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration like 90s or 12h", s.env, raw)
+		}
+		*target = &value
+	case *[]int64:
+		var ids []int64
+		for _, part := range strings.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ',' }) {
+			id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a category ID", s.env, part)
+			}
+			ids = append(ids, id)
+		}
+		*target = ids
+	default:
+		return fmt.Errorf("%s: unsupported setting type %s", s.env, s.value.Type())
+	}
+	return nil
+}
+
+// format returns the setting as its environment variable, false when it is unset
+func (s configSetting) format() (string, bool) {
+	switch value := s.value.Interface().(type) {
+	case *string:
+		if value != nil {
+			return *value, true
+		}
+	case *int:
+		if value != nil {
+			return strconv.Itoa(*value), true
+		}
+	case *time.Duration:
+		if value != nil {
+			return value.String(), true
+		}
+	case []int64:
+		if value != nil {
+			ids := make([]string, len(value))
+			for i, id := range value {
+				ids[i] = strconv.FormatInt(id, 10)
+			}
+			return strings.Join(ids, ";"), true
+		}
+	}
+	return "", false
+}
+
+// validate reports every invalid setting of c, naming it by its YAML path
+func (c *Config) validate() error {
+	var errs []error
+	invalid := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	atLeast := func(path string, value *int, min int) {
+		if value != nil && *value < min {
+			invalid(path, "must be at least %d, got %d", min, *value)
+		}
+	}
+	positive := func(path string, value *time.Duration) {
+		if value != nil && *value <= 0 {
+			invalid(path, "must be a positive duration, got %v", *value)
+		}
+	}
+
+	if c.Server.LogLevel != nil {
+		if _, ok := logLevels[strings.ToLower(*c.Server.LogLevel)]; !ok {
+			invalid("server.logLevel", "must be debug, info, warn or error, got %q", *c.Server.LogLevel)
+		}
+	}
+	if c.Keepa.Domain != nil {
+		if _, ok := keepaDomains[*c.Keepa.Domain]; !ok {
+			invalid("keepa.domain", "must be a Keepa domain ID, got %q", *c.Keepa.Domain)
+		}
+	}
+	for _, id := range c.Keepa.Categories {
+		if id <= 0 {
+			invalid("keepa.categories", "category IDs must be positive, got %d", id)
+		}
+	}
+	if c.Keepa.PageSize != nil && (*c.Keepa.PageSize < 50 || *c.Keepa.PageSize > 10000) {
+		invalid("keepa.pageSize", "must be between 50 and 10000, got %d", *c.Keepa.PageSize)
+	}
+	if c.Keepa.BatchSize != nil && (*c.Keepa.BatchSize < 1 || *c.Keepa.BatchSize > 100) {
+		invalid("keepa.batchSize", "must be between 1 and 100, got %d", *c.Keepa.BatchSize)
+	}
+	atLeast("keepa.maxPages", c.Keepa.MaxPages, 1)
+	atLeast("keepa.maxPagesLimit", c.Keepa.MaxPagesLimit, 1)
+	positive("keepa.timeout", c.Keepa.Timeout)
+
+	positive("cache.productTTL", c.Cache.ProductTTL)
+	positive("cache.sellerTTL", c.Cache.SellerTTL)
+	positive("cache.dealTTL", c.Cache.DealTTL)
+	positive("cache.lightningDealTTL", c.Cache.LightningDealTTL)
+	positive("cache.searchTTL", c.Cache.SearchTTL)
+	positive("cache.localTTL", c.Cache.LocalTTL)
+	if c.Cache.TTLJitter != nil && (*c.Cache.TTLJitter < 0 || *c.Cache.TTLJitter > 100) {
+		invalid("cache.ttlJitterPercent", "must be between 0 and 100, got %d", *c.Cache.TTLJitter)
+	}
+
+	atLeast("tasks.runners", c.Tasks.Runners, 1)
+	atLeast("tasks.queueSize", c.Tasks.QueueSize, 1)
+	atLeast("tasks.workerConcurrency", c.Tasks.WorkerConcurrency, 1)
+	atLeast("tasks.categoryConcurrency", c.Tasks.CategoryConcurrency, 1)
+	positive("tasks.deadline", c.Tasks.Deadline)
+
+	atLeast("alerts.quotaWarningTokens", c.Alerts.QuotaWarningTokens, 0)
+	atLeast("alerts.quotaCriticalTokens", c.Alerts.QuotaCriticalTokens, 0)
+	if c.Alerts.QuotaWarningTokens != nil && c.Alerts.QuotaCriticalTokens != nil && *c.Alerts.QuotaCriticalTokens > *c.Alerts.QuotaWarningTokens {
+		invalid("alerts.quotaCriticalTokens", "must not exceed quotaWarningTokens (%d), got %d", *c.Alerts.QuotaWarningTokens, *c.Alerts.QuotaCriticalTokens)
+	}
+	atLeast("alerts.tokenAlertThreshold", c.Alerts.TokenAlertThreshold, 0)
+	atLeast("alerts.tokenAlertAfterMinutes", c.Alerts.TokenAlertAfterMinutes, 1)
+	positive("alerts.rulesRefresh", c.Alerts.RulesRefresh)
+
+	atLeast("limits.ratePerMinute", c.Limits.RatePerMinute, 0)
+	atLeast("limits.rateBurst", c.Limits.RateBurst, 1)
+	atLeast("limits.taskRatePerMinute", c.Limits.TaskRatePerMinute, 0)
+	atLeast("limits.taskRateBurst", c.Limits.TaskRateBurst, 1)
+	atLeast("limits.maxActiveTasksPerCaller", c.Limits.MaxActiveTasks, 0)
+	atLeast("limits.maxJsonBodyBytes", c.Limits.MaxJSONBodyBytes, 1)
+	atLeast("limits.maxUploadBytes", c.Limits.MaxUploadBytes, 1)
+
+	if c.Keepa.Mode != nil && *c.Keepa.Mode != KeepaModeLive && *c.Keepa.Mode != KeepaModeMock {
+		invalid("keepa.mode", "must be live or mock, got %q", *c.Keepa.Mode)
+	}
+	if c.Redis.Mode != nil {
+		if _, ok := storage.RedisPoolDefaults[*c.Redis.Mode]; !ok {
+			invalid("redis.mode", "must be standalone, cluster or sentinel, got %q", *c.Redis.Mode)
+		}
+	}
+	atLeast("redis.db", c.Redis.DB, 0)
+	atLeast("redis.poolSize", c.Redis.PoolSize, 1)
+	atLeast("redis.minIdleConns", c.Redis.MinIdleConns, 0)
+	return errors.Join(errs...)
+}
+
+// loadConfig reads path, applies the environment variables of the typed settings and
+// validates the result. Without a path only the environment is validated.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config file: %v", err)
+		}
+		defer file.Close()
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+
+	var errs []error
+	for _, setting := range config.settings() {
+		if raw := os.Getenv(setting.env); raw != "" {
+			if err := setting.set(raw); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%v", err)
+	}
+	return config, nil
+}
+
+// configStore holds the current configuration as environment variable values
+type configStore struct {
+	mu      sync.RWMutex
+	path    string
+	values  map[string]string
+	restart map[string]bool // Variables only read at startup
+	err     error           // Why the configuration failed to load at startup
+}
+
+// configs is the process-wide configuration. It is loaded before any other package
+// variable reads the environment, so it may not log.
+var configs = newConfigStore(os.Getenv("CONFIG_FILE"))
+
+// newConfigStore loads the configuration of path
+func newConfigStore(path string) *configStore {
+	store := &configStore{path: path, values: make(map[string]string), restart: make(map[string]bool)}
+	config, err := loadConfig(path)
+	if err != nil {
+		store.err = err
+		return store
+	}
+	store.values, store.restart = configValues(config)
+	return store
+}
+
+// configValues flattens a configuration into environment variable values
+func configValues(config *Config) (map[string]string, map[string]bool) {
+	values := make(map[string]string, len(config.Env))
+	restart := make(map[string]bool)
+	for key, value := range config.Env {
+		values[key] = value
+	}
+	for _, setting := range config.settings() {
+		if value, ok := setting.format(); ok {
+			values[setting.env] = value
+		}
+		restart[setting.env] = setting.restart
+	}
+	return values, restart
+}
+
+// value returns the configured value of an environment variable
+func (s *configStore) value(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// reload reads the config file again. An invalid file, including invalid simplification
+// rules, keeps the current configuration. It returns the changed variables, and those
+// of them only read at startup.
+func (s *configStore) reload() (changed, restartRequired []string, err error) {
+	config, err := loadConfig(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	values, restart := configValues(config)
+	rules, err := parseSimplificationRules(func(key string) string {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+		return values[key]
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	for key, value := range values {
+		if previous, ok := s.values[key]; !ok || previous != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range s.values {
+		if _, ok := values[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	s.values, s.restart = values, restart
+	s.mu.Unlock()
+	simplificationRules.Store(rules)
+
+	sort.Strings(changed)
+	for _, key := range changed {
+		if restart[key] {
+			restartRequired = append(restartRequired, key)
+		}
+	}
+	setLogLevel()
+	return changed, restartRequired, nil
+}
+
+// reloadConfig reloads the configuration, logging the outcome
+func reloadConfig(trigger string) (changed, restartRequired []string, err error) {
+	changed, restartRequired, err = configs.reload()
+	if err != nil {
+		logger.Error("Config reload failed, keeping the current configuration", "trigger", trigger, "error", err)
+		return nil, nil, err
+	}
+	logger.Info("Reloaded config", "trigger", trigger, "changed", changed)
+	if len(restartRequired) > 0 {
+		logger.Warn("Changed settings apply after a restart", "settings", restartRequired)
+	}
+	return changed, restartRequired, nil
+}
+
+// watchConfigReloads reloads the configuration on SIGHUP
+func watchConfigReloads() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadConfig("SIGHUP")
+		}
+	}()
+}
+
+// handleReloadConfig reloads the configuration of this instance
+func handleReloadConfig(c *gin.Context) {
+	changed, restartRequired, err := reloadConfig("api")
+	if err != nil {
+		respondProblem(c, http.StatusUnprocessableEntity, CodeInvalidRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": changed, "restartRequired": restartRequired})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FailedASINsCollection is the per-task subcollection holding ASINs that failed processing
+const FailedASINsCollection = "failed_asins"
+
+// FailedASIN is a dead-lettered ASIN of a task
+type FailedASIN struct {
+	ASIN     string    `json:"asin" firestore:"asin"`
+	Class    string    `json:"class" firestore:"class"`
+	Error    string    `json:"error" firestore:"error"`
+	Attempts int       `json:"attempts" firestore:"attempts"`
+	FailedAt time.Time `json:"failed_at" firestore:"failedAt"`
+}
+
+// failedASINRef returns the dead letter document of an ASIN
+func failedASINRef(taskID, asin string) *firestore.DocumentRef {
+	return firestoreClient.Collection(TasksCollection).Doc(taskID).Collection(FailedASINsCollection).Doc(asin)
+}
+
+// saveFailedASIN records or updates a dead-lettered ASIN, counting the attempts
+func saveFailedASIN(taskID string, failure TaskFailure) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := withRetry(ctx, DependencyFirestore, func() error {
+		_, err := failedASINRef(taskID, failure.ASIN).Set(ctx, map[string]interface{}{
+			"asin":     failure.ASIN,
+			"class":    failure.Class,
+			"error":    failure.Error,
+			"attempts": firestore.Increment(1),
+			"failedAt": time.Now().UTC(),
+		}, firestore.MergeAll)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to dead-letter ASIN", LogKeyTaskID, taskID, LogKeyASIN, failure.ASIN, "error", err)
+	}
+}
+
+// deleteFailedASIN removes an ASIN from the dead letter list after a successful retry
+func deleteFailedASIN(taskID, asin string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := withRetry(ctx, DependencyFirestore, func() error {
+		_, err := failedASINRef(taskID, asin).Delete(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error("Failed to remove ASIN from the dead letter list", LogKeyTaskID, taskID, LogKeyASIN, asin, "error", err)
+	}
+}
+
+// loadFailedASINs reads the dead-lettered ASINs of a task
+func loadFailedASINs(ctx context.Context, taskID string) ([]FailedASIN, error) {
+	iter := firestoreClient.Collection(TasksCollection).Doc(taskID).Collection(FailedASINsCollection).Documents(ctx)
+	defer iter.Stop()
+
+	var failed []FailedASIN
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read failed ASINs from Firestore: %v", err)
+		}
+		var entry FailedASIN
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, fmt.Errorf("failed to decode failed ASIN %s: %v", doc.Ref.ID, err)
+		}
+		failed = append(failed, entry)
+	}
+	return failed, nil
+}
+
+// handleListFailedASINs returns the dead-lettered ASINs of a task of the caller's tenant
+func handleListFailedASINs(c *gin.Context) {
+	taskID := c.Param("id")
+	_, ok, err := tasks.lookup(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskID))
+		return
+	}
+
+	failed, err := loadFailedASINs(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"task_id": taskID, "failed_asins": failed})
+}
+
+// handleRetryFailed queues a retry task for the dead-lettered ASINs of a task. The
+// retry task waits until the tokens of the caller's Keepa key recovered to
+// RETRY_MIN_TOKENS before it starts.
+func (client *KeepaClient) handleRetryFailed(c *gin.Context) {
+	client = client.forContext(c.Request.Context())
+	taskID := c.Param("id")
+	task, ok, err := tasks.lookup(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskID))
+		return
+	}
+	if task.Status == "pending" || task.Status == "running" {
+		respondError(c, http.StatusConflict, fmt.Sprintf("Task %s is still %s", taskID, task.Status))
+		return
+	}
+
+	failed, err := loadFailedASINs(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(failed) == 0 {
+		c.JSON(http.StatusOK, gin.H{"task_id": taskID, "asins": []string{}, "message": "No failed ASINs to retry"})
+		return
+	}
+	asins := make([]string, 0, len(failed))
+	for _, entry := range failed {
+		asins = append(asins, entry.ASIN)
+	}
+
+	minTokens, _ := strconv.Atoi(getEnv("RETRY_MIN_TOKENS", getEnv("QUOTA_WARNING_TOKENS", "100")))
+	retryID := generateTaskID()
+	tasks.create(c.Request.Context(), retryID, TaskKindASINs)
+	tasks.update(retryID, func(retry *Task) {
+		retry.RetryOf = taskID
+		retry.Domain = task.Domain
+	})
+	tasks.addASINs(retryID, asins)
+	client.Logger.InfoContext(c.Request.Context(), "Created retry task", LogKeyTaskID, retryID, "asins", len(asins), "source_task_id", taskID)
+
+	if !enqueueTask(func() {
+		client.waitForTokenRecovery(minTokens)
+		client.runASINTask(retryID, asins, false)
+	}) {
+		tasks.finish(retryID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{
+		"task_id":  retryID,
+		"retry_of": taskID,
+		"status":   "pending",
+		"asins":    asins,
+	}))
+}
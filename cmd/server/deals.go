@@ -0,0 +1,235 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DealRedisKeyPrefix = "keepa:deal:"
+	dealPageSize       = 150 // Keepa returns up to 150 deals per page
+)
+
+// Deal price types, the indexes of keepa.Deal.Current and the inner arrays of Delta and DeltaPercent
+const (
+	dealPriceAmazon    = 0
+	dealPriceNew       = 1
+	dealPriceSalesRank = 3
+)
+
+// Deal date ranges, the outer index of keepa.Deal.Delta, DeltaPercent and Avg
+var dealDateRanges = []string{"day", "week", "month", "90days"}
+
+// SimplifiedDeal is a deal with the price and sales rank changes of each date range
+type SimplifiedDeal struct {
+	Asin         string         `json:"asin"`
+	Title        string         `json:"title"`
+	RootCategory int64          `json:"rootCategory"`
+	Categories   []int64        `json:"categories"`
+	AmazonPrice  int            `json:"amazonPrice,omitempty"`
+	NewPrice     int            `json:"newPrice,omitempty"`
+	SalesRank    int            `json:"salesRank,omitempty"`
+	Delta        map[string]int `json:"delta,omitempty"`        // New price change in cents by date range
+	DeltaPercent map[string]int `json:"deltaPercent,omitempty"` // New price change in percent by date range
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+}
+
+// DealsResult is one page of deals
+type DealsResult struct {
+	Domain         string           `json:"domain"`
+	Page           int              `json:"page"`
+	Deals          []SimplifiedDeal `json:"deals"`
+	CategoryNames  map[int64]string `json:"categoryNames,omitempty"`
+	TokensConsumed int              `json:"-"` // Not stored, cached pages report 0
+}
+
+// DealsRequest is the body of POST /keepa/deals
+type DealsRequest struct {
+	Query    map[string]interface{} `json:"query"` // Keepa deal query, e.g. {"priceTypes": [0], "deltaPercentRange": [20, 100]}
+	Page     int                    `json:"page"`
+	Domain   string                 `json:"domain"`
+	UseCache bool                   `json:"use_cache"`
+}
+
+// Deals requests one page of Keepa's browsing deals matching selection
+func (client *KeepaClient) Deals(ctx context.Context, domain string, selection map[string]interface{}, page int) (*DealsResult, error) {
+	query := make(map[string]interface{}, len(selection)+2)
+	for key, value := range selection {
+		query[key] = value
+	}
+	domainID, err := strconv.Atoi(domain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain %q", domain)
+	}
+	query["domainId"] = domainID
+	query["page"] = page
+
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/deal?key=%s", apiKey)
+
+	// A deal request costs 5 tokens per page of up to 150 deals
+	apiResp, err := client.doRequest(ctx, url, 5, "POST", query)
+	if err != nil {
+		return nil, err
+	}
+	client.Logger.InfoContext(ctx, "Deals", "domain", domain, "page", page, "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+
+	result := &DealsResult{Domain: domain, Page: page, Deals: []SimplifiedDeal{}, TokensConsumed: apiResp.TokensConsumed}
+	if apiResp.Deals == nil {
+		return result, nil
+	}
+	for _, deal := range apiResp.Deals.Deals {
+		result.Deals = append(result.Deals, simplifyDeal(deal))
+	}
+	if len(apiResp.Deals.CategoryIDs) == len(apiResp.Deals.CategoryNames) {
+		result.CategoryNames = make(map[int64]string, len(apiResp.Deals.CategoryIDs))
+		for i, id := range apiResp.Deals.CategoryIDs {
+			result.CategoryNames[id] = apiResp.Deals.CategoryNames[i]
+		}
+	}
+	return result, nil
+}
+
+// simplifyDeal keeps the current prices and the new price changes of a deal
+func simplifyDeal(deal keepa.Deal) SimplifiedDeal {
+	simplified := SimplifiedDeal{
+		Asin:         deal.Asin,
+		Title:        deal.Title,
+		RootCategory: deal.RootCat,
+		Categories:   deal.Categories,
+		AmazonPrice:  dealValue(deal.Current, dealPriceAmazon),
+		NewPrice:     dealValue(deal.Current, dealPriceNew),
+		SalesRank:    dealValue(deal.Current, dealPriceSalesRank),
+		CreatedAt:    keepatime.ToTime(deal.CreationDate),
+		UpdatedAt:    keepatime.ToTime(deal.LastUpdate),
+	}
+	for i, dateRange := range dealDateRanges {
+		if i < len(deal.Delta) {
+			if delta := dealValue(deal.Delta[i], dealPriceNew); delta != 0 {
+				if simplified.Delta == nil {
+					simplified.Delta = make(map[string]int)
+				}
+				simplified.Delta[dateRange] = delta
+			}
+		}
+		if i < len(deal.DeltaPercent) {
+			if percent := dealValue(deal.DeltaPercent[i], dealPriceNew); percent != 0 {
+				if simplified.DeltaPercent == nil {
+					simplified.DeltaPercent = make(map[string]int)
+				}
+				simplified.DeltaPercent[dateRange] = percent
+			}
+		}
+	}
+	return simplified
+}
+
+// dealValue returns values[index], or 0 when it is missing or unavailable (-1)
+func dealValue(values []int, index int) int {
+	if index >= len(values) || values[index] < 0 {
+		return 0
+	}
+	return values[index]
+}
+
+// dealCacheKey identifies a deal page cached by the tenant of ctx by its domain, page
+// and query
+func dealCacheKey(ctx context.Context, domain string, page int, selection map[string]interface{}) string {
+	data, _ := json.Marshal(selection) // map keys are marshalled in sorted order
+	sum := sha256.Sum256(data)
+	return tenantRedisKey(ctx, fmt.Sprintf("%s%s:%d:%s", DealRedisKeyPrefix, domain, page, hex.EncodeToString(sum[:8])))
+}
+
+// getDealsFromRedis reads a cached deal page
+func getDealsFromRedis(ctx context.Context, key string) (*DealsResult, error) {
+	var data []byte
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		data, err = redisClient.Get(ctx, key).Bytes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result DealsResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal deals from Redis: %v", err)
+	}
+	return &result, nil
+}
+
+// saveDealsToRedis caches a deal page
+func saveDealsToRedis(ctx context.Context, key string, result *DealsResult) error {
+	data, _ := json.Marshal(result)
+	return withRetry(ctx, DependencyRedis, func() error {
+		return redisClient.Set(ctx, key, data, cacheTTL(CacheTypeDeal)).Err()
+	})
+}
+
+// handleDeals returns a page of Keepa deals matching the query. With use_cache the
+// page is served from and stored in Redis.
+func (client *KeepaClient) handleDeals(c *gin.Context) {
+	var request DealsRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	if request.Page < 0 {
+		respondError(c, http.StatusBadRequest, "Invalid page")
+		return
+	}
+	if request.Domain == "" {
+		request.Domain = getEnv("KEEPA_DOMAIN", "1")
+	}
+	if _, err := strconv.Atoi(request.Domain); err != nil {
+		respondError(c, http.StatusBadRequest, "Invalid domain")
+		return
+	}
+	if request.Query == nil {
+		request.Query = map[string]interface{}{}
+	}
+
+	ctx := c.Request.Context()
+	cacheKey := dealCacheKey(ctx, request.Domain, request.Page, request.Query)
+	if request.UseCache {
+		if cached, err := getDealsFromRedis(ctx, cacheKey); err == nil {
+			c.JSON(http.StatusOK, withQuotaWarning(dealsResponse(cached, true)))
+			return
+		}
+	}
+
+	result, err := client.Deals(ctx, request.Domain, request.Query, request.Page)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	if request.UseCache {
+		if err := saveDealsToRedis(ctx, cacheKey, result); err != nil {
+			logger.WarnContext(ctx, "Failed to cache deals page", "page", request.Page, "error", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(dealsResponse(result, false)))
+}
+
+// dealsResponse renders a deal page; hasMore is set when the page is full
+func dealsResponse(result *DealsResult, cached bool) gin.H {
+	return gin.H{
+		"deals":          result.Deals,
+		"categoryNames":  result.CategoryNames,
+		"domain":         result.Domain,
+		"page":           result.Page,
+		"hasMore":        len(result.Deals) == dealPageSize,
+		"tokensConsumed": result.TokensConsumed,
+		"cached":         cached,
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keepaDomains names the Amazon marketplaces by Keepa domain ID
+var keepaDomains = map[string]string{
+	"1":  "com",
+	"2":  "co.uk",
+	"3":  "de",
+	"4":  "fr",
+	"5":  "co.jp",
+	"6":  "ca",
+	"8":  "it",
+	"9":  "es",
+	"10": "in",
+	"11": "com.mx",
+	"12": "com.br",
+}
+
+// defaultDomain is KEEPA_DOMAIN, the domain of requests that do not name one
+func defaultDomain() string {
+	return getEnv("KEEPA_DOMAIN", "1")
+}
+
+// parseDomain resolves a domain given by Keepa ID or marketplace, e.g. "3", "de" or
+// "amazon.de", to its ID. An empty value is the default domain.
+func parseDomain(value string) (string, error) {
+	value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "amazon.")
+	if value == "" {
+		return defaultDomain(), nil
+	}
+	if _, ok := keepaDomains[value]; ok {
+		return value, nil
+	}
+	for id, name := range keepaDomains {
+		if name == value {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("unknown domain %q, expected a Keepa domain ID or one of %s", value, strings.Join(domainNames(), ", "))
+}
+
+// parseDomains resolves a comma-separated list of domains, dropping repeated ones
+func parseDomains(value string) ([]string, error) {
+	var domains []string
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		domain, err := parseDomain(part)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// splitDomains returns one copy of a POST /keepa body per domain it lists in
+// "domains", each with "domain" set, or the body itself when it lists none
+func splitDomains(requestData map[string]interface{}) ([]map[string]interface{}, error) {
+	rawDomains, ok := requestData["domains"]
+	if !ok {
+		return []map[string]interface{}{requestData}, nil
+	}
+	delete(requestData, "domains")
+	if _, ok := requestData["domain"]; ok {
+		return nil, fmt.Errorf("Use either domain or domains")
+	}
+	list, ok := rawDomains.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid domains: expected a list of domains")
+	}
+	values := make([]string, len(list))
+	for i, value := range list {
+		values[i] = fmt.Sprint(value)
+	}
+	domains, err := parseDomains(strings.Join(values, ","))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid domains: %v", err)
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("Invalid domains: at least one domain is required")
+	}
+	bodies := make([]map[string]interface{}, len(domains))
+	for i, domain := range domains {
+		body := make(map[string]interface{}, len(requestData)+1)
+		for key, value := range requestData {
+			body[key] = value
+		}
+		body["domain"] = domain
+		bodies[i] = body
+	}
+	return bodies, nil
+}
+
+// domainNames lists the marketplace names sorted by domain ID
+func domainNames() []string {
+	ids := make([]string, 0, len(keepaDomains))
+	for id := range keepaDomains {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = keepaDomains[id]
+	}
+	return names
+}
+
+// requestDomain returns the domain of ?domain=, the default domain when it is not set.
+// It answers 400 and returns false when the domain is unknown.
+func requestDomain(c *gin.Context) (string, bool) {
+	domain, err := parseDomain(c.Query("domain"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid domain: %v", err))
+		return "", false
+	}
+	return domain, true
+}
+
+// productDocID returns the Firestore document ID of a product. Products of the default
+// domain keep the bare ASIN of single-domain deployments, so their stored documents stay
+// readable; other domains are keyed <domain>_<asin>.
+func productDocID(domain, asin string) string {
+	if domain == "" || domain == defaultDomain() {
+		return asin
+	}
+	return domain + "_" + asin
+}
+
+// productDomain returns the domain of the task's products, the default domain for
+// tasks stored before tasks had one
+func (task *Task) productDomain() string {
+	if task.Domain == "" {
+		return defaultDomain()
+	}
+	return task.Domain
+}
+
+// taskDomain returns the domain of a running task, the default domain for unknown tasks
+func taskDomain(taskID string) string {
+	task, ok := tasks.get(taskID)
+	if !ok {
+		return defaultDomain()
+	}
+	return task.productDomain()
+}
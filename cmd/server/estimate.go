@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"time"
+)
+
+// finderMinPageSize is the smallest page Keepa's Product Finder returns, used to count results
+const finderMinPageSize = 50
+
+// CategoryEstimate is the projected cost of scanning one category
+type CategoryEstimate struct {
+	Category      string `json:"category"`
+	TotalResults  int    `json:"totalResults"`  // Products matching the query in this category
+	ASINs         int    `json:"asins"`         // Products the task would process, capped by maxPages
+	FinderPages   int    `json:"finderPages"`   // Product Finder requests
+	FinderTokens  int    `json:"finderTokens"`  // Tokens of the Product Finder requests
+	ProductTokens int    `json:"productTokens"` // Tokens of the Product Requests, assuming no cache hits
+	Error         string `json:"error,omitempty"`
+}
+
+// TaskEstimate is the projected cost of a fetch task
+type TaskEstimate struct {
+	Categories       []CategoryEstimate `json:"categories"`
+	TotalASINs       int                `json:"totalAsins"`
+	TotalTokens      int                `json:"totalTokens"`
+	TokensPerASIN    int                `json:"tokensPerAsin"`
+	TokensLeft       int                `json:"tokensLeft"`
+	RefillRate       float64            `json:"refillRate"` // Tokens per minute
+	EstimatedSeconds int                `json:"estimatedSeconds"`
+	DryRunTokens     int                `json:"dryRunTokens"` // Tokens the counting requests consumed
+}
+
+// maxTokens is the upper bound of a task's cost: every finder page full of ASINs
+// that all miss the cache
+func (spec *FetchTaskSpec) maxTokens() int {
+	if len(spec.ASINs) > 0 {
+		return len(spec.ASINs) * spec.Options.tokensPerASIN()
+	}
+	finderPages := len(spec.Categories) * spec.MaxPages
+	return finderPages * (calculateProductFinderTokens(spec.PageSize) + spec.PageSize*spec.Options.tokensPerASIN())
+}
+
+// estimateCategory counts the results of one category with a minimal finder page and
+// projects the cost of scanning it with the spec's page size and page limit
+func (client *KeepaClient) estimateCategory(ctx context.Context, spec *FetchTaskSpec, category string) (CategoryEstimate, int) {
+	estimate := CategoryEstimate{Category: category}
+	requestData := spec.categorySelection(category)
+	requestData["page"] = 0
+	requestData["perPage"] = finderMinPageSize
+
+	result, err := client.ProductFinder(withTokenUsageScope(ctx, "", category), spec.Domain, requestData, finderMinPageSize, PriorityInteractive)
+	if err != nil {
+		estimate.Error = err.Error()
+		return estimate, 0
+	}
+	estimate.TotalResults = result.TotalResults
+	estimate.ASINs = result.TotalResults
+	if maxASINs := spec.MaxPages * spec.PageSize; estimate.ASINs > maxASINs {
+		estimate.ASINs = maxASINs
+	}
+
+	// The scan stops after the first short page, which may be empty
+	estimate.FinderPages = estimate.ASINs/spec.PageSize + 1
+	if estimate.FinderPages > spec.MaxPages {
+		estimate.FinderPages = spec.MaxPages
+	}
+	estimate.FinderTokens = estimate.FinderPages * calculateProductFinderTokens(spec.PageSize)
+	estimate.ProductTokens = estimate.ASINs * spec.Options.tokensPerASIN()
+	return estimate, result.TokensConsumed
+}
+
+// estimateTask projects the token cost and duration of a fetch task without running
+// any Product Request. ASINs matched by several categories are counted once per category.
+func (client *KeepaClient) estimateTask(ctx context.Context, spec *FetchTaskSpec) *TaskEstimate {
+	client = client.forContext(ctx)
+	estimate := &TaskEstimate{
+		Categories:    make([]CategoryEstimate, 0, len(spec.Categories)),
+		TokensPerASIN: spec.Options.tokensPerASIN(),
+		RefillRate:    client.Tokens.RefillRate(),
+	}
+	for _, category := range spec.Categories {
+		categoryEstimate, consumed := client.estimateCategory(ctx, spec, category)
+		estimate.Categories = append(estimate.Categories, categoryEstimate)
+		estimate.TotalASINs += categoryEstimate.ASINs
+		estimate.TotalTokens += categoryEstimate.FinderTokens + categoryEstimate.ProductTokens
+		estimate.DryRunTokens += consumed
+	}
+	if len(spec.ASINs) > 0 {
+		estimate.TotalASINs = len(spec.ASINs)
+		estimate.TotalTokens = spec.maxTokens()
+	}
+
+	// Tokens beyond the current balance arrive at RefillRate per minute
+	estimate.TokensLeft = client.tokensLeft()
+	if missing := estimate.TotalTokens - estimate.TokensLeft; missing > 0 && client.Tokens.RefillRate() > 0 {
+		estimate.EstimatedSeconds = int(math.Ceil(float64(missing) / client.Tokens.RefillRate() * 60))
+	}
+	return estimate
+}
+
+// respondWithEstimate answers a dry run with the projected cost of the specs; several
+// specs, one per domain, are estimated one by one
+func (client *KeepaClient) respondWithEstimate(c *gin.Context, specs []*FetchTaskSpec) {
+	if len(specs) == 1 {
+		estimate := client.estimateTask(c.Request.Context(), specs[0])
+		c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+			"dryRun":            true,
+			"estimate":          estimate,
+			"estimatedDuration": (time.Duration(estimate.EstimatedSeconds) * time.Second).String(),
+		}))
+		return
+	}
+	estimates := make([]gin.H, 0, len(specs))
+	totalTokens := 0
+	for _, spec := range specs {
+		estimate := client.estimateTask(c.Request.Context(), spec)
+		totalTokens += estimate.TotalTokens
+		estimates = append(estimates, gin.H{
+			"domain":            spec.Domain,
+			"estimate":          estimate,
+			"estimatedDuration": (time.Duration(estimate.EstimatedSeconds) * time.Second).String(),
+		})
+	}
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"dryRun": true, "domains": estimates, "totalTokens": totalTokens}))
+}
+
+// handleEstimate projects the token cost of a POST /keepa body without starting a task
+func (client *KeepaClient) handleEstimate(c *gin.Context) {
+	specs, _, ok := parseFetchRequest(c)
+	if !ok {
+		return
+	}
+	client.respondWithEstimate(c, specs)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// exportColumn is one column of a task export
+type exportColumn struct {
+	Header string
+	value  func(product *SimplifiedProduct) interface{} // string, int, float64 or nil when unknown
+}
+
+// exportColumns are the columns of GET /tasks/:id/export by ?columns name
+var exportColumns = map[string]exportColumn{
+	"asin":  {"ASIN", func(p *SimplifiedProduct) interface{} { return p.Asin }},
+	"title": {"Title", func(p *SimplifiedProduct) interface{} { return p.Title }},
+	"brand": {"Brand", func(p *SimplifiedProduct) interface{} { return p.Brand }},
+	"buyBoxPrice": {"Buy Box Price", func(p *SimplifiedProduct) interface{} {
+		if p.BuyBoxPrice <= 0 {
+			return nil
+		}
+		return float64(p.BuyBoxPrice) / 100
+	}},
+	"salesRank": {"Sales Rank", func(p *SimplifiedProduct) interface{} {
+		if rank, ok := latestSalesRank(p.SalesRanks); ok && rank > 0 {
+			return rank
+		}
+		return nil
+	}},
+	"offerCount": {"Offers", func(p *SimplifiedProduct) interface{} { return p.OfferCountFBA + p.OfferCountFBM }},
+	"monthlySold": {"Monthly Sold", func(p *SimplifiedProduct) interface{} {
+		if p.MonthlySold <= 0 {
+			return nil
+		}
+		return p.MonthlySold
+	}},
+}
+
+// defaultExportColumns is the column set when neither ?columns nor EXPORT_COLUMNS is set
+const defaultExportColumns = "asin,title,brand,buyBoxPrice,salesRank,offerCount,monthlySold"
+
+// parseExportColumns resolves a comma separated list of column names
+func parseExportColumns(value string) ([]exportColumn, error) {
+	var columns []exportColumn
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		column, ok := exportColumns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q, expected some of %s", name, defaultExportColumns)
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns selected")
+	}
+	return columns, nil
+}
+
+// exportRow returns the cells of one product
+func exportRow(columns []exportColumn, product *SimplifiedProduct) []interface{} {
+	row := make([]interface{}, len(columns))
+	for i, column := range columns {
+		row[i] = column.value(product)
+	}
+	return row
+}
+
+// csvRecord formats the cells of a row for encoding/csv
+func csvRecord(row []interface{}) []string {
+	record := make([]string, len(row))
+	for i, cell := range row {
+		switch value := cell.(type) {
+		case nil:
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', 2, 64)
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+	return record
+}
+
+// handleTaskExport streams the products of a task as a spreadsheet, ?format=csv (default)
+// or xlsx. ?columns selects the columns, defaulting to EXPORT_COLUMNS or all of
+// exportColumns. Prices are in the marketplace currency. The velocity parameters of
+// parseVelocityFilter filter the products like GET /tasks/:id/results.
+func handleTaskExport(c *gin.Context) {
+	taskID := c.Param("id")
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		respondError(c, http.StatusBadRequest, "format must be csv or xlsx")
+		return
+	}
+	columns, err := parseExportColumns(c.DefaultQuery("columns", getEnv("EXPORT_COLUMNS", defaultExportColumns)))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter, err := parseVelocityFilter(c.Request.URL.Query())
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	task, ok, err := tasks.lookup(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskID))
+		return
+	}
+	if task.FinishedAt != nil {
+		etag, err := taskExportETag(c.Request.Context(), &task, c.Request.URL.RawQuery)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if notModified(c, etag) {
+			return
+		}
+	}
+
+	// The status is sent with the first bytes, so a Firestore failure after that can
+	// only be logged and ends the file early
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="task-%s.%s"`, task.ID, format))
+	c.Header("Cache-Control", "no-cache")
+	if format == "xlsx" {
+		c.Header("Content-Type", xlsxContentType)
+	} else {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	}
+	c.Status(http.StatusOK)
+	ctx := c.Request.Context()
+	if err := writeTaskExport(ctx, c.Writer, &task, format, columns, filter, c.Writer.Flush); err != nil {
+		logger.ErrorContext(ctx, "Failed to export task results", LogKeyTaskID, task.ID, "format", format, "error", err)
+	}
+}
+
+// taskExportETag returns the entity tag of the export of a finished task. Besides the
+// task and the options it covers the update times of the product documents, which
+// change when a product is fetched again, reading only their metadata.
+func taskExportETag(ctx context.Context, task *Task, rawQuery string) (string, error) {
+	parts := []interface{}{task.ID, task.UpdatedAt.UnixNano(), rawQuery}
+	var asins []string
+	for _, chunk := range task.Chunks {
+		asins = append(asins, chunk.ASINs...)
+	}
+	// Firestore allows up to 30 values for the in operator
+	const batchSize = 30
+	for start := 0; start < len(asins); start += batchSize {
+		batch := asins[start:min(start+batchSize, len(asins))]
+		refs := make([]*firestore.DocumentRef, len(batch))
+		for i, asin := range batch {
+			refs[i] = productRef(ctx, task.productDomain(), asin)
+		}
+		docs, err := refs[0].Parent.Where(firestore.DocumentID, "in", refs).Select().Documents(ctx).GetAll()
+		if err != nil {
+			return "", fmt.Errorf("failed to read product update times: %v", err)
+		}
+		for _, doc := range docs {
+			parts = append(parts, doc.Ref.ID, doc.UpdateTime.UnixNano())
+		}
+	}
+	return stateETag(parts...), nil
+}
+
+// writeTaskExport writes the products of a task to w as csv or xlsx, calling flush
+// after each batch of products read from Firestore
+func writeTaskExport(ctx context.Context, w io.Writer, task *Task, format string, columns []exportColumn, filter velocityFilter, flush func()) error {
+	var asins []string
+	for _, chunk := range task.Chunks {
+		asins = append(asins, chunk.ASINs...)
+	}
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column.Header
+	}
+
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(csvRecord(header))
+		err := readResultBatches(ctx, task.productDomain(), asins, func(products []SimplifiedProduct) bool {
+			for _, product := range filter.apply(products) {
+				writer.Write(csvRecord(exportRow(columns, &product)))
+			}
+			writer.Flush()
+			flush()
+			return writer.Error() == nil
+		})
+		writer.Flush()
+		if err == nil {
+			err = writer.Error()
+		}
+		return err
+	case "xlsx":
+		writer, err := newXLSXWriter(w)
+		if err != nil {
+			return err
+		}
+		writer.writeRow(header)
+		err = readResultBatches(ctx, task.productDomain(), asins, func(products []SimplifiedProduct) bool {
+			for _, product := range filter.apply(products) {
+				writer.writeRow(exportRow(columns, &product))
+			}
+			if writer.flush() != nil {
+				return false
+			}
+			flush()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return writer.close()
+	}
+	return fmt.Errorf("format must be csv or xlsx")
+}
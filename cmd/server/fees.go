@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"time"
+)
+
+// FeePreviewRequest asks for the fees of selling an ASIN at a given price
+type FeePreviewRequest struct {
+	ASIN  string `json:"asin"`
+	Price int    `json:"price"` // Intended sell price in cents
+}
+
+// FeePreview is the estimated fee breakdown of a sale
+type FeePreview struct {
+	ASIN               string        `json:"asin"`
+	Price              int           `json:"price"`
+	ReferralFeePercent float64       `json:"referralFeePercent"`
+	ReferralFee        int           `json:"referralFee"`
+	PickAndPackFee     int           `json:"pickAndPackFee"`
+	NetProceeds        int           `json:"netProceeds"` // Price minus referral and FBA fees, in cents
+	FetchedAt          time.Time     `json:"fetchedAt"`   // Age of the fee data
+	Source             string        `json:"source"`
+	QuotaWarning       *QuotaWarning `json:"quota_warning,omitempty"`
+}
+
+// calculateFeePreview estimates the fees of selling a product at price
+func calculateFeePreview(product *SimplifiedProduct, price int) FeePreview {
+	referralFee := int(math.Round(float64(price) * product.ReferralFeePercent / 100))
+	return FeePreview{
+		ASIN:               product.Asin,
+		Price:              price,
+		ReferralFeePercent: product.ReferralFeePercent,
+		ReferralFee:        referralFee,
+		PickAndPackFee:     product.PickAndPackFee,
+		NetProceeds:        price - referralFee - product.PickAndPackFee,
+		FetchedAt:          product.FetchedAt,
+	}
+}
+
+// handleFeePreview estimates referral fee, FBA fee and net proceeds for a sell price
+// from the stored product of the ?domain= marketplace
+func (client *KeepaClient) handleFeePreview(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	var req FeePreviewRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.ASIN == "" || req.Price <= 0 {
+		respondError(c, http.StatusBadRequest, "asin and a positive price are required")
+		return
+	}
+
+	product, source, status, err := client.loadFeeProduct(c.Request.Context(), domain, req.ASIN)
+	if err != nil {
+		respondKeepaError(c, err, status, err.Error())
+		return
+	}
+
+	preview := calculateFeePreview(product, req.Price)
+	preview.Source = source
+	preview.QuotaWarning = quota.warning()
+	c.JSON(http.StatusOK, preview)
+}
+
+// loadFeeProduct returns the stored product of an ASIN for fee calculations. Missing
+// products and fee data older than FEE_DATA_MAX_AGE are refreshed from Keepa first.
+// On error the HTTP status to answer with is returned along with it.
+func (client *KeepaClient) loadFeeProduct(ctx context.Context, domain, asin string) (*SimplifiedProduct, string, int, error) {
+	maxAge, err := time.ParseDuration(getEnv("FEE_DATA_MAX_AGE", "168h"))
+	if err != nil {
+		maxAge = 7 * 24 * time.Hour
+	}
+
+	response, source, err := loadProduct(ctx, domain, asin)
+	if err != nil || len(response.Products) == 0 || time.Since(response.Products[0].FetchedAt) > maxAge {
+		client.Logger.InfoContext(ctx, "Refreshing fee data", LogKeyASIN, asin, "domain", domain)
+		result, err := client.processASIN(ctx, "fee-preview", domain, asin, false)
+		if result.Product == nil {
+			return nil, "", http.StatusBadGateway, newTaskError(classifyError(err), fmt.Errorf("Failed to refresh product %s: %v", asin, err))
+		}
+		if err != nil {
+			client.Logger.WarnContext(ctx, "Fee data refreshed with errors", LogKeyASIN, asin, "error", err)
+		}
+		response, source = result.Product, SourceKeepa
+	}
+	if len(response.Products) == 0 {
+		return nil, "", http.StatusNotFound, fmt.Errorf("Product %s not found", asin)
+	}
+	return &response.Products[0], source, http.StatusOK, nil
+}
+
+// ProfitRequest asks for the profitability of selling an ASIN bought at a landed cost
+type ProfitRequest struct {
+	LandedCost int `json:"landed_cost"` // Cost of goods including inbound shipping, in cents
+	Price      int `json:"price"`       // Sell price in cents, defaults to the current buy box price
+}
+
+// ProfitBreakdown is the margin of selling a product via FBA
+type ProfitBreakdown struct {
+	FeePreview
+	LandedCost int     `json:"landedCost"`
+	NetProfit  int     `json:"netProfit"` // Net proceeds minus landed cost, in cents
+	Margin     float64 `json:"margin"`    // Net profit relative to the sell price
+	ROI        float64 `json:"roi"`       // Net profit relative to the landed cost
+}
+
+// calculateProfit computes the margin of selling a product at price
+func calculateProfit(product *SimplifiedProduct, price, landedCost int) ProfitBreakdown {
+	breakdown := ProfitBreakdown{FeePreview: calculateFeePreview(product, price), LandedCost: landedCost}
+	breakdown.NetProfit = breakdown.NetProceeds - landedCost
+	if price > 0 {
+		breakdown.Margin = math.Round(float64(breakdown.NetProfit)/float64(price)*10000) / 10000
+	}
+	if landedCost > 0 {
+		breakdown.ROI = math.Round(float64(breakdown.NetProfit)/float64(landedCost)*10000) / 10000
+	}
+	return breakdown
+}
+
+// handleProfit computes the FBA net margin of an ASIN for a landed cost at the given
+// price or the current buy box price, from cached data when it is fresh enough.
+// ?domain= selects the marketplace.
+func (client *KeepaClient) handleProfit(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	var req ProfitRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.LandedCost < 0 || req.Price < 0 {
+		respondError(c, http.StatusBadRequest, "landed_cost and price must not be negative")
+		return
+	}
+
+	asin := c.Param("asin")
+	product, source, status, err := client.loadFeeProduct(c.Request.Context(), domain, asin)
+	if err != nil {
+		respondKeepaError(c, err, status, err.Error())
+		return
+	}
+	price := req.Price
+	if price == 0 {
+		price = product.BuyBoxPrice
+	}
+	if price <= 0 {
+		respondError(c, http.StatusUnprocessableEntity, fmt.Sprintf("Product %s has no buy box price, pass a price", asin))
+		return
+	}
+
+	breakdown := calculateProfit(product, price, req.LandedCost)
+	breakdown.Source = source
+	breakdown.QuotaWarning = quota.warning()
+	c.JSON(http.StatusOK, breakdown)
+}
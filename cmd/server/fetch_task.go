@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FetchTaskSpec describes the work of a POST /keepa task
+type FetchTaskSpec struct {
+	Domain            string                 `json:"domain,omitempty" firestore:"domain"` // Keepa domain ID, empty for KEEPA_DOMAIN
+	Categories        []string               `json:"categories" firestore:"categories"`
+	Query             map[string]interface{} `json:"query" firestore:"query"` // Product Finder selection
+	PageSize          int                    `json:"page_size" firestore:"pageSize"`
+	MaxPages          int                    `json:"max_pages" firestore:"maxPages"`
+	ScanOpportunities bool                   `json:"scan_opportunities,omitempty" firestore:"scanOpportunities"`
+	Fields            []string               `json:"fields,omitempty" firestore:"fields"`       // Field groups to map, empty for SIMPLIFY_FIELDS
+	Options           *ProductOptions        `json:"options,omitempty" firestore:"options"`     // Overrides of the KEEPA_* Product Request parameters
+	Watchlist         string                 `json:"watchlist,omitempty" firestore:"watchlist"` // Watchlist the selection was taken from
+	ASINs             []string               `json:"asins,omitempty" firestore:"asins"`         // Members of an ASIN watchlist, processed without a finder scan
+}
+
+// runFetchTask scans the categories of the spec concurrently, at most
+// CATEGORY_CONCURRENCY at a time, with per-category progress. Every finder page is
+// processed as soon as it arrives: its ASINs not found on an earlier page are fetched
+// and stored, then the page becomes a readable chunk. The task fails when any category
+// failed; the pages of the others are still processed.
+func (client *KeepaClient) runFetchTask(taskID string, spec *FetchTaskSpec) {
+	client = client.forTask(taskID)
+	startedAt := time.Now()
+	defer client.Starvation.forgetTask(taskID)
+	var taskErr error
+	defer func() { tasks.finish(taskID, taskErr) }()
+	tasks.start(taskID)
+
+	concurrency, _ := strconv.Atoi(getEnv("CATEGORY_CONCURRENCY", "3"))
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// A resumed task first processes the pages fetched before it stopped
+	state, _ := tasks.get(taskID)
+	pages := newFetchPageProcessor(client, taskID, spec, startedAt, state)
+	pages.resume(state)
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, category := range spec.Categories {
+		progress := state.CategoryProgress[category]
+		if progress.Status == "completed" {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(category string, progress CategoryProgress) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := client.scanCategory(taskID, spec, category, progress, pages.process)
+			tasks.finishCategory(taskID, category, err)
+			if err != nil {
+				client.Logger.Error("Category scan failed", LogKeyTaskID, taskID, LogKeyCategory, category, "error", err)
+				mu.Lock()
+				failed = append(failed, err.Error())
+				mu.Unlock()
+			}
+		}(category, progress)
+	}
+	wg.Wait()
+	pages.annotateLateMatches()
+
+	if len(failed) > 0 {
+		taskErr = fmt.Errorf("%s", strings.Join(failed, "; "))
+		return
+	}
+	client.Logger.Info("Task completed", LogKeyTaskID, taskID, "duration_seconds", time.Since(startedAt).Seconds())
+}
+
+// fetchPageProcessor processes the finder pages of a fetch task while its categories
+// are scanned. Every ASIN is processed once, on the first page it was found on, and
+// its document is annotated with the categories that matched it so far. Categories
+// matching it later are added to the stored document by annotateLateMatches.
+type fetchPageProcessor struct {
+	client    *KeepaClient
+	taskID    string
+	spec      *FetchTaskSpec
+	startedAt time.Time
+
+	mu      sync.Mutex
+	matched map[string][]string // Categories whose pages contained the ASIN
+	late    map[string][]string // Categories found after the ASIN was processed
+}
+
+// newFetchPageProcessor returns the processor of a task, knowing the categories of the
+// pages already collected
+func newFetchPageProcessor(client *KeepaClient, taskID string, spec *FetchTaskSpec, startedAt time.Time, state Task) *fetchPageProcessor {
+	return &fetchPageProcessor{
+		client:    client,
+		taskID:    taskID,
+		spec:      spec,
+		startedAt: startedAt,
+		matched:   matchedCategories(state.Pages),
+		late:      make(map[string][]string),
+	}
+}
+
+// resume processes the collected pages without a chunk. The processed ASINs found in
+// several categories may have been stored before the later ones were found, so all
+// of their categories are annotated again.
+func (p *fetchPageProcessor) resume(state Task) {
+	seen := make(map[string]bool, len(state.Processed))
+	for _, asin := range state.Processed {
+		seen[asin] = true
+		if len(p.matched[asin]) > 1 {
+			p.late[asin] = append([]string(nil), p.matched[asin]...)
+		}
+	}
+	for _, page := range state.Pages {
+		var pending []string
+		for _, asin := range page.ASINs {
+			if !seen[asin] {
+				seen[asin] = true
+				pending = append(pending, asin)
+			}
+		}
+		if !hasChunk(state.Chunks, page.Category, page.Page) {
+			p.processPage(page, pending)
+		}
+	}
+}
+
+// process records the categories of a page just collected and processes its new ASINs
+func (p *fetchPageProcessor) process(page TaskPage, newASINs []string) {
+	isNew := make(map[string]bool, len(newASINs))
+	for _, asin := range newASINs {
+		isNew[asin] = true
+	}
+	p.mu.Lock()
+	for _, asin := range page.ASINs {
+		if containsString(p.matched[asin], page.Category) {
+			continue
+		}
+		p.matched[asin] = append(p.matched[asin], page.Category)
+		if !isNew[asin] {
+			p.late[asin] = append(p.late[asin], page.Category)
+		}
+	}
+	p.mu.Unlock()
+	p.processPage(page, newASINs)
+}
+
+// processPage processes the ASINs of a page not processed before and completes its
+// chunk, making the page's results available
+func (p *fetchPageProcessor) processPage(page TaskPage, pending []string) {
+	p.mu.Lock()
+	matched := make(map[string][]string, len(pending))
+	for _, asin := range pending {
+		matched[asin] = append([]string(nil), p.matched[asin]...)
+	}
+	p.mu.Unlock()
+
+	p.client.processASINs(p.taskID, pending, true, p.startedAt, matched, func(asin string, result ASINResult, err error) {
+		if p.spec.ScanOpportunities && result.Product != nil {
+			recordOpportunities(p.taskID, result.Product)
+		}
+	})
+	tasks.completeChunk(p.taskID, page.Category, page.Page, page.ASINs)
+}
+
+// annotateLateMatches adds the categories found after an ASIN was processed to the
+// matchedCategories of its stored document. ASINs that failed have no document.
+func (p *fetchPageProcessor) annotateLateMatches() {
+	if len(p.late) == 0 {
+		return
+	}
+	ctx := withTaskTenant(context.Background(), p.taskID)
+	domain := taskDomain(p.taskID)
+	writer := firestoreClient.BulkWriter(ctx)
+	jobs := make(map[string]*firestore.BulkWriterJob, len(p.late))
+	for asin, categories := range p.late {
+		values := make([]interface{}, len(categories))
+		for i, category := range categories {
+			values[i] = category
+		}
+		job, err := writer.Update(productRef(ctx, domain, asin), []firestore.Update{{Path: "matchedCategories", Value: firestore.ArrayUnion(values...)}})
+		if err != nil {
+			p.client.Logger.Warn("Failed to queue matched categories", LogKeyTaskID, p.taskID, LogKeyASIN, asin, "error", err)
+			continue
+		}
+		jobs[asin] = job
+	}
+	writer.End()
+	for asin, job := range jobs {
+		if _, err := job.Results(); err != nil && status.Code(err) != codes.NotFound {
+			p.client.Logger.Warn("Failed to add matched categories", LogKeyTaskID, p.taskID, LogKeyASIN, asin, "error", err)
+		}
+	}
+}
+
+// categorySelection returns a copy of the finder query restricted to one root category
+func (spec *FetchTaskSpec) categorySelection(category string) map[string]interface{} {
+	// Every category needs its own copy of the finder query
+	requestData := make(map[string]interface{}, len(spec.Query)+4)
+	for key, value := range spec.Query {
+		requestData[key] = value
+	}
+	requestData["rootCategory"] = category
+	requestData["salesRankReference"] = category
+	return requestData
+}
+
+// scanCategory runs Product Finder for the pages of one category, recording each
+// page in the task store and passing it to onPage with the ASINs not found on an
+// earlier page. A resumed category continues at its next unfetched page.
+func (client *KeepaClient) scanCategory(taskID string, spec *FetchTaskSpec, category string, progress CategoryProgress, onPage func(page TaskPage, newASINs []string)) error {
+	requestData := spec.categorySelection(category)
+	ctx := withTokenUsageScope(withTaskTenant(context.Background(), taskID), taskID, category)
+	client.Logger.InfoContext(ctx, "Fetching category", "page_size", spec.PageSize, "max_pages", spec.MaxPages)
+
+	for page := progress.Page; page < spec.MaxPages; page++ {
+		requestData["page"] = page
+		requestData["perPage"] = spec.PageSize
+
+		finderResult, err := client.ProductFinder(ctx, spec.Domain, requestData, spec.PageSize, PriorityBulk)
+		if err != nil {
+			return fmt.Errorf("Product Finder failed for category %s page %d: %v", category, page, err)
+		}
+
+		asins := finderResult.ASINs
+		tasks.addTokens(taskID, finderResult.TokensConsumed)
+		newASINs := tasks.addPage(taskID, category, page, asins)
+		client.Logger.InfoContext(ctx, "Retrieved ASINs from Product Finder", "asins", len(asins), "new_asins", len(newASINs), "page", page)
+		onPage(TaskPage{Category: category, Page: page, ASINs: asins}, newASINs)
+
+		// A short page means the finder has no further results
+		if len(asins) < spec.PageSize {
+			break
+		}
+	}
+
+	client.Logger.InfoContext(ctx, "Finished category")
+	return nil
+}
+
+// matchedCategories maps every ASIN of the finder pages to the categories it was found in
+func matchedCategories(pages []TaskPage) map[string][]string {
+	matched := make(map[string][]string)
+	for _, page := range pages {
+		for _, asin := range page.ASINs {
+			if !containsString(matched[asin], page.Category) {
+				matched[asin] = append(matched[asin], page.Category)
+			}
+		}
+	}
+	return matched
+}
+
+// hasChunk reports whether the page of a category was already completed
+func hasChunk(chunks []TaskChunk, category string, page int) bool {
+	for _, chunk := range chunks {
+		if chunk.Category == category && chunk.Page == page {
+			return true
+		}
+	}
+	return false
+}
+
+// runASINTask processes an explicit ASIN list, e.g. for refreshes. With useCache
+// unset every ASIN is fetched from Keepa even when cached. A resumed task skips
+// the ASINs already processed.
+func (client *KeepaClient) runASINTask(taskID string, asins []string, useCache bool) {
+	client = client.forTask(taskID)
+	startedAt := time.Now()
+	defer client.Starvation.forgetTask(taskID)
+	defer tasks.finish(taskID, nil)
+	tasks.start(taskID)
+
+	state, _ := tasks.get(taskID)
+	client.processASINs(taskID, unprocessedASINs(asins, state.Processed), useCache, startedAt, nil, nil)
+	tasks.completeChunk(taskID, "", 0, asins)
+	client.Logger.Info("Task completed", LogKeyTaskID, taskID, "asins", len(asins), "duration_seconds", time.Since(startedAt).Seconds())
+}
+
+// processASINs processes asins in batches of up to KEEPA_BATCH_SIZE on up to
+// WORKER_CONCURRENCY parallel workers and records every result in the task store.
+// The workers share the client's token estimate, so concurrency only helps while
+// tokens are available. The products are requested from the task's domain with the
+// key of the task's tenant. matched is passed on to processASINBatch. onResult, if
+// set, is called on the worker goroutine after each ASIN.
+func (client *KeepaClient) processASINs(taskID string, asins []string, useCache bool, startedAt time.Time, matched map[string][]string, onResult func(asin string, result ASINResult, err error)) {
+	ctx := withTaskTenant(context.Background(), taskID)
+	client = client.forContext(ctx)
+	batchSize, _ := strconv.Atoi(getEnv("KEEPA_BATCH_SIZE", "10"))
+	if batchSize < 1 || batchSize > maxProductBatch {
+		batchSize = maxProductBatch
+	}
+	workers, _ := strconv.Atoi(getEnv("WORKER_CONCURRENCY", "4"))
+	if workers < 1 {
+		workers = 1
+	}
+
+	domain := taskDomain(taskID)
+	jobs := make(chan []string)
+	remaining := int64(len(asins))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range jobs {
+				client.Starvation.checkTaskDeadline(taskID, startedAt, int(atomic.LoadInt64(&remaining)), client.tokensLeft(), client.Tokens.RefillRate())
+				results, errs := client.processASINBatch(ctx, taskID, domain, batch, useCache, matched)
+				for i, asin := range batch {
+					left := atomic.AddInt64(&remaining, -1)
+					tasks.recordResult(taskID, asin, results[i], errs[i])
+					if onResult != nil {
+						onResult(asin, results[i], errs[i])
+					}
+					if errs[i] != nil {
+						client.Logger.Warn("ASIN failed", LogKeyTaskID, taskID, LogKeyASIN, asin, "class", classifyError(errs[i]), "error", errs[i])
+						continue // Skip failed ASIN and continue with the next one
+					}
+					client.Logger.Info("Processed ASIN", LogKeyTaskID, taskID, LogKeyASIN, asin,
+						"progress", len(asins)-int(left), "total", len(asins), "cache_hit", results[i].CacheHit, "tokens_consumed", results[i].TokensConsumed)
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < len(asins); start += batchSize {
+		end := start + batchSize
+		if end > len(asins) {
+			end = len(asins)
+		}
+		jobs <- asins[start:end]
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// unprocessedASINs returns the ASINs missing from processed
+func unprocessedASINs(asins, processed []string) []string {
+	done := make(map[string]bool, len(processed))
+	for _, asin := range processed {
+		done[asin] = true
+	}
+	pending := make([]string, 0, len(asins))
+	for _, asin := range asins {
+		if !done[asin] {
+			pending = append(pending, asin)
+		}
+	}
+	return pending
+}
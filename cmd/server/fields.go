@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Optional field groups of SimplifiedProduct. Asin, title, categories, brand, the buy
+// box price with its averages and fetchedAt are always mapped.
+const (
+	FieldSalesRanks    = "salesRanks"
+	FieldOffers        = "offers"
+	FieldBuyBoxHistory = "buyBoxHistory"
+	FieldPriceHistory  = "priceHistory"
+	FieldMonthlySold   = "monthlySold"
+	FieldVelocity      = "velocity"
+	FieldVariations    = "variations"
+	FieldFees          = "fees"
+	FieldRating        = "rating"
+	FieldOfferCounts   = "offerCounts"
+)
+
+var knownProductFields = []string{
+	FieldSalesRanks, FieldOffers, FieldBuyBoxHistory, FieldPriceHistory, FieldMonthlySold,
+	FieldVelocity, FieldVariations, FieldFees, FieldRating, FieldOfferCounts,
+}
+
+// productFields selects the field groups mapped into SimplifiedProduct; nil selects all
+type productFields map[string]bool
+
+// defaultProductFields is the deployment default, loaded from SIMPLIFY_FIELDS, a
+// comma-separated list of field groups. Empty maps every group.
+var defaultProductFields = loadDefaultProductFields()
+
+// loadDefaultProductFields parses SIMPLIFY_FIELDS
+func loadDefaultProductFields() productFields {
+	value := getEnv("SIMPLIFY_FIELDS", "")
+	if value == "" {
+		return nil
+	}
+	fields, err := parseProductFields(strings.Split(value, ","))
+	if err != nil {
+		logger.Warn("Invalid SIMPLIFY_FIELDS, mapping all fields", "error", err)
+		return nil
+	}
+	return fields
+}
+
+// parseProductFields validates a list of field group names; an empty list selects all
+func parseProductFields(names []string) (productFields, error) {
+	fields := make(productFields)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !containsString(knownProductFields, name) {
+			return nil, fmt.Errorf("unknown field %q, expected one of %s", name, strings.Join(knownProductFields, ", "))
+		}
+		fields[name] = true
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+// has reports whether the field group is selected
+func (f productFields) has(name string) bool {
+	return f == nil || f[name]
+}
+
+// list returns the selected groups sorted, or nil when all are selected
+func (f productFields) list() []string {
+	if f == nil {
+		return nil
+	}
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// coveredBy reports whether a product mapped with the stored field list (nil for
+// all groups) holds every selected group, i.e. whether a cached copy can be used
+func (f productFields) coveredBy(stored []string) bool {
+	if len(stored) == 0 {
+		return true
+	}
+	if f == nil {
+		return false
+	}
+	for name := range f {
+		if !containsString(stored, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// taskProductFields returns the field selection of a task, falling back to SIMPLIFY_FIELDS
+func taskProductFields(taskID string) productFields {
+	task, ok := tasks.get(taskID)
+	if !ok || task.Spec == nil || len(task.Spec.Fields) == 0 {
+		return defaultProductFields
+	}
+	fields, err := parseProductFields(task.Spec.Fields)
+	if err != nil {
+		return defaultProductFields
+	}
+	return fields
+}
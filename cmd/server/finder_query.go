@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// finderStrings accepts a single string or a list of strings, like Keepa does
+type finderStrings []string
+
+// UnmarshalJSON decodes a string or a list of strings
+func (s *finderStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = finderStrings{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or a list of strings")
+	}
+	*s = list
+	return nil
+}
+
+// finderQueryFields are the named selection fields of the Product Finder
+type finderQueryFields struct {
+	Title        string        `json:"title,omitempty"`
+	Brand        finderStrings `json:"brand,omitempty"`
+	Manufacturer finderStrings `json:"manufacturer,omitempty"`
+	ProductGroup finderStrings `json:"productGroup,omitempty"`
+	Model        finderStrings `json:"model,omitempty"`
+	Color        finderStrings `json:"color,omitempty"`
+	Size         finderStrings `json:"size,omitempty"`
+	Author       finderStrings `json:"author,omitempty"`
+	Binding      finderStrings `json:"binding,omitempty"`
+	Publisher    finderStrings `json:"publisher,omitempty"`
+	PartNumber   finderStrings `json:"partNumber,omitempty"`
+
+	CategoriesInclude []int64 `json:"categories_include,omitempty"`
+	CategoriesExclude []int64 `json:"categories_exclude,omitempty"`
+	ProductType       []int   `json:"productType,omitempty"` // 0 standard, 1 downloadable, 2 eBook, 5 variation parent
+
+	SellerIDs           finderStrings `json:"sellerIds,omitempty"`
+	BuyBoxSellerID      finderStrings `json:"buyBoxSellerId,omitempty"`
+	BuyBoxIsAmazon      *bool         `json:"buyBoxIsAmazon,omitempty"`
+	BuyBoxIsFBA         *bool         `json:"buyBoxIsFBA,omitempty"`
+	BuyBoxIsUnqualified *bool         `json:"buyBoxIsUnqualified,omitempty"`
+	HasReviews          *bool         `json:"hasReviews,omitempty"`
+	HasParentASIN       *bool         `json:"hasParentASIN,omitempty"`
+	IsAdultProduct      *bool         `json:"isAdultProduct,omitempty"`
+	IsHazMat            *bool         `json:"isHazMat,omitempty"`
+	IsPrimeExclusive    *bool         `json:"isPrimeExclusive,omitempty"`
+	IsSNS               *bool         `json:"isSNS,omitempty"`
+	SingleVariation     *bool         `json:"singleVariation,omitempty"`
+
+	// Sort lists [field, "asc"|"desc"] pairs, e.g. [["current_SALES", "asc"]]
+	Sort [][]string `json:"sort,omitempty"`
+}
+
+// FinderQuery is a Product Finder selection: the named fields plus the range filters
+// such as current_SALES_gte or avg90_BUY_BOX_SHIPPING_lte
+type FinderQuery struct {
+	finderQueryFields
+	Ranges map[string]int64 `json:"-"`
+}
+
+// finderStatPrefixes are the statistics a csv type range filter can select on
+var finderStatPrefixes = []string{
+	"current", "avg1", "avg7", "avg30", "avg90", "avg180", "avg365",
+	"delta1", "delta7", "delta30", "delta90",
+	"deltaPercent1", "deltaPercent7", "deltaPercent30", "deltaPercent90", "deltaLast",
+}
+
+// finderRangeBases are the range filters that are not based on a csv type
+var finderRangeBases = []string{
+	"monthlySold", "trackingSince", "listedSince", "lastOffersUpdate", "variationCount",
+	"numberOfItems", "numberOfPages", "outOfStockPercentage30", "outOfStockPercentage90",
+	"packageHeight", "packageLength", "packageWidth", "packageWeight",
+	"itemHeight", "itemLength", "itemWidth", "itemWeight",
+}
+
+// finderReservedKeys are set per finder page by scanCategory
+var finderReservedKeys = map[string]string{
+	"rootCategory":       "use categoryNames or KEEPA_CATEGORY",
+	"salesRankReference": "it is the scanned category",
+	"page":               "use maxPages",
+	"perPage":            "the page size is fixed",
+}
+
+var finderRangeKey = regexp.MustCompile(`^(.+)_(gte|lte)$`)
+
+// finderNamedKeys lists the JSON names of finderQueryFields
+func finderNamedKeys() []string {
+	fieldsType := reflect.TypeOf(finderQueryFields{})
+	keys := make([]string, 0, fieldsType.NumField())
+	for i := 0; i < fieldsType.NumField(); i++ {
+		keys = append(keys, strings.Split(fieldsType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return keys
+}
+
+// finderRangeBase reports whether base, e.g. "avg90_NEW" or "monthlySold", can be
+// filtered on with _gte and _lte and sorted by
+func finderRangeBase(base string) bool {
+	if containsString(finderRangeBases, base) {
+		return true
+	}
+	for _, prefix := range finderStatPrefixes {
+		if name := strings.TrimPrefix(base, prefix+"_"); name != base {
+			_, ok := csvTypeNames[name]
+			return ok
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON decodes a selection, rejecting unknown keys with the closest known one
+func (q *FinderQuery) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	namedKeys := finderNamedKeys()
+	named := make(map[string]json.RawMessage)
+	q.Ranges = make(map[string]int64)
+	for key, value := range raw {
+		if reason, ok := finderReservedKeys[key]; ok {
+			return fmt.Errorf("%s cannot be set in the query, %s", key, reason)
+		}
+		if containsString(namedKeys, key) {
+			named[key] = value
+			continue
+		}
+		if match := finderRangeKey.FindStringSubmatch(key); match != nil && finderRangeBase(match[1]) {
+			var bound int64
+			if err := json.Unmarshal(value, &bound); err != nil {
+				return fmt.Errorf("%s must be an integer", key)
+			}
+			q.Ranges[key] = bound
+			continue
+		}
+		return fmt.Errorf("unknown query field %q%s", key, finderSuggestion(key, namedKeys))
+	}
+
+	data, err := json.Marshal(named)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &q.finderQueryFields); err != nil {
+		return fmt.Errorf("invalid query field: %v", err)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the selection as the Product Finder expects it
+func (q FinderQuery) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(q.finderQueryFields)
+	if err != nil {
+		return nil, err
+	}
+	query := make(map[string]interface{})
+	if err := json.Unmarshal(data, &query); err != nil {
+		return nil, err
+	}
+	for key, bound := range q.Ranges {
+		query[key] = bound
+	}
+	return json.Marshal(query)
+}
+
+// normalize trims the text fields and lower-cases the sort directions
+func (q *FinderQuery) normalize() {
+	q.Title = strings.TrimSpace(q.Title)
+	for _, list := range []finderStrings{q.Brand, q.Manufacturer, q.ProductGroup, q.Model, q.Color, q.Size, q.Author, q.Binding, q.Publisher, q.PartNumber, q.SellerIDs, q.BuyBoxSellerID} {
+		for i := range list {
+			list[i] = strings.TrimSpace(list[i])
+		}
+	}
+	for _, criterion := range q.Sort {
+		if len(criterion) == 2 {
+			criterion[1] = strings.ToLower(criterion[1])
+		}
+	}
+}
+
+// validate checks the sort criteria, the category IDs, that no list holds an empty
+// value and that no range has its lower bound above its upper bound or a negative
+// bound on a quantity that cannot be negative
+func (q *FinderQuery) validate() error {
+	lists := map[string]finderStrings{
+		"brand": q.Brand, "manufacturer": q.Manufacturer, "productGroup": q.ProductGroup, "model": q.Model,
+		"color": q.Color, "size": q.Size, "author": q.Author, "binding": q.Binding, "publisher": q.Publisher,
+		"partNumber": q.PartNumber, "sellerIds": q.SellerIDs, "buyBoxSellerId": q.BuyBoxSellerID,
+	}
+	for key, list := range lists {
+		if containsString(list, "") {
+			return fmt.Errorf("%s must not contain empty values", key)
+		}
+	}
+	for _, category := range append(append([]int64{}, q.CategoriesInclude...), q.CategoriesExclude...) {
+		if category <= 0 {
+			return fmt.Errorf("category %d is not a Keepa category ID", category)
+		}
+	}
+	for _, category := range q.CategoriesInclude {
+		if slices.Contains(q.CategoriesExclude, category) {
+			return fmt.Errorf("category %d is both included and excluded", category)
+		}
+	}
+	for key, bound := range q.Ranges {
+		if bound < 0 && containsString(finderRangeBases, finderRangeKey.FindStringSubmatch(key)[1]) {
+			return fmt.Errorf("%s must not be negative", key)
+		}
+	}
+	for key, lower := range q.Ranges {
+		if !strings.HasSuffix(key, "_gte") {
+			continue
+		}
+		upperKey := strings.TrimSuffix(key, "_gte") + "_lte"
+		if upper, ok := q.Ranges[upperKey]; ok && lower > upper {
+			return fmt.Errorf("%s (%d) is greater than %s (%d)", key, lower, upperKey, upper)
+		}
+	}
+	for _, criterion := range q.Sort {
+		if len(criterion) != 2 {
+			return fmt.Errorf("sort criteria must be [field, direction] pairs")
+		}
+		if !finderRangeBase(criterion[0]) {
+			return fmt.Errorf("cannot sort by %q", criterion[0])
+		}
+		if criterion[1] != "asc" && criterion[1] != "desc" {
+			return fmt.Errorf("sort direction of %s must be asc or desc", criterion[0])
+		}
+	}
+	for _, productType := range q.ProductType {
+		if productType < 0 || productType > 5 {
+			return fmt.Errorf("productType %d is not a Keepa product type", productType)
+		}
+	}
+	return nil
+}
+
+// toMap returns the selection as the query map stored in FetchTaskSpec
+func (q *FinderQuery) toMap() (map[string]interface{}, error) {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	query := make(map[string]interface{})
+	if err := json.Unmarshal(data, &query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// parseFinderQuery decodes, normalizes and validates the selection of a request body
+func parseFinderQuery(requestData map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(requestData)
+	if err != nil {
+		return nil, err
+	}
+	var query FinderQuery
+	if err := json.Unmarshal(data, &query); err != nil {
+		return nil, err
+	}
+	query.normalize()
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	return query.toMap()
+}
+
+// finderSuggestion names the known key closest to an unknown one, if any is close
+func finderSuggestion(key string, namedKeys []string) string {
+	candidates := append([]string{}, namedKeys...)
+	base, suffix := key, ""
+	if match := finderRangeKey.FindStringSubmatch(key); match != nil {
+		base, suffix = match[1], "_"+match[2]
+	}
+	candidates = append(candidates, finderRangeBases...)
+	for _, prefix := range finderStatPrefixes {
+		for name := range csvTypeNames {
+			candidates = append(candidates, prefix+"_"+name)
+		}
+	}
+	sort.Strings(candidates)
+
+	best, bestDistance := "", len(base)/3+1
+	for _, candidate := range candidates {
+		if distance := editDistance(strings.ToLower(base), strings.ToLower(candidate)); distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	if finderRangeBase(best) && !containsString(namedKeys, best) {
+		if suffix == "" {
+			suffix = "_gte"
+		}
+		best += suffix
+	}
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+// editDistance returns the Levenshtein distance of two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// ProductsCollection is the Firestore collection holding one document per domain and
+// ASIN, see productDocID
+const ProductsCollection = "products"
+
+// ProductSnapshotsCollection is the subcollection of a product document holding a copy
+// of every fetch, keyed by its time in snapshotIDLayout. The product document itself
+// is the latest snapshot.
+const ProductSnapshotsCollection = "snapshots"
+
+// snapshotIDLayout formats snapshot document IDs, which sort chronologically
+const snapshotIDLayout = "20060102T150405.000000Z"
+
+// productRef returns the document of a product of a domain stored by the tenant of ctx
+func productRef(ctx context.Context, domain, asin string) *firestore.DocumentRef {
+	return tenantCollection(ctx, ProductsCollection).Doc(productDocID(domain, asin))
+}
+
+// productSnapshotRef returns the snapshot document of a product stored at updatedAt
+func productSnapshotRef(ctx context.Context, domain, asin string, updatedAt time.Time) *firestore.DocumentRef {
+	return productRef(ctx, domain, asin).Collection(ProductSnapshotsCollection).Doc(updatedAt.UTC().Format(snapshotIDLayout))
+}
+
+// ProductDocument is the Firestore representation of a product. The top-level
+// fields duplicate parts of the simplified response so documents can be queried.
+type ProductDocument struct {
+	Asin              string              `firestore:"asin"`
+	Domain            string              `firestore:"domain"` // Keepa domain, empty in documents stored before domains were tracked
+	Brand             string              `firestore:"brand"`
+	Categories        []int64             `firestore:"categories"`
+	MatchedCategories []string            `firestore:"matchedCategories,omitempty"` // Root categories of the task whose finder results contained the ASIN
+	UpdatedAt         time.Time           `firestore:"updatedAt"`                   // Last time the content changed
+	CheckedAt         time.Time           `firestore:"checkedAt"`                   // Last time the product was fetched, also when unchanged
+	ContentHash       string              `firestore:"contentHash"`                 // See productContentHash
+	Stale             bool                `firestore:"stale,omitempty"`             // Marked by the cleanup, see cleanupStaleProducts
+	StaleSince        *time.Time          `firestore:"staleSince,omitempty"`
+	BuyBoxPrice       int                 `firestore:"buyBoxPrice"` // Cents, 0 when unknown
+	HasAmazonOffer    bool                `firestore:"hasAmazonOffer"`
+	SalesRank         int                 `firestore:"salesRank"`               // Latest rank in the root category, 0 when unknown
+	SalesEstimate     *SalesEstimate      `firestore:"salesEstimate,omitempty"` // Units sold estimated from stock decreases, see estimateSales
+	Products          []SimplifiedProduct `firestore:"Products"`
+}
+
+// newProductDocument builds the Firestore document for a simplified response
+func newProductDocument(domain, asin string, productData *SimplifiedResponse, matchedCategories []string) *ProductDocument {
+	now := time.Now().UTC()
+	doc := &ProductDocument{
+		Asin:              asin,
+		Domain:            domain,
+		MatchedCategories: matchedCategories,
+		UpdatedAt:         now,
+		CheckedAt:         now,
+		ContentHash:       productContentHash(productData.Products),
+		Products:          productData.Products,
+	}
+	if len(productData.Products) > 0 {
+		doc.Brand = productData.Products[0].Brand
+		doc.Categories = productData.Products[0].Categories
+		doc.BuyBoxPrice = productData.Products[0].BuyBoxPrice
+		doc.HasAmazonOffer = productData.Products[0].HasAmazonOffer
+		doc.SalesRank, _ = latestSalesRank(productData.Products[0].SalesRanks)
+		windowDays, maxDrop := salesEstimateSettings()
+		doc.SalesEstimate = estimateSales(&productData.Products[0], windowDays, maxDrop, doc.UpdatedAt)
+	}
+	return doc
+}
+
+// storedProducts returns the products of a stored document, nil when there is none
+func (doc *ProductDocument) storedProducts() *SimplifiedResponse {
+	if doc == nil {
+		return nil
+	}
+	return &SimplifiedResponse{Products: doc.Products}
+}
+
+// getProductDocument reads the stored document of an ASIN, nil when there is none
+func getProductDocument(ctx context.Context, domain, asin string) (*ProductDocument, error) {
+	snapshot, err := productRef(ctx, domain, asin).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product from Firestore: %v", err)
+	}
+	var doc ProductDocument
+	if err := snapshot.DataTo(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode product from Firestore: %v", err)
+	}
+	return &doc, nil
+}
+
+// firestoreFunction stores a single product. The Set replaces the whole document, so
+// fields of the previous fetch do not survive. An unchanged product only has its
+// checkedAt refreshed.
+func firestoreFunction(ctx context.Context, requestID, domain, asin string, productData *SimplifiedResponse, matchedCategories []string) error {
+	// The stored product tells whether anything changed and is the base of the product.updated diff
+	stored, err := getProductDocument(ctx, domain, asin)
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to read the stored product, writing it anyway", LogKeyASIN, asin, "error", err)
+	}
+	doc := newProductDocument(domain, asin, productData, matchedCategories)
+	if stored.unchangedBy(doc) {
+		err := withRetry(ctx, DependencyFirestore, func() error {
+			_, err := productRef(ctx, domain, asin).Update(ctx, checkedAtUpdate(doc))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("[RequestID: %s] Failed to refresh unchanged data in Firestore for ASIN %s: %v", requestID, asin, err)
+		}
+		unchangedWrites.record(ctx, 1)
+		return nil
+	}
+
+	// Save to Firestore
+	if err := saveToFirestore(ctx, doc); err != nil {
+		return fmt.Errorf("[RequestID: %s] Failed to save data to Firestore for ASIN %s: %v", requestID, asin, err)
+	}
+
+	productStored(ctx, requestID, domain, stored.storedProducts(), productData)
+	return nil
+}
+
+// productStored hands a stored product of a domain to the optional sinks
+func productStored(ctx context.Context, requestID, domain string, previous, productData *SimplifiedResponse) {
+	// Keep the history of the product for analytics
+	productSnapshots.enqueue(ctx, domain, productData.Products)
+	pubsubEvents.publishProductUpdates(ctx, requestID, domain, previous, productData)
+	detectStockTransitions(ctx, requestID, domain, previous, productData)
+	evaluateAlertRules(ctx, requestID, domain, previous, productData)
+}
+
+// productBatchEntry is one product queued in a productBatchWriter
+type productBatchEntry struct {
+	asin              string
+	product           *SimplifiedResponse
+	matchedCategories []string
+}
+
+// productBatchWriter stores the products of a task batch with one Firestore BulkWriter,
+// which sends the Sets in parallel batches and retries failed writes, instead of a
+// round trip per ASIN. All products of a batch belong to one domain.
+type productBatchWriter struct {
+	ctx     context.Context
+	taskID  string
+	domain  string
+	entries []productBatchEntry
+}
+
+// newProductBatchWriter creates an empty batch of a task
+func newProductBatchWriter(ctx context.Context, taskID, domain string) *productBatchWriter {
+	return &productBatchWriter{ctx: ctx, taskID: taskID, domain: domain}
+}
+
+// add queues a product, written by flush
+func (w *productBatchWriter) add(asin string, product *SimplifiedResponse, matchedCategories []string) {
+	w.entries = append(w.entries, productBatchEntry{asin: asin, product: product, matchedCategories: matchedCategories})
+}
+
+// storedDocuments reads the stored documents of the batch by ASIN. When they cannot be
+// read every product is written.
+func (w *productBatchWriter) storedDocuments() map[string]*ProductDocument {
+	refs := make([]*firestore.DocumentRef, len(w.entries))
+	for i, entry := range w.entries {
+		refs[i] = productRef(w.ctx, w.domain, entry.asin)
+	}
+	snapshots, err := firestoreClient.GetAll(w.ctx, refs)
+	if err != nil {
+		logger.WarnContext(w.ctx, "Failed to read the stored products, writing all of them", "error", err)
+		return nil
+	}
+	// GetAll returns the snapshots in the order of refs
+	stored := make(map[string]*ProductDocument, len(snapshots))
+	for i, snapshot := range snapshots {
+		var doc ProductDocument
+		if snapshot.Exists() && snapshot.DataTo(&doc) == nil {
+			stored[w.entries[i].asin] = &doc
+		}
+	}
+	return stored
+}
+
+// flush writes the queued products and returns the errors by ASIN. Changed products
+// are written twice, as the latest document and its snapshot; unchanged ones only
+// have their checkedAt refreshed. The outcome of the whole batch is reported in one
+// log line.
+func (w *productBatchWriter) flush() map[string]error {
+	errs := make(map[string]error)
+	if len(w.entries) == 0 {
+		return errs
+	}
+	startedAt := time.Now()
+	stored := w.storedDocuments()
+
+	writer := firestoreClient.BulkWriter(w.ctx)
+	jobs := make([][]*firestore.BulkWriterJob, len(w.entries))
+	unchanged := make([]bool, len(w.entries))
+	var firstErr error
+	queued := func(i int, job *firestore.BulkWriterJob, err error) {
+		if err != nil {
+			errs[w.entries[i].asin] = fmt.Errorf("[RequestID: %s] Failed to queue data for Firestore for ASIN %s: %v", w.taskID, w.entries[i].asin, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		jobs[i] = append(jobs[i], job)
+	}
+	for i, entry := range w.entries {
+		doc := newProductDocument(w.domain, entry.asin, entry.product, entry.matchedCategories)
+		ref := productRef(w.ctx, w.domain, entry.asin)
+		if stored[entry.asin].unchangedBy(doc) {
+			unchanged[i] = true
+			job, err := writer.Update(ref, checkedAtUpdate(doc))
+			queued(i, job, err)
+			continue
+		}
+		for _, target := range []*firestore.DocumentRef{ref, productSnapshotRef(w.ctx, w.domain, entry.asin, doc.UpdatedAt)} {
+			job, err := writer.Set(target, doc)
+			queued(i, job, err)
+		}
+	}
+	writer.End()
+
+	skipped := 0
+	for i, entry := range w.entries {
+		for _, job := range jobs[i] {
+			if _, err := job.Results(); err != nil && errs[entry.asin] == nil {
+				errs[entry.asin] = fmt.Errorf("[RequestID: %s] Failed to save data to Firestore for ASIN %s: %v", w.taskID, entry.asin, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		switch {
+		case errs[entry.asin] != nil:
+		case unchanged[i]:
+			skipped++
+		default:
+			productStored(w.ctx, w.taskID, w.domain, stored[entry.asin].storedProducts(), entry.product)
+		}
+	}
+	unchangedWrites.record(w.ctx, skipped)
+
+	if len(errs) > 0 {
+		logger.WarnContext(w.ctx, "Firestore batch write partially failed", "products", len(w.entries), "unchanged", skipped,
+			"failed", len(errs), "first_error", firstErr, LogKeyLatency, time.Since(startedAt).Milliseconds())
+	} else {
+		logger.DebugContext(w.ctx, "Firestore batch written", "products", len(w.entries), "unchanged", skipped,
+			LogKeyLatency, time.Since(startedAt).Milliseconds())
+	}
+	return errs
+}
+
+// saveToFirestore writes a product document and its snapshot
+func saveToFirestore(ctx context.Context, doc *ProductDocument) error {
+	docRef := productRef(ctx, doc.Domain, doc.Asin)
+	err := withRetry(ctx, DependencyFirestore, func() error {
+		_, err := docRef.Set(ctx, doc)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save product to Firestore: %v", err)
+	}
+	err = withRetry(ctx, DependencyFirestore, func() error {
+		_, err := productSnapshotRef(ctx, doc.Domain, doc.Asin, doc.UpdatedAt).Set(ctx, doc)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save product snapshot to Firestore: %v", err)
+	}
+	return nil
+}
+
+// getProductsFromFirestore reads the stored products of a domain for a list of ASINs,
+// skipping missing documents
+func getProductsFromFirestore(ctx context.Context, domain string, asins []string) ([]SimplifiedProduct, error) {
+	if len(asins) == 0 {
+		return nil, nil
+	}
+	refs := make([]*firestore.DocumentRef, 0, len(asins))
+	for _, asin := range asins {
+		refs = append(refs, productRef(ctx, domain, asin))
+	}
+
+	docs, err := firestoreClient.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read products from Firestore: %v", err)
+	}
+
+	products := make([]SimplifiedProduct, 0, len(docs))
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var productDoc ProductDocument
+		if err := doc.DataTo(&productDoc); err != nil {
+			return nil, fmt.Errorf("failed to decode product %s from Firestore: %v", doc.Ref.ID, err)
+		}
+		products = append(products, productDoc.Products...)
+	}
+	return products, nil
+}
+
+// getProductFromFirestore reads the stored simplified response of a single ASIN
+func getProductFromFirestore(ctx context.Context, domain, asin string) (*SimplifiedResponse, error) {
+	doc, err := productRef(ctx, domain, asin).Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product from Firestore: %v", err)
+	}
+	var productDoc ProductDocument
+	if err := doc.DataTo(&productDoc); err != nil {
+		return nil, fmt.Errorf("failed to decode product from Firestore: %v", err)
+	}
+	return &SimplifiedResponse{Products: productDoc.Products}, nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"Keepa-api/graph"
+	"Keepa-api/pkg/keepatime"
+	"context"
+	"fmt"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/gin-gonic/gin"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxGraphQLComplexity caps the fields a GraphQL query selects, nested ones included
+const maxGraphQLComplexity = 500
+
+// maxGraphQLTasks caps the tasks of one tasks query
+const maxGraphQLTasks = 100
+
+// GraphQLRequest is the body of POST /graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query" binding:"required"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlExecutor runs the queries of handleGraphQL against the schema of the graph
+// package. Product fields read the stored documents like GET /products/:asin, so only
+// the fields a query selects are sent. Times are formatted like the REST API formats
+// them.
+var graphqlExecutor = newGraphQLExecutor()
+
+// newGraphQLExecutor builds the executor with introspection and the complexity limit
+func newGraphQLExecutor() *executor.Executor {
+	exec := executor.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graphqlResolver{}}))
+	exec.Use(extension.Introspection{})
+	exec.Use(extension.FixedComplexityLimit(maxGraphQLComplexity))
+	return exec
+}
+
+// graphqlFormatterKey is the context key of the timeFormatter of a GraphQL request
+type graphqlFormatterKey struct{}
+
+// formatterFrom returns the timeFormatter of the GraphQL request of ctx
+func formatterFrom(ctx context.Context) timeFormatter {
+	if formatter, ok := ctx.Value(graphqlFormatterKey{}).(timeFormatter); ok {
+		return formatter
+	}
+	return newTimeFormatter(TimeFormatConfig{Format: TimeFormatISO8601})
+}
+
+// handleGraphQL runs a GraphQL query over the stored data. Like other GraphQL servers
+// it answers 200 with failed fields listed in "errors"; each error carries the
+// problem code of the REST API as extensions.code.
+func handleGraphQL(c *gin.Context) {
+	var request GraphQLRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), graphqlFormatterKey{}, timeFormatterFor(c))
+	ctx = graphql.StartOperationTrace(ctx)
+	now := graphql.Now()
+	params := &graphql.RawParams{
+		Query:         request.Query,
+		OperationName: request.OperationName,
+		Variables:     request.Variables,
+		Headers:       c.Request.Header,
+		ReadTime:      graphql.TraceTiming{Start: now, End: now},
+	}
+
+	var response *graphql.Response
+	operation, errs := graphqlExecutor.CreateOperationContext(ctx, params)
+	if errs != nil {
+		response = graphqlExecutor.DispatchError(graphql.WithOperationContext(ctx, operation), errs)
+	} else {
+		var handler graphql.ResponseHandler
+		handler, ctx = graphqlExecutor.DispatchOperation(ctx, operation)
+		response = handler(ctx)
+	}
+	if len(response.Errors) > 0 {
+		logger.InfoContext(ctx, "GraphQL query failed", "errors", len(response.Errors), "error", response.Errors[0].Message)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// graphqlError reports a ServiceError in the "errors" of a GraphQL response
+func graphqlError(err *ServiceError) error {
+	return &gqlerror.Error{
+		Err:        err,
+		Message:    err.Detail,
+		Extensions: map[string]interface{}{"code": err.Code, "status": err.Status},
+	}
+}
+
+// newGraphQLError describes a failed field with the code of status
+func newGraphQLError(status int, detail string) error {
+	return graphqlError(newServiceError(status, detail))
+}
+
+// graphqlDomain parses an optional domain argument
+func graphqlDomain(domain *string) (string, error) {
+	value := ""
+	if domain != nil {
+		value = *domain
+	}
+	parsed, err := parseDomain(value)
+	if err != nil {
+		return "", graphqlError(&ServiceError{Status: http.StatusBadRequest, Code: CodeInvalidQuery, Detail: err.Error()})
+	}
+	return parsed, nil
+}
+
+// graphqlResolver implements graph.ResolverRoot over the stored data
+type graphqlResolver struct{}
+
+func (r *graphqlResolver) Query() graph.QueryResolver           { return queryResolver{} }
+func (r *graphqlResolver) Product() graph.ProductResolver       { return productResolver{} }
+func (r *graphqlResolver) PricePoint() graph.PricePointResolver { return pricePointResolver{} }
+func (r *graphqlResolver) Snapshot() graph.SnapshotResolver     { return snapshotResolver{} }
+func (r *graphqlResolver) Task() graph.TaskResolver             { return taskResolver{} }
+
+// queryResolver resolves the Query type
+type queryResolver struct{}
+
+// Product resolves Query.product. Products that are not stored resolve to null.
+func (queryResolver) Product(ctx context.Context, asin string, domain *string) (*graph.Product, error) {
+	parsed, err := graphqlDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	response, _, err := loadProduct(ctx, parsed, asin)
+	if err != nil || len(response.Products) == 0 {
+		return nil, nil
+	}
+	return graphProduct(response.Products[0], parsed), nil
+}
+
+// Products resolves Query.products
+func (queryResolver) Products(ctx context.Context, domain, brand, category *string, hasAmazonOffer *bool,
+	minPrice, maxPrice, minSalesRank, maxSalesRank *int, sort, order *string, limit *int, cursor *string) (*graph.ProductPage, error) {
+	// The arguments are read like the query parameters of GET /products
+	params := map[string]string{}
+	for name, value := range map[string]*string{"domain": domain, "brand": brand, "category": category,
+		"sort": sort, "order": order, "cursor": cursor} {
+		if value != nil {
+			params[name] = *value
+		}
+	}
+	for name, value := range map[string]*int{"minPrice": minPrice, "maxPrice": maxPrice,
+		"minSalesRank": minSalesRank, "maxSalesRank": maxSalesRank, "limit": limit} {
+		if value != nil {
+			params[name] = strconv.Itoa(*value)
+		}
+	}
+	if hasAmazonOffer != nil {
+		params["hasAmazonOffer"] = strconv.FormatBool(*hasAmazonOffer)
+	}
+	query, err := parseProductQuery(func(name string) string { return params[name] })
+	if err != nil {
+		return nil, graphqlError(&ServiceError{Status: http.StatusBadRequest, Code: CodeInvalidQuery, Detail: err.Error()})
+	}
+	docs, nextCursor, err := query.run(ctx)
+	if err != nil {
+		return nil, newGraphQLError(http.StatusInternalServerError, err.Error())
+	}
+	page := &graph.ProductPage{Products: make([]*graph.Product, 0, len(docs))}
+	for _, doc := range docs {
+		for _, product := range doc.Products {
+			page.Products = append(page.Products, graphProduct(product, doc.Domain))
+		}
+	}
+	page.NextCursor = optionalString(nextCursor)
+	return page, nil
+}
+
+// Snapshots resolves Query.snapshots. from and to are RFC 3339 timestamps or dates and
+// default like GET /products/:asin/history.
+func (queryResolver) Snapshots(ctx context.Context, asin string, domain, from, to *string, limit *int) (*graph.SnapshotPage, error) {
+	parsed, err := graphqlDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now().UTC()
+	if to != nil {
+		if end, err = parseReportTime(*to); err != nil {
+			return nil, newGraphQLError(http.StatusBadRequest, "Invalid to, expected an RFC 3339 timestamp or YYYY-MM-DD")
+		}
+	}
+	start := end.Add(-defaultHistoryPeriod)
+	if from != nil {
+		if start, err = parseReportTime(*from); err != nil {
+			return nil, newGraphQLError(http.StatusBadRequest, "Invalid from, expected an RFC 3339 timestamp or YYYY-MM-DD")
+		}
+	}
+	if !start.Before(end) {
+		return nil, newGraphQLError(http.StatusBadRequest, "from must be before to")
+	}
+	maxSnapshots := maxHistorySnapshots
+	if limit != nil {
+		maxSnapshots = min(max(*limit, 1), maxHistorySnapshots)
+	}
+
+	docs, truncated, err := loadSnapshots(ctx, parsed, asin, start, end, maxSnapshots)
+	if err != nil {
+		return nil, newGraphQLError(http.StatusInternalServerError, err.Error())
+	}
+	page := &graph.SnapshotPage{Snapshots: make([]*graph.Snapshot, 0, len(docs)), Truncated: truncated}
+	for _, doc := range docs {
+		snapshot := &graph.Snapshot{Time: doc.UpdatedAt}
+		if len(doc.Products) > 0 {
+			snapshot.Product = graphProduct(doc.Products[0], parsed)
+		}
+		page.Snapshots = append(page.Snapshots, snapshot)
+	}
+	return page, nil
+}
+
+// Task resolves Query.task. Tasks of other tenants resolve to null.
+func (queryResolver) Task(ctx context.Context, id string) (*graph.Task, error) {
+	task, err := getTask(ctx, id)
+	if err != nil {
+		if serviceErr, ok := err.(*ServiceError); ok && serviceErr.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, newGraphQLError(http.StatusInternalServerError, err.Error())
+	}
+	return graphTask(task), nil
+}
+
+// Tasks resolves Query.tasks with the tasks of the calling tenant
+func (queryResolver) Tasks(ctx context.Context, status *string, limit *int) ([]*graph.Task, error) {
+	maxTasks := 20
+	if limit != nil {
+		maxTasks = min(max(*limit, 1), maxGraphQLTasks)
+	}
+	filter := taskListFilter{TenantID: tenantID(ctx)}
+	if status != nil {
+		filter.Status = *status
+	}
+	matches, _, err := listTasks(ctx, filter, nil, maxTasks)
+	if err != nil {
+		return nil, newGraphQLError(http.StatusInternalServerError, err.Error())
+	}
+	tasks := make([]*graph.Task, 0, len(matches))
+	for _, task := range matches {
+		tasks = append(tasks, graphTask(task))
+	}
+	return tasks, nil
+}
+
+// graphProduct converts a stored SimplifiedProduct. The times are formatted by
+// productResolver once a query selects them.
+func graphProduct(product SimplifiedProduct, domain string) *graph.Product {
+	categories := make([]string, 0, len(product.Categories))
+	for _, category := range product.Categories {
+		categories = append(categories, strconv.FormatInt(category, 10))
+	}
+	priceHistory := make(map[string][]*graph.PricePoint, len(product.PriceHistory))
+	for name, series := range product.PriceHistory {
+		points := make([]*graph.PricePoint, 0, len(series))
+		for _, point := range series {
+			points = append(points, &graph.PricePoint{Time: point.Time, Cents: point.Cents, Shipping: optionalInt(point.Shipping)})
+		}
+		priceHistory[name] = points
+	}
+	converted := &graph.Product{
+		Asin:               product.Asin,
+		Domain:             optionalString(domain),
+		Title:              product.Title,
+		Brand:              product.Brand,
+		Categories:         categories,
+		CategoryPath:       optionalString(product.CategoryPath),
+		ParentAsin:         optionalString(product.ParentAsin),
+		BuyBoxPrice:        optionalInt(product.BuyBoxPrice),
+		BuyBoxAvg30:        optionalInt(product.BuyBoxAvg30),
+		BuyBoxAvg90:        optionalInt(product.BuyBoxAvg90),
+		HasAmazonOffer:     product.HasAmazonOffer,
+		AmazonAvailability: optionalString(product.AmazonAvailability),
+		MonthlySold:        optionalInt(product.MonthlySold),
+		OfferCountFBA:      product.OfferCountFBA,
+		OfferCountFBM:      product.OfferCountFBM,
+		ReviewCount:        optionalInt(product.ReviewCount),
+		FetchedAt:          product.FetchedAt,
+		SalesRanks:         product.SalesRanks,
+		PriceHistory:       priceHistory,
+	}
+	if product.Rating != 0 {
+		converted.Rating = &product.Rating
+	}
+	return converted
+}
+
+// graphTask converts a task
+func graphTask(task Task) *graph.Task {
+	classes := make([]string, 0, len(task.ErrorCounts))
+	for class := range task.ErrorCounts {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	counts := make([]*graph.ErrorCount, 0, len(classes))
+	for _, class := range classes {
+		counts = append(counts, &graph.ErrorCount{Class: class, Count: task.ErrorCounts[class]})
+	}
+	return &graph.Task{
+		ID:          task.ID,
+		Kind:        task.Kind,
+		Domain:      optionalString(task.Domain),
+		Status:      task.Status,
+		Error:       optionalString(task.Error),
+		Progress:    task.Progress,
+		Total:       task.Total,
+		Categories:  append([]string{}, task.Categories...),
+		ErrorCounts: counts,
+		ScheduleID:  optionalString(task.ScheduleID),
+		CreatedAt:   task.CreatedAt,
+		UpdatedAt:   task.UpdatedAt,
+		FinishedAt:  task.FinishedAt,
+	}
+}
+
+// productResolver resolves the formatted fields of Product
+type productResolver struct{}
+
+func (productResolver) FetchedAt(ctx context.Context, obj *graph.Product) (*string, error) {
+	if obj.FetchedAt.IsZero() {
+		return nil, nil
+	}
+	return optionalString(formatterFrom(ctx).key(obj.FetchedAt)), nil
+}
+
+// SalesRanks resolves Product.salesRanks from the stored salesRanks, keyed by time
+func (productResolver) SalesRanks(ctx context.Context, obj *graph.Product, last *int) ([]*graph.RankPoint, error) {
+	keys := make([]string, 0, len(obj.SalesRanks))
+	for key := range obj.SalesRanks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // Stored keys sort chronologically
+	keys = lastN(keys, last)
+
+	formatter := formatterFrom(ctx)
+	points := make([]*graph.RankPoint, 0, len(keys))
+	for _, key := range keys {
+		point := &graph.RankPoint{Time: key, Rank: obj.SalesRanks[key]}
+		if t, err := keepatime.ParseKey(key); err == nil {
+			point.Time = formatter.key(t)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// PriceHistory resolves Product.priceHistory
+func (productResolver) PriceHistory(ctx context.Context, obj *graph.Product, typeArg string, last *int) ([]*graph.PricePoint, error) {
+	if _, ok := csvTypeNames[typeArg]; !ok {
+		return nil, graphqlError(&ServiceError{Status: http.StatusBadRequest, Code: CodeInvalidQuery, Detail: fmt.Sprintf("Unknown price history type %s", typeArg)})
+	}
+	history := lastN(obj.PriceHistory[typeArg], last)
+	if history == nil {
+		history = []*graph.PricePoint{}
+	}
+	return history, nil
+}
+
+// pricePointResolver resolves the formatted fields of PricePoint
+type pricePointResolver struct{}
+
+func (pricePointResolver) Time(ctx context.Context, obj *graph.PricePoint) (string, error) {
+	return formatterFrom(ctx).key(obj.Time), nil
+}
+
+// snapshotResolver resolves the formatted fields of Snapshot
+type snapshotResolver struct{}
+
+func (snapshotResolver) Time(ctx context.Context, obj *graph.Snapshot) (string, error) {
+	return formatterFrom(ctx).key(obj.Time), nil
+}
+
+// taskResolver resolves the formatted fields of Task
+type taskResolver struct{}
+
+func (taskResolver) CreatedAt(ctx context.Context, obj *graph.Task) (string, error) {
+	return formatterFrom(ctx).key(obj.CreatedAt), nil
+}
+
+func (taskResolver) UpdatedAt(ctx context.Context, obj *graph.Task) (string, error) {
+	return formatterFrom(ctx).key(obj.UpdatedAt), nil
+}
+
+func (taskResolver) FinishedAt(ctx context.Context, obj *graph.Task) (*string, error) {
+	if obj.FinishedAt == nil {
+		return nil, nil
+	}
+	return optionalString(formatterFrom(ctx).key(*obj.FinishedAt)), nil
+}
+
+// optionalString returns nil for an empty string, which GraphQL answers as null
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// optionalInt returns nil for 0, the unknown value of stored products
+func optionalInt(value int) *int {
+	if value == 0 {
+		return nil
+	}
+	return &value
+}
+
+// lastN returns the last n values, all of them when n is nil
+func lastN[T any](values []T, n *int) []T {
+	if n == nil || *n >= len(values) {
+		return values
+	}
+	return values[len(values)-max(*n, 0):]
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"Keepa-api/keepapb"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// grpcServer serves KeepaService with the service layer of the REST handlers
+type grpcServer struct {
+	keepapb.UnimplementedKeepaServiceServer
+	client *KeepaClient
+}
+
+// startGRPCServer serves KeepaService on GRPC_PORT next to the REST API. It does
+// nothing when GRPC_PORT is unset.
+func startGRPCServer(client *KeepaClient) {
+	port := getEnv("GRPC_PORT", "")
+	if port == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		logger.Error("Failed to listen for gRPC", "port", port, "error", err)
+		os.Exit(1)
+	}
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	)
+	keepapb.RegisterKeepaServiceServer(server, &grpcServer{client: client})
+	go func() {
+		logger.Info("Serving gRPC", "port", port)
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC server stopped", "error", err)
+		}
+	}()
+}
+
+// grpcUnaryInterceptor prepares the context of unary calls with grpcContext and logs them
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := grpcContext(ctx)
+	if err == nil {
+		var resp interface{}
+		resp, err = handler(ctx, req)
+		if err == nil {
+			logGRPCCall(ctx, info.FullMethod, start, nil)
+			return resp, nil
+		}
+		err = grpcError(err)
+	}
+	logGRPCCall(ctx, info.FullMethod, start, err)
+	return nil, err
+}
+
+// grpcStreamInterceptor prepares the context of streaming calls with grpcContext and logs them
+func grpcStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := grpcContext(stream.Context())
+	if err == nil {
+		if err = handler(srv, &grpcContextStream{ServerStream: stream, ctx: ctx}); err != nil {
+			err = grpcError(err)
+		}
+	}
+	logGRPCCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// grpcContextStream is a server stream with the context prepared by grpcContext
+type grpcContextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *grpcContextStream) Context() context.Context {
+	return s.ctx
+}
+
+// logGRPCCall logs a finished call like requestLoggingMiddleware logs requests
+func logGRPCCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK, codes.Canceled:
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	logger.LogAttrs(ctx, level, "gRPC call handled",
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Int64(LogKeyLatency, time.Since(start).Milliseconds()),
+	)
+}
+
+// grpcContext applies the REST middleware to a call: it resolves the tenant of the
+// x-tenant-key metadata, authenticates the caller once AUTH_METHODS is set and applies
+// the failed credential and request rate limits. Request IDs are taken from
+// x-request-id like RequestIDHeader.
+func grpcContext(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := func(name string) string { // Metadata keys are lower case, Get lowers name
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	requestID := header(RequestIDHeader)
+	if requestID == "" || len(requestID) > 128 {
+		requestID = newRequestID()
+	}
+	ctx = withLogAttrs(ctx, slog.String(LogKeyRequestID, requestID))
+
+	clientIP := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		clientIP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	// Rejected credentials are booked on failedAuthLimit like on REST, see allowAuthAttempt
+	authLimitKey := "ip:" + clientIP
+	allowAuthAttempt := func() error {
+		if exhausted, _ := failedAuthLimit.exhausted(ctx, authLimitKey); exhausted {
+			return status.Error(codes.ResourceExhausted, "Too many invalid credentials, try again later")
+		}
+		return nil
+	}
+
+	if key := header(TenantKeyHeader); key != "" {
+		if err := allowAuthAttempt(); err != nil {
+			return ctx, err
+		}
+		tenant, err := tenants.byAccessKey(ctx, key)
+		if err != nil {
+			return ctx, status.Error(codes.Unavailable, err.Error())
+		}
+		if tenant == nil || tenant.Disabled {
+			failedAuthLimit.allow(ctx, authLimitKey)
+			return ctx, status.Error(codes.Unauthenticated, "Invalid tenant key")
+		}
+		ctx = withTenant(ctx, tenant)
+	}
+
+	if methods := authMethods(); len(methods) > 0 {
+		var principal *Principal
+		if tenant := tenantFrom(ctx); tenant != nil {
+			principal = &Principal{ID: tenant.ID, Method: "tenant", Role: RoleUser}
+		} else {
+			presented := header(APIKeyHeader) != "" || header("Authorization") != ""
+			if presented {
+				if err := allowAuthAttempt(); err != nil {
+					return ctx, err
+				}
+			}
+			var err error
+			if principal, err = authenticate(ctx, header, methods); err != nil {
+				return ctx, status.Error(codes.Unavailable, err.Error())
+			}
+			if presented && principal == nil {
+				failedAuthLimit.allow(ctx, authLimitKey)
+			}
+		}
+		if principal == nil {
+			return ctx, status.Error(codes.Unauthenticated, "Missing or invalid credentials")
+		}
+		ctx = context.WithValue(ctx, principalKey{}, principal)
+		ctx = withLogAttrs(ctx, slog.String("principal", principal.Method+":"+principal.ID))
+	}
+
+	caller := requestCaller(ctx, clientIP)
+	ctx = withCaller(ctx, caller)
+	if ok, retryAfter := requestRateLimit.allow(ctx, caller); !ok {
+		return ctx, grpcError(&ServiceError{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Detail: "Rate limit exceeded, slow down", RetryAfter: retryAfter})
+	}
+	return ctx, nil
+}
+
+// grpcCodes maps the HTTP statuses of ServiceErrors to gRPC codes
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.Aborted,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusBadGateway:          codes.Unavailable,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// grpcError converts an error of the service layer to a gRPC status carrying the
+// Problem code as ErrorInfo reason and, when worth retrying later, a RetryInfo.
+// Failed Keepa calls map like respondKeepaError answers them.
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) {
+		serviceErr = keepaServiceError(err, http.StatusBadGateway, err.Error())
+	}
+
+	code, ok := grpcCodes[serviceErr.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	st := status.New(code, serviceErr.Detail)
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: serviceErr.Code, Domain: "keepa-api"}}
+	if serviceErr.RetryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(serviceErr.RetryAfter)})
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// FetchProducts starts the tasks of a query, like POST /keepa
+func (s *grpcServer) FetchProducts(ctx context.Context, req *keepapb.FetchProductsRequest) (*keepapb.FetchProductsResponse, error) {
+	specs, callbackURL, err := parseFetchSpecs(ctx, req.GetQuery().AsMap(), req.GetFields())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTaskLimits(ctx); err != nil {
+		return nil, err
+	}
+	started, err := s.client.startFetchTasks(ctx, specs, callbackURL, req.GetIdempotencyKey())
+	if err != nil {
+		return nil, err
+	}
+	response := &keepapb.FetchProductsResponse{}
+	for _, task := range started {
+		response.Tasks = append(response.Tasks, &keepapb.StartedTask{
+			TaskId:          task.TaskID,
+			Domain:          task.Domain,
+			Status:          task.Status,
+			EstimatedTokens: int32(task.EstimatedTokens),
+			Replayed:        task.Replayed,
+		})
+		response.EstimatedTokens += int32(task.EstimatedTokens)
+	}
+	return response, nil
+}
+
+// GetProduct returns a product, like GET /products/:asin
+func (s *grpcServer) GetProduct(ctx context.Context, req *keepapb.GetProductRequest) (*keepapb.Product, error) {
+	domain, err := parseDomain(req.GetDomain())
+	if err != nil {
+		return nil, newServiceError(http.StatusBadRequest, err.Error())
+	}
+	asin, reason := normalizeASIN(req.GetAsin())
+	if reason != "" {
+		return nil, newServiceError(http.StatusBadRequest, fmt.Sprintf("%q is %s", req.GetAsin(), reason))
+	}
+	response, source, err := s.client.getProduct(ctx, domain, asin, req.GetRefresh())
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Products) == 0 {
+		return nil, newServiceError(http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+	}
+	product := response.Products[0]
+	data, err := toStruct(product)
+	if err != nil {
+		return nil, newServiceError(http.StatusInternalServerError, err.Error())
+	}
+	return &keepapb.Product{
+		Asin:   product.Asin,
+		Domain: domain,
+		Title:  product.Title,
+		Brand:  product.Brand,
+		Source: source,
+		Data:   data,
+	}, nil
+}
+
+// GetTask returns the state of a task, like GET /tasks/:id
+func (s *grpcServer) GetTask(ctx context.Context, req *keepapb.GetTaskRequest) (*keepapb.Task, error) {
+	task, err := getTask(ctx, req.GetTaskId())
+	if err != nil {
+		return nil, err
+	}
+	return taskMessage(&task), nil
+}
+
+// WatchTask streams the progress of a task, like GET /tasks/:id/stream
+func (s *grpcServer) WatchTask(req *keepapb.WatchTaskRequest, stream keepapb.KeepaService_WatchTaskServer) error {
+	ctx := stream.Context()
+	task, events, unsubscribe, err := watchTask(ctx, req.GetTaskId())
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	client := s.client.forContext(ctx)
+	snapshot := newTaskEvent(TaskEventProgress, &task)
+	snapshot.TokensLeft = client.tokensLeft()
+	snapshot.Time = time.Now().UTC()
+	if err := stream.Send(taskProgressMessage(snapshot)); err != nil {
+		return err
+	}
+	if taskFinished(&task) {
+		return stream.Send(taskProgressMessage(newTaskEvent(TaskEventFinished, &task)))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-events:
+			event.TokensLeft = client.tokensLeft()
+			if err := stream.Send(taskProgressMessage(event)); err != nil {
+				return err
+			}
+			if event.Type == TaskEventFinished {
+				return nil
+			}
+		}
+	}
+}
+
+// toStruct converts a value to a Struct through its JSON encoding, so it reads like
+// the REST response
+func toStruct(value interface{}) (*structpb.Struct, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return structpb.NewStruct(fields)
+}
+
+// taskMessage converts a task to its gRPC message
+func taskMessage(task *Task) *keepapb.Task {
+	message := &keepapb.Task{
+		Id:         task.ID,
+		Kind:       task.Kind,
+		Domain:     task.Domain,
+		Status:     task.Status,
+		Error:      task.Error,
+		Progress:   int32(task.Progress),
+		Total:      int32(task.Total),
+		Categories: task.Categories,
+		ScheduleId: task.ScheduleID,
+		CreatedAt:  timestamppb.New(task.CreatedAt),
+		UpdatedAt:  timestamppb.New(task.UpdatedAt),
+	}
+	if task.FinishedAt != nil {
+		message.FinishedAt = timestamppb.New(*task.FinishedAt)
+	}
+	if len(task.ErrorCounts) > 0 {
+		message.ErrorCounts = make(map[string]int32, len(task.ErrorCounts))
+		for class, count := range task.ErrorCounts {
+			message.ErrorCounts[class] = int32(count)
+		}
+	}
+	return message
+}
+
+// taskProgressMessage converts a task event to its gRPC message
+func taskProgressMessage(event TaskEvent) *keepapb.TaskProgress {
+	message := &keepapb.TaskProgress{
+		Type:       event.Type,
+		TaskId:     event.TaskID,
+		Asin:       event.ASIN,
+		Class:      event.Class,
+		Error:      event.Error,
+		Chunk:      int32(event.Chunk),
+		Status:     event.Status,
+		Progress:   int32(event.Progress),
+		Total:      int32(event.Total),
+		TokensLeft: int32(event.TokensLeft),
+	}
+	if !event.Time.IsZero() {
+		message.Time = timestamppb.New(event.Time)
+	}
+	return message
+}
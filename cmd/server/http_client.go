@@ -0,0 +1,166 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Keepa backends selected by KEEPA_MODE
+const (
+	KeepaModeLive = "live" // Requests go to api.keepa.com
+	KeepaModeMock = "mock" // Requests are answered from fixtures without spending tokens
+)
+
+// keepaMode returns KEEPA_MODE, live when it is unset or unknown
+func keepaMode() string {
+	switch mode := getEnv("KEEPA_MODE", KeepaModeLive); mode {
+	case KeepaModeLive, KeepaModeMock:
+		return mode
+	default:
+		logger.Warn("Ignoring unsupported KEEPA_MODE", "value", mode)
+		return KeepaModeLive
+	}
+}
+
+// tlsVersions maps KEEPA_TLS_MIN_VERSION values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// envDuration parses a duration variable, returning defaultValue when it is unset or invalid
+func envDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// envInt parses a positive integer variable, returning defaultValue when it is unset or invalid
+func envInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || value < 1 {
+		return defaultValue
+	}
+	return value
+}
+
+// newKeepaHTTPClient creates the client all Keepa calls share, so connections to the
+// API are reused. It is configured by:
+//
+//	KEEPA_HTTP_TIMEOUT                  whole request including the body (60s)
+//	KEEPA_HTTP_DIAL_TIMEOUT             TCP connect (10s)
+//	KEEPA_HTTP_TLS_HANDSHAKE_TIMEOUT    TLS handshake (10s)
+//	KEEPA_HTTP_RESPONSE_HEADER_TIMEOUT  wait for the response headers (45s)
+//	KEEPA_HTTP_IDLE_CONN_TIMEOUT        idle connections are closed after (90s)
+//	KEEPA_HTTP_MAX_IDLE_CONNS_PER_HOST  idle connections kept to the API (16)
+//	KEEPA_HTTP_PROXY                    proxy URL, HTTP_PROXY/HTTPS_PROXY otherwise
+//	KEEPA_TLS_MIN_VERSION               "1.2" or "1.3" (1.2)
+//	KEEPA_TLS_CA_FILE                   PEM bundle trusted in addition to the system roots
+//
+// With KEEPA_MODE=mock the client answers from newKeepaMockTransport instead.
+func newKeepaHTTPClient() *http.Client {
+	if keepaMode() == KeepaModeMock {
+		return &http.Client{
+			Transport: newKeepaMockTransport(),
+			Timeout:   envDuration("KEEPA_HTTP_TIMEOUT", 60*time.Second),
+		}
+	}
+
+	maxIdlePerHost, err := strconv.Atoi(getEnv("KEEPA_HTTP_MAX_IDLE_CONNS_PER_HOST", "16"))
+	if err != nil || maxIdlePerHost < 1 {
+		maxIdlePerHost = 16
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if rawURL := getEnv("KEEPA_HTTP_PROXY", ""); rawURL != "" {
+		if proxyURL, err := neturl.Parse(rawURL); err == nil && proxyURL.Host != "" {
+			proxy = http.ProxyURL(proxyURL)
+		} else {
+			logger.Warn("Ignoring invalid KEEPA_HTTP_PROXY", "value", rawURL)
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   envDuration("KEEPA_HTTP_DIAL_TIMEOUT", 10*time.Second),
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       envDuration("KEEPA_HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		TLSHandshakeTimeout:   envDuration("KEEPA_HTTP_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		ResponseHeaderTimeout: envDuration("KEEPA_HTTP_RESPONSE_HEADER_TIMEOUT", 45*time.Second),
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       keepaTLSConfig(),
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   envDuration("KEEPA_HTTP_TIMEOUT", 60*time.Second),
+	}
+}
+
+// newKeepaMockTransport creates the fake Keepa backend of KEEPA_MODE=mock, for
+// integration and load tests. It is configured by:
+//
+//	KEEPA_MOCK_FIXTURES        directory of recorded payloads, see keepa.MockTransport
+//	KEEPA_MOCK_LATENCY         added to every response (0)
+//	KEEPA_MOCK_LATENCY_JITTER  random extra latency up to this duration (0)
+//	KEEPA_MOCK_RATE_LIMIT      fraction of requests answered 429, e.g. 0.05 (0)
+//	KEEPA_MOCK_REFILL_RATE     tokens per minute of the simulated plan (1000)
+func newKeepaMockTransport() *keepa.MockTransport {
+	rateLimitRate, err := strconv.ParseFloat(getEnv("KEEPA_MOCK_RATE_LIMIT", "0"), 64)
+	if err != nil || rateLimitRate < 0 || rateLimitRate > 1 {
+		logger.Warn("Ignoring invalid KEEPA_MOCK_RATE_LIMIT, it must be between 0 and 1", "value", getEnv("KEEPA_MOCK_RATE_LIMIT", ""))
+		rateLimitRate = 0
+	}
+	opts := keepa.MockOptions{
+		FixturesDir:   getEnv("KEEPA_MOCK_FIXTURES", ""),
+		Latency:       envDuration("KEEPA_MOCK_LATENCY", 0),
+		LatencyJitter: envDuration("KEEPA_MOCK_LATENCY_JITTER", 0),
+		RateLimitRate: rateLimitRate,
+		RefillRate:    envInt("KEEPA_MOCK_REFILL_RATE", 1000),
+	}
+	logger.Warn("Keepa requests are answered by the mock backend", "fixtures", opts.FixturesDir, "latency", opts.Latency.String(), "rate_limit", opts.RateLimitRate)
+	return keepa.NewMockTransport(opts)
+}
+
+// keepaTLSConfig returns the TLS settings of the Keepa client
+func keepaTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if version := getEnv("KEEPA_TLS_MIN_VERSION", "1.2"); tlsVersions[version] != 0 {
+		config.MinVersion = tlsVersions[version]
+	} else {
+		logger.Warn("Ignoring unsupported KEEPA_TLS_MIN_VERSION", "value", version)
+	}
+
+	// Extra roots, e.g. for a TLS-inspecting egress proxy
+	if path := getEnv("KEEPA_TLS_CA_FILE", ""); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error("Failed to read KEEPA_TLS_CA_FILE", "path", path, "error", err)
+			return config
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			logger.Error("No certificates found in KEEPA_TLS_CA_FILE", "path", path)
+			return config
+		}
+		config.RootCAs = roots
+	}
+	return config
+}
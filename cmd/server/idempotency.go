@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// IdempotencyRedisKeyPrefix prefixes the Idempotency-Key -> task ID mappings
+const IdempotencyRedisKeyPrefix = "keepa:idempotency:"
+
+// idempotencyWindow is how long an Idempotency-Key maps to its task (IDEMPOTENCY_WINDOW)
+func idempotencyWindow() time.Duration {
+	window, err := time.ParseDuration(getEnv("IDEMPOTENCY_WINDOW", "24h"))
+	if err != nil || window <= 0 {
+		return 24 * time.Hour
+	}
+	return window
+}
+
+// claimIdempotencyKey maps key of the tenant of ctx to taskID unless the key is
+// already mapped, in which case the existing task ID is returned
+func claimIdempotencyKey(ctx context.Context, key, taskID string) (string, error) {
+	redisKey := tenantRedisKey(ctx, IdempotencyRedisKeyPrefix+key)
+	var claimed bool
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		claimed, err = redisClient.SetNX(ctx, redisKey, taskID, idempotencyWindow()).Result()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store idempotency key: %v", err)
+	}
+	if claimed {
+		return "", nil
+	}
+
+	existing, err := redisClient.Get(ctx, redisKey).Result()
+	if err == redis.Nil {
+		// The mapping expired in between, claim it again
+		return claimIdempotencyKey(ctx, key, taskID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read idempotency key: %v", err)
+	}
+	return existing, nil
+}
+
+// releaseIdempotencyKey removes the mapping of a key whose task could not be started
+func releaseIdempotencyKey(ctx context.Context, key string) {
+	redisClient.Del(ctx, tenantRedisKey(ctx, IdempotencyRedisKeyPrefix+key))
+}
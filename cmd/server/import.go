@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ImportFileField is the multipart form field of an ASIN import
+const ImportFileField = "file"
+
+// errImportTooLarge stops reading an upload with more ASINs than IMPORT_MAX_ASINS
+var errImportTooLarge = errors.New("too many ASINs")
+
+// asinImport collects the ASINs of an upload. Rows are CSV or a bare ASIN per line;
+// a header row naming an "asin" column selects that column, otherwise the first
+// column is read.
+type asinImport struct {
+	ASINs    []string
+	Rejected RejectedRowsError
+	column   int
+	header   bool
+	seen     map[string]bool
+	maxASINs int
+}
+
+// newASINImport creates an import accepting up to maxASINs ASINs
+func newASINImport(maxASINs int) *asinImport {
+	return &asinImport{seen: make(map[string]bool), maxASINs: maxASINs}
+}
+
+// splitImportRow splits a row at commas, semicolons or tabs and unquotes the values
+func splitImportRow(line string) []string {
+	fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ';' || r == '\t' })
+	for i, field := range fields {
+		fields[i] = strings.Trim(strings.TrimSpace(field), `"'`)
+	}
+	return fields
+}
+
+// add validates one row of the upload
+func (imp *asinImport) add(row int, line string) error {
+	fields := splitImportRow(line)
+	if !imp.header {
+		imp.header = true
+		for i, field := range fields {
+			if strings.EqualFold(field, "asin") {
+				imp.column = i
+				return nil
+			}
+		}
+	}
+
+	if imp.column >= len(fields) || fields[imp.column] == "" {
+		imp.Rejected.add(row, line, "missing ASIN")
+		return nil
+	}
+	asin, reason := normalizeASIN(fields[imp.column])
+	switch {
+	case reason != "":
+		imp.Rejected.add(row, fields[imp.column], reason)
+	case imp.seen[asin]:
+		imp.Rejected.add(row, fields[imp.column], "duplicate ASIN")
+	case len(imp.ASINs) >= imp.maxASINs:
+		return errImportTooLarge
+	default:
+		imp.seen[asin] = true
+		imp.ASINs = append(imp.ASINs, asin)
+	}
+	return nil
+}
+
+// handleImportASINs starts a task fetching the ASINs of an uploaded CSV or text file
+// with the product pipeline, skipping Product Finder. The file is the "file" part of a
+// multipart upload or the plain body. Invalid and duplicate rows are skipped and
+// reported; ?dryRun=true only validates the file.
+func (client *KeepaClient) handleImportASINs(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	maxASINs := envInt("IMPORT_MAX_ASINS", 10000)
+
+	imp := newASINImport(maxASINs)
+	if err := streamUploadLines(c, ImportFileField, imp.add); err != nil {
+		switch {
+		case isBodyTooLarge(err):
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload too large: %v", err))
+		case errors.Is(err, errImportTooLarge):
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("The upload lists more than %d ASINs", maxASINs))
+		default:
+			respondError(c, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	if len(imp.ASINs) == 0 {
+		respondRejectedRows(c, "The upload contains no valid ASIN", &imp.Rejected)
+		return
+	}
+
+	result := gin.H{
+		"domain":           domain,
+		"accepted":         len(imp.ASINs),
+		"rejected":         imp.Rejected.Total,
+		"errors":           imp.Rejected.Rows,
+		"estimated_tokens": calculateProductRequestTokens(len(imp.ASINs)),
+	}
+	if dryRun, _ := strconv.ParseBool(c.Query("dryRun")); dryRun {
+		result["dryRun"] = true
+		c.JSON(http.StatusOK, withQuotaWarning(result))
+		return
+	}
+
+	taskID := generateTaskID()
+	client.Logger.InfoContext(c.Request.Context(), "Created import task", LogKeyTaskID, taskID, "domain", domain, "asins", len(imp.ASINs), "rejected", imp.Rejected.Total)
+
+	tasks.create(c.Request.Context(), taskID, TaskKindASINs)
+	tasks.update(taskID, func(task *Task) { task.Domain = domain })
+	tasks.addASINs(taskID, imp.ASINs)
+
+	asins := imp.ASINs
+	if !enqueueTask(func() { client.runASINTask(taskID, asins, false) }) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+
+	result["task_id"] = taskID
+	result["status"] = "pending"
+	c.JSON(http.StatusAccepted, withQuotaWarning(result))
+}
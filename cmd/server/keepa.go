@@ -0,0 +1,924 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// NewKeepaClient initializes a new Keepa client
+func NewKeepaClient() *KeepaClient {
+	// Start with a full bucket refilling 5 tokens per minute
+	tokens := keepa.NewTokenBucket(tokenBucketCapacity, tokenBucketCapacity, 5.0, time.Now())
+	clientLogger := logger.With(LogKeyComponent, "keepa_client")
+	return &KeepaClient{
+		Tokens:          tokens,
+		SafetyThreshold: 10, // Safety threshold for tokens
+		Logger:          clientLogger,
+		Starvation:      newTokenStarvationMonitor(),
+		Shared:          newSharedTokenBucket(keepaAPIKey(context.Background())),
+		API:             newKeepaAPI(newKeepaHTTPClient(), clientLogger, tokens),
+	}
+}
+
+// newKeepaAPI creates the API client of a KeepaClient. Retries are left to
+// doRequestWithPriority, which also waits for the circuit breaker and the scheduler.
+func newKeepaAPI(httpClient *http.Client, clientLogger *slog.Logger, tokens *keepa.TokenBucket) *keepa.Client {
+	return keepa.NewClient(keepa.WithHTTPClient(httpClient), keepa.WithLogger(clientLogger), keepa.WithTokenBucket(tokens), keepa.WithRetryPolicy(retryPolicyFor(DependencyKeepa)))
+}
+
+// observeTokens reports the balance to the starvation monitor and the quota warnings.
+// The quota warnings follow the deployment's key only.
+func (client *KeepaClient) observeTokens(tokensLeft int) {
+	client.Starvation.observeTokens(tokensLeft)
+	if client.Tenant == nil {
+		quota.observe(tokensLeft)
+	}
+}
+
+// waitForTokens waits until requiredTokens plus the safety threshold are available and
+// reserves requiredTokens of the estimate, so concurrent workers do not plan with the
+// same tokens. The next Keepa response replaces the estimate. Waiting requests are
+// served by priority, then in arrival order.
+func (client *KeepaClient) waitForTokens(requiredTokens int, refillIn int, priority int) {
+	// Keepa accepts a request while the balance is positive, so a request costing more
+	// than the bucket holds only waits for a full bucket
+	if limit := client.Tokens.Capacity() - client.SafetyThreshold; requiredTokens > limit {
+		requiredTokens = limit
+	}
+	// Only the most urgent waiting request reserves tokens, see requestScheduler
+	waiter := keepaScheduler.enter(priority)
+	defer keepaScheduler.leave(waiter)
+	for {
+		keepaScheduler.awaitTurn(waiter)
+		available, reserved := client.reserveTokens(requiredTokens)
+		if reserved {
+			return
+		}
+
+		// Calculate wait time
+		wait := client.Tokens.TimeUntil(requiredTokens + client.SafetyThreshold - available)
+
+		// Use refillIn if provided
+		if refillIn > 0 {
+			wait = time.Duration(refillIn) * time.Millisecond
+			refillIn = 0
+		}
+
+		client.Logger.Info("Tokens insufficient, waiting",
+			"required_tokens", requiredTokens+client.SafetyThreshold, LogKeyTokensLeft, available, "wait_seconds", wait.Seconds())
+		tokenWaits.sleep(WaitReasonInsufficientTokens, DependencyKeepa, wait)
+	}
+}
+
+// reserveTokens takes requiredTokens from the shared bucket, or from the local estimate
+// when the bucket is disabled or Redis fails. It returns the balance and whether the
+// tokens were taken.
+func (client *KeepaClient) reserveTokens(requiredTokens int) (int, bool) {
+	if client.Shared != nil {
+		available, reserved, err := client.Shared.consume(requiredTokens, client.SafetyThreshold, client.Tokens.RefillRate(), client.Tokens.Capacity())
+		if err == nil {
+			client.observeTokens(available)
+			return available, reserved
+		}
+		client.Logger.Warn("Shared token bucket unavailable, using the local estimate", "error", err)
+	}
+
+	available, reserved := client.Tokens.Consume(requiredTokens, client.SafetyThreshold, time.Now())
+	client.observeTokens(available)
+	return available, reserved
+}
+
+// availableTokens returns the refilled balance of the shared bucket, or of the local
+// estimate when the bucket is disabled or Redis fails
+func (client *KeepaClient) availableTokens() int {
+	available, _ := client.reserveTokens(0)
+	return available
+}
+
+// waitForTokenRecovery blocks until the token estimate reaches minTokens
+func (client *KeepaClient) waitForTokenRecovery(minTokens int) {
+	if capacity := client.Tokens.Capacity(); minTokens > capacity {
+		minTokens = capacity // The bucket never holds more
+	}
+	for {
+		missing := minTokens - client.availableTokens()
+		if missing <= 0 {
+			return
+		}
+		wait := client.Tokens.TimeUntil(missing)
+		client.Logger.Info("Waiting for tokens to recover", "min_tokens", minTokens, "wait_seconds", wait.Seconds())
+		tokenWaits.sleep(WaitReasonInsufficientTokens, DependencyKeepa, wait)
+	}
+}
+
+// tokensLeft returns the current token estimate, shared by all instances when enabled
+func (client *KeepaClient) tokensLeft() int {
+	if client.Shared != nil {
+		if tokens, err := client.Shared.peek(client.Tokens.RefillRate(), client.Tokens.Capacity()); err == nil {
+			return tokens
+		}
+	}
+	return client.Tokens.Tokens()
+}
+
+// setTokenState replaces the token estimate with the state reported by a Keepa
+// response and learns the refill rate and capacity of the plan from it
+func (client *KeepaClient) setTokenState(apiResp *keepa.Response) {
+	tokensLeft := apiResp.TokensLeft
+	if client.API.UpdateTokens(apiResp) {
+		client.Logger.Info("Token bucket updated from Keepa", "refill_rate", apiResp.RefillRate, "capacity", client.Tokens.Capacity())
+	}
+	if client.Shared != nil {
+		if err := client.Shared.set(tokensLeft); err != nil {
+			client.Logger.Warn("Failed to update the shared token bucket", "error", err)
+		}
+	}
+	client.observeTokens(tokensLeft)
+}
+
+// calculateDynamicBatchSize dynamically calculates batchSize based on current token count
+// and the cost of one ASIN
+func (client *KeepaClient) calculateDynamicBatchSize(maxBatchSize, tokensPerASIN int) int {
+	// Update token state
+	availableTokens := client.availableTokens() - client.SafetyThreshold
+
+	// Calculate available tokens
+	if availableTokens <= 0 {
+		return 1 // Process at least 1 ASIN
+	}
+
+	maxASINs := availableTokens / tokensPerASIN
+	if maxASINs > maxBatchSize {
+		maxASINs = maxBatchSize
+	}
+	if maxASINs < 1 {
+		maxASINs = 1
+	}
+
+	client.Logger.Debug("Calculated dynamic batch size", "batch_size", maxASINs, "available_tokens", availableTokens, "tokens_per_asin", tokensPerASIN)
+	return maxASINs
+}
+
+// doRequest is a generic request method with retry logic and exponential backoff
+func (client *KeepaClient) doRequest(ctx context.Context, url string, requiredTokens int, method string, queryParam map[string]interface{}) (*keepa.Response, error) {
+	return client.doRequestWithPriority(ctx, url, requiredTokens, method, queryParam, PriorityInteractive)
+}
+
+// doRequestWithPriority is doRequest for requests of the given priority, see requestScheduler.
+// Rate limits, network errors, timeouts and transient 5xx responses are retried as the
+// keepa retry policy allows. Requests and waits end early once ctx is done. Requests
+// of a tenant draw from the tenant's token bucket.
+func (client *KeepaClient) doRequestWithPriority(ctx context.Context, url string, requiredTokens int, method string, queryParam map[string]interface{}, priority int) (*keepa.Response, error) {
+	client = client.forContext(ctx)
+	if err := awaitKeepaCircuit(ctx, priority); err != nil {
+		return nil, err
+	}
+
+	// Estimate token consumption and wait until it is available
+	client.waitForTokens(requiredTokens, 0, priority)
+
+	var body interface{}
+	if method == "POST" {
+		body = queryParam
+	}
+
+	// Retry logic, configured by the keepa retry policy
+	policy := retryPolicyFor(DependencyKeepa)
+	startedAt := time.Now()
+	endpoint := keepaEndpoint(url)
+
+	// backOff waits before retrying a failed attempt. It returns err when the policy
+	// does not retry it, and the aborted wait's error when ctx is done.
+	backOff := func(attempt int, err error) error {
+		wait := policy.Delay(attempt)
+		if !policy.Retries(retryErrorClass(err)) || !policy.AllowsRetry(attempt, startedAt, wait) {
+			return err
+		}
+		client.Logger.WarnContext(ctx, "Retrying Keepa request after error",
+			"endpoint", endpoint, "attempt", attempt, "max_attempts", policy.MaxAttempts, "wait_seconds", wait.Seconds(), "error", err)
+		if waitErr := tokenWaits.sleepContext(ctx, WaitReasonRetryBackoff, DependencyKeepa, wait); waitErr != nil {
+			return fmt.Errorf("%v (retry aborted: %v)", err, waitErr)
+		}
+		return awaitKeepaCircuit(ctx, priority)
+	}
+
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		client.Logger.DebugContext(ctx, "Sending Keepa request", "endpoint", endpoint, "attempt", attempt, "max_attempts", policy.MaxAttempts)
+		sentAt := time.Now()
+
+		reply, err := client.API.Send(ctx, method, url, body)
+		if reply == nil {
+			if ctx.Err() != nil {
+				// The caller gave up, which says nothing about Keepa's health
+				keepaBreaker.abandon()
+				return nil, fmt.Errorf("HTTP request aborted: %v", ctx.Err())
+			}
+			var retryable *keepa.RetryableError
+			if !errors.As(err, &retryable) {
+				keepaBreaker.abandon()
+				return nil, err
+			}
+			keepaBreaker.record(true)
+			client.Logger.WarnContext(ctx, "Keepa request failed", "endpoint", endpoint, LogKeyLatency, time.Since(sentAt).Milliseconds(), "error", err)
+			if err := backOff(attempt, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Rate limits and client errors say nothing about Keepa's health
+		keepaBreaker.record(reply.StatusCode >= 500)
+
+		if errors.Is(err, keepa.ErrMalformedResponse) {
+			client.Logger.ErrorContext(ctx, "Failed to parse response", "endpoint", endpoint, "status", reply.StatusCode, "error", err)
+			return nil, newTaskError(ErrClassParse, err)
+		}
+
+		// Check status code
+		if reply.StatusCode == http.StatusTooManyRequests { // 429
+			apiResp := reply.Response
+
+			// Update token state
+			client.setTokenState(apiResp)
+			client.Logger.WarnContext(ctx, "Keepa rate limited the request",
+				"endpoint", endpoint, "attempt", attempt, "max_attempts", policy.MaxAttempts,
+				LogKeyTokensLeft, apiResp.TokensLeft, "refill_in_ms", apiResp.RefillIn, LogKeyLatency, time.Since(sentAt).Milliseconds())
+
+			// Backoff: wait time = base wait time + policy backoff
+			baseWaitSeconds := float64(apiResp.RefillIn) / 1000.0
+			if baseWaitSeconds <= 0 {
+				baseWaitSeconds = client.Tokens.TimeUntil(requiredTokens + client.SafetyThreshold - apiResp.TokensLeft).Seconds()
+			}
+			retryWait := time.Duration(baseWaitSeconds*float64(time.Second)) + policy.Delay(attempt)
+
+			// Return error if max attempts or elapsed time are reached or the policy does not retry rate limits
+			if !policy.Retries(keepa.RetryOnRateLimited) || !policy.AllowsRetry(attempt, startedAt, retryWait) {
+				client.Logger.ErrorContext(ctx, "Max retries reached after 429 error", "endpoint", endpoint)
+				go sendThrottledNotification("tokens_exhausted", 15*time.Minute, "tokens_exhausted", "critical", "Keepa requests are failing for lack of tokens", map[string]interface{}{
+					"endpoint":     endpoint,
+					"tokens_left":  apiResp.TokensLeft,
+					"refill_in_ms": apiResp.RefillIn,
+				})
+				return nil, newTaskError(ErrClassTokenExhausted, fmt.Errorf("Max retries reached after 429 error"))
+			}
+
+			if err := tokenWaits.sleepContext(ctx, WaitReasonRateLimited, DependencyKeepa, retryWait); err != nil {
+				return nil, newTaskError(ErrClassTokenExhausted, fmt.Errorf("Rate limited, retry aborted: %v", err))
+			}
+			if err := awaitKeepaCircuit(ctx, priority); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Handle non-200 status codes, retrying transient server errors
+		if reply.StatusCode != http.StatusOK {
+			var keepaErr *keepa.Error
+			if errors.As(err, &keepaErr) {
+				reportKeepaError(ctx, endpoint, keepaErr)
+			}
+			client.Logger.WarnContext(ctx, "Unexpected Keepa status code",
+				"endpoint", endpoint, "status", reply.StatusCode, LogKeyLatency, time.Since(sentAt).Milliseconds(), "error", err)
+			if err := backOff(attempt, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if reply.Response == nil {
+			client.Logger.ErrorContext(ctx, "Failed to read response body", "endpoint", endpoint, "error", err)
+			return nil, err
+		}
+
+		// Report Keepa fields our models do not decode
+		schemaDrift.inspect(reply.Body)
+		// Keep the payload for backfills before it is simplified
+		rawResponses.archive(ctx, endpoint, reply.Body)
+
+		// Update token state
+		apiResp := reply.Response
+		client.setTokenState(apiResp)
+		atomic.AddInt64(&consumedTokens, int64(apiResp.TokensConsumed))
+		tokenUsage.record(ctx, endpoint, apiResp.TokensConsumed)
+		var keepaErr *keepa.Error
+		if errors.As(err, &keepaErr) {
+			reportKeepaError(ctx, endpoint, keepaErr)
+			client.Logger.WarnContext(ctx, "Keepa rejected the request", "endpoint", endpoint, "type", apiResp.Error.Type, "error", keepaErr)
+			return nil, keepaErr
+		}
+		client.Logger.InfoContext(ctx, "Keepa request completed",
+			"endpoint", endpoint, "attempt", attempt, "tokens_consumed", apiResp.TokensConsumed,
+			LogKeyTokensLeft, apiResp.TokensLeft, "refill_in_ms", apiResp.RefillIn, LogKeyLatency, time.Since(sentAt).Milliseconds())
+		return apiResp, nil
+	}
+
+	return nil, fmt.Errorf("Unexpected error after retries")
+}
+
+// keepaEndpoint returns the path of a Keepa URL for logging, leaving out the API key
+func keepaEndpoint(rawURL string) string {
+	if parsed, err := neturl.Parse(rawURL); err == nil {
+		return parsed.Path
+	}
+	return ""
+}
+
+// FinderResult is the outcome of a Product Finder request
+type FinderResult struct {
+	ASINs          []string
+	TotalResults   int
+	TokensConsumed int
+}
+
+// ProductFinder simulates a Product Finder API request. Concurrent requests for the
+// same query and page size are sent once; the others report no consumed tokens.
+func (client *KeepaClient) ProductFinder(ctx context.Context, domain string, queryParam map[string]interface{}, pageSize int, priority int) (*FinderResult, error) {
+	value, shared, err := coalesce(ctx, "query", finderFlightKey(domain, queryParam, pageSize), func() (interface{}, error) {
+		return client.productFinder(ctx, domain, queryParam, pageSize, priority)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := *value.(*FinderResult)
+	if shared {
+		result.TokensConsumed = 0
+	}
+	return &result, nil
+}
+
+// productFinder sends a Product Finder request
+func (client *KeepaClient) productFinder(ctx context.Context, domain string, queryParam map[string]interface{}, pageSize int, priority int) (*FinderResult, error) {
+	// Estimate token consumption
+	requiredTokens := calculateProductFinderTokens(pageSize)
+	// Construct request URL
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/query?domain=%s&key=%s", domain, apiKey)
+
+	// Send request
+	apiResp, err := client.doRequestWithPriority(ctx, url, requiredTokens, "POST", queryParam, priority)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Product Finder", "domain", domain, "results", len(apiResp.AsinList), "total_results", apiResp.TotalResults,
+		"tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	return &FinderResult{
+		ASINs:          apiResp.AsinList,
+		TotalResults:   apiResp.TotalResults,
+		TokensConsumed: apiResp.TokensConsumed,
+	}, nil
+}
+
+// CategoryLookup fetches up to 10 categories by ID; category 0 returns all root categories
+func (client *KeepaClient) CategoryLookup(ctx context.Context, domain string, categoryIDs []int64) (map[string]keepa.Category, error) {
+	ids := make([]string, 0, len(categoryIDs))
+	for _, id := range categoryIDs {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/category?domain=%s&key=%s&category=%s&parents=0",
+		domain, apiKey, strings.Join(ids, ","))
+
+	// A category request costs 1 token
+	apiResp, err := client.doRequest(ctx, url, 1, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Category Lookup", "domain", domain, "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	return apiResp.Categories, nil
+}
+
+// CategorySearch finds categories whose name contains all words of term
+func (client *KeepaClient) CategorySearch(ctx context.Context, domain, term string) (map[string]keepa.Category, error) {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/search?domain=%s&key=%s&type=category&term=%s",
+		domain, apiKey, neturl.QueryEscape(term))
+
+	// A category search costs 1 token
+	apiResp, err := client.doRequest(ctx, url, 1, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Category Search", "domain", domain, "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	return apiResp.Categories, nil
+}
+
+// maxProductBatch is the largest number of ASINs Keepa accepts per Product Request
+const maxProductBatch = 100
+
+// ProductRequest simulates a Product Request API request
+func (client *KeepaClient) ProductRequest(ctx context.Context, domain, asin string) (*SimplifiedResponse, error) {
+	responses, err := client.requestProducts(ctx, domain, []string{asin}, defaultProductFields, nil, PriorityInteractive)
+	if err != nil {
+		return nil, err
+	}
+	return responses[asin], nil
+}
+
+// ProductRequestBatch requests the ASINs in chunks sized by calculateDynamicBatchSize and
+// returns one simplified response per ASIN mapped with the selected fields; options,
+// if set, override the KEEPA_* request parameters. The requests wait for tokens with
+// the given priority. On error the responses of the chunks
+// fetched so far are returned along with it.
+func (client *KeepaClient) ProductRequestBatch(ctx context.Context, domain string, asins []string, fields productFields, options *ProductOptions, priority int) (map[string]*SimplifiedResponse, error) {
+	responses := make(map[string]*SimplifiedResponse, len(asins))
+	for start := 0; start < len(asins); {
+		end := start + client.calculateDynamicBatchSize(maxProductBatch, options.tokensPerASIN())
+		if end > len(asins) {
+			end = len(asins)
+		}
+		chunk, err := client.requestProducts(ctx, domain, asins[start:end], fields, options, priority)
+		if err != nil {
+			return responses, err
+		}
+		for asin, response := range chunk {
+			responses[asin] = response
+		}
+		start = end
+	}
+	return responses, nil
+}
+
+// requestProducts sends a single Product Request for up to maxProductBatch ASINs.
+// Every requested ASIN gets a response, without products when Keepa returned none
+// or the simplification rules excluded it. The consumed tokens are split evenly.
+// Concurrent identical requests are sent once; the others report no consumed tokens.
+func (client *KeepaClient) requestProducts(ctx context.Context, domain string, asins []string, fields productFields, options *ProductOptions, priority int) (map[string]*SimplifiedResponse, error) {
+	value, shared, err := coalesce(ctx, "product", productFlightKey(domain, asins, fields, options), func() (interface{}, error) {
+		return client.sendProductRequest(ctx, domain, asins, fields, options, priority)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every caller gets its own responses, the products are shared read-only
+	responses := make(map[string]*SimplifiedResponse, len(asins))
+	for asin, response := range value.(map[string]*SimplifiedResponse) {
+		copied := *response
+		if shared {
+			copied.TokensConsumed = 0
+		}
+		responses[asin] = &copied
+	}
+	return responses, nil
+}
+
+// sendProductRequest sends the Product Request of requestProducts
+func (client *KeepaClient) sendProductRequest(ctx context.Context, domain string, asins []string, fields productFields, options *ProductOptions, priority int) (map[string]*SimplifiedResponse, error) {
+	// Estimate token consumption
+	requiredTokens := len(asins) * options.tokensPerASIN()
+
+	// Send request
+	apiResp, err := client.doRequestWithPriority(ctx, productRequestURL(ctx, domain, "asin", strings.Join(asins, ","), options), requiredTokens, "GET", nil, priority)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Product Request", "domain", domain, "asins", len(asins), "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+
+	// Parse the Keepa API response into one response per ASIN
+	responses := make(map[string]*SimplifiedResponse, len(asins))
+	for i, asin := range asins {
+		tokens := apiResp.TokensConsumed / len(asins)
+		if i == 0 {
+			tokens += apiResp.TokensConsumed % len(asins)
+		}
+		responses[asin] = &SimplifiedResponse{Products: make([]SimplifiedProduct, 0), TokensConsumed: tokens}
+	}
+	for _, product := range apiResp.Products {
+		simplifiedProduct, include := simplifyProduct(&product, fields)
+		if !include {
+			client.Logger.InfoContext(ctx, "Product excluded by simplification rules", LogKeyASIN, product.Asin)
+			continue
+		}
+		if response, ok := responses[product.Asin]; ok {
+			response.Products = append(response.Products, simplifiedProduct)
+		}
+	}
+	client.enrichCategories(ctx, domain, apiResp.Products, responseProducts(responses))
+	return responses, nil
+}
+
+// ProductRequestByCode looks up the products of a UPC, EAN or ISBN-13 code. A code can
+// map to several ASINs, each gets its own response; the consumed tokens are split evenly.
+func (client *KeepaClient) ProductRequestByCode(ctx context.Context, domain, code string) (map[string]*SimplifiedResponse, error) {
+	// A code costs 1 token per matched product, estimate a single match
+	apiResp, err := client.doRequest(ctx, productRequestURL(ctx, domain, "code", code, nil), calculateProductRequestTokens(1), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Product Request by code", "code", code, "products", len(apiResp.Products),
+		"tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+
+	responses := make(map[string]*SimplifiedResponse, len(apiResp.Products))
+	for i, product := range apiResp.Products {
+		tokens := apiResp.TokensConsumed / len(apiResp.Products)
+		if i == 0 {
+			tokens += apiResp.TokensConsumed % len(apiResp.Products)
+		}
+		response := &SimplifiedResponse{Products: make([]SimplifiedProduct, 0), TokensConsumed: tokens}
+		if simplifiedProduct, include := simplifyProduct(&product, defaultProductFields); include {
+			response.Products = append(response.Products, simplifiedProduct)
+		} else {
+			client.Logger.InfoContext(ctx, "Product excluded by simplification rules", LogKeyASIN, product.Asin)
+		}
+		responses[product.Asin] = response
+	}
+	client.enrichCategories(ctx, domain, apiResp.Products, responseProducts(responses))
+	return responses, nil
+}
+
+// productRequestURL builds a Product Request URL of a domain selecting products by param
+// ("asin" or "code") with the KEEPA_* request options, overridden by options when set
+func productRequestURL(ctx context.Context, domain, param, value string, options *ProductOptions) string {
+	apiKey := keepaAPIKey(ctx)
+	params := options.params()
+	codeLimit := getEnv("KEEPA_CODE_LIMIT", "10")
+	rental := getEnv("KEEPA_RENTAL", "0")
+	videos := getEnv("KEEPA_VIDEOS", "0")
+	aplus := getEnv("KEEPA_APLUS", "0")
+
+	// Construct request URL
+	return fmt.Sprintf("https://api.keepa.com/product?domain=%s&key=%s&%s=%s&stats=%s&update=%s&history=%s&days=%s&code-limit=%s&offers=%s&only-live-offers=%s&rental=%s&videos=%s&aplus=%s&rating=%s&buybox=%s&stock=%s",
+		domain, apiKey, param, value, params["stats"], params["update"], params["history"], params["days"], codeLimit, params["offers"], params["only-live-offers"], rental, videos, aplus, params["rating"], params["buybox"], params["stock"])
+}
+
+// ASINResult describes how a single ASIN was processed
+type ASINResult struct {
+	Product        *SimplifiedResponse
+	CacheHit       bool
+	TokensConsumed int
+}
+
+// processASIN runs the Product Request -> Redis -> Firestore pipeline for one ASIN.
+// When useCache is set a cached Redis entry is stored instead of calling Keepa.
+// The product is part of the result even when a later pipeline step failed.
+func (client *KeepaClient) processASIN(ctx context.Context, taskID, domain, asin string, useCache bool) (ASINResult, error) {
+	results, errs := client.processASINBatch(ctx, taskID, domain, []string{asin}, useCache, nil)
+	return results[0], errs[0]
+}
+
+// processASINBatch runs the pipeline of processASIN for several ASINs of a domain,
+// fetching all cache misses with one batched Product Request. matchedCategories, if set, lists the
+// task categories per ASIN to annotate the stored documents with. All products are
+// written to Firestore in one bulk write. The results and errors are aligned with asins.
+// The products are fetched and stored for the tenant of ctx, even after ctx ended.
+func (client *KeepaClient) processASINBatch(ctx context.Context, taskID, domain string, asins []string, useCache bool, matchedCategories map[string][]string) (results []ASINResult, errs []error) {
+	// Create a context with timeout
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Minute)
+	defer cancel()
+
+	results = make([]ASINResult, len(asins))
+	errs = make([]error, len(asins))
+	fields := taskProductFields(taskID)
+	options := taskProductOptions(taskID)
+
+	// Written once all products of the batch are known
+	store := newProductBatchWriter(ctx, taskID, domain)
+	cacheErrs := make([]error, len(asins))
+	defer func() {
+		storeErrs := store.flush()
+		for i, asin := range asins {
+			if results[i].Product == nil {
+				continue
+			}
+			if err, failed := storeErrs[asin]; failed {
+				errs[i] = classifyStepError(ctx, ErrClassStore, err)
+			} else {
+				errs[i] = cacheErrs[i]
+			}
+		}
+	}()
+
+	// Try to get data from Redis first. The cache holds products fetched with the
+	// deployment parameters.
+	misses := asins
+	if useCache && options == nil {
+		cached, _, err := getProductsFromRedis(ctx, domain, asins)
+		if err != nil {
+			client.Logger.WarnContext(ctx, "Failed to read cached products", LogKeyTaskID, taskID, "error", err)
+		}
+		misses = nil
+		for i, asin := range asins {
+			// A cached copy mapped with fewer field groups than requested is a miss
+			if product, ok := cached[asin]; ok && (len(product.Products) == 0 || fields.coveredBy(product.Products[0].Fields)) {
+				results[i] = ASINResult{Product: product, CacheHit: true}
+				store.add(asin, product, matchedCategories[asin])
+				continue
+			}
+			misses = append(misses, asin)
+		}
+	}
+	if len(misses) == 0 {
+		return results, errs
+	}
+
+	// Call Product Request for the cache misses. The tokens are booked on the first
+	// category that matched, which is the category of the finder page being processed.
+	category := ""
+	if matched := matchedCategories[misses[0]]; len(matched) > 0 {
+		category = matched[0]
+	}
+	products, requestErr := client.ProductRequestBatch(withTokenUsageScope(ctx, taskID, category), domain, misses, fields, options, requestPriorityFor(taskID))
+	for i, asin := range asins {
+		if results[i].CacheHit {
+			continue
+		}
+		product, ok := products[asin]
+		if !ok {
+			err := requestErr
+			if err == nil {
+				err = fmt.Errorf("no response")
+			}
+			errs[i] = newTaskError(classifyError(err), fmt.Errorf("failed to retrieve data for ASIN %s: %v", asin, err))
+			continue
+		}
+		results[i] = ASINResult{Product: product, TokensConsumed: product.TokensConsumed}
+		cacheErrs[i] = client.cacheProduct(ctx, taskID, domain, asin, product)
+		store.add(asin, product, matchedCategories[asin])
+	}
+	return results, errs
+}
+
+// cacheProduct saves a fetched product to Redis, returning the classified error
+func (client *KeepaClient) cacheProduct(ctx context.Context, taskID, domain, asin string, product *SimplifiedResponse) error {
+	if err := saveProductToRedis(ctx, domain, asin, product); err != nil {
+		client.Logger.WarnContext(ctx, "Failed to save data to Redis", LogKeyTaskID, taskID, LogKeyASIN, asin, "error", err)
+		return classifyStepError(ctx, ErrClassCache, fmt.Errorf("failed to save data to Redis for ASIN %s: %v", asin, err))
+	}
+	return nil
+}
+
+// storeProduct saves a fetched product of a domain to Redis and Firestore
+func (client *KeepaClient) storeProduct(ctx context.Context, taskID, domain, asin string, product *SimplifiedResponse, matchedCategories []string) error {
+	cacheErr := client.cacheProduct(ctx, taskID, domain, asin, product)
+	if err := firestoreFunction(ctx, taskID, domain, asin, product, matchedCategories); err != nil {
+		return classifyStepError(ctx, ErrClassStore, err)
+	}
+	return cacheErr
+}
+
+// classifyStepError tags a pipeline step error with its class, or timeout when ctx expired
+func classifyStepError(ctx context.Context, class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return newTaskError(ErrClassTimeout, err)
+	}
+	return newTaskError(class, err)
+}
+
+// handleFetchProducts handles Product Finder and Product Request requests. With
+// ?dryRun=true it only estimates the token cost, see handleEstimate.
+func (client *KeepaClient) handleFetchProducts(c *gin.Context) {
+	specs, callbackURL, ok := parseFetchRequest(c)
+	if !ok {
+		return
+	}
+	if c.Query("dryRun") == "true" {
+		client.respondWithEstimate(c, specs)
+		return
+	}
+
+	// A retried request with the same Idempotency-Key gets the tasks of the first one
+	started, err := client.startFetchTasks(c.Request.Context(), specs, callbackURL, c.GetHeader("Idempotency-Key"))
+	if len(specs) > 1 {
+		if err != nil {
+			respondServiceError(c, err, gin.H{"tasks": started})
+			return
+		}
+		estimatedTokens := 0
+		for _, task := range started {
+			estimatedTokens += task.EstimatedTokens
+		}
+		c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{"tasks": started, "estimated_tokens": estimatedTokens}))
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	task := started[0]
+	if task.Replayed {
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(http.StatusOK, withQuotaWarning(gin.H{"task_id": task.TaskID, "status": task.Status}))
+		return
+	}
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{"task_id": task.TaskID, "status": task.Status, "estimated_tokens": task.EstimatedTokens}))
+}
+
+// startFetchTask creates a fetch task of the tenant of ctx and queues it, or an ASIN task for the ASINs of
+// a watchlist. scheduleID names the schedule that started it, if any. It returns
+// false, failing the task, when the task queue is full.
+func (client *KeepaClient) startFetchTask(ctx context.Context, taskID string, spec *FetchTaskSpec, callbackURL, scheduleID string) bool {
+	run := func() { client.runFetchTask(taskID, spec) }
+	if len(spec.ASINs) > 0 {
+		tasks.create(ctx, taskID, TaskKindASINs)
+		tasks.addASINs(taskID, spec.ASINs)
+		run = func() { client.runASINTask(taskID, spec.ASINs, false) }
+	} else {
+		tasks.create(ctx, taskID, TaskKindFetch)
+	}
+	tasks.update(taskID, func(task *Task) {
+		task.Categories = spec.Categories
+		task.CategoryProgress = newCategoryProgress(spec.Categories)
+		task.Spec = spec
+		task.CallbackURL = callbackURL
+		task.ScheduleID = scheduleID
+		task.Domain = spec.Domain
+	})
+	if !enqueueTask(run) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		return false
+	}
+	return true
+}
+
+// parseFetchRequest builds the task specs of a POST /keepa body, one per domain when
+// the body lists "domains", otherwise a single one. It answers 400 and returns false
+// when the body is invalid, invalid_query when its query is.
+func parseFetchRequest(c *gin.Context) ([]*FetchTaskSpec, string, bool) {
+	// Parse JSON data from the request
+	var requestData map[string]interface{}
+	if !bindJSON(c, &requestData) {
+		return nil, "", false
+	}
+	specs, callbackURL, err := parseFetchSpecs(c.Request.Context(), requestData, c.Query("fields"))
+	if err != nil {
+		respondServiceError(c, err)
+		return nil, "", false
+	}
+	return specs, callbackURL, true
+}
+
+// buildFetchSpec builds the task spec and callback URL of a POST /keepa body.
+// fieldsQuery is the ?fields= value, used when the body has no include list.
+func buildFetchSpec(ctx context.Context, requestData map[string]interface{}, fieldsQuery string) (*FetchTaskSpec, string, error) {
+	pageSize, _ := strconv.Atoi(getEnv("KEEPA_PAGE_SIZE", "50"))
+
+	// The marketplace scanned, by Keepa domain ID or name; POST /keepa splits "domains"
+	// into one spec per domain before it gets here
+	if _, ok := requestData["domains"]; ok {
+		return nil, "", fmt.Errorf("domains is only supported by POST /keepa; use domain")
+	}
+	var rawDomain string
+	if value, ok := requestData["domain"]; ok {
+		rawDomain = fmt.Sprint(value)
+	}
+	domain, err := parseDomain(rawDomain)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid domain: %v", err)
+	}
+	delete(requestData, "domain")
+
+	// Get Keepa API URL and credentials from environment variables
+
+	categoryList := getEnv("KEEPA_CATEGORY", "1055398;3760901;3760911;16310101;165796011;2619533011;3375251;228013;1064954;172282")
+	categoryListArr := strings.Split(categoryList, ";")
+
+	// The caller may select the root categories by ID instead of KEEPA_CATEGORY
+	if rawCategories, ok := requestData["categories"]; ok {
+		categories, err := parseCategoryIDs(rawCategories)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid categories: %v", err)
+		}
+		if _, ok := requestData["categoryNames"]; ok {
+			return nil, "", fmt.Errorf("Use either categories or categoryNames")
+		}
+		categoryListArr = categories
+	}
+	delete(requestData, "categories")
+
+	// Number of ASINs per finder page, Keepa accepts 50 to 10000
+	if value, ok := requestData["pageSize"]; ok {
+		size, isNumber := value.(float64)
+		if !isNumber || size != float64(int(size)) || size < 50 || size > 10000 {
+			return nil, "", fmt.Errorf("Invalid pageSize: must be an integer between 50 and 10000")
+		}
+		pageSize = int(size)
+	}
+	delete(requestData, "pageSize")
+
+	// Resolve category names to IDs when the caller selects categories by name
+	if rawNames, ok := requestData["categoryNames"].([]interface{}); ok && len(rawNames) > 0 {
+		names := make([]string, 0, len(rawNames))
+		for _, rawName := range rawNames {
+			names = append(names, fmt.Sprint(rawName))
+		}
+		ids, err := resolveCategoryNames(ctx, domain, names)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid categoryNames: %v", err)
+		}
+		categoryListArr = ids
+	}
+	delete(requestData, "categoryNames")
+
+	// Number of finder pages scanned per category (deep scans use more than one), capped
+	// by KEEPA_MAX_PAGES_LIMIT so one task cannot drain the token budget
+	maxPagesLimit := envInt("KEEPA_MAX_PAGES_LIMIT", 100)
+	maxPages, _ := strconv.Atoi(getEnv("KEEPA_MAX_PAGES", "1"))
+	maxPages = min(maxPages, maxPagesLimit)
+	if value, ok := requestData["maxPages"]; ok {
+		pages, isNumber := value.(float64)
+		if !isNumber || pages != float64(int(pages)) || pages < 1 || pages > float64(maxPagesLimit) {
+			return nil, "", fmt.Errorf("Invalid maxPages: must be an integer between 1 and %d", maxPagesLimit)
+		}
+		maxPages = int(pages)
+	}
+	delete(requestData, "maxPages")
+
+	// An optional callback URL is notified when the task finishes
+	callbackURL, _ := requestData["callback_url"].(string)
+	if callbackURL != "" {
+		if err := validateCallbackURL(callbackURL); err != nil {
+			return nil, "", fmt.Errorf("Invalid callback_url: %v", err)
+		}
+	}
+	delete(requestData, "callback_url")
+
+	// The opportunities scan mode looks for discounted used and warehouse deal offers
+	scanOpportunities := requestData["scanMode"] == "opportunities"
+	delete(requestData, "scanMode")
+
+	// The include list (or ?fields=) selects the field groups mapped into the products
+	var fieldNames []string
+	if rawFields, ok := requestData["include"].([]interface{}); ok {
+		for _, rawField := range rawFields {
+			fieldNames = append(fieldNames, fmt.Sprint(rawField))
+		}
+	} else if fieldsQuery != "" {
+		fieldNames = strings.Split(fieldsQuery, ",")
+	}
+	fields, err := parseProductFields(fieldNames)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid include: %v", err)
+	}
+	delete(requestData, "include")
+
+	// The options object overrides the KEEPA_* Product Request parameters of this task
+	var options *ProductOptions
+	if rawOptions, ok := requestData["options"]; ok {
+		options, err = decodeProductOptions(rawOptions)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid options: %v", err)
+		}
+	}
+	delete(requestData, "options")
+
+	// A watchlist selects its members instead of a finder query
+	watchlistID, _ := requestData["watchlist"].(string)
+	delete(requestData, "watchlist")
+	var watchlistASINs []string
+	if watchlistID != "" {
+		watchlistASINs, err = applyWatchlist(ctx, watchlistID, requestData)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid watchlist: %v", err)
+		}
+	}
+	if len(watchlistASINs) > 0 {
+		return &FetchTaskSpec{
+			Domain:    domain,
+			ASINs:     watchlistASINs,
+			Watchlist: watchlistID,
+			Fields:    fields.list(),
+			Options:   options,
+		}, callbackURL, nil
+	}
+
+	// What is left is the finder selection; typos would silently match nothing
+	query, err := parseFinderQuery(requestData)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid query: %v", err)
+	}
+
+	spec := &FetchTaskSpec{
+		Domain:            domain,
+		Categories:        categoryListArr,
+		Query:             query,
+		PageSize:          pageSize,
+		MaxPages:          maxPages,
+		ScanOpportunities: scanOpportunities,
+		Fields:            fields.list(),
+		Options:           options,
+		Watchlist:         watchlistID,
+	}
+	return spec, callbackURL, nil
+}
+
+// Generate a unique Task ID for each request
+func generateTaskID() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"errors"
+	"time"
+)
+
+// reportKeepaError alerts on errors that stop every request until someone acts:
+// a rejected API key or a missing payment
+func reportKeepaError(ctx context.Context, endpoint string, err *keepa.Error) {
+	if !errors.Is(err, keepa.ErrInvalidKey) && !errors.Is(err, keepa.ErrPaymentRequired) {
+		return
+	}
+	go sendThrottledNotification("keepa_account:"+tenantID(ctx), 15*time.Minute, "keepa_account", "critical", "Keepa rejects the account: "+err.Error(), map[string]interface{}{
+		"endpoint": endpoint,
+		"tenant":   tenantID(ctx),
+		"type":     err.Payload.Type,
+		"status":   err.StatusCode,
+	})
+}
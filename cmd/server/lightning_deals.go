@@ -0,0 +1,153 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepatime"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LightningDealRedisKeyPrefix prefixes the cached lightning deal lists, keyed by domain
+const LightningDealRedisKeyPrefix = "keepa:lightningdeals:"
+
+// SimplifiedLightningDeal is a lightning deal with its times converted from Keepa time
+type SimplifiedLightningDeal struct {
+	Asin           string    `json:"asin"`
+	Title          string    `json:"title"`
+	DealID         string    `json:"dealId"`
+	SellerID       string    `json:"sellerId"`
+	SellerName     string    `json:"sellerName"`
+	RootCategory   int64     `json:"rootCategory,omitempty"`
+	DealPrice      int       `json:"dealPrice"`
+	CurrentPrice   int       `json:"currentPrice"`
+	PercentClaimed int       `json:"percentClaimed"`
+	State          string    `json:"state"`
+	IsPrime        bool      `json:"isPrime"`
+	IsFBA          bool      `json:"isFBA"`
+	StartTime      time.Time `json:"startTime"`
+	EndTime        time.Time `json:"endTime"`
+}
+
+// LightningDeals fetches the lightning deals of a domain, or only the deal of asin
+// when it is set. The full list costs 500 tokens, a single ASIN 1.
+func (client *KeepaClient) LightningDeals(ctx context.Context, domain, asin string) ([]SimplifiedLightningDeal, error) {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/lightningdeal?domain=%s&key=%s", domain, apiKey)
+	requiredTokens := 500
+	if asin != "" {
+		url += "&asin=" + asin
+		requiredTokens = 1
+	}
+
+	apiResp, err := client.doRequest(ctx, url, requiredTokens, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	client.Logger.InfoContext(ctx, "Lightning Deals", "domain", domain, "deals", len(apiResp.LightningDeals), "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+
+	deals := make([]SimplifiedLightningDeal, 0, len(apiResp.LightningDeals))
+	for _, deal := range apiResp.LightningDeals {
+		deals = append(deals, SimplifiedLightningDeal{
+			Asin:           deal.Asin,
+			Title:          deal.Title,
+			DealID:         deal.DealID,
+			SellerID:       deal.SellerID,
+			SellerName:     deal.SellerName,
+			RootCategory:   deal.RootCat,
+			DealPrice:      deal.DealPrice,
+			CurrentPrice:   deal.CurrentPrice,
+			PercentClaimed: deal.PercentClaimed,
+			State:          deal.DealState,
+			IsPrime:        deal.IsPrimeEligible,
+			IsFBA:          deal.IsFBA,
+			StartTime:      keepatime.ToTime(deal.StartTime),
+			EndTime:        keepatime.ToTime(deal.EndTime),
+		})
+	}
+	return deals, nil
+}
+
+// cachedLightningDeals returns the full lightning deal list of a domain, fetching it
+// from Keepa when the tenant of ctx has not cached it
+func (client *KeepaClient) cachedLightningDeals(ctx context.Context, domain string) ([]SimplifiedLightningDeal, bool, error) {
+	key := tenantRedisKey(ctx, LightningDealRedisKeyPrefix+domain)
+	var data []byte
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		data, err = redisClient.Get(ctx, key).Bytes()
+		return err
+	})
+	if err == nil {
+		var deals []SimplifiedLightningDeal
+		if err := json.Unmarshal(data, &deals); err == nil {
+			return deals, true, nil
+		}
+	}
+
+	deals, err := client.LightningDeals(ctx, domain, "")
+	if err != nil {
+		return nil, false, err
+	}
+	data, _ = json.Marshal(deals)
+	err = withRetry(ctx, DependencyRedis, func() error {
+		return redisClient.Set(ctx, key, data, cacheTTL(CacheTypeLightningDeal)).Err()
+	})
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to cache lightning deals", "domain", domain, "error", err)
+	}
+	return deals, false, nil
+}
+
+// handleLightningDeals returns lightning deals. ?asin looks up a single product,
+// otherwise the cached domain list is filtered by ?category (comma-separated root
+// category IDs, default KEEPA_CATEGORY) and ?state (comma-separated deal states).
+func (client *KeepaClient) handleLightningDeals(c *gin.Context) {
+	domain := c.DefaultQuery("domain", getEnv("KEEPA_DOMAIN", "1"))
+	if asin := c.Query("asin"); asin != "" {
+		deals, err := client.LightningDeals(c.Request.Context(), domain, asin)
+		if err != nil {
+			respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, withQuotaWarning(gin.H{"domain": domain, "lightning_deals": deals}))
+		return
+	}
+
+	categories := make(map[int64]bool)
+	for _, id := range strings.FieldsFunc(c.DefaultQuery("category", getEnv("KEEPA_CATEGORY", "")), func(r rune) bool { return r == ',' || r == ';' }) {
+		categoryID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid category %q", id))
+			return
+		}
+		categories[categoryID] = true
+	}
+	states := make(map[string]bool)
+	for _, state := range strings.Split(c.Query("state"), ",") {
+		if state = strings.ToUpper(strings.TrimSpace(state)); state != "" {
+			states[state] = true
+		}
+	}
+
+	deals, cached, err := client.cachedLightningDeals(c.Request.Context(), domain)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	matches := make([]SimplifiedLightningDeal, 0)
+	for _, deal := range deals {
+		if len(categories) > 0 && !categories[deal.RootCategory] {
+			continue
+		}
+		if len(states) > 0 && !states[deal.State] {
+			continue
+		}
+		matches = append(matches, deal)
+	}
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"domain": domain, "lightning_deals": matches, "cached": cached}))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bodyLimitMiddleware caps inbound request bodies: JSON bodies at MAX_JSON_BODY_BYTES
+// and multipart uploads at MAX_UPLOAD_BYTES
+func bodyLimitMiddleware() gin.HandlerFunc {
+	maxJSONBytes, _ := strconv.ParseInt(getEnv("MAX_JSON_BODY_BYTES", "1048576"), 10, 64)
+	maxUploadBytes, _ := strconv.ParseInt(getEnv("MAX_UPLOAD_BYTES", "10485760"), 10, 64)
+
+	return func(c *gin.Context) {
+		limit := maxJSONBytes
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			limit = maxUploadBytes
+		}
+		if c.Request.ContentLength > limit {
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the limit of %d bytes", limit))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// isBodyTooLarge reports whether err was caused by exceeding the body limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// bindJSON binds the request body, answering 413 or 400 on failure
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	if err := c.ShouldBindJSON(obj); err != nil {
+		if isBodyTooLarge(err) {
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body too large: %v", err))
+			return false
+		}
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request data: %v", err))
+		return false
+	}
+	return true
+}
+
+// streamUploadLines reads the named multipart file part line by line without
+// buffering the whole upload, calling fn with the 1-based row number of each
+// non-empty line. A plain text body is accepted as well.
+func streamUploadLines(c *gin.Context, field string, fn func(row int, line string) error) error {
+	var reader io.Reader = c.Request.Body
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") {
+		multipartReader, err := c.Request.MultipartReader()
+		if err != nil {
+			return fmt.Errorf("invalid multipart upload: %w", err)
+		}
+		for {
+			part, err := multipartReader.NextPart()
+			if err == io.EOF {
+				return fmt.Errorf("multipart upload has no %q file", field)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read multipart upload: %w", err)
+			}
+			if part.FormName() == field {
+				reader = part
+				break
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(reader)
+	row := 0
+	for scanner.Scan() {
+		row++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := fn(row, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	return nil
+}
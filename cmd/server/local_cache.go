@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"sync"
+	"time"
+)
+
+// Cache layers and lookup results reported by the keepa.cache.lookups metric
+const (
+	CacheLayerLocal = "local"
+	CacheLayerRedis = "redis"
+
+	CacheResultHit   = "hit"
+	CacheResultStale = "stale" // Expired local entry served because Redis failed
+	CacheResultMiss  = "miss"
+	CacheResultError = "error"
+)
+
+// localCacheEntry is one cached value with the time it was stored
+type localCacheEntry struct {
+	key      string
+	data     []byte
+	storedAt time.Time
+	maxAge   time.Duration // Age after which the entry is no longer served, even as a fallback
+}
+
+// localCache is a size-bounded in-process LRU. Entries are fresh for ttl; older ones
+// stay until evicted and are only served by stale when Redis cannot be reached.
+type localCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int
+	ttl        time.Duration
+	bytes      int
+	order      *list.List // Most recently used first
+	items      map[string]*list.Element
+}
+
+// productLocalCache is the L1 cache of products in front of Redis, configured by
+// LOCAL_CACHE_MAX_ENTRIES (10000), LOCAL_CACHE_MAX_BYTES (67108864) and LOCAL_CACHE_TTL (5m)
+var productLocalCache = newLocalCache(
+	envInt("LOCAL_CACHE_MAX_ENTRIES", 10000),
+	envInt("LOCAL_CACHE_MAX_BYTES", 64<<20),
+	envDuration("LOCAL_CACHE_TTL", 5*time.Minute),
+)
+
+// newLocalCache creates an empty cache
+func newLocalCache(maxEntries, maxBytes int, ttl time.Duration) *localCache {
+	return &localCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// get returns a fresh entry
+func (c *localCache) get(key string) ([]byte, bool) {
+	return c.lookup(key, c.ttl)
+}
+
+// stale returns an entry up to the maxAge it was stored with, for when Redis fails
+func (c *localCache) stale(key string) ([]byte, bool) {
+	return c.lookup(key, 0)
+}
+
+// lookup returns an entry younger than maxAge, or than its own maxAge when 0
+func (c *localCache) lookup(key string, maxAge time.Duration) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*localCacheEntry)
+	age := time.Since(entry.storedAt)
+	if age >= entry.maxAge {
+		c.remove(element)
+		return nil, false
+	}
+	if maxAge > 0 && age >= maxAge {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return entry.data, true
+}
+
+// set stores data, usable as a fallback for maxAge, evicting the least recently used
+// entries beyond the size bounds. Values larger than a quarter of maxBytes are not cached.
+func (c *localCache) set(key string, data []byte, maxAge time.Duration) {
+	if len(data) > c.maxBytes/4 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	c.items[key] = c.order.PushFront(&localCacheEntry{key: key, data: data, storedAt: time.Now(), maxAge: maxAge})
+	c.bytes += len(data)
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// delete removes an entry
+func (c *localCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+}
+
+// age returns how long ago an entry was stored, if it is still held
+func (c *localCache) age(key string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return 0, false
+	}
+	return time.Since(element.Value.(*localCacheEntry).storedAt), true
+}
+
+// deleteMatching removes the entries whose key matches and returns how many it removed
+func (c *localCache) deleteMatching(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deleted := 0
+	for key, element := range c.items {
+		if match(key) {
+			c.remove(element)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// remove drops an element. The caller must hold mu.
+func (c *localCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*localCacheEntry)
+	delete(c.items, entry.key)
+	c.bytes -= len(entry.data)
+}
+
+// cacheLookups counts cache lookups per layer and result
+var cacheLookups, _ = otel.Meter("Keepa-api").Int64Counter("keepa.cache.lookups",
+	metric.WithDescription("Product cache lookups by layer (local, redis) and result (hit, stale, miss, error)"))
+
+// recordCacheLookup counts one lookup of a layer
+func recordCacheLookup(ctx context.Context, layer, result string) {
+	cacheLookups.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("cache.layer", layer),
+		attribute.String("cache.result", result),
+	))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log attribute keys shared by all lines, so Cloud Logging can filter on them
+const (
+	LogKeyRequestID  = "request_id"
+	LogKeyTaskID     = "task_id"
+	LogKeyASIN       = "asin"
+	LogKeyCategory   = "category"
+	LogKeyTokensLeft = "tokens_left"
+	LogKeyLatency    = "latency_ms"
+	LogKeyComponent  = "component"
+)
+
+// RequestIDHeader carries the request ID from the caller and back in the response
+const RequestIDHeader = "X-Request-ID"
+
+// logLevels maps LOG_LEVEL values to slog levels
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"warn":    slog.LevelWarn,
+	"warning": slog.LevelWarn,
+	"error":   slog.LevelError,
+}
+
+// logger is the process-wide structured logger writing JSON lines to logOutput at
+// LOG_LEVEL (info). It is also the slog default, so the log package writes through it.
+var logger = newLogger()
+
+// logOutput is stdout for the server, where Cloud Logging collects the lines, and
+// stderr when a CLI command of cliCommands runs, as its results go to stdout
+func logOutput() io.Writer {
+	for _, arg := range os.Args[1:] {
+		if containsString(cliCommands, arg) {
+			return os.Stderr
+		}
+	}
+	return os.Stdout
+}
+
+// logLevel is the level of logger, changed by config reloads
+var logLevel = new(slog.LevelVar)
+
+// setLogLevel applies LOG_LEVEL
+func setLogLevel() {
+	level, ok := logLevels[strings.ToLower(getEnv("LOG_LEVEL", "info"))]
+	if !ok {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+}
+
+// newLogger creates the JSON logger and installs it as the slog default
+func newLogger() *slog.Logger {
+	setLogLevel()
+	handler := slog.NewJSONHandler(logOutput(), &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       logLevel,
+		ReplaceAttr: cloudLoggingAttr,
+	})
+	l := slog.New(contextHandler{handler})
+	slog.SetDefault(l)
+	return l
+}
+
+// cloudLoggingAttr renames the level and message keys to the ones Cloud Logging
+// recognizes, so severity filters work on the parsed JSON payload
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		level, _ := a.Value.Any().(slog.Level)
+		severity := level.String()
+		if level == slog.LevelWarn {
+			severity = "WARNING"
+		}
+		return slog.String("severity", severity)
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// logAttrsKey stores the attributes added to every line logged with a context
+type logAttrsKey struct{}
+
+// withLogAttrs returns a copy of ctx whose log lines carry attrs in addition to
+// the ones ctx already carries
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(append(combined, existing...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// contextHandler adds the attributes of withLogAttrs to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return generateTaskID()
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestLoggingMiddleware assigns every request an ID, taken from X-Request-ID when
+// the caller sent one, echoes it in the response and attaches it to all lines logged
+// with the request context. It replaces gin's text access log with a JSON line.
+func requestLoggingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		c.Header(RequestIDHeader, requestID)
+		ctx := withLogAttrs(c.Request.Context(), slog.String(LogKeyRequestID, requestID))
+		c.Request = c.Request.WithContext(ctx)
+
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.LogAttrs(ctx, level, "Request handled",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", c.Writer.Status()),
+			slog.Int64(LogKeyLatency, time.Since(start).Milliseconds()),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
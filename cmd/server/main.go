@@ -0,0 +1,377 @@
+package main
+
+import (
+	"Keepa-api/internal/storage"
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Add these constants for Redis
+const (
+	// ... existing constants
+	RedisKeyPrefix = "keepa:product:" // Followed by the domain and the ASIN, see productCacheKey
+)
+
+// redisClient is the single-node, cluster or sentinel client selected by REDIS_MODE
+var redisClient redis.UniversalClient
+
+// Add Firestore client as a global variable
+var firestoreClient *firestore.Client
+
+// jobScheduler runs recurring jobs within the daily token budget
+var jobScheduler *budgetScheduler
+
+func init() {
+	// Configure Redis options
+	ctx := context.Background()
+
+	// CONFIG_FILE and the environment were read before init, refuse to start on errors
+	if configs.err != nil {
+		logger.Error("Failed to load configuration", "error", configs.err)
+		os.Exit(1)
+	}
+	if err := loadSimplificationRules(); err != nil {
+		logger.Error("Failed to load simplification rules", "error", err)
+		os.Exit(1)
+	}
+	watchConfigReloads()
+
+	projectID := getEnv("PROJECT_ID", "")
+
+	// Load credentials from Secret Manager before connecting to anything
+	startSecrets(ctx)
+	if secret("KEEPA_API_KEY", "") == "" && keepaMode() != KeepaModeMock {
+		logger.Error("KEEPA_API_KEY is not set, Keepa requests will be rejected")
+	}
+
+	// Initialize Redis client
+	tlsConfig, err := redisTLSConfig(ctx)
+	if err != nil {
+		logger.Error("Failed to load the Redis CA, connecting without TLS", "error", err)
+	}
+	mode := redisMode()
+	redisClient = newRedisClient(mode, tlsConfig)
+	logger.Info("Connecting to Redis", "mode", mode)
+
+	// Test Redis connection
+
+	_, _ = redisClient.Ping(ctx).Result()
+
+	// 启动健康检查 goroutine
+	go func() {
+		ticker := time.NewTicker(30 * time.Second) // 每 30 秒检查一次
+		defer ticker.Stop()
+		for range ticker.C {
+			_ = redisClient.Ping(ctx).Err()
+		}
+	}()
+
+	// Initialize the Firestore client and Firebase Auth for ID token verification
+	clients, err := storage.NewFirebase(ctx, projectID)
+	if err != nil {
+		logger.Error("Failed to initialize Firebase", "error", err)
+	}
+	if clients != nil {
+		firestoreClient, authClient = clients.Firestore, clients.Auth
+	}
+
+}
+
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runServer serves the API until the process is stopped
+func runServer() {
+	// Initialize Keepa client
+	client := NewKeepaClient()
+
+	// Start background task runners
+	startTaskRunners()
+
+	// Resume tasks interrupted by the previous shutdown, later those of instances that stopped
+	resumeCtx, cancelResume := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := client.resumeTasks(resumeCtx); err != nil {
+		client.Logger.Error("Failed to resume tasks", "error", err)
+	}
+	cancelResume()
+	go client.watchTaskLeases()
+
+	// Point Keepa tracking notifications at this service
+	go func() {
+		if err := client.registerTrackingWebhook(context.Background()); err != nil {
+			client.Logger.Error("Failed to register the tracking webhook", "error", err)
+		}
+	}()
+
+	// Start the budget-aware scheduler for recurring jobs
+	jobScheduler = newBudgetScheduler(client)
+	client.registerCategorySync(jobScheduler)
+	registerProductCleanup(jobScheduler)
+	client.registerCacheWarmer(jobScheduler)
+	jobScheduler.start()
+
+	// Run the stored cron schedules
+	client.startSchedules()
+
+	// Save the consumed tokens for GET /reports/tokens
+	tokenUsage.start()
+
+	// Initialize Gin router; requests are logged as JSON lines by requestLoggingMiddleware
+	r := gin.New()
+	r.HandleMethodNotAllowed = true
+	if err := configureClientIP(r); err != nil {
+		logger.Error("Failed to configure trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	r.Use(gin.Recovery())
+	r.Use(requestLoggingMiddleware())
+	r.Use(compressionMiddleware())
+	r.Use(problemMiddleware())
+	r.Use(bodyLimitMiddleware())
+	r.Use(tenantMiddleware())
+	r.Use(authMiddleware())
+	r.Use(rateLimitMiddleware())
+	r.Use(quotaWarningMiddleware())
+	r.Use(asinParamMiddleware())
+	r.Use(timeFormatMiddleware())
+
+	// Endpoint: Trigger Product Finder and Product Request
+	r.POST("/keepa", taskLimitMiddleware(), client.handleFetchProducts)
+
+	// Endpoint: Fetch the ASINs of an uploaded CSV or text file, skipping Product Finder
+	r.POST("/keepa/import", taskLimitMiddleware(), client.handleImportASINs)
+
+	// Endpoint: Estimate the token cost of a POST /keepa body without starting a task
+	r.POST("/keepa/estimate", client.handleEstimate)
+
+	// Endpoint: Refresh stored products matching a Firestore query
+	r.POST("/refresh", client.handleRefresh) // Applies the task limits once a task is started
+
+	// Endpoint: List recent tasks
+	r.GET("/tasks", etagMiddleware(), handleListTasks)
+
+	// Endpoint: Task status
+	r.GET("/tasks/:id", etagMiddleware(), handleGetTask)
+
+	// Endpoint: Read results of completed task chunks, ?format=ndjson streams them
+	r.GET("/tasks/:id/results", etagMiddleware(), handleTaskResults)
+	// Endpoint: Download task products as a CSV or XLSX spreadsheet
+	r.GET("/tasks/:id/export", handleTaskExport)
+
+	// Endpoint: Dead-lettered ASINs of a task
+	r.GET("/tasks/:id/failed", handleListFailedASINs)
+
+	// Endpoint: Retry the dead-lettered ASINs of a finished task
+	r.POST("/tasks/:id/retry-failed", taskLimitMiddleware(), client.handleRetryFailed)
+
+	// Endpoint: Live task progress as Server-Sent Events
+	r.GET("/tasks/:id/stream", client.handleTaskStream)
+
+	// Endpoint: Search the synced Keepa category tree
+	r.GET("/categories", etagMiddleware(), handleSearchCategories)
+
+	// Endpoint: Cached category hierarchy below a category, 0 for all root categories
+	r.GET("/categories/tree/:rootId", etagMiddleware(), handleCategoryTree)
+
+	// Endpoint: Query stored products by brand, category, buy box price, Amazon offer and sales rank
+	r.GET("/products", etagMiddleware(), handleQueryProducts)
+
+	// Endpoint: Stored product from Redis or Firestore, ?refresh=true fetches it from Keepa first
+	r.GET("/products/:asin", etagMiddleware(), client.handleGetProduct)
+
+	// Endpoint: Stored copies of a product across the ?domains marketplaces
+	r.GET("/products/:asin/domains", etagMiddleware(), handleProductDomains)
+
+	// Endpoint: Competitor price matrix of a stored product
+	r.GET("/products/:asin/competition", etagMiddleware(), handleProductCompetition)
+
+	// Endpoint: Stored snapshots of a product between ?from and ?to
+	r.GET("/products/:asin/history", etagMiddleware(), handleProductHistory)
+
+	// Endpoint: GraphQL query over the stored products, their snapshots and the tasks
+	r.POST("/graphql", handleGraphQL)
+
+	// Endpoint: Buy box ownership timeline of a stored product
+	r.GET("/products/:asin/buybox-history", etagMiddleware(), handleBuyBoxHistory)
+
+	// Endpoint: Units sold estimated from the stock decreases of a stored product's offers
+	r.GET("/products/:asin/sales-estimate", etagMiddleware(), handleSalesEstimate)
+
+	// Endpoint: FBA net margin of a product for a landed cost
+	r.POST("/products/:asin/profit", client.handleProfit)
+
+	// Endpoint: Variation family of a stored product, optionally expanded from Keepa
+	r.GET("/products/:asin/variations", etagMiddleware(), client.handleVariationFamily)
+
+	// Endpoint: Side-by-side comparison of several products
+	r.GET("/products/compare", etagMiddleware(), client.handleCompareProducts)
+
+	// Endpoint: Keepa response fields not covered by our models
+	r.GET("/keepa/schema-drift", handleSchemaDrift)
+
+	// Endpoint: Time spent waiting for tokens and backoffs, by reason
+	r.GET("/keepa/token-waits", handleTokenWaits)
+
+	// Endpoint: Keepa tokens consumed per endpoint, category, task and day
+	r.GET("/reports/tokens", handleTokenReport)
+
+	// Endpoint: Live token bucket state
+	r.GET("/keepa/tokens", client.handleTokens)
+
+	// Endpoint: Fee and net proceeds estimate for a sell price
+	r.POST("/fees/preview", client.handleFeePreview)
+
+	// Endpoint: Page of Keepa deals matching a deal query
+	r.POST("/keepa/deals", client.handleDeals)
+
+	// Endpoint: Fetch the best sellers of a category through the product pipeline
+	r.GET("/keepa/bestsellers/:category", taskLimitMiddleware(), client.handleBestSellers)
+
+	// Endpoint: Seller rating history, storefront and offer counts
+	r.GET("/keepa/sellers/:sellerId", client.handleSellerLookup)
+
+	// Endpoint: Search Keepa categories by name
+	r.GET("/keepa/categories/search", client.handleKeepaCategorySearch)
+
+	// Endpoint: Keepa category by ID, 0 for the root categories
+	r.GET("/keepa/categories/:id", client.handleKeepaCategory)
+
+	// Endpoint: Keyword product search
+	r.POST("/keepa/search", client.handleProductSearch)
+
+	// Endpoint: Look up and store the products of a UPC/EAN code
+	r.GET("/keepa/products/by-code/:code", client.handleProductsByCode)
+
+	// Endpoint: Create Keepa trackers with push notifications
+	r.POST("/keepa/tracking", client.handleCreateTracking)
+
+	// Endpoint: Remove the Keepa tracker of an ASIN
+	r.DELETE("/keepa/tracking/:asin", client.handleDeleteTracking)
+
+	// Endpoint: Receiver for Keepa tracking notifications
+	r.POST("/keepa/notifications", client.handleKeepaNotification)
+
+	// Endpoint: Lightning deals in our categories
+	r.GET("/keepa/lightning-deals", client.handleLightningDeals)
+
+	// Endpoint: Harvest a seller's storefront ASINs, optionally fetching their products
+	r.POST("/keepa/storefront", taskLimitMiddleware(), client.handleStorefront)
+
+	// Endpoint: Create a cron schedule starting a fetch task with a POST /keepa body
+	r.POST("/schedules", requireRole(RoleAdmin), handleCreateSchedule)
+
+	// Endpoint: List the schedules
+	r.GET("/schedules", handleListSchedules)
+
+	// Endpoint: Get a schedule
+	r.GET("/schedules/:id", handleGetSchedule)
+
+	// Endpoint: Run history of a schedule, newest first
+	r.GET("/schedules/:id/runs", handleScheduleRuns)
+
+	// Endpoint: Delete a schedule and its run history
+	r.DELETE("/schedules/:id", requireRole(RoleAdmin), handleDeleteSchedule)
+
+	// Endpoint: Create a watchlist of ASINs or brands, referenced by "watchlist" in a POST /keepa body
+	r.POST("/watchlists", handleCreateWatchlist)
+
+	// Endpoint: List the watchlists
+	r.GET("/watchlists", etagMiddleware(), handleListWatchlists)
+
+	// Endpoint: Get a watchlist
+	r.GET("/watchlists/:id", etagMiddleware(), handleGetWatchlist)
+
+	// Endpoint: Replace the name and members of a watchlist
+	r.PUT("/watchlists/:id", handleUpdateWatchlist)
+
+	// Endpoint: Delete a watchlist
+	r.DELETE("/watchlists/:id", handleDeleteWatchlist)
+
+	// Endpoint: Fetch the members of a watchlist now
+	r.POST("/watchlists/:id/refresh", taskLimitMiddleware(), client.handleRefreshWatchlist)
+
+	// Endpoint: Register an alert rule evaluated whenever products are stored
+	r.POST("/alerts", handleCreateAlertRule)
+
+	// Endpoint: List the alert rules
+	r.GET("/alerts/rules", handleListAlertRules)
+
+	// Endpoint: Delete an alert rule
+	r.DELETE("/alerts/rules/:id", handleDeleteAlertRule)
+
+	// Endpoint: Triggered alerts, latest first; ?acknowledged=false lists the open ones
+	r.GET("/alerts/triggered", handleListAlerts)
+
+	// Endpoint: Acknowledge a triggered alert
+	r.POST("/alerts/triggered/:id/ack", handleAcknowledgeAlert)
+
+	// Admin endpoints, for admins only
+	admin := r.Group("/admin", requireRole(RoleAdmin))
+
+	// Endpoint: Mark or delete products not fetched for a while, ?dryRun=true only lists them
+	admin.POST("/cleanup", handleProductCleanup)
+
+	// Endpoint: TTL and size of a cached product, ?payload=true includes it
+	admin.GET("/cache/:asin", handleInspectCache)
+
+	// Endpoint: Remove a product from the caches
+	admin.DELETE("/cache/:asin", handleDeleteCache)
+
+	// Endpoint: Delete cached keys by ?pattern or ?prefix, counting them unless ?confirm=true
+	admin.POST("/cache/flush", handleFlushCache)
+
+	// Endpoint: Register a tenant with its own Keepa key, returning its access key once
+	admin.POST("/tenants", client.handleCreateTenant)
+
+	// Endpoint: List the tenants
+	admin.GET("/tenants", handleListTenants)
+
+	// Endpoint: Disable a tenant, rejecting its access key
+	admin.DELETE("/tenants/:id", handleDisableTenant)
+
+	// Endpoint: Create an API key, returning it once
+	admin.POST("/api-keys", handleCreateAPIKey)
+
+	// Endpoint: List the API keys
+	admin.GET("/api-keys", handleListAPIKeys)
+
+	// Endpoint: Disable an API key
+	admin.DELETE("/api-keys/:id", handleDisableAPIKey)
+
+	// Endpoint: Reload CONFIG_FILE on this instance, as SIGHUP does
+	admin.POST("/config/reload", handleReloadConfig)
+
+	// Endpoint: OpenAPI 3 description of the routes above
+	r.GET(OpenAPIPath, handleOpenAPI(r))
+
+	// Endpoint: Swagger UI rendering the OpenAPI description
+	if getEnv("SWAGGER_UI", "false") == "true" {
+		r.GET(SwaggerUIPath, handleSwaggerUI)
+	}
+
+	// Unknown routes and methods are answered as problems too
+	r.NoRoute(func(c *gin.Context) {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("No route for %s %s", c.Request.Method, c.Request.URL.Path))
+	})
+	r.NoMethod(func(c *gin.Context) {
+		respondProblem(c, http.StatusMethodNotAllowed, CodeInvalidRequest, fmt.Sprintf("%s is not allowed on %s", c.Request.Method, c.Request.URL.Path))
+	})
+
+	startGRPCServer(client)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	r.Run(":" + port)
+}
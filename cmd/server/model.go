@@ -0,0 +1,114 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"log/slog"
+	"time"
+)
+
+// Task represents the state of a task
+type Task struct {
+	ID               string                      `json:"id" firestore:"id"`
+	Kind             string                      `json:"kind" firestore:"kind"`                   // TaskKindFetch, TaskKindASINs or TaskKindStorefront
+	Domain           string                      `json:"domain,omitempty" firestore:"domain"`     // Keepa domain of the products, KEEPA_DOMAIN when empty
+	Status           string                      `json:"status" firestore:"status"`               // "pending", "running", "completed", "failed"
+	ASINs            []string                    `json:"asins,omitempty" firestore:"-"`           // Stored in the asins subcollection, see TaskASIN
+	Products         []string                    `json:"products,omitempty" firestore:"products"` // Stores historical data for each ASIN
+	Error            string                      `json:"error,omitempty" firestore:"error"`
+	CreatedAt        time.Time                   `json:"created_at" firestore:"createdAt"`
+	FinishedAt       *time.Time                  `json:"finished_at,omitempty" firestore:"finishedAt"`
+	Progress         int                         `json:"progress" firestore:"progress"`                            // Number of ASINs processed so far
+	Total            int                         `json:"total" firestore:"total"`                                  // Total number of ASINs to process
+	ErrorCounts      map[string]int              `json:"error_counts,omitempty" firestore:"errorCounts"`           // Failed ASINs per failure class
+	Failures         []TaskFailure               `json:"failures,omitempty" firestore:"-"`                         // Per-ASIN failure details, stored in the asins subcollection
+	Chunks           []TaskChunk                 `json:"chunks,omitempty" firestore:"-"`                           // Completed finder pages, readable before the task ends, stored in the chunks subcollection
+	Summary          *TaskSummary                `json:"summary,omitempty" firestore:"summary"`                    // Aggregate statistics, computed on completion
+	SummaryData      *taskSummaryAccumulator     `json:"-" firestore:"summaryData"`                                // Running statistics, persisted so resumed tasks keep them
+	Categories       []string                    `json:"categories,omitempty" firestore:"categories"`              // Root categories scanned by the task
+	Pages            []TaskPage                  `json:"-" firestore:"-"`                                          // Finder pages collected by a fetch task, stored in the pages subcollection
+	Spec             *FetchTaskSpec              `json:"-" firestore:"spec"`                                       // Work of a fetch task, needed to resume it
+	CategoryProgress map[string]CategoryProgress `json:"category_progress,omitempty" firestore:"categoryProgress"` // Scan progress per root category of a fetch task
+	Processed        []string                    `json:"-" firestore:"-"`                                          // ASINs processed so far, skipped when the task is resumed
+	CallbackURL      string                      `json:"callback_url,omitempty" firestore:"callbackUrl"`           // Notified when the task finishes
+	RetryOf          string                      `json:"retry_of,omitempty" firestore:"retryOf"`                   // Task whose failed ASINs this task retries
+	UseCache         bool                        `json:"-" firestore:"useCache"`                                   // Whether an ASIN task reads cached products
+	SellerID         string                      `json:"seller_id,omitempty" firestore:"sellerId"`                 // Seller whose storefront a storefront task fetches
+	QuotaWarning     *QuotaWarning               `json:"quota_warning,omitempty" firestore:"quotaWarning"`         // Most severe quota warning seen while the task ran
+	ScheduleID       string                      `json:"schedule_id,omitempty" firestore:"scheduleId"`             // Schedule that started the task
+	TenantID         string                      `json:"tenant_id,omitempty" firestore:"tenantId"`                 // Tenant that started the task, empty for the deployment itself
+	CreatedBy        string                      `json:"created_by,omitempty" firestore:"createdBy"`               // Caller that started the task, see requestCaller
+	UpdatedAt        time.Time                   `json:"updated_at" firestore:"updatedAt"`
+	Owner            string                      `json:"-" firestore:"owner"`          // Instance running the task, see instanceID
+	LeaseExpiresAt   time.Time                   `json:"-" firestore:"leaseExpiresAt"` // Until when Owner holds the task, renewed while it runs
+
+	known map[string]struct{} // Set of ASINs, see knownASINs; not copied by copyTask
+}
+
+// KeepaClient represents a Keepa API client
+type KeepaClient struct {
+	Tokens          *keepa.TokenBucket // Local estimate of the token balance
+	SafetyThreshold int
+	Logger          *slog.Logger
+	Starvation      *tokenStarvationMonitor
+	Shared          *sharedTokenBucket // Token balance shared by all instances, nil for a local estimate
+	API             *keepa.Client      // Client of all Keepa calls, its HTTP client replaceable to mock the API
+	Tenant          *Tenant            // Tenant whose Keepa key the client spends, nil for the deployment's key
+}
+
+// Create simplified response with only the needed fields
+type SimplifiedOffer struct {
+	SellerID        string         `json:"sellerId"`
+	Condition       int            `json:"condition"`
+	IsPrime         bool           `json:"isPrime"`
+	IsAmazon        bool           `json:"isAmazon"`
+	IsFBA           bool           `json:"isFBA"`
+	IsLive          bool           `json:"isLive"`
+	Price           int            `json:"price,omitempty"`         // Latest offer price in cents
+	Shipping        int            `json:"shipping,omitempty"`      // Latest shipping cost in cents
+	StockEstimate   int            `json:"stockEstimate,omitempty"` // Latest value of the stock history
+	StockCSV        map[string]int `json:"stockCSV,omitempty"`
+	IsWarehouseDeal bool           `json:"isWarehouseDeal,omitempty"`
+}
+
+type SimplifiedProduct struct {
+	Asin               string                  `json:"asin"`
+	Title              string                  `json:"title"`
+	Categories         []int64                 `json:"categories"`
+	CategoryPath       string                  `json:"categoryPath,omitempty"` // Breadcrumb of the first category, e.g. "Home & Kitchen > Kitchen & Dining"
+	Brand              string                  `json:"brand"`
+	ParentAsin         string                  `json:"parentAsin,omitempty"`
+	Variations         []SimplifiedVariation   `json:"variations,omitempty"` // Sibling variations including this product
+	BuyBoxPrice        int                     `json:"buyBoxPrice,omitempty"`
+	BuyBoxAvg30        int                     `json:"buyBoxAvg30,omitempty"`        // 30-day average of the buy box price including shipping
+	BuyBoxAvg90        int                     `json:"buyBoxAvg90,omitempty"`        // 90-day average, like BuyBoxAvg30
+	HasAmazonOffer     bool                    `json:"hasAmazonOffer,omitempty"`     // Amazon itself offers the product
+	AmazonAvailability string                  `json:"amazonAvailability,omitempty"` // Availability of Amazon's offer, see amazonAvailabilities
+	SalesRanks         map[string]int          `json:"salesRanks,omitempty"`
+	MonthlySold        int                     `json:"monthlySold,omitempty"`        // Units bought in the past month, as shown on Amazon
+	MonthlySoldHistory map[string]int          `json:"monthlySoldHistory,omitempty"` // Keyed like SalesRanks
+	Velocity           *SalesVelocity          `json:"velocity,omitempty"`           // Sales rank drops and velocity score
+	OfferCountFBA      int                     `json:"offerCountFBA,omitempty"`
+	OfferCountFBM      int                     `json:"offerCountFBM,omitempty"`
+	Rating             float64                 `json:"rating,omitempty"` // Latest star rating, needs KEEPA_RATING=1
+	ReviewCount        int                     `json:"reviewCount,omitempty"`
+	Offers             []SimplifiedOffer       `json:"offers,omitempty"`
+	Computed           map[string]interface{}  `json:"computed,omitempty"` // Fields added by simplification rules
+	BuyBoxHistory      []BuyBoxOwnership       `json:"buyBoxHistory,omitempty"`
+	BuyBoxUsedHistory  []BuyBoxOwnership       `json:"buyBoxUsedHistory,omitempty"`
+	ReferralFeePercent float64                 `json:"referralFeePercent,omitempty"`
+	PickAndPackFee     int                     `json:"pickAndPackFee,omitempty"` // FBA pick and pack fee in cents
+	FetchedAt          time.Time               `json:"fetchedAt,omitempty"`      // When the product was fetched from Keepa
+	Fields             []string                `json:"fields,omitempty"`         // Field groups mapped, empty when all were; see productFields
+	PriceHistory       map[string][]PricePoint `json:"priceHistory,omitempty"`   // Csv histories selected by KEEPA_PRICE_HISTORY, keyed by type name
+}
+
+// SimplifiedVariation is one member of a variation family
+type SimplifiedVariation struct {
+	Asin       string            `json:"asin"`
+	Attributes map[string]string `json:"attributes,omitempty"` // Dimension to value, e.g. "Color": "Red"
+}
+
+type SimplifiedResponse struct {
+	Products       []SimplifiedProduct `json:"products"`
+	TokensConsumed int                 `json:"-"` // Tokens spent fetching this response, not stored
+}
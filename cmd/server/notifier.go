@@ -0,0 +1,412 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification is a message emitted by the service, e.g. an operational alert
+type Notification struct {
+	Type      string                 `json:"type"`
+	Severity  string                 `json:"severity"` // "info", "warning", "critical"
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// Notifier delivers notifications to a destination
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+// Destination types of NOTIFY_DESTINATIONS
+const (
+	DestinationSlack   = "slack"
+	DestinationEmail   = "email"
+	DestinationWebhook = "webhook"
+)
+
+// notificationSeverities orders the severities for a destination's minSeverity
+var notificationSeverities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// NotifyDestination is one target of NOTIFY_DESTINATIONS. Templates are text/template
+// strings executed with the Notification, e.g. "{{.Severity}}: {{.Message}}"; the
+// json function encodes a value, e.g. {{json .Details}}.
+type NotifyDestination struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`                  // "slack", "email" or "webhook"
+	URL         string            `json:"url,omitempty"`         // Slack incoming webhook or HTTP endpoint
+	Headers     map[string]string `json:"headers,omitempty"`     // Extra webhook headers, e.g. Authorization
+	To          []string          `json:"to,omitempty"`          // Email recipients
+	Subject     string            `json:"subject,omitempty"`     // Email subject template
+	Template    string            `json:"template,omitempty"`    // Message template; a webhook posts the notification as JSON without one
+	Types       []string          `json:"types,omitempty"`       // Notification types delivered, empty for all
+	MinSeverity string            `json:"minSeverity,omitempty"` // Least severe notification delivered, "info" when empty
+}
+
+// Default templates of the destinations
+const (
+	defaultSlackTemplate = "*[{{.Severity}}] {{.Type}}*: {{.Message}}{{range $key, $value := .Details}}\n• {{$key}}: {{$value}}{{end}}"
+	defaultEmailSubject  = "[Keepa API] {{.Severity}}: {{.Message}}"
+	defaultEmailTemplate = "{{.Message}}\n\nType: {{.Type}}\nSeverity: {{.Severity}}\nTime: {{.CreatedAt}}\n{{range $key, $value := .Details}}\n{{$key}}: {{$value}}{{end}}\n"
+)
+
+// notificationTemplateFuncs are available in destination templates
+var notificationTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// notifier is the process-wide notifier built from environment variables
+var notifier = newNotifierFromEnv()
+
+// newNotifierFromEnv always logs and delivers to the destinations of NOTIFY_DESTINATIONS,
+// a JSON array of NotifyDestination, or NOTIFY_DESTINATIONS_FILE. NOTIFY_WEBHOOK_URL
+// adds a webhook receiving every notification. Invalid destinations are skipped.
+func newNotifierFromEnv() Notifier {
+	notifiers := multiNotifier{&logNotifier{logger: logger.With(LogKeyComponent, "notifier")}}
+	if url := getEnv("NOTIFY_WEBHOOK_URL", ""); url != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:        url,
+			httpClient: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	data := []byte(getEnv("NOTIFY_DESTINATIONS", ""))
+	if path := getEnv("NOTIFY_DESTINATIONS_FILE", ""); len(data) == 0 && path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error("Failed to read notification destinations file", "path", path, "error", err)
+			return notifiers
+		}
+		data = fileData
+	}
+	if len(data) == 0 {
+		return notifiers
+	}
+	var destinations []NotifyDestination
+	if err := json.Unmarshal(data, &destinations); err != nil {
+		logger.Error("Failed to parse notification destinations", "error", err)
+		return notifiers
+	}
+	for _, destination := range destinations {
+		n, err := newDestinationNotifier(destination)
+		if err != nil {
+			logger.Error("Invalid notification destination, skipping it", "destination", destination.Name, "error", err)
+			continue
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers
+}
+
+// newDestinationNotifier builds the notifier of a destination, wrapped in its filter
+func newDestinationNotifier(destination NotifyDestination) (Notifier, error) {
+	body, err := parseNotificationTemplate(destination.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+
+	var n Notifier
+	switch destination.Type {
+	case DestinationSlack:
+		if _, err := validateWebhookURL(destination.URL); err != nil {
+			return nil, fmt.Errorf("invalid url: %v", err)
+		}
+		if body == nil {
+			body = template.Must(parseNotificationTemplate(defaultSlackTemplate))
+		}
+		n = &slackNotifier{url: destination.URL, template: body, httpClient: httpClient}
+	case DestinationWebhook:
+		if _, err := validateWebhookURL(destination.URL); err != nil {
+			return nil, fmt.Errorf("invalid url: %v", err)
+		}
+		n = &webhookNotifier{url: destination.URL, headers: destination.Headers, template: body, httpClient: httpClient}
+	case DestinationEmail:
+		if len(destination.To) == 0 {
+			return nil, fmt.Errorf("to is required")
+		}
+		subject, err := parseNotificationTemplate(destination.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject: %v", err)
+		}
+		if subject == nil {
+			subject = template.Must(parseNotificationTemplate(defaultEmailSubject))
+		}
+		if body == nil {
+			body = template.Must(parseNotificationTemplate(defaultEmailTemplate))
+		}
+		email, err := newEmailNotifierFromEnv(destination.To, subject, body)
+		if err != nil {
+			return nil, err
+		}
+		n = email
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected slack, email or webhook", destination.Type)
+	}
+
+	minSeverity := destination.MinSeverity
+	if minSeverity == "" {
+		minSeverity = "info"
+	}
+	level, ok := notificationSeverities[minSeverity]
+	if !ok {
+		return nil, fmt.Errorf("minSeverity must be info, warning or critical")
+	}
+	return &filteredNotifier{name: destination.Name, types: destination.Types, minLevel: level, next: n}, nil
+}
+
+// parseNotificationTemplate parses a destination template, nil when text is empty
+func parseNotificationTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("notification").Funcs(notificationTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// renderNotification executes a destination template
+func renderNotification(tmpl *template.Template, notification Notification) (string, error) {
+	var out strings.Builder
+	if err := tmpl.Execute(&out, notification); err != nil {
+		return "", fmt.Errorf("failed to render notification: %v", err)
+	}
+	return out.String(), nil
+}
+
+// sendNotification fills in the timestamp and delivers a notification, logging failures
+func sendNotification(notificationType, severity, message string, details map[string]interface{}) {
+	notification := Notification{
+		Type:      notificationType,
+		Severity:  severity,
+		Message:   message,
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := notifier.Notify(ctx, notification); err != nil {
+		logger.Error("Failed to send notification", "type", notificationType, "error", err)
+	}
+}
+
+// notificationsSent holds when a throttled notification was last sent, by key
+var notificationsSent sync.Map
+
+// sendThrottledNotification sends a notification unless one with the same key was sent
+// within every, for conditions that can repeat on every request
+func sendThrottledNotification(key string, every time.Duration, notificationType, severity, message string, details map[string]interface{}) {
+	now := time.Now()
+	if last, loaded := notificationsSent.LoadOrStore(key, now); loaded {
+		if now.Sub(last.(time.Time)) < every || !notificationsSent.CompareAndSwap(key, last, now) {
+			return
+		}
+	}
+	sendNotification(notificationType, severity, message, details)
+}
+
+// multiNotifier fans a notification out to several notifiers
+type multiNotifier []Notifier
+
+func (notifiers multiNotifier) Notify(ctx context.Context, notification Notification) error {
+	var firstErr error
+	for _, n := range notifiers {
+		if err := n.Notify(ctx, notification); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// logNotifier writes notifications to the log
+type logNotifier struct {
+	logger *slog.Logger
+}
+
+// notificationLevels maps notification severities to log levels
+var notificationLevels = map[string]slog.Level{
+	"info":     slog.LevelInfo,
+	"warning":  slog.LevelWarn,
+	"critical": slog.LevelError,
+}
+
+func (n *logNotifier) Notify(ctx context.Context, notification Notification) error {
+	level, ok := notificationLevels[notification.Severity]
+	if !ok {
+		level = slog.LevelWarn
+	}
+	n.logger.Log(ctx, level, notification.Message, "type", notification.Type, "details", notification.Details)
+	return nil
+}
+
+// filteredNotifier delivers the notifications of a destination's types and severities
+type filteredNotifier struct {
+	name     string
+	types    []string
+	minLevel int
+	next     Notifier
+}
+
+func (n *filteredNotifier) Notify(ctx context.Context, notification Notification) error {
+	if len(n.types) > 0 && !containsString(n.types, notification.Type) {
+		return nil
+	}
+	if level, ok := notificationSeverities[notification.Severity]; ok && level < n.minLevel {
+		return nil
+	}
+	if err := n.next.Notify(ctx, notification); err != nil {
+		return fmt.Errorf("destination %s: %v", n.name, err)
+	}
+	return nil
+}
+
+// webhookNotifier posts notifications to an HTTP endpoint, as JSON or rendered with
+// the destination template
+type webhookNotifier struct {
+	url        string
+	headers    map[string]string
+	template   *template.Template
+	httpClient *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	var data []byte
+	if n.template != nil {
+		text, err := renderNotification(n.template, notification)
+		if err != nil {
+			return err
+		}
+		data = []byte(text)
+	} else {
+		encoded, err := json.Marshal(notification)
+		if err != nil {
+			return fmt.Errorf("failed to marshal notification: %v", err)
+		}
+		data = encoded
+	}
+	return postNotification(ctx, n.httpClient, n.url, n.headers, data)
+}
+
+// slackNotifier posts notifications to a Slack incoming webhook
+type slackNotifier struct {
+	url        string
+	template   *template.Template
+	httpClient *http.Client
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, notification Notification) error {
+	text, err := renderNotification(n.template, notification)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("failed to marshal Slack message: %v", err)
+	}
+	return postNotification(ctx, n.httpClient, n.url, nil, data)
+}
+
+// postNotification posts a notification body, JSON unless headers set a Content-Type
+func postNotification(ctx context.Context, httpClient *http.Client, url string, headers map[string]string, data []byte) error {
+	return withRetry(ctx, DependencyWebhook, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to create webhook request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("webhook request failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return keepa.HTTPStatusError(resp.StatusCode, fmt.Errorf("webhook returned status code %d", resp.StatusCode))
+		}
+		return nil
+	})
+}
+
+// emailNotifier sends notifications by SMTP
+type emailNotifier struct {
+	addr     string // host:port of the SMTP server
+	auth     smtp.Auth
+	from     string
+	to       []string
+	subject  *template.Template
+	template *template.Template
+}
+
+// newEmailNotifierFromEnv creates an email notifier for the SMTP server of SMTP_HOST,
+// SMTP_PORT (587), SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM. The server must offer
+// STARTTLS for the credentials to be sent.
+func newEmailNotifierFromEnv(to []string, subject, body *template.Template) (*emailNotifier, error) {
+	host := getEnv("SMTP_HOST", "")
+	from := getEnv("SMTP_FROM", "")
+	if host == "" || from == "" {
+		return nil, fmt.Errorf("SMTP_HOST and SMTP_FROM are required for email destinations")
+	}
+	n := &emailNotifier{
+		addr:     net.JoinHostPort(host, getEnv("SMTP_PORT", "587")),
+		from:     from,
+		to:       to,
+		subject:  subject,
+		template: body,
+	}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		n.auth = smtp.PlainAuth("", username, secret("SMTP_PASSWORD", ""), host)
+	}
+	return n, nil
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, notification Notification) error {
+	subject, err := renderNotification(n.subject, notification)
+	if err != nil {
+		return err
+	}
+	body, err := renderNotification(n.template, notification)
+	if err != nil {
+		return err
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", n.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.to, ", "))
+	// Header values must not contain line breaks
+	fmt.Fprintf(&message, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", notification.CreatedAt.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// smtp.SendMail takes no context; it is bounded by the caller's timeout instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.addr, n.auth, n.from, n.to, []byte(message.String()))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("failed to send email: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send email: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths of the API description, served without authentication
+const (
+	OpenAPIPath   = "/openapi.json"
+	SwaggerUIPath = "/docs"
+)
+
+// apiObject describes a JSON object built with gin.H by an example value per member.
+// The schema of each member is derived from the type of its value.
+type apiObject map[string]interface{}
+
+// apiOperation documents a route in the OpenAPI spec. Routes missing from
+// apiOperations are still listed, with an untyped response.
+type apiOperation struct {
+	Summary  string
+	Query    []string    // Query parameters
+	Request  interface{} // Example of the JSON body, nil without one
+	Optional bool        // Whether the body may be left out
+	Upload   string      // Form field of a multipart file upload taken instead of a JSON body
+	Status   int         // Success status, 200 when 0
+	Response interface{} // Example of the success body, nil when it is not JSON
+	Content  []string    // Media types of a success body that is not JSON
+}
+
+// taskStarted is the answer of the routes starting a task
+var taskStarted = apiObject{"task_id": "", "status": "", "estimated_tokens": 0, "quota_warning": QuotaWarning{}}
+
+// timeQuery are the query parameters of the routes returning formatted timestamps
+var timeQuery = []string{TimeFormatParam, TimezoneParam}
+
+// apiOperations documents the routes by "METHOD path", the path as registered with gin
+var apiOperations = map[string]apiOperation{
+	"POST /keepa": {
+		Summary: "Trigger Product Finder and Product Request; keys other than the task settings are the Product Finder selection",
+		Query:   []string{"dryRun", "fields"},
+		Request: apiObject{"domain": "", "domains": []string{}, "watchlist": "", "categories": []int64{}, "brand": []string{}, "current_SALES_lte": 0, "include": []string{}, "options": ProductOptions{}, "callback_url": ""},
+		Status:  http.StatusAccepted, Response: taskStarted,
+	},
+	"POST /keepa/import": {
+		Summary: "Fetch the ASINs of an uploaded CSV or text file, skipping Product Finder",
+		Query:   []string{"domain", "dryRun"},
+		Upload:  ImportFileField, Status: http.StatusAccepted,
+		Response: apiObject{"task_id": "", "status": "", "domain": "", "accepted": 0, "rejected": 0, "errors": []RejectedRow{}, "estimated_tokens": 0},
+	},
+	"POST /keepa/estimate": {
+		Summary:  "Estimate the token cost of a POST /keepa body without starting a task",
+		Request:  apiObject{"domain": "", "domains": []string{}, "categories": []int64{}, "brand": []string{}, "current_SALES_lte": 0},
+		Response: apiObject{"dryRun": true, "estimate": TaskEstimate{}, "estimatedDuration": "", "quota_warning": QuotaWarning{}},
+	},
+	"POST /refresh": {
+		Summary: "Refresh stored products matching a Firestore query, 200 without a task when none match",
+		Request: RefreshRequest{}, Status: http.StatusAccepted,
+		Response: apiObject{"task_id": "", "status": "", "domain": "", "asins": []string{}, "estimated_tokens": 0},
+	},
+	"GET /tasks": {
+		Summary:  "List recent tasks",
+		Query:    []string{"status", "category", "from", "to", "limit", "cursor"},
+		Response: apiObject{"tasks": []Task{}, "next_cursor": ""},
+	},
+	"GET /tasks/:id": {Summary: "Task status", Response: Task{}},
+	"GET /tasks/:id/results": {
+		Summary:  "Read results of completed task chunks, ?format=ndjson streams them",
+		Query:    append([]string{"after", "format"}, timeQuery...),
+		Response: apiObject{"task_id": "", "status": "", "progress": 0, "total": 0, "chunks": []TaskChunk{}, "products": []SimplifiedProduct{}, "next_after": 0, "complete": true},
+		Content:  []string{"application/x-ndjson"},
+	},
+	"GET /tasks/:id/export": {
+		Summary: "Download task products as a CSV or XLSX spreadsheet",
+		Query:   []string{"format", "columns"},
+		Content: []string{"text/csv", xlsxContentType},
+	},
+	"GET /tasks/:id/failed": {
+		Summary:  "Dead-lettered ASINs of a task",
+		Response: apiObject{"task_id": "", "failed_asins": []FailedASIN{}},
+	},
+	"POST /tasks/:id/retry-failed": {
+		Summary: "Retry the dead-lettered ASINs of a finished task",
+		Status:  http.StatusAccepted, Response: apiObject{"task_id": "", "retry_of": "", "status": "", "asins": []string{}, "estimated_tokens": 0},
+	},
+	"GET /tasks/:id/stream": {Summary: "Live task progress as Server-Sent Events", Content: []string{"text/event-stream"}},
+	"GET /categories": {
+		Summary:  "Search the synced Keepa category tree",
+		Query:    []string{"q", "domain", "limit"},
+		Response: apiObject{"domain": "", "categories": []keepa.Category{}},
+	},
+	"GET /categories/tree/:rootId": {
+		Summary:  "Cached category hierarchy below a category, 0 for all root categories",
+		Query:    []string{"domain", "depth"},
+		Response: apiObject{"domain": "", "path": "", "tree": CategoryNode{}, "categories": 0},
+	},
+	"GET /products": {
+		Summary:  "Query stored products by brand, category, buy box price, Amazon offer and sales rank",
+		Query:    append([]string{"domain", "brand", "category", "hasAmazonOffer", "minPrice", "maxPrice", "minSalesRank", "maxSalesRank", "sort", "order", "limit", "cursor"}, timeQuery...),
+		Response: apiObject{"products": []ProductDocument{}, "count": 0, "sort": "", "descending": true, "nextCursor": ""},
+	},
+	"GET /products/:asin": {
+		Summary:  "Stored product from Redis or Firestore, ?refresh=true fetches it from Keepa first",
+		Query:    append([]string{"domain", "refresh"}, timeQuery...),
+		Response: SimplifiedResponse{},
+	},
+	"GET /products/:asin/domains": {
+		Summary:  "Stored copies of a product across the ?domains marketplaces",
+		Query:    []string{"domains"},
+		Response: apiObject{"asin": "", "domains": []ComparisonEntry{}, "found": 0},
+	},
+	"GET /products/:asin/competition": {
+		Summary:  "Competitor price matrix of a stored product",
+		Query:    []string{"domain"},
+		Response: apiObject{"asin": "", "domain": "", "buyBoxPrice": 0, "source": "", "offers": []CompetitionEntry{}},
+	},
+	"GET /products/:asin/history": {
+		Summary:  "Stored snapshots of a product between ?from and ?to",
+		Query:    append([]string{"domain", "from", "to", "limit"}, timeQuery...),
+		Response: apiObject{"asin": "", "domain": "", "from": "", "to": "", "snapshots": []ProductDocument{}, "count": 0, "truncated": true},
+	},
+	"POST /graphql": {
+		Summary:  "GraphQL query over the stored products, their snapshots and the tasks",
+		Query:    timeQuery,
+		Request:  GraphQLRequest{},
+		Response: apiObject{"data": map[string]interface{}{}, "errors": []map[string]interface{}{}},
+	},
+	"GET /products/:asin/buybox-history": {
+		Summary:  "Buy box ownership timeline of a stored product",
+		Query:    append([]string{"domain", "used"}, timeQuery...),
+		Response: apiObject{"asin": "", "domain": "", "source": "", "timeline": []BuyBoxOwnership{}, "sellers": []BuyBoxSellerSummary{}},
+	},
+	"GET /products/:asin/sales-estimate": {
+		Summary:  "Units sold estimated from the stock decreases of a stored product's offers",
+		Query:    []string{"domain", "days"},
+		Response: apiObject{"asin": "", "domain": "", "source": "", "estimate": SalesEstimate{}},
+	},
+	"POST /products/:asin/profit": {
+		Summary: "FBA net margin of a product for a landed cost",
+		Query:   []string{"domain"}, Request: ProfitRequest{}, Response: ProfitBreakdown{},
+	},
+	"GET /products/:asin/variations": {
+		Summary:  "Variation family of a stored product, optionally expanded from Keepa",
+		Query:    []string{"domain", "expandVariations"},
+		Response: apiObject{"asin": "", "domain": "", "parentAsin": "", "expanded": true, "variations": []FamilyMember{}, "totalMonthlySold": 0},
+	},
+	"GET /products/compare": {
+		Summary:  "Side-by-side comparison of several products",
+		Query:    []string{"asins", "domain"},
+		Response: apiObject{"asins": []string{}, "domain": "", "products": []ComparisonEntry{}},
+	},
+	"GET /keepa/schema-drift": {
+		Summary:  "Keepa response fields not covered by our models",
+		Response: apiObject{"enabled": true, "fields": []SchemaDriftEntry{}},
+	},
+	"GET /keepa/token-waits": {
+		Summary:  "Time spent waiting for tokens and backoffs, by reason",
+		Response: apiObject{"by_reason": map[string]TokenWaitStats{}, "recent": []TokenWait{}, "queued": map[string]int{}},
+	},
+	"GET /reports/tokens": {
+		Summary:  "Keepa tokens consumed per endpoint, category, task and day",
+		Query:    []string{"from", "to"},
+		Response: TokenUsageReport{},
+	},
+	"GET /keepa/tokens": {
+		Summary:  "Live token bucket state",
+		Response: apiObject{"tokens": keepa.TokenBucketState{}, "shared": true, "safetyThreshold": 0, "queued": map[string]int{}, "circuit": map[string]interface{}{}},
+	},
+	"POST /fees/preview": {Summary: "Fee and net proceeds estimate for a sell price", Request: FeePreviewRequest{}, Response: FeePreview{}},
+	"POST /keepa/deals": {
+		Summary:  "Page of Keepa deals matching a deal query",
+		Request:  DealsRequest{},
+		Response: apiObject{"deals": []SimplifiedDeal{}, "categoryNames": map[string]string{}, "domain": "", "page": 0, "hasMore": true, "tokensConsumed": 0, "cached": true},
+	},
+	"GET /keepa/bestsellers/:category": {
+		Summary: "Fetch the best sellers of a category through the product pipeline",
+		Query:   []string{"domain", "limit", "use_cache"},
+		Status:  http.StatusAccepted, Response: apiObject{"task_id": "", "status": "", "category": 0, "domain": "", "asins": []string{}, "last_update": ""},
+	},
+	"GET /keepa/sellers/:sellerId": {
+		Summary:  "Seller rating history, storefront and offer counts",
+		Query:    append([]string{"domain", "refresh", "storefront"}, timeQuery...),
+		Response: apiObject{"seller": SimplifiedSeller{}, "cached": true},
+	},
+	"GET /keepa/categories/search": {
+		Summary:  "Search Keepa categories by name",
+		Query:    []string{"q", "domain"},
+		Response: apiObject{"domain": "", "categories": []keepa.Category{}},
+	},
+	"GET /keepa/categories/:id": {
+		Summary:  "Keepa category by ID, 0 for the root categories; cached unless ?refresh=true",
+		Query:    []string{"domain", "refresh"},
+		Response: apiObject{"domain": "", "category": keepa.Category{}, "cached": true, "categories": []keepa.Category{}},
+	},
+	"POST /keepa/search": {
+		Summary:  "Keyword product search",
+		Query:    timeQuery,
+		Request:  SearchRequest{},
+		Response: apiObject{"term": "", "domain": "", "page": 0, "products": []SimplifiedProduct{}, "cached": true},
+	},
+	"GET /keepa/products/by-code/:code": {
+		Summary:  "Look up and store the products of a UPC/EAN code",
+		Query:    append([]string{"domain"}, timeQuery...),
+		Response: apiObject{"code": "", "domain": "", "asins": []string{}, "results": []apiObject{{"asin": "", "products": []SimplifiedProduct{}, "error": ""}}},
+	},
+	"POST /keepa/tracking":         {Summary: "Create Keepa trackers with push notifications", Request: TrackingRequest{}},
+	"DELETE /keepa/tracking/:asin": {Summary: "Remove the Keepa tracker of an ASIN", Response: apiObject{"asin": "", "tracked": true}},
+	"POST /keepa/notifications": {
+		Summary:  "Receiver for Keepa tracking notifications",
+		Query:    []string{"tenant", "token"},
+		Request:  keepa.Notification{},
+		Response: apiObject{"asin": "", "domain": "", "task_id": "", "ignored": true},
+	},
+	"GET /keepa/lightning-deals": {
+		Summary:  "Lightning deals in our categories",
+		Query:    []string{"domain", "category", "state", "asin"},
+		Response: apiObject{"domain": "", "lightning_deals": []SimplifiedLightningDeal{}, "cached": true},
+	},
+	"POST /keepa/storefront": {
+		Summary: "Harvest a seller's storefront ASINs, optionally fetching their products",
+		Request: StorefrontRequest{}, Status: http.StatusAccepted,
+		Response: apiObject{"task_id": "", "status": "", "sellerId": "", "domain": "", "asins": []string{}, "estimated_tokens": 0},
+	},
+	"POST /schedules": {
+		Summary: "Create a cron schedule starting a fetch task with a POST /keepa body",
+		Request: ScheduleRequest{}, Status: http.StatusCreated, Response: Schedule{},
+	},
+	"GET /schedules":     {Summary: "List the schedules", Response: apiObject{"schedules": []Schedule{}, "count": 0}},
+	"GET /schedules/:id": {Summary: "Get a schedule", Response: Schedule{}},
+	"GET /schedules/:id/runs": {
+		Summary:  "Run history of a schedule, newest first",
+		Response: apiObject{"scheduleId": "", "runs": []ScheduleRun{}, "count": 0},
+	},
+	"DELETE /schedules/:id": {
+		Summary:  "Delete a schedule and its run history",
+		Response: apiObject{"id": "", "deleted": true, "runsDeleted": 0},
+	},
+	"POST /watchlists": {
+		Summary: "Create a watchlist of ASINs or brands, referenced by \"watchlist\" in a POST /keepa body",
+		Request: WatchlistRequest{}, Status: http.StatusCreated, Response: Watchlist{},
+	},
+	"GET /watchlists":        {Summary: "List the watchlists", Response: apiObject{"watchlists": []Watchlist{}, "count": 0}},
+	"GET /watchlists/:id":    {Summary: "Get a watchlist", Response: Watchlist{}},
+	"PUT /watchlists/:id":    {Summary: "Replace the name and members of a watchlist", Request: WatchlistRequest{}, Response: Watchlist{}},
+	"DELETE /watchlists/:id": {Summary: "Delete a watchlist", Response: apiObject{"id": "", "deleted": true}},
+	"POST /watchlists/:id/refresh": {
+		Summary: "Fetch the members of a watchlist now",
+		Query:   []string{"fields"},
+		Request: apiObject{"include": []string{}, "options": ProductOptions{}, "categories": []int64{}, "callback_url": ""}, Optional: true,
+		Status: http.StatusAccepted, Response: apiObject{"task_id": "", "status": "", "watchlist": "", "estimated_tokens": 0},
+	},
+	"POST /alerts": {
+		Summary: "Register an alert rule evaluated whenever products are stored",
+		Request: AlertRuleRequest{}, Status: http.StatusCreated, Response: AlertRule{},
+	},
+	"GET /alerts/rules":        {Summary: "List the alert rules", Response: apiObject{"rules": []AlertRule{}, "count": 0}},
+	"DELETE /alerts/rules/:id": {Summary: "Delete an alert rule", Response: apiObject{"id": "", "deleted": true}},
+	"GET /alerts/triggered": {
+		Summary:  "Triggered alerts, latest first; ?acknowledged=false lists the open ones",
+		Query:    []string{"acknowledged", "asin", "ruleId"},
+		Response: apiObject{"alerts": []Alert{}, "count": 0},
+	},
+	"POST /alerts/triggered/:id/ack": {
+		Summary:  "Acknowledge a triggered alert",
+		Response: apiObject{"id": "", "acknowledged": true, "acknowledgedAt": time.Time{}},
+	},
+	"POST /admin/cleanup": {
+		Summary:  "Mark or delete products not fetched for a while, ?dryRun=true only lists them",
+		Query:    []string{"dryRun", "maxAgeDays", "mode"},
+		Response: CleanupReport{},
+	},
+	"GET /admin/cache/:asin": {
+		Summary:  "TTL and size of a cached product, ?payload=true includes it",
+		Query:    []string{"domain", "payload"},
+		Response: apiObject{"asin": "", "domain": "", "key": "", "redis": map[string]interface{}{}, "local": map[string]interface{}{}},
+	},
+	"DELETE /admin/cache/:asin": {
+		Summary:  "Remove a product from the caches",
+		Query:    []string{"domain"},
+		Response: apiObject{"asin": "", "domain": "", "key": "", "deleted": true},
+	},
+	"POST /admin/cache/flush": {
+		Summary:  "Delete cached keys by ?pattern or ?prefix, counting them unless ?confirm=true",
+		Query:    []string{"pattern", "prefix", "confirm"},
+		Response: apiObject{"pattern": "", "confirmed": true, "matched": 0, "deleted": 0},
+	},
+	"POST /admin/tenants": {
+		Summary: "Register a tenant with its own Keepa key, returning its access key once",
+		Request: TenantRequest{}, Status: http.StatusCreated, Response: apiObject{"tenant": Tenant{}, "accessKey": ""},
+	},
+	"GET /admin/tenants":        {Summary: "List the tenants", Response: apiObject{"tenants": []Tenant{}, "count": 0}},
+	"DELETE /admin/tenants/:id": {Summary: "Disable a tenant, rejecting its access key", Response: apiObject{"id": "", "disabled": true}},
+	"POST /admin/api-keys": {
+		Summary: "Create an API key, returning it once",
+		Request: APIKeyRequest{}, Status: http.StatusCreated, Response: apiObject{"apiKey": APIKey{}, "key": ""},
+	},
+	"GET /admin/api-keys":        {Summary: "List the API keys", Response: apiObject{"apiKeys": []APIKey{}, "count": 0}},
+	"DELETE /admin/api-keys/:id": {Summary: "Disable an API key", Response: apiObject{"id": "", "disabled": true}},
+	"POST /admin/config/reload": {
+		Summary:  "Reload CONFIG_FILE on this instance, as SIGHUP does",
+		Response: apiObject{"changed": []string{}, "restartRequired": []string{}},
+	},
+}
+
+// openAPISchemas collects the component schemas of named types while a spec is built
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+// componentName returns the schema name of a named struct type, prefixing the types of
+// pkg/keepa so they do not clash with the server's
+func componentName(t reflect.Type) string {
+	if strings.HasSuffix(t.PkgPath(), "/pkg/keepa") {
+		return "Keepa" + t.Name()
+	}
+	return t.Name()
+}
+
+// of returns the schema of t, a reference for named structs
+func (s *openAPISchemas) of(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			return map[string]interface{}{"type": "integer", "format": "int64", "description": "Nanoseconds"}
+		}
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := componentName(t)
+		if _, ok := s.components[name]; !ok {
+			s.components[name] = map[string]interface{}{} // Placeholder for recursive types
+			s.components[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{} // Interfaces and anything else take any value
+}
+
+// object returns the schema of the JSON members of a struct. Embedded structs are
+// flattened as encoding/json does and binding:"required" fields are required.
+func (s *openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" {
+				embedded := field.Type
+				if embedded.Kind() == reflect.Pointer {
+					embedded = embedded.Elem()
+				}
+				if embedded.Kind() == reflect.Struct {
+					addFields(embedded)
+					continue
+				}
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = s.of(field.Type)
+			if strings.Contains(field.Tag.Get("binding"), "required") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// example returns the schema of an example value of apiOperation
+func (s *openAPISchemas) example(value interface{}) map[string]interface{} {
+	switch value := value.(type) {
+	case apiObject:
+		properties := make(map[string]interface{}, len(value))
+		for name, member := range value {
+			properties[name] = s.example(member)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	case []apiObject:
+		var item interface{} = apiObject{}
+		if len(value) > 0 {
+			item = value[0]
+		}
+		return map[string]interface{}{"type": "array", "items": s.example(item)}
+	}
+	return s.of(reflect.TypeOf(value))
+}
+
+// openAPIPath converts a gin path to an OpenAPI path and lists its parameters
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// operationID derives a unique operation ID from the handler name, e.g.
+// main.(*KeepaClient).handleGetProduct-fm becomes getProduct
+func operationID(handler string) string {
+	name := handler[strings.LastIndex(handler, ".")+1:]
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "handle"), "-fm")
+	if name == "" || strings.HasPrefix(name, "func") {
+		return ""
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// buildOpenAPISpec describes the routes in an OpenAPI 3 document
+func buildOpenAPISpec(routes gin.RoutesInfo) map[string]interface{} {
+	schemas := &openAPISchemas{components: map[string]interface{}{}}
+	problem := map[string]interface{}{
+		"description": "Error described as RFC 9457 problem details",
+		"content": map[string]interface{}{
+			"application/problem+json": map[string]interface{}{"schema": schemas.of(reflect.TypeOf(Problem{}))},
+		},
+	}
+
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		if route.Path == OpenAPIPath || route.Path == SwaggerUIPath {
+			continue
+		}
+		path, pathParams := openAPIPath(route.Path)
+		doc := apiOperations[route.Method+" "+route.Path]
+
+		var parameters []interface{}
+		for _, name := range pathParams {
+			parameters = append(parameters, map[string]interface{}{"name": name, "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+		}
+		for _, name := range doc.Query {
+			parameters = append(parameters, map[string]interface{}{"name": name, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+		}
+
+		success := map[string]interface{}{"description": "Success"}
+		content := map[string]interface{}{}
+		if doc.Response != nil {
+			content["application/json"] = map[string]interface{}{"schema": schemas.example(doc.Response)}
+		}
+		for _, mediaType := range doc.Content {
+			content[mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		}
+		if len(content) > 0 {
+			success["content"] = content
+		}
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		tag, _, _ := strings.Cut(strings.TrimPrefix(route.Path, "/"), "/")
+		operation := map[string]interface{}{
+			"tags":      []string{tag},
+			"responses": map[string]interface{}{fmt.Sprint(status): success, "default": problem},
+		}
+		if doc.Summary != "" {
+			operation["summary"] = doc.Summary
+		}
+		if id := operationID(route.Handler); id != "" {
+			operation["operationId"] = id
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if doc.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": !doc.Optional,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemas.example(doc.Request)},
+				},
+			}
+		}
+
+		if doc.Upload != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{"schema": map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{doc.Upload: map[string]interface{}{"type": "string", "format": "binary"}},
+						"required":   []string{doc.Upload},
+					}},
+					"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+		}
+
+		item, _ := paths[path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Keepa API",
+			"description": "Fetches Amazon products from Keepa, stores them and serves them with their history.",
+			"version":     getEnv("API_VERSION", "1.0.0"),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"apiKey":    map[string]interface{}{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"tenantKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": TenantKeyHeader},
+				"firebase":  map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{"tenantKey": []string{}},
+			map[string]interface{}{"firebase": []string{}},
+		},
+	}
+	if baseURL := getEnv("PUBLIC_BASE_URL", ""); baseURL != "" {
+		spec["servers"] = []interface{}{map[string]interface{}{"url": baseURL}}
+	}
+	return spec
+}
+
+// handleOpenAPI serves the OpenAPI spec of the routes of r. It is built on the first
+// request, once every route is registered.
+func handleOpenAPI(r *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	var spec []byte
+	return func(c *gin.Context) {
+		once.Do(func() {
+			spec, _ = json.Marshal(buildOpenAPISpec(r.Routes()))
+		})
+		c.Data(http.StatusOK, "application/json; charset=utf-8", spec)
+	}
+}
+
+// swaggerUIPage renders the spec with Swagger UI loaded from a CDN
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Keepa API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "` + OpenAPIPath + `", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// handleSwaggerUI serves the Swagger UI page, enabled by SWAGGER_UI=true
+func handleSwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// OpportunitiesCollection stores detected used/warehouse deal opportunities
+const OpportunitiesCollection = "opportunities"
+
+// Keepa offer conditions for used items
+const (
+	ConditionUsedLikeNew    = 2
+	ConditionUsedAcceptable = 5
+)
+
+// Opportunity is a used or warehouse deal offer priced well below the new buy box
+type Opportunity struct {
+	TaskID          string    `json:"task_id" firestore:"taskId"`
+	ASIN            string    `json:"asin" firestore:"asin"`
+	Title           string    `json:"title" firestore:"title"`
+	SellerID        string    `json:"seller_id" firestore:"sellerId"`
+	Condition       int       `json:"condition" firestore:"condition"`
+	IsWarehouseDeal bool      `json:"is_warehouse_deal" firestore:"isWarehouseDeal"`
+	LandedPrice     int       `json:"landed_price" firestore:"landedPrice"`
+	BuyBoxPrice     int       `json:"buy_box_price" firestore:"buyBoxPrice"`
+	PricePercent    float64   `json:"price_percent" firestore:"pricePercent"`       // Landed price as a percentage of the new buy box
+	EstimatedMargin int       `json:"estimated_margin" firestore:"estimatedMargin"` // Buy box minus landed price, in cents, before fees
+	DetectedAt      time.Time `json:"detected_at" firestore:"detectedAt"`
+}
+
+// findOpportunities returns live used and warehouse deal offers whose landed price
+// is at most maxPercent of the new buy box price
+func findOpportunities(product *SimplifiedProduct, maxPercent float64) []Opportunity {
+	if product.BuyBoxPrice <= 0 {
+		return nil
+	}
+
+	var opportunities []Opportunity
+	for _, offer := range product.Offers {
+		isUsed := offer.Condition >= ConditionUsedLikeNew && offer.Condition <= ConditionUsedAcceptable
+		if !offer.IsLive || offer.Price <= 0 || (!isUsed && !offer.IsWarehouseDeal) {
+			continue
+		}
+
+		landedPrice := offer.Price + offer.Shipping
+		percent := float64(landedPrice) / float64(product.BuyBoxPrice) * 100
+		if percent > maxPercent {
+			continue
+		}
+		opportunities = append(opportunities, Opportunity{
+			ASIN:            product.Asin,
+			Title:           product.Title,
+			SellerID:        offer.SellerID,
+			Condition:       offer.Condition,
+			IsWarehouseDeal: offer.IsWarehouseDeal,
+			LandedPrice:     landedPrice,
+			BuyBoxPrice:     product.BuyBoxPrice,
+			PricePercent:    percent,
+			EstimatedMargin: product.BuyBoxPrice - landedPrice,
+		})
+	}
+	return opportunities
+}
+
+// recordOpportunities scans a processed product, stores each opportunity in
+// Firestore and sends a notification for it
+func recordOpportunities(taskID string, response *SimplifiedResponse) {
+	maxPercent, err := strconv.ParseFloat(getEnv("OPPORTUNITY_MAX_PRICE_PERCENT", "70"), 64)
+	if err != nil {
+		maxPercent = 70
+	}
+
+	ctx, cancel := context.WithTimeout(withTaskTenant(context.Background(), taskID), 30*time.Second)
+	defer cancel()
+
+	for i := range response.Products {
+		for _, opportunity := range findOpportunities(&response.Products[i], maxPercent) {
+			opportunity.TaskID = taskID
+			opportunity.DetectedAt = time.Now().UTC()
+
+			docID := fmt.Sprintf("%s_%s_%d", opportunity.ASIN, opportunity.SellerID, opportunity.Condition)
+			if _, err := tenantCollection(ctx, OpportunitiesCollection).Doc(docID).Set(ctx, opportunity); err != nil {
+				logger.Error("Failed to save opportunity", LogKeyTaskID, taskID, LogKeyASIN, opportunity.ASIN, "error", err)
+			}
+
+			sendNotification("opportunity", "info", fmt.Sprintf("%s offer for %s at %.0f%% of buy box", conditionLabel(opportunity), opportunity.ASIN, opportunity.PricePercent), map[string]interface{}{
+				"task_id":          taskID,
+				"asin":             opportunity.ASIN,
+				"seller_id":        opportunity.SellerID,
+				"landed_price":     opportunity.LandedPrice,
+				"buy_box_price":    opportunity.BuyBoxPrice,
+				"estimated_margin": opportunity.EstimatedMargin,
+			})
+		}
+	}
+}
+
+// conditionLabel describes the offer type of an opportunity
+func conditionLabel(opportunity Opportunity) string {
+	if opportunity.IsWarehouseDeal {
+		return "Warehouse deal"
+	}
+	return "Used"
+}
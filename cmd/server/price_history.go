@@ -0,0 +1,174 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"strings"
+	"time"
+)
+
+// Keepa csv types, the indexes of keepa.Product.Csv
+const (
+	CsvAmazon                 = 0
+	CsvNew                    = 1
+	CsvUsed                   = 2
+	CsvSales                  = 3 // Sales rank, not a price
+	CsvListPrice              = 4
+	CsvCollectible            = 5
+	CsvRefurbished            = 6
+	CsvNewFBMShipping         = 7
+	CsvLightningDeal          = 8
+	CsvWarehouse              = 9
+	CsvNewFBA                 = 10
+	CsvCountNew               = 11
+	CsvCountUsed              = 12
+	CsvCountRefurbished       = 13
+	CsvCountCollectible       = 14
+	CsvRating                 = 16 // Rating times ten, e.g. 45 for 4.5 stars
+	CsvCountReviews           = 17
+	CsvBuyBoxShipping         = 18
+	CsvUsedNewShipping        = 19
+	CsvUsedVeryGoodShipping   = 20
+	CsvUsedGoodShipping       = 21
+	CsvUsedAcceptableShipping = 22
+	CsvCollectibleNewShipping = 23
+	CsvRefurbishedShipping    = 27
+	CsvBuyBoxUsedShipping     = 32
+)
+
+// csvTypeNames maps the names used in KEEPA_PRICE_HISTORY and the API to csv types
+var csvTypeNames = map[string]int{
+	"AMAZON":                   CsvAmazon,
+	"NEW":                      CsvNew,
+	"USED":                     CsvUsed,
+	"SALES":                    CsvSales,
+	"LISTPRICE":                CsvListPrice,
+	"COLLECTIBLE":              CsvCollectible,
+	"REFURBISHED":              CsvRefurbished,
+	"NEW_FBM_SHIPPING":         CsvNewFBMShipping,
+	"LIGHTNING_DEAL":           CsvLightningDeal,
+	"WAREHOUSE":                CsvWarehouse,
+	"NEW_FBA":                  CsvNewFBA,
+	"COUNT_NEW":                CsvCountNew,
+	"COUNT_USED":               CsvCountUsed,
+	"COUNT_REFURBISHED":        CsvCountRefurbished,
+	"COUNT_COLLECTIBLE":        CsvCountCollectible,
+	"RATING":                   CsvRating,
+	"COUNT_REVIEWS":            CsvCountReviews,
+	"BUY_BOX_SHIPPING":         CsvBuyBoxShipping,
+	"USED_NEW_SHIPPING":        CsvUsedNewShipping,
+	"USED_VERY_GOOD_SHIPPING":  CsvUsedVeryGoodShipping,
+	"USED_GOOD_SHIPPING":       CsvUsedGoodShipping,
+	"USED_ACCEPTABLE_SHIPPING": CsvUsedAcceptableShipping,
+	"COLLECTIBLE_NEW_SHIPPING": CsvCollectibleNewShipping,
+	"REFURBISHED_SHIPPING":     CsvRefurbishedShipping,
+	"BUY_BOX_USED_SHIPPING":    CsvBuyBoxUsedShipping,
+}
+
+// PricePoint is one entry of a price history. Cents is -1 while there was no offer
+// (out of stock); for the sales rank, count and rating types it holds the raw value.
+type PricePoint struct {
+	Time     time.Time `json:"time"`
+	Cents    int       `json:"cents"`
+	Shipping int       `json:"shipping,omitempty"` // Shipping cost in cents, only for *_SHIPPING types
+}
+
+// Available reports whether the product had an offer at this point
+func (p PricePoint) Available() bool {
+	return p.Cents >= 0
+}
+
+// csvStride returns the number of elements per entry: the *_SHIPPING types (7,
+// 18 to 29 and 32) encode time, price and shipping, all others time and value
+func csvStride(csvType int) int {
+	if csvType == CsvNewFBMShipping || (csvType >= CsvBuyBoxShipping && csvType <= 29) || csvType == CsvBuyBoxUsedShipping {
+		return 3
+	}
+	return 2
+}
+
+// decodeCsvSeries decodes one csv history of a product. Keepa sends null for types
+// without data, which yields nil; a malformed array also yields nil.
+func decodeCsvSeries(csv []interface{}, csvType int) []PricePoint {
+	if csvType < 0 || csvType >= len(csv) || csv[csvType] == nil {
+		return nil
+	}
+	raw, ok := csv[csvType].([]interface{})
+	if !ok {
+		return nil
+	}
+	stride := csvStride(csvType)
+	if len(raw)%stride != 0 {
+		return nil
+	}
+
+	series := make([]PricePoint, 0, len(raw)/stride)
+	for i := 0; i < len(raw); i += stride {
+		values := make([]int, stride)
+		for j := range values {
+			number, ok := raw[i+j].(float64)
+			if !ok {
+				return nil
+			}
+			values[j] = int(number)
+		}
+		point := PricePoint{Time: keepatime.ToTime(values[0]), Cents: values[1]}
+		if stride == 3 {
+			point.Shipping = values[2]
+			if point.Cents < 0 || point.Shipping < 0 {
+				point.Cents, point.Shipping = -1, 0
+			}
+		}
+		series = append(series, point)
+	}
+	return series
+}
+
+// priceHistoryTypes are the csv histories included in simplified products, loaded from
+// KEEPA_PRICE_HISTORY, a comma-separated list of names such as "AMAZON,NEW,BUY_BOX_SHIPPING".
+// Empty disables the price history.
+var priceHistoryTypes = loadPriceHistoryTypes()
+
+// loadPriceHistoryTypes parses KEEPA_PRICE_HISTORY
+func loadPriceHistoryTypes() map[string]int {
+	types := make(map[string]int)
+	for _, name := range strings.Split(getEnv("KEEPA_PRICE_HISTORY", ""), ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		csvType, ok := csvTypeNames[name]
+		if !ok {
+			logger.Warn("Ignoring unknown csv type in KEEPA_PRICE_HISTORY", "csv_type", name)
+			continue
+		}
+		types[name] = csvType
+	}
+	return types
+}
+
+// decodePriceHistory decodes the configured csv histories of a product, keyed by type name
+func decodePriceHistory(product *keepa.Product, types map[string]int) map[string][]PricePoint {
+	if len(types) == 0 {
+		return nil
+	}
+	history := make(map[string][]PricePoint, len(types))
+	for name, csvType := range types {
+		if series := decodeCsvSeries(product.Csv, csvType); series != nil {
+			history[name] = series
+		}
+	}
+	if len(history) == 0 {
+		return nil
+	}
+	return history
+}
+
+// latestCsvValue returns the most recent value of a csv history, if it is available
+func latestCsvValue(csv []interface{}, csvType int) (int, bool) {
+	series := decodeCsvSeries(csv, csvType)
+	if len(series) == 0 || !series[len(series)-1].Available() {
+		return 0, false
+	}
+	return series[len(series)-1].Cents, true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeCsvSeries(t *testing.T) {
+	at := func(keepaMinutes int) time.Time {
+		return time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(keepaMinutes) * time.Minute)
+	}
+	// csvWith returns a csv array with series at index csvType and null elsewhere
+	csvWith := func(csvType int, series []interface{}) []interface{} {
+		csv := make([]interface{}, 33)
+		csv[csvType] = series
+		return csv
+	}
+
+	tests := []struct {
+		name    string
+		csv     []interface{}
+		csvType int
+		want    []PricePoint
+	}{
+		{
+			name:    "null entry",
+			csv:     make([]interface{}, 33),
+			csvType: CsvAmazon,
+			want:    nil,
+		},
+		{
+			name:    "type past the end",
+			csv:     []interface{}{[]interface{}{0.0, 1999.0}},
+			csvType: CsvNew,
+			want:    nil,
+		},
+		{
+			name:    "stride 2",
+			csv:     csvWith(CsvAmazon, []interface{}{7000000.0, 1999.0, 7000060.0, 1899.0}),
+			csvType: CsvAmazon,
+			want: []PricePoint{
+				{Time: time.Date(2024, 4, 23, 2, 40, 0, 0, time.UTC), Cents: 1999},
+				{Time: time.Date(2024, 4, 23, 3, 40, 0, 0, time.UTC), Cents: 1899},
+			},
+		},
+		{
+			name:    "no offer",
+			csv:     csvWith(CsvNew, []interface{}{100.0, 2500.0, 200.0, -1.0}),
+			csvType: CsvNew,
+			want:    []PricePoint{{Time: at(100), Cents: 2500}, {Time: at(200), Cents: -1}},
+		},
+		{
+			name:    "keepa epoch",
+			csv:     csvWith(CsvSales, []interface{}{0.0, 12345.0}),
+			csvType: CsvSales,
+			want:    []PricePoint{{Time: time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC), Cents: 12345}},
+		},
+		{
+			name:    "odd length",
+			csv:     csvWith(CsvAmazon, []interface{}{100.0, 1999.0, 200.0}),
+			csvType: CsvAmazon,
+			want:    nil,
+		},
+		{
+			name:    "empty series",
+			csv:     csvWith(CsvAmazon, []interface{}{}),
+			csvType: CsvAmazon,
+			want:    []PricePoint{},
+		},
+		{
+			name:    "not a number",
+			csv:     csvWith(CsvAmazon, []interface{}{100.0, "1999"}),
+			csvType: CsvAmazon,
+			want:    nil,
+		},
+		{
+			name:    "buy box shipping stride 3",
+			csv:     csvWith(CsvBuyBoxShipping, []interface{}{100.0, 2999.0, 499.0, 200.0, 2899.0, 0.0}),
+			csvType: CsvBuyBoxShipping,
+			want:    []PricePoint{{Time: at(100), Cents: 2999, Shipping: 499}, {Time: at(200), Cents: 2899}},
+		},
+		{
+			name:    "buy box shipping no offer",
+			csv:     csvWith(CsvBuyBoxShipping, []interface{}{100.0, -1.0, -1.0, 200.0, 2999.0, -1.0}),
+			csvType: CsvBuyBoxShipping,
+			want:    []PricePoint{{Time: at(100), Cents: -1}, {Time: at(200), Cents: -1}},
+		},
+		{
+			name:    "buy box shipping length not a multiple of 3",
+			csv:     csvWith(CsvBuyBoxShipping, []interface{}{100.0, 2999.0, 499.0, 200.0}),
+			csvType: CsvBuyBoxShipping,
+			want:    nil,
+		},
+		{
+			name:    "new FBM shipping stride 3",
+			csv:     csvWith(CsvNewFBMShipping, []interface{}{100.0, 1500.0, 350.0}),
+			csvType: CsvNewFBMShipping,
+			want:    []PricePoint{{Time: at(100), Cents: 1500, Shipping: 350}},
+		},
+		{
+			name:    "used acceptable shipping stride 3",
+			csv:     csvWith(CsvUsedAcceptableShipping, []interface{}{100.0, 800.0, 399.0}),
+			csvType: CsvUsedAcceptableShipping,
+			want:    []PricePoint{{Time: at(100), Cents: 800, Shipping: 399}},
+		},
+		{
+			name:    "buy box used shipping stride 3",
+			csv:     csvWith(CsvBuyBoxUsedShipping, []interface{}{100.0, 1200.0, 0.0}),
+			csvType: CsvBuyBoxUsedShipping,
+			want:    []PricePoint{{Time: at(100), Cents: 1200}},
+		},
+		{
+			name:    "stride 2 series read as shipping type",
+			csv:     csvWith(CsvRefurbishedShipping, []interface{}{100.0, 1200.0}),
+			csvType: CsvRefurbishedShipping,
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeCsvSeries(tt.csv, tt.csvType)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCsvSeries() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
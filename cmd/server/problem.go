@@ -0,0 +1,184 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ProblemContentType is the media type of error responses, see RFC 7807
+const ProblemContentType = "application/problem+json"
+
+// Machine-readable codes of error responses, the "code" member of a Problem
+const (
+	CodeInvalidRequest     = "invalid_request" // Malformed body, parameter or path
+	CodeInvalidQuery       = "invalid_query"   // A product or finder query that cannot be run
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodePayloadTooLarge    = "payload_too_large"
+	CodeRateLimited        = "rate_limited"      // Inbound rate limit or active task cap
+	CodeQueueFull          = "queue_full"        // The task queue of the instance is full
+	CodeTokenExhausted     = "token_exhausted"   // Not enough Keepa tokens to answer now
+	CodeKeepaUnavailable   = "keepa_unavailable" // Keepa calls are suspended or timed out
+	CodeKeepaError         = "keepa_error"       // Keepa answered with an error
+	CodeKeepaInvalidKey    = "keepa_invalid_key" // Keepa rejected the API key
+	CodeKeepaPayment       = "keepa_payment_required"
+	CodeNotConfigured      = "not_configured" // The feature is disabled in this deployment
+	CodeServiceUnavailable = "service_unavailable"
+	CodeInternal           = "internal_error"
+)
+
+// statusCodes is the default code of an error status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeInvalidRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusBadGateway:            CodeKeepaError,
+	http.StatusServiceUnavailable:    CodeServiceUnavailable,
+	http.StatusGatewayTimeout:        CodeKeepaUnavailable,
+}
+
+// Problem is an RFC 7807 problem details response. Type is a URI reference relative
+// to the API naming the code, so clients may switch on either.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"` // Path of the failed request
+	Code      string `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// newProblem describes a failure of the request of c
+func newProblem(c *gin.Context, status int, code, detail string) *Problem {
+	return &Problem{
+		Type:      "/problems/" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: c.Writer.Header().Get(RequestIDHeader),
+	}
+}
+
+// respondProblem answers with a problem of the given code and aborts the handler chain.
+// extra, if set, holds further members, e.g. the tasks started before a failure.
+func respondProblem(c *gin.Context, status int, code, detail string, extra ...gin.H) {
+	problem := newProblem(c, status, code, detail)
+	body := gin.H{
+		"type":   problem.Type,
+		"title":  problem.Title,
+		"status": problem.Status,
+		"code":   problem.Code,
+	}
+	if problem.Detail != "" {
+		body["detail"] = problem.Detail
+	}
+	if problem.Instance != "" {
+		body["instance"] = problem.Instance
+	}
+	if problem.RequestID != "" {
+		body["requestId"] = problem.RequestID
+	}
+	for _, members := range extra {
+		for key, value := range members {
+			body[key] = value
+		}
+	}
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatusJSON(status, body)
+}
+
+// respondError answers with a problem whose code follows from status
+func respondError(c *gin.Context, status int, detail string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	respondProblem(c, status, code, detail)
+}
+
+// respondKeepaError answers a failed Keepa call. Suspended calls answer 503
+// keepa_unavailable and exhausted tokens 503 token_exhausted, both with a Retry-After
+// header; timeouts answer 504. Requests Keepa rejected answer 400 invalid_query, or
+// 502 keepa_invalid_key or keepa_payment_required, with Keepa's error as keepaError.
+// Other errors answer status.
+func respondKeepaError(c *gin.Context, err error, status int, detail string) {
+	serviceErr := keepaServiceError(err, status, detail)
+	var extra []gin.H
+	var keepaErr *keepa.Error
+	if errors.As(err, &keepaErr) {
+		extra = append(extra, gin.H{"keepaError": keepaErr.Payload})
+	}
+	if serviceErr.RetryAfter > 0 {
+		setRetryAfter(c, serviceErr.RetryAfter.Seconds())
+	}
+	respondProblem(c, serviceErr.Status, serviceErr.Code, serviceErr.Detail, extra...)
+}
+
+// keepaServiceError describes a failed Keepa call as respondKeepaError answers it,
+// falling back to status
+func keepaServiceError(err error, status int, detail string) *ServiceError {
+	var keepaErr *keepa.Error
+	if errors.As(err, &keepaErr) {
+		switch {
+		case errors.Is(err, keepa.ErrInvalidQuery):
+			return &ServiceError{Status: http.StatusBadRequest, Code: CodeInvalidQuery, Detail: detail}
+		case errors.Is(err, keepa.ErrInvalidKey):
+			return &ServiceError{Status: http.StatusBadGateway, Code: CodeKeepaInvalidKey, Detail: detail}
+		case errors.Is(err, keepa.ErrPaymentRequired):
+			return &ServiceError{Status: http.StatusBadGateway, Code: CodeKeepaPayment, Detail: detail}
+		default:
+			return &ServiceError{Status: http.StatusBadGateway, Code: CodeKeepaError, Detail: detail}
+		}
+	}
+	switch classifyError(err) {
+	case ErrClassCircuitOpen:
+		return &ServiceError{Status: http.StatusServiceUnavailable, Code: CodeKeepaUnavailable, Detail: detail, RetryAfter: keepaBreaker.retryAfter()}
+	case ErrClassTokenExhausted:
+		return &ServiceError{Status: http.StatusServiceUnavailable, Code: CodeTokenExhausted, Detail: detail, RetryAfter: time.Minute}
+	case ErrClassTimeout:
+		return &ServiceError{Status: http.StatusGatewayTimeout, Code: CodeKeepaUnavailable, Detail: detail}
+	default:
+		return newServiceError(status, detail)
+	}
+}
+
+// setRetryAfter sets the Retry-After header to at least one second
+func setRetryAfter(c *gin.Context, seconds float64) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(seconds)))))
+}
+
+// problemMiddleware makes sure every request is answered: a panic answers 500 and a
+// handler returning without writing anything answers 500 as well, both as problems
+func problemMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.ErrorContext(c.Request.Context(), "Handler panicked", "panic", fmt.Sprint(recovered))
+				if !c.Writer.Written() {
+					respondProblem(c, http.StatusInternalServerError, CodeInternal, "The request failed unexpectedly")
+				}
+				c.Abort()
+			}
+		}()
+		c.Next()
+		if !c.Writer.Written() && c.Writer.Status() == http.StatusOK && c.Request.Method != http.MethodHead {
+			logger.ErrorContext(c.Request.Context(), "Handler returned without a response", "path", c.FullPath())
+			respondProblem(c, http.StatusInternalServerError, CodeInternal, "The request was not answered")
+		}
+	}
+}
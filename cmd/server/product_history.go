@@ -0,0 +1,106 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"time"
+)
+
+// defaultHistoryPeriod is the period of GET /products/:asin/history without from
+const defaultHistoryPeriod = 90 * 24 * time.Hour
+
+// maxHistorySnapshots caps the snapshots of one history response
+const maxHistorySnapshots = 1000
+
+// handleProductHistory returns the stored snapshots of a product between ?from (default
+// 90 days before to) and ?to (default now), both RFC 3339 timestamps or dates, oldest
+// first. At most maxHistorySnapshots are returned; "truncated" tells whether more exist.
+// ?domain= selects the marketplace.
+func handleProductHistory(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := parseReportTime(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid to, expected an RFC 3339 timestamp or YYYY-MM-DD")
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultHistoryPeriod)
+	if value := c.Query("from"); value != "" {
+		parsed, err := parseReportTime(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid from, expected an RFC 3339 timestamp or YYYY-MM-DD")
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		respondError(c, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	docs, truncated, err := loadSnapshots(c.Request.Context(), domain, asin, from, to, maxHistorySnapshots)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	formatter := timeFormatterFor(c)
+	snapshots := make([]gin.H, 0, len(docs))
+	for _, doc := range docs {
+		snapshots = append(snapshots, gin.H{
+			"time":     formatter.value(doc.UpdatedAt),
+			"products": formatter.products(doc.Products),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"asin":      asin,
+		"domain":    domain,
+		"from":      formatter.value(from),
+		"to":        formatter.value(to),
+		"snapshots": snapshots,
+		"count":     len(snapshots),
+		"truncated": truncated,
+	})
+}
+
+// loadSnapshots reads at most limit snapshots of a product of the tenant of ctx
+// updated between from and to, oldest first, and whether more exist
+func loadSnapshots(ctx context.Context, domain, asin string, from, to time.Time, limit int) ([]ProductDocument, bool, error) {
+	iter := productRef(ctx, domain, asin).Collection(ProductSnapshotsCollection).
+		Where("updatedAt", ">=", from).
+		Where("updatedAt", "<", to).
+		OrderBy("updatedAt", firestore.Asc).
+		Limit(limit + 1).
+		Documents(ctx)
+	defer iter.Stop()
+
+	docs := make([]ProductDocument, 0)
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return docs, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to read history of %s: %v", asin, err)
+		}
+		if len(docs) == limit {
+			return docs, true, nil
+		}
+		var doc ProductDocument
+		if err := snapshot.DataTo(&doc); err != nil {
+			return nil, false, fmt.Errorf("Failed to decode snapshot %s of %s: %v", snapshot.Ref.ID, asin, err)
+		}
+		docs = append(docs, doc)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ProductOptions overrides the KEEPA_* Product Request parameters of one request.
+// Unset options keep the deployment value.
+type ProductOptions struct {
+	Stats          *int  `json:"stats,omitempty" firestore:"stats,omitempty"`     // Days of statistics, 0 disables them
+	Days           *int  `json:"days,omitempty" firestore:"days,omitempty"`       // Days of history
+	Update         *int  `json:"update,omitempty" firestore:"update,omitempty"`   // Max data age in hours, -1 never refreshes
+	History        *bool `json:"history,omitempty" firestore:"history,omitempty"` // Include the csv histories
+	Offers         *int  `json:"offers,omitempty" firestore:"offers,omitempty"`   // Offers to fetch, 0 or 20 to 100
+	OnlyLiveOffers *bool `json:"onlyLiveOffers,omitempty" firestore:"onlyLiveOffers,omitempty"`
+	Rating         *bool `json:"rating,omitempty" firestore:"rating,omitempty"`
+	Buybox         *bool `json:"buybox,omitempty" firestore:"buybox,omitempty"`
+	Stock          *bool `json:"stock,omitempty" firestore:"stock,omitempty"` // Needs offers
+}
+
+// decodeProductOptions decodes and validates the options object of a request body
+func decodeProductOptions(raw interface{}) (*ProductOptions, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var options ProductOptions
+	if err := decoder.Decode(&options); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return &options, nil
+}
+
+// validate checks the overrides against the ranges Keepa accepts
+func (o *ProductOptions) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Stats != nil && *o.Stats < 0 {
+		return fmt.Errorf("stats must be 0 or more days")
+	}
+	if o.Days != nil && *o.Days < 1 {
+		return fmt.Errorf("days must be at least 1")
+	}
+	if o.Update != nil && *o.Update < -1 {
+		return fmt.Errorf("update must be -1 or more hours")
+	}
+	if o.Offers != nil && *o.Offers != 0 && (*o.Offers < 20 || *o.Offers > 100) {
+		return fmt.Errorf("offers must be 0 or between 20 and 100")
+	}
+	params := o.params()
+	if params["stock"] == "1" && params["offers"] == "0" {
+		return fmt.Errorf("stock needs offers")
+	}
+	return nil
+}
+
+// params resolves the Product Request parameters, overrides first, then KEEPA_*
+func (o *ProductOptions) params() map[string]string {
+	params := map[string]string{
+		"stats":            getEnv("KEEPA_STATS", "90"),
+		"update":           getEnv("KEEPA_UPDATE", "-1"),
+		"history":          getEnv("KEEPA_HISTORY", "1"),
+		"days":             getEnv("KEEPA_DAYS", "90"),
+		"offers":           getEnv("KEEPA_OFFERS", "20"),
+		"only-live-offers": getEnv("KEEPA_ONLY_LIVE_OFFERS", "1"),
+		"rating":           getEnv("KEEPA_RATING", "0"),
+		"buybox":           getEnv("KEEPA_BUYBOX", "1"),
+		"stock":            getEnv("KEEPA_STOCK", "1"),
+	}
+	if o == nil {
+		return params
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			params[name] = strconv.Itoa(*value)
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			params[name] = "0"
+			if *value {
+				params[name] = "1"
+			}
+		}
+	}
+	setInt("stats", o.Stats)
+	setInt("update", o.Update)
+	setBool("history", o.History)
+	setInt("days", o.Days)
+	setInt("offers", o.Offers)
+	setBool("only-live-offers", o.OnlyLiveOffers)
+	setBool("rating", o.Rating)
+	setBool("buybox", o.Buybox)
+	setBool("stock", o.Stock)
+	return params
+}
+
+// Keepa's Product Request token costs per product
+const (
+	productBaseTokens      = 1 // Every product
+	productRefreshTokens   = 1 // update >= 0, when the product is refreshed
+	productOfferPageTokens = 6 // Every page of up to 10 offers
+	productBuyBoxTokens    = 2 // buybox without offers; included in the offer cost
+	productStockTokens     = 2 // stock, needs offers
+	productRatingTokens    = 1 // rating, when the rating is refreshed
+)
+
+// productRequestTokens returns the worst case token cost of one product requested
+// with the resolved parameters
+func productRequestTokens(params map[string]string) int {
+	tokens := productBaseTokens
+	if update, err := strconv.Atoi(params["update"]); err == nil && update >= 0 {
+		tokens += productRefreshTokens
+	}
+	offers, _ := strconv.Atoi(params["offers"])
+	if offers > 0 {
+		tokens += productOfferPageTokens * ((offers + 9) / 10)
+		if params["stock"] == "1" {
+			tokens += productStockTokens
+		}
+	} else if params["buybox"] == "1" {
+		tokens += productBuyBoxTokens
+	}
+	if params["rating"] == "1" {
+		tokens += productRatingTokens
+	}
+	return tokens
+}
+
+// tokensPerASIN estimates the Product Request cost of one ASIN with the overrides
+// applied to the KEEPA_* parameters; a nil receiver uses the KEEPA_* parameters only
+func (o *ProductOptions) tokensPerASIN() int {
+	return productRequestTokens(o.params())
+}
+
+// taskProductOptions returns the Keepa parameter overrides of a task, nil when it has none
+func taskProductOptions(taskID string) *ProductOptions {
+	task, ok := tasks.get(taskID)
+	if !ok || task.Spec == nil {
+		return nil
+	}
+	return task.Spec.Options
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of a GET /products page
+const (
+	defaultProductQueryLimit = 50
+	maxProductQueryLimit     = 500
+)
+
+// productSortFields are the ProductDocument fields GET /products sorts by.
+// firestore.indexes.json has a composite index per equality filter, sort field and
+// direction; Firestore merges them for queries combining several filters.
+var productSortFields = map[string]bool{
+	"updatedAt":   true,
+	"buyBoxPrice": true,
+	"salesRank":   true,
+}
+
+// ProductQuery is a parsed GET /products request
+type ProductQuery struct {
+	Domain         string // Empty for all domains
+	Brand          string
+	Category       *int64
+	HasAmazonOffer *bool
+	MinPrice       *int // Buy box price range in cents
+	MaxPrice       *int
+	MinSalesRank   *int
+	MaxSalesRank   *int
+	Sort           string
+	Descending     bool
+	Limit          int
+	Cursor         *productCursor
+}
+
+// productCursor is the position after the last product of a page: the value of the
+// sort field and the document ID, see productDocID, which breaks ties
+type productCursor struct {
+	Number int64     `json:"n,omitempty"`
+	Time   time.Time `json:"t,omitempty"`
+	ASIN   string    `json:"id"`
+}
+
+// encode returns the opaque cursor string
+func (cursor *productCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeProductCursor parses a cursor returned by a previous page
+func decodeProductCursor(value string) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor productCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ASIN == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// queryInt parses an optional integer query parameter
+func queryInt(param func(name string) string, name string) (*int, error) {
+	value := param(name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return &n, nil
+}
+
+// parseProductQuery reads the filters, sort order and page of GET /products from the
+// query parameters returned by param. Firestore allows range filters on the sort field
+// only, so a price or sales rank range sorts by that field and both cannot be combined.
+func parseProductQuery(param func(name string) string) (*ProductQuery, error) {
+	query := &ProductQuery{Brand: param("brand"), Limit: defaultProductQueryLimit}
+	var err error
+
+	if value := param("domain"); value != "" {
+		if query.Domain, err = parseDomain(value); err != nil {
+			return nil, err
+		}
+	}
+	if value := param("category"); value != "" {
+		category, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("category must be a category ID")
+		}
+		query.Category = &category
+	}
+	if value := param("hasAmazonOffer"); value != "" {
+		hasAmazonOffer, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("hasAmazonOffer must be true or false")
+		}
+		query.HasAmazonOffer = &hasAmazonOffer
+	}
+	for name, target := range map[string]**int{
+		"minPrice":     &query.MinPrice,
+		"maxPrice":     &query.MaxPrice,
+		"minSalesRank": &query.MinSalesRank,
+		"maxSalesRank": &query.MaxSalesRank,
+	} {
+		if *target, err = queryInt(param, name); err != nil {
+			return nil, err
+		}
+	}
+	if value, err := queryInt(param, "limit"); err != nil {
+		return nil, err
+	} else if value != nil {
+		query.Limit = min(max(*value, 1), maxProductQueryLimit)
+	}
+
+	priceRange := query.MinPrice != nil || query.MaxPrice != nil
+	rankRange := query.MinSalesRank != nil || query.MaxSalesRank != nil
+	switch {
+	case priceRange && rankRange:
+		return nil, fmt.Errorf("filter by either a price or a sales rank range, not both")
+	case priceRange:
+		query.Sort = "buyBoxPrice"
+	case rankRange:
+		query.Sort = "salesRank"
+	default:
+		query.Sort = "updatedAt"
+		query.Descending = true
+	}
+	if sort := param("sort"); sort != "" {
+		if !productSortFields[sort] {
+			return nil, fmt.Errorf("sort must be one of updatedAt, buyBoxPrice or salesRank")
+		}
+		if (priceRange || rankRange) && sort != query.Sort {
+			return nil, fmt.Errorf("a %s range can only be sorted by %s", query.Sort, query.Sort)
+		}
+		query.Sort = sort
+		query.Descending = false
+	}
+	switch param("order") {
+	case "":
+	case "asc":
+		query.Descending = false
+	case "desc":
+		query.Descending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+
+	if value := param("cursor"); value != "" {
+		if query.Cursor, err = decodeProductCursor(value); err != nil {
+			return nil, err
+		}
+	}
+	return query, nil
+}
+
+// firestoreQuery builds the Firestore query of one page of the products of the tenant
+// of ctx. Products without a known buy box price or sales rank are left out when
+// sorting or filtering by it.
+func (query *ProductQuery) firestoreQuery(ctx context.Context) firestore.Query {
+	q := tenantCollection(ctx, ProductsCollection).Query
+	if query.Domain != "" {
+		q = q.Where("domain", "==", query.Domain)
+	}
+	if query.Brand != "" {
+		q = q.Where("brand", "==", query.Brand)
+	}
+	if query.Category != nil {
+		q = q.Where("categories", "array-contains", *query.Category)
+	}
+	if query.HasAmazonOffer != nil {
+		q = q.Where("hasAmazonOffer", "==", *query.HasAmazonOffer)
+	}
+
+	// Stored values of 0 are unknown
+	lower, upper := query.MinPrice, query.MaxPrice
+	if query.Sort == "salesRank" {
+		lower, upper = query.MinSalesRank, query.MaxSalesRank
+	}
+	if query.Sort != "updatedAt" {
+		from := 1
+		if lower != nil && *lower > 1 {
+			from = *lower
+		}
+		q = q.Where(query.Sort, ">=", from)
+		if upper != nil {
+			q = q.Where(query.Sort, "<=", *upper)
+		}
+	}
+
+	direction := firestore.Asc
+	if query.Descending {
+		direction = firestore.Desc
+	}
+	q = q.OrderBy(query.Sort, direction).OrderBy(firestore.DocumentID, direction)
+	if query.Cursor != nil {
+		var value interface{} = query.Cursor.Number
+		if query.Sort == "updatedAt" {
+			value = query.Cursor.Time
+		}
+		q = q.StartAfter(value, query.Cursor.ASIN)
+	}
+	// One more than the page tells whether there is a next page
+	return q.Limit(query.Limit + 1)
+}
+
+// run reads one page of products of the tenant of ctx and the cursor of the next
+// page, empty on the last one
+func (query *ProductQuery) run(ctx context.Context) ([]ProductDocument, string, error) {
+	iter := query.firestoreQuery(ctx).Documents(ctx)
+	defer iter.Stop()
+	docs := make([]ProductDocument, 0, query.Limit+1)
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to query products: %v", err)
+		}
+		var doc ProductDocument
+		if err := snapshot.DataTo(&doc); err != nil {
+			return nil, "", fmt.Errorf("Failed to decode product %s: %v", snapshot.Ref.ID, err)
+		}
+		if doc.Asin == "" {
+			doc.Asin = snapshot.Ref.ID
+		}
+		docs = append(docs, doc)
+	}
+
+	nextCursor := ""
+	if len(docs) > query.Limit {
+		docs = docs[:query.Limit]
+		nextCursor = query.cursorAfter(&docs[len(docs)-1]).encode()
+	}
+	return docs, nextCursor, nil
+}
+
+// cursorAfter returns the cursor positioned after a product document
+func (query *ProductQuery) cursorAfter(doc *ProductDocument) *productCursor {
+	cursor := &productCursor{ASIN: productDocID(doc.Domain, doc.Asin)}
+	switch query.Sort {
+	case "updatedAt":
+		cursor.Time = doc.UpdatedAt
+	case "buyBoxPrice":
+		cursor.Number = int64(doc.BuyBoxPrice)
+	case "salesRank":
+		cursor.Number = int64(doc.SalesRank)
+	}
+	return cursor
+}
+
+// handleQueryProducts lists stored products matching ?domain, ?brand, ?category,
+// ?hasAmazonOffer, a buy box price range (?minPrice, ?maxPrice in cents) or a sales
+// rank range (?minSalesRank, ?maxSalesRank), sorted by ?sort and ?order. Pages hold
+// ?limit products; ?cursor continues after the page that returned it as nextCursor.
+// Products stored before domains were tracked have no domain and only match without
+// ?domain.
+func handleQueryProducts(c *gin.Context) {
+	query, err := parseProductQuery(c.Query)
+	if err != nil {
+		respondProblem(c, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	docs, nextCursor, err := query.run(c.Request.Context())
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	formatter := timeFormatterFor(c)
+	products := make([]SimplifiedProduct, 0, len(docs))
+	for _, doc := range docs {
+		products = append(products, formatter.products(doc.Products)...)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"products":   products,
+		"count":      len(products),
+		"sort":       query.Sort,
+		"descending": query.Descending,
+		"nextCursor": nextCursor,
+	})
+}
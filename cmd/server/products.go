@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Product data sources reported by loadProduct
+const (
+	SourceRedis     = "redis"
+	SourceFirestore = "firestore"
+	SourceKeepa     = "keepa"
+)
+
+// loadProduct reads a stored product of a domain from Redis, falling back to Firestore.
+// The read is counted for the cache warmer.
+func loadProduct(ctx context.Context, domain, asin string) (*SimplifiedResponse, string, error) {
+	recordProductRead(ctx, domain, asin)
+	if product, err := getProductFromRedis(ctx, domain, asin); err == nil {
+		return product, SourceRedis, nil
+	}
+	product, err := getProductFromFirestore(ctx, domain, asin)
+	if err != nil {
+		return nil, "", err
+	}
+	return product, SourceFirestore, nil
+}
+
+// Response headers of GET /products/:asin
+const (
+	DataSourceHeader = "X-Data-Source" // SourceRedis, SourceFirestore or SourceKeepa
+	CacheHeader      = "X-Cache"       // "HIT" when served from Redis, "MISS" otherwise
+)
+
+// handleGetProduct returns a stored product from Redis, falling back to Firestore.
+// With ?refresh=true the product is fetched from Keepa and stored first. ?domain=
+// selects the marketplace.
+func (client *KeepaClient) handleGetProduct(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	response, source, err := client.getProduct(c.Request.Context(), domain, c.Param("asin"), c.Query("refresh") == "true")
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+
+	cache := "MISS"
+	if source == SourceRedis {
+		cache = "HIT"
+	}
+	c.Header(DataSourceHeader, source)
+	c.Header(CacheHeader, cache)
+	c.JSON(http.StatusOK, SimplifiedResponse{Products: timeFormatterFor(c).products(response.Products)})
+}
+
+// handleProductDomains compares the stored copies of an ASIN across the domains of
+// ?domains, all known domains when empty. Nothing is fetched from Keepa; domains
+// without a stored copy are listed with an error.
+func handleProductDomains(c *gin.Context) {
+	asin := c.Param("asin")
+	domains, err := parseDomains(c.Query("domains"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid domains: %v", err))
+		return
+	}
+	if len(domains) == 0 {
+		for _, name := range domainNames() {
+			domain, _ := parseDomain(name)
+			domains = append(domains, domain)
+		}
+	}
+
+	entries := make([]ComparisonEntry, 0, len(domains))
+	found := 0
+	for _, domain := range domains {
+		response, source, err := loadProduct(c.Request.Context(), domain, asin)
+		if err != nil || len(response.Products) == 0 {
+			entries = append(entries, ComparisonEntry{Asin: asin, Domain: domain, Error: "product not found"})
+			continue
+		}
+		entry := newComparisonEntry(&response.Products[0], source)
+		entry.Domain = domain
+		entries = append(entries, entry)
+		found++
+	}
+	if found == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s not found in any of the domains", asin))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"asin": asin, "domains": entries, "found": found})
+}
+
+// CompetitionEntry is one live offer in the competitor price matrix
+type CompetitionEntry struct {
+	SellerID      string `json:"sellerId"`
+	Condition     int    `json:"condition"`
+	IsFBA         bool   `json:"isFBA"`
+	IsPrime       bool   `json:"isPrime"`
+	IsAmazon      bool   `json:"isAmazon"`
+	Price         int    `json:"price"`
+	Shipping      int    `json:"shipping"`
+	LandedPrice   int    `json:"landedPrice"`
+	StockEstimate int    `json:"stockEstimate"`
+}
+
+// buildCompetitionMatrix lists the live offers of a product sorted by landed price
+func buildCompetitionMatrix(product *SimplifiedProduct) []CompetitionEntry {
+	entries := make([]CompetitionEntry, 0, len(product.Offers))
+	for _, offer := range product.Offers {
+		if !offer.IsLive || offer.Price <= 0 {
+			continue
+		}
+		entries = append(entries, CompetitionEntry{
+			SellerID:      offer.SellerID,
+			Condition:     offer.Condition,
+			IsFBA:         offer.IsFBA,
+			IsPrime:       offer.IsPrime,
+			IsAmazon:      offer.IsAmazon,
+			Price:         offer.Price,
+			Shipping:      offer.Shipping,
+			LandedPrice:   offer.Price + offer.Shipping,
+			StockEstimate: offer.StockEstimate,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LandedPrice < entries[j].LandedPrice
+	})
+	return entries
+}
+
+// handleProductCompetition returns the competitor price matrix of a stored product
+func handleProductCompetition(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	response, source, err := loadProduct(c.Request.Context(), domain, asin)
+	if err != nil || len(response.Products) == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+		return
+	}
+
+	product := response.Products[0]
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"asin":        product.Asin,
+		"domain":      domain,
+		"buyBoxPrice": product.BuyBoxPrice,
+		"source":      source,
+		"offers":      buildCompetitionMatrix(&product),
+	}))
+}
+
+// handleProductsByCode looks up the products of a UPC/EAN code on Keepa and stores
+// every resolved ASIN in Redis and Firestore. ?domain= selects the marketplace.
+func (client *KeepaClient) handleProductsByCode(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	code := c.Param("code")
+	if len(code) < 8 || len(code) > 14 || strings.Trim(code, "0123456789") != "" {
+		respondError(c, http.StatusBadRequest, "Invalid code, expected 8 to 14 digits")
+		return
+	}
+
+	requestID := generateTaskID()
+	responses, err := client.ProductRequestByCode(c.Request.Context(), domain, code)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	if len(responses) == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("No products found for code %s", code))
+		return
+	}
+
+	asins := make([]string, 0, len(responses))
+	for asin := range responses {
+		asins = append(asins, asin)
+	}
+	sort.Strings(asins)
+
+	formatter := timeFormatterFor(c)
+	results := make([]gin.H, 0, len(asins))
+	for _, asin := range asins {
+		result := gin.H{"asin": asin, "products": formatter.products(responses[asin].Products)}
+		if err := client.storeProduct(c.Request.Context(), requestID, domain, asin, responses[asin], nil); err != nil {
+			result["error"] = err.Error()
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"code": code, "domain": domain, "asins": asins, "results": results}))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cloud.google.com/go/pubsub"
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// Event types published to Pub/Sub. The type is also the "type" message attribute,
+// so subscriptions can filter on it.
+const (
+	EventTaskStarted    = "task.started"
+	EventTaskCompleted  = "task.completed" // Also sent for failed tasks, see Status
+	EventProductUpdated = "product.updated"
+
+	EventProductOutOfStock  = "product.out_of_stock"  // The product can no longer be bought
+	EventProductBackInStock = "product.back_in_stock" // The product can be bought again
+)
+
+// Event is the JSON payload of a Pub/Sub message
+type Event struct {
+	Type    string                  `json:"type"`
+	Time    time.Time               `json:"time"`
+	TaskID  string                  `json:"taskId,omitempty"`
+	Kind    string                  `json:"kind,omitempty"`   // Task kind
+	Status  string                  `json:"status,omitempty"` // Task status
+	Error   string                  `json:"error,omitempty"`
+	Summary *TaskSummary            `json:"summary,omitempty"`
+	ASIN    string                  `json:"asin,omitempty"`
+	Domain  string                  `json:"domain,omitempty"`  // Keepa domain of the product
+	Tenant  string                  `json:"tenant,omitempty"`  // Tenant of the task or product, empty for the deployment itself
+	Created bool                    `json:"created,omitempty"` // The product was not stored before
+	Changes map[string]ProductDelta `json:"changes,omitempty"` // Changed fields of product.updated, by name
+}
+
+// ProductDelta is the previous and the new value of a product field
+type ProductDelta struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// productDiffFields are the fields compared for product.updated
+var productDiffFields = map[string]func(p *SimplifiedProduct) interface{}{
+	"title":          func(p *SimplifiedProduct) interface{} { return p.Title },
+	"brand":          func(p *SimplifiedProduct) interface{} { return p.Brand },
+	"buyBoxPrice":    func(p *SimplifiedProduct) interface{} { return p.BuyBoxPrice },
+	"hasAmazonOffer": func(p *SimplifiedProduct) interface{} { return p.HasAmazonOffer },
+	"stock":          func(p *SimplifiedProduct) interface{} { return productStockState(p) },
+	"salesRank": func(p *SimplifiedProduct) interface{} {
+		rank, _ := latestSalesRank(p.SalesRanks)
+		return rank
+	},
+	"monthlySold":   func(p *SimplifiedProduct) interface{} { return p.MonthlySold },
+	"offerCountFBA": func(p *SimplifiedProduct) interface{} { return p.OfferCountFBA },
+	"offerCountFBM": func(p *SimplifiedProduct) interface{} { return p.OfferCountFBM },
+	"rating":        func(p *SimplifiedProduct) interface{} { return p.Rating },
+	"reviewCount":   func(p *SimplifiedProduct) interface{} { return p.ReviewCount },
+	"categories":    func(p *SimplifiedProduct) interface{} { return p.Categories },
+}
+
+// diffProducts returns the fields of productDiffFields that differ between previous
+// and current. Without a previous product every field is reported.
+func diffProducts(previous, current *SimplifiedProduct) map[string]ProductDelta {
+	changes := make(map[string]ProductDelta)
+	for name, value := range productDiffFields {
+		newValue := value(current)
+		if previous == nil {
+			changes[name] = ProductDelta{New: newValue}
+			continue
+		}
+		if oldValue := value(previous); !reflect.DeepEqual(oldValue, newValue) {
+			changes[name] = ProductDelta{Old: oldValue, New: newValue}
+		}
+	}
+	return changes
+}
+
+// eventPublisher publishes events to a Pub/Sub topic. Publishing is best effort: events
+// are sent in the background, retried with the pubsub policy and dropped after that,
+// counting the failure in the keepa.events.publish_errors metric.
+type eventPublisher struct {
+	topic  *pubsub.Topic
+	errors metric.Int64Counter
+}
+
+// pubsubEvents publishes to PUBSUB_TOPIC in PUBSUB_PROJECT (PROJECT_ID), nil when no topic is set
+var pubsubEvents = newEventPublisherFromEnv()
+
+// newEventPublisherFromEnv connects to the configured topic
+func newEventPublisherFromEnv() *eventPublisher {
+	topicID := getEnv("PUBSUB_TOPIC", "")
+	if topicID == "" {
+		return nil
+	}
+	project := getEnv("PUBSUB_PROJECT", getEnv("PROJECT_ID", ""))
+	client, err := pubsub.NewClient(context.Background(), project)
+	if err != nil {
+		logger.Error("Failed to create the Pub/Sub client, events are not published", "error", err)
+		return nil
+	}
+	publishErrors, _ := otel.Meter("Keepa-api").Int64Counter("keepa.events.publish_errors",
+		metric.WithDescription("Events dropped after failing to publish to Pub/Sub, by type"))
+	return &eventPublisher{topic: client.Topic(topicID), errors: publishErrors}
+}
+
+// enabled reports whether events are published, so callers can skip preparing them
+func (p *eventPublisher) enabled() bool {
+	return p != nil
+}
+
+// publish sends an event in the background. Events without a tenant get the one of ctx.
+func (p *eventPublisher) publish(ctx context.Context, event Event) {
+	if p == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	if event.Tenant == "" {
+		event.Tenant = tenantID(ctx)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to encode event", "type", event.Type, "error", err)
+		return
+	}
+	attributes := map[string]string{"type": event.Type}
+	if event.TaskID != "" {
+		attributes["taskId"] = event.TaskID
+	}
+	if event.ASIN != "" {
+		attributes["asin"] = event.ASIN
+	}
+	if event.Domain != "" {
+		attributes["domain"] = event.Domain
+	}
+	if event.Tenant != "" {
+		attributes["tenant"] = event.Tenant
+	}
+
+	// Detached from ctx, which usually ends with the request or task step
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := withRetry(ctx, DependencyPubSub, func() error {
+			publishCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			_, err := p.topic.Publish(publishCtx, &pubsub.Message{Data: data, Attributes: attributes}).Get(publishCtx)
+			return err
+		})
+		if err != nil {
+			p.errors.Add(ctx, 1, metric.WithAttributes(attribute.String("event.type", event.Type)))
+			logger.ErrorContext(ctx, "Failed to publish event", "type", event.Type, "error", err)
+		}
+	}()
+}
+
+// publishTask sends a task lifecycle event
+func (p *eventPublisher) publishTask(eventType string, task *Task) {
+	if p == nil {
+		return
+	}
+	ctx := withLogAttrs(context.Background(), slog.String(LogKeyTaskID, task.ID))
+	p.publish(ctx, Event{
+		Type:    eventType,
+		TaskID:  task.ID,
+		Kind:    task.Kind,
+		Status:  task.Status,
+		Error:   task.Error,
+		Summary: task.Summary,
+		Tenant:  task.TenantID,
+	})
+}
+
+// publishProductUpdates sends product.updated for every product of current whose
+// fields changed since previous, which is nil for products stored the first time
+func (p *eventPublisher) publishProductUpdates(ctx context.Context, taskID, domain string, previous, current *SimplifiedResponse) {
+	if p == nil {
+		return
+	}
+	before := make(map[string]*SimplifiedProduct)
+	if previous != nil {
+		for i := range previous.Products {
+			before[previous.Products[i].Asin] = &previous.Products[i]
+		}
+	}
+	for i := range current.Products {
+		product := &current.Products[i]
+		old := before[product.Asin]
+		changes := diffProducts(old, product)
+		if len(changes) == 0 {
+			continue
+		}
+		p.publish(ctx, Event{
+			Type:    EventProductUpdated,
+			TaskID:  taskID,
+			ASIN:    product.Asin,
+			Domain:  domain,
+			Created: old == nil,
+			Changes: changes,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"sync"
+)
+
+// Quota warning levels, from least to most severe
+const (
+	QuotaLevelLow      = "low"
+	QuotaLevelCritical = "critical"
+)
+
+// QuotaWarning tells API consumers that the shared token bucket is running low,
+// so fresh Keepa data is delayed and responses lean on cached products
+type QuotaWarning struct {
+	Level      string `json:"level" firestore:"level"`
+	TokensLeft int    `json:"tokens_left" firestore:"tokensLeft"`
+	Threshold  int    `json:"threshold" firestore:"threshold"`
+	Message    string `json:"message" firestore:"message"`
+}
+
+// quotaMonitor tracks the token level against the warning thresholds
+type quotaMonitor struct {
+	mu         sync.Mutex
+	tokensLeft int
+	observed   bool
+}
+
+var quota = &quotaMonitor{}
+
+// thresholds reads QUOTA_WARNING_TOKENS and QUOTA_CRITICAL_TOKENS, so reloads apply
+func (m *quotaMonitor) thresholds() (low, critical int) {
+	low, _ = strconv.Atoi(getEnv("QUOTA_WARNING_TOKENS", "100"))
+	critical, _ = strconv.Atoi(getEnv("QUOTA_CRITICAL_TOKENS", "30"))
+	return low, critical
+}
+
+// observe records the current token level
+func (m *quotaMonitor) observe(tokensLeft int) {
+	m.mu.Lock()
+	m.tokensLeft = tokensLeft
+	m.observed = true
+	m.mu.Unlock()
+}
+
+// warning returns the warning for the current token level, or nil while tokens are sufficient
+func (m *quotaMonitor) warning() *QuotaWarning {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.observed {
+		return nil
+	}
+	low, critical := m.thresholds()
+	switch {
+	case m.tokensLeft < critical:
+		return &QuotaWarning{
+			Level:      QuotaLevelCritical,
+			TokensLeft: m.tokensLeft,
+			Threshold:  critical,
+			Message:    "Keepa tokens are nearly exhausted; new data is heavily delayed and most results are served from cache",
+		}
+	case m.tokensLeft < low:
+		return &QuotaWarning{
+			Level:      QuotaLevelLow,
+			TokensLeft: m.tokensLeft,
+			Threshold:  low,
+			Message:    "Keepa tokens are low; fresh data may be delayed and more results are served from cache",
+		}
+	}
+	return nil
+}
+
+// moreSevere reports whether w is a more severe warning than other
+func (w *QuotaWarning) moreSevere(other *QuotaWarning) bool {
+	if w == nil {
+		return false
+	}
+	return other == nil || (w.Level == QuotaLevelCritical && other.Level != QuotaLevelCritical)
+}
+
+// withQuotaWarning adds the current quota warning, if any, to a response body
+func withQuotaWarning(body gin.H) gin.H {
+	if warning := quota.warning(); warning != nil {
+		body["quota_warning"] = warning
+	}
+	return body
+}
+
+// quotaWarningMiddleware reports a low token bucket in the X-Quota-Warning header of every
+// response to the deployment itself; tenants spend their own keys
+func quotaWarningMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tenantFrom(c.Request.Context()) != nil {
+			c.Next()
+			return
+		}
+		if warning := quota.warning(); warning != nil {
+			c.Header("X-Quota-Warning", fmt.Sprintf("%s; tokens_left=%d", warning.Level, warning.TokensLeft))
+		}
+		c.Next()
+	}
+}
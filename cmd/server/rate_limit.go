@@ -0,0 +1,206 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimitRedisKeyPrefix prefixes the inbound rate limit buckets, followed by the
+// limit name and the caller
+const RateLimitRedisKeyPrefix = "keepa:ratelimit:"
+
+// activeTaskRetryAfter is the Retry-After of a caller at its active task cap. Tasks
+// run for minutes, so a short wait would only repeat the rejection.
+const activeTaskRetryAfter = 30 * time.Second
+
+type callerKey struct{}
+
+// callerFrom returns the caller of ctx as set by rateLimitMiddleware, "" outside requests
+func callerFrom(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// configureClientIP decides where the client IP of the per-IP limits comes from. By
+// default no proxy is trusted and the peer address is used, as X-Forwarded-For is set
+// by the client. TRUSTED_PROXIES lists the CIDRs of the load balancers whose
+// X-Forwarded-For entries are trusted, TRUSTED_PLATFORM names a header the platform
+// sets to the client IP instead, e.g. "X-Appengine-Remote-Addr" or "CF-Connecting-IP".
+func configureClientIP(r *gin.Engine) error {
+	var proxies []string
+	for _, proxy := range strings.Split(getEnv("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.TrustedPlatform = getEnv("TRUSTED_PLATFORM", "")
+	return nil
+}
+
+// requestCaller identifies the caller of a request for rate limiting: the authenticated
+// principal, else the tenant, else the client IP
+func requestCaller(ctx context.Context, clientIP string) string {
+	if principal := principalFrom(ctx); principal != nil {
+		return principal.Method + ":" + principal.ID
+	}
+	if tenant := tenantFrom(ctx); tenant != nil {
+		return "tenant:" + tenant.ID
+	}
+	return "ip:" + clientIP
+}
+
+// withCaller returns a copy of ctx carrying caller, see callerFrom
+func withCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// rateLimit is a per-caller token bucket kept in Redis, so all instances enforce it together
+type rateLimit struct {
+	name      string
+	prefix    string
+	perMinute int // Default refill rate
+	burst     int // Default capacity
+}
+
+// newRateLimit configures the limit <prefix>_PER_MINUTE with the burst <prefix>_BURST.
+// Both are read on use, so config reloads apply.
+func newRateLimit(name, prefix string, perMinute, burst int) *rateLimit {
+	return &rateLimit{name: name, prefix: prefix, perMinute: perMinute, burst: burst}
+}
+
+// envLimit parses a limit variable, where 0 disables the limit
+func envLimit(key string, defaultValue int) int {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// allow takes a token of caller's bucket. When none is left it returns false with the
+// time until one is. When Redis fails the request is allowed.
+func (l *rateLimit) allow(ctx context.Context, caller string) (bool, time.Duration) {
+	return l.take(ctx, caller, 1)
+}
+
+// exhausted reports whether caller's bucket is empty, without taking a token, and the
+// time until one is back. When Redis fails the bucket counts as not empty.
+func (l *rateLimit) exhausted(ctx context.Context, caller string) (bool, time.Duration) {
+	ok, retryAfter := l.take(ctx, caller, 0)
+	return !ok, retryAfter
+}
+
+// take takes required tokens, 0 or 1, of caller's bucket. With 0 it only checks that a
+// token is left.
+func (l *rateLimit) take(ctx context.Context, caller string, required int) (bool, time.Duration) {
+	perMinute := float64(envLimit(l.prefix+"_PER_MINUTE", l.perMinute))
+	if perMinute <= 0 {
+		return true, 0
+	}
+	key := RateLimitRedisKeyPrefix + l.name + ":" + caller
+	result, err := consumeTokensScript.Run(ctx, redisClient, []string{key}, perMinute, envInt(l.prefix+"_BURST", l.burst), required, 0).Int64Slice()
+	if err != nil {
+		logger.WarnContext(ctx, "Rate limit unavailable, allowing the request", "limit", l.name, "error", err)
+		return true, 0
+	}
+	if result[0] == 1 || required == 0 && result[1] >= 1 {
+		return true, 0
+	}
+	// The balance is rounded down, so waiting for a whole token is an upper bound
+	return false, time.Duration(float64(time.Minute) / perMinute)
+}
+
+// tooManyRequests answers 429 rate_limited with a Retry-After of whole seconds
+func tooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+	setRetryAfter(c, retryAfter.Seconds())
+	seconds, _ := strconv.Atoi(c.Writer.Header().Get("Retry-After"))
+	respondProblem(c, http.StatusTooManyRequests, CodeRateLimited, message, gin.H{"retryAfterSeconds": seconds})
+}
+
+// requestRateLimit limits every caller to RATE_LIMIT_PER_MINUTE (120) requests with
+// bursts of RATE_LIMIT_BURST (60). A limit of 0 disables it.
+var requestRateLimit = newRateLimit("requests", "RATE_LIMIT", 120, 60)
+
+// taskRateLimit limits every caller to TASK_RATE_LIMIT_PER_MINUTE (10) new tasks with
+// bursts of TASK_RATE_LIMIT_BURST (5). A limit of 0 disables it.
+var taskRateLimit = newRateLimit("tasks", "TASK_RATE_LIMIT", 10, 5)
+
+// failedAuthLimit limits every client IP to AUTH_FAILURE_LIMIT_PER_MINUTE (10) rejected
+// credentials with bursts of AUTH_FAILURE_LIMIT_BURST (20), so guessing keys cannot
+// cause unbounded Firestore reads. A limit of 0 disables it.
+var failedAuthLimit = newRateLimit("auth-failures", "AUTH_FAILURE_LIMIT", 10, 20)
+
+// rateLimitMiddleware applies requestRateLimit. Keepa notifications are not limited,
+// as Keepa sends them in bursts.
+func rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller := requestCaller(c.Request.Context(), c.ClientIP())
+		c.Request = c.Request.WithContext(withCaller(c.Request.Context(), caller))
+		if c.Request.URL.Path == "/keepa/notifications" {
+			c.Next()
+			return
+		}
+		if ok, retryAfter := requestRateLimit.allow(c.Request.Context(), caller); !ok {
+			tooManyRequests(c, retryAfter, "Rate limit exceeded, slow down")
+			return
+		}
+		c.Next()
+	}
+}
+
+// taskLimitMiddleware guards the routes starting Keepa tasks with checkTaskLimits
+func taskLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := checkTaskLimits(c.Request.Context()); err != nil {
+			tooManyRequests(c, err.RetryAfter, err.Detail)
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkTaskLimits rejects the caller of ctx with 429 past taskRateLimit or with
+// MAX_ACTIVE_TASKS_PER_CALLER (5) tasks pending or running, 0 disabling the cap
+func checkTaskLimits(ctx context.Context) *ServiceError {
+	caller := callerFrom(ctx)
+	if maxActive := envLimit("MAX_ACTIVE_TASKS_PER_CALLER", 5); maxActive > 0 {
+		active, err := activeTasksOf(ctx, caller)
+		if err != nil {
+			logger.WarnContext(ctx, "Failed to count active tasks, allowing the request", "error", err)
+		} else if active >= maxActive {
+			return &ServiceError{Status: http.StatusTooManyRequests, Code: CodeRateLimited,
+				Detail: fmt.Sprintf("%d tasks are still active, the limit is %d", active, maxActive), RetryAfter: activeTaskRetryAfter}
+		}
+	}
+	if ok, retryAfter := taskRateLimit.allow(ctx, caller); !ok {
+		return &ServiceError{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Detail: "Task rate limit exceeded, slow down", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// activeTasksOf counts the pending and running tasks a caller started on any instance.
+// Tasks of this instance not flushed to Firestore yet are counted from memory, so a
+// burst of requests within TASK_PERSIST_INTERVAL cannot pass the cap.
+func activeTasksOf(ctx context.Context, caller string) (int, error) {
+	query := firestoreClient.Collection(TasksCollection).
+		Where("createdBy", "==", caller).
+		Where("status", "in", []string{"pending", "running"})
+	result, err := query.NewAggregationQuery().WithCount("active").Get(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count active tasks: %v", err)
+	}
+	count, ok := result["active"].(*firestorepb.Value)
+	if !ok {
+		return 0, fmt.Errorf("failed to count active tasks: unexpected result %v", result["active"])
+	}
+	return int(count.GetIntegerValue()) + tasks.unsavedActiveOf(caller), nil
+}
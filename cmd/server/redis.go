@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+)
+
+// getProductFromRedis reads a product from productLocalCache, then from Redis. When
+// Redis fails, an expired local entry younger than the product TTL is served instead.
+func getProductFromRedis(ctx context.Context, domain, asin string) (*SimplifiedResponse, error) {
+	key := productCacheKey(ctx, domain, asin)
+	data, ok := productLocalCache.get(key)
+	if ok {
+		recordCacheLookup(ctx, CacheLayerLocal, CacheResultHit)
+	} else {
+		recordCacheLookup(ctx, CacheLayerLocal, CacheResultMiss)
+		err := withRetry(ctx, DependencyRedis, func() error {
+			var err error
+			data, err = redisClient.Get(ctx, key).Bytes()
+			return err
+		})
+		if err == redis.Nil {
+			recordCacheLookup(ctx, CacheLayerRedis, CacheResultMiss)
+			return nil, fmt.Errorf("product not found in Redis")
+		} else if err != nil {
+			recordCacheLookup(ctx, CacheLayerRedis, CacheResultError)
+			if data, ok = productLocalCache.stale(key); !ok {
+				return nil, fmt.Errorf("failed to get product from Redis: %v", err)
+			}
+			recordCacheLookup(ctx, CacheLayerLocal, CacheResultStale)
+			logger.WarnContext(ctx, "Redis unavailable, serving product from the local cache", LogKeyASIN, asin, "error", err)
+		} else {
+			recordCacheLookup(ctx, CacheLayerRedis, CacheResultHit)
+			productLocalCache.set(key, data, cacheTTLBase(CacheTypeProduct))
+		}
+	}
+	var simplifiedResponse SimplifiedResponse
+	err := json.Unmarshal(data, &simplifiedResponse)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product from Redis: %v", err)
+	}
+	return &simplifiedResponse, nil
+}
+
+// getProductsFromRedis reads several products in one round trip, checking productLocalCache
+// first. ASINs without a usable cached product are returned as misses, in the order
+// given. When Redis fails the ASINs not in the local cache, even expired, are misses
+// and the error is returned along with the products found.
+func getProductsFromRedis(ctx context.Context, domain string, asins []string) (map[string]*SimplifiedResponse, []string, error) {
+	found := make(map[string]*SimplifiedResponse, len(asins))
+	cached := make(map[string][]byte, len(asins))
+	var keys, keyASINs []string
+	for _, asin := range asins {
+		key := productCacheKey(ctx, domain, asin)
+		if data, ok := productLocalCache.get(key); ok {
+			recordCacheLookup(ctx, CacheLayerLocal, CacheResultHit)
+			cached[asin] = data
+			continue
+		}
+		recordCacheLookup(ctx, CacheLayerLocal, CacheResultMiss)
+		keys = append(keys, key)
+		keyASINs = append(keyASINs, asin)
+	}
+
+	var redisErr error
+	if len(keys) > 0 {
+		var values []interface{}
+		redisErr = withRetry(ctx, DependencyRedis, func() error {
+			var err error
+			values, err = redisGetMany(ctx, keys)
+			return err
+		})
+		for i, key := range keys {
+			asin := keyASINs[i]
+			if redisErr != nil {
+				recordCacheLookup(ctx, CacheLayerRedis, CacheResultError)
+				if data, ok := productLocalCache.stale(key); ok {
+					recordCacheLookup(ctx, CacheLayerLocal, CacheResultStale)
+					cached[asin] = data
+				}
+				continue
+			}
+			value, ok := values[i].(string)
+			if !ok {
+				recordCacheLookup(ctx, CacheLayerRedis, CacheResultMiss)
+				continue
+			}
+			recordCacheLookup(ctx, CacheLayerRedis, CacheResultHit)
+			cached[asin] = []byte(value)
+			productLocalCache.set(key, cached[asin], cacheTTLBase(CacheTypeProduct))
+		}
+		if redisErr != nil {
+			logger.WarnContext(ctx, "Redis unavailable, serving products from the local cache", "asins", len(keys), "error", redisErr)
+			redisErr = fmt.Errorf("failed to get products from Redis: %v", redisErr)
+		}
+	}
+
+	var misses []string
+	for _, asin := range asins {
+		data, ok := cached[asin]
+		if !ok {
+			misses = append(misses, asin)
+			continue
+		}
+		var simplifiedResponse SimplifiedResponse
+		if err := json.Unmarshal(data, &simplifiedResponse); err != nil {
+			logger.WarnContext(ctx, "Failed to unmarshal product from Redis", LogKeyASIN, asin, "error", err)
+			misses = append(misses, asin)
+			continue
+		}
+		found[asin] = &simplifiedResponse
+	}
+	return found, misses, redisErr
+}
+
+// saveProductToRedis caches a product in productLocalCache and Redis. The local copy is
+// kept even when Redis fails, so lookups do not go to Keepa while Redis is down.
+func saveProductToRedis(ctx context.Context, domain, asin string, simplifiedResponse *SimplifiedResponse) error {
+	key := productCacheKey(ctx, domain, asin)
+	data, _ := json.Marshal(simplifiedResponse)
+	ttl := cacheTTL(CacheTypeProduct)
+	productLocalCache.set(key, data, ttl)
+	return withRetry(ctx, DependencyRedis, func() error {
+		return redisClient.Set(ctx, key, data, ttl).Err()
+	})
+}
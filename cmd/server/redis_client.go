@@ -0,0 +1,69 @@
+package main
+
+import (
+	"Keepa-api/internal/storage"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+)
+
+// redisMode returns REDIS_MODE, standalone when it is unset or unknown
+func redisMode() string {
+	mode := getEnv("REDIS_MODE", storage.RedisModeStandalone)
+	if _, ok := storage.RedisPoolDefaults[mode]; !ok {
+		logger.Warn("Ignoring unsupported REDIS_MODE", "value", mode)
+		return storage.RedisModeStandalone
+	}
+	return mode
+}
+
+// newRedisClient creates the Redis client of REDIS_MODE. All modes satisfy
+// redis.UniversalClient, so callers do not depend on the deployment:
+//
+//	standalone  REDIS_ADDR is the instance (localhost:6379), REDIS_DB the database
+//	cluster     REDIS_ADDR lists seed nodes separated by commas
+//	sentinel    REDIS_ADDR lists the sentinels, REDIS_SENTINEL_MASTER names the master
+//	            and REDIS_SENTINEL_PASSWORD authenticates to the sentinels
+//
+// The REDIS_PASSWORD secret authenticates to the data nodes. It is read for every new
+// connection, so a rotated password needs no restart, except in sentinel mode.
+// REDIS_POOL_SIZE and REDIS_MIN_IDLE_CONNS override the pool defaults of the mode.
+func newRedisClient(mode string, tlsConfig *tls.Config) redis.UniversalClient {
+	addrs := strings.Split(getEnv("REDIS_ADDR", "localhost:6379"), ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	redisDB, _ := strconv.Atoi(getEnv("REDIS_DB", "0"))
+	pool := storage.RedisPoolDefaults[mode]
+	return storage.NewRedis(storage.RedisOptions{
+		Mode:  mode,
+		Addrs: addrs,
+		DB:    redisDB,
+		Password: func() string {
+			return secret("REDIS_PASSWORD", "")
+		},
+		SentinelMaster:   getEnv("REDIS_SENTINEL_MASTER", "mymaster"),
+		SentinelPassword: secret("REDIS_SENTINEL_PASSWORD", ""),
+		Pool: storage.RedisPool{
+			Size:    envInt("REDIS_POOL_SIZE", pool.Size),
+			MinIdle: envInt("REDIS_MIN_IDLE_CONNS", pool.MinIdle),
+		},
+		TLSConfig: tlsConfig,
+	})
+}
+
+// redisTLSConfig trusts the CA of REDIS_TLS_CA_FILE or, without it, the server CA of
+// the Memorystore instance INSTANCE_ID in PROJECT_ID and REGION
+func redisTLSConfig(ctx context.Context) (*tls.Config, error) {
+	instance := fmt.Sprintf("projects/%s/locations/%s/instances/%s", getEnv("PROJECT_ID", ""), getEnv("REGION", ""), getEnv("INSTANCE_ID", ""))
+	return storage.RedisTLSConfig(ctx, getEnv("REDIS_TLS_CA_FILE", ""), instance)
+}
+
+// redisGetMany reads several keys of redisClient in one round trip, returning nil for
+// missing keys
+func redisGetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	return storage.GetMany(ctx, redisClient, keys)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RefreshRequest selects stored products to re-fetch from Keepa
+type RefreshRequest struct {
+	Domain      string `json:"domain"` // Keepa domain ID or name, KEEPA_DOMAIN when empty
+	Brand       string `json:"brand"`
+	Category    int64  `json:"category"`
+	StaleAfter  string `json:"staleAfter"`  // Only refresh products older than this duration, e.g. "24h"
+	TokenBudget int    `json:"tokenBudget"` // Maximum tokens the refresh may consume
+}
+
+// findRefreshCandidates resolves the ASINs matching a refresh request from Firestore,
+// stalest first, limited to at most maxASINs entries. Documents stored before domains
+// were tracked have no domain and belong to the default domain, so that domain is
+// filtered after the query, reading further pages until maxASINs are collected.
+func findRefreshCandidates(ctx context.Context, req *RefreshRequest, staleBefore time.Time, maxASINs int) ([]string, error) {
+	query := tenantCollection(ctx, ProductsCollection).Query
+	filterDomain := req.Domain == defaultDomain()
+	if !filterDomain {
+		query = query.Where("domain", "==", req.Domain)
+	}
+	if req.Brand != "" {
+		query = query.Where("brand", "==", req.Brand)
+	}
+	if req.Category != 0 {
+		query = query.Where("categories", "array-contains", req.Category)
+	}
+	if !staleBefore.IsZero() {
+		query = query.Where("updatedAt", "<", staleBefore)
+	}
+	query = query.OrderBy("updatedAt", firestore.Asc).Limit(maxASINs).Select("asin", "domain", "updatedAt")
+
+	var asins []string
+	var last *firestore.DocumentSnapshot
+	for len(asins) < maxASINs {
+		pageQuery := query
+		if last != nil {
+			pageQuery = query.StartAfter(last)
+		}
+		docs, err := pageQuery.Documents(ctx).GetAll()
+		if err != nil {
+			return nil, fmt.Errorf("failed to query products from Firestore: %v", err)
+		}
+		for _, doc := range docs {
+			var product ProductDocument
+			if err := doc.DataTo(&product); err != nil {
+				return nil, fmt.Errorf("failed to decode product %s from Firestore: %v", doc.Ref.ID, err)
+			}
+			if product.Domain != "" && product.Domain != req.Domain {
+				continue
+			}
+			if product.Asin == "" {
+				product.Asin = doc.Ref.ID
+			}
+			if asins = append(asins, product.Asin); len(asins) == maxASINs {
+				break
+			}
+		}
+		// Without the domain filter every document matched, so one page is enough
+		if !filterDomain || len(docs) < maxASINs {
+			break
+		}
+		last = docs[len(docs)-1]
+	}
+	return asins, nil
+}
+
+// handleRefresh re-fetches stored products matching a brand/category/staleness query.
+// When no product matches it answers 200 without starting a task.
+func (client *KeepaClient) handleRefresh(c *gin.Context) {
+	var req RefreshRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	domain, err := parseDomain(req.Domain)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid domain: %v", err))
+		return
+	}
+	req.Domain = domain
+	if req.Brand == "" && req.Category == 0 && req.StaleAfter == "" {
+		respondError(c, http.StatusBadRequest, "At least one of brand, category or staleAfter is required")
+		return
+	}
+
+	var staleBefore time.Time
+	if req.StaleAfter != "" {
+		staleAfter, err := time.ParseDuration(req.StaleAfter)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid staleAfter: %v", err))
+			return
+		}
+		staleBefore = time.Now().UTC().Add(-staleAfter)
+	}
+
+	if req.TokenBudget <= 0 {
+		req.TokenBudget, _ = strconv.Atoi(getEnv("REFRESH_TOKEN_BUDGET", "600"))
+	}
+	maxASINs := req.TokenBudget / calculateProductRequestTokens(1)
+	if maxASINs < 1 {
+		respondError(c, http.StatusBadRequest, "Token budget too small to refresh a single product")
+		return
+	}
+
+	asins, err := findRefreshCandidates(c.Request.Context(), &req, staleBefore, maxASINs)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(asins) == 0 {
+		c.JSON(http.StatusOK, gin.H{"domain": req.Domain, "asins": []string{}, "message": "No stored products match the refresh query"})
+		return
+	}
+	// Only a refresh that starts a task counts toward the task limits
+	if err := checkTaskLimits(c.Request.Context()); err != nil {
+		tooManyRequests(c, err.RetryAfter, err.Detail)
+		return
+	}
+
+	taskID := generateTaskID()
+	client.Logger.InfoContext(c.Request.Context(), "Created refresh task", LogKeyTaskID, taskID, "domain", req.Domain, "asins", len(asins), "token_budget", req.TokenBudget)
+
+	tasks.create(c.Request.Context(), taskID, TaskKindASINs)
+	tasks.update(taskID, func(task *Task) { task.Domain = req.Domain })
+	tasks.addASINs(taskID, asins)
+
+	if !enqueueTask(func() { client.runASINTask(taskID, asins, false) }) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{
+		"task_id":          taskID,
+		"status":           "pending",
+		"domain":           req.Domain,
+		"asins":            asins,
+		"estimated_tokens": calculateProductRequestTokens(len(asins)),
+	}))
+}
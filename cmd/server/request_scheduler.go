@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// Priorities of Keepa requests waiting for tokens, higher is served first
+const (
+	PriorityBulk        = 0 // Task crawls and scheduled jobs
+	PriorityInteractive = 1 // Requests a caller is waiting on, e.g. a single-ASIN lookup
+)
+
+// priorityNames names the priorities in GET /keepa/token-waits
+var priorityNames = map[int]string{
+	PriorityBulk:        "bulk",
+	PriorityInteractive: "interactive",
+}
+
+// tokenWaiter is a request queued for tokens
+type tokenWaiter struct {
+	priority int
+	seq      uint64
+	index    int
+}
+
+// tokenWaiterHeap orders waiters by priority, then arrival
+type tokenWaiterHeap []*tokenWaiter
+
+func (h tokenWaiterHeap) Len() int { return len(h) }
+func (h tokenWaiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h tokenWaiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *tokenWaiterHeap) Push(x interface{}) {
+	waiter := x.(*tokenWaiter)
+	waiter.index = len(*h)
+	*h = append(*h, waiter)
+}
+func (h *tokenWaiterHeap) Pop() interface{} {
+	old := *h
+	waiter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return waiter
+}
+
+// requestScheduler lets only the most urgent waiting request reserve tokens, so an
+// interactive lookup is not stuck behind the requests of a large task
+type requestScheduler struct {
+	mu      sync.Mutex
+	turn    *sync.Cond
+	waiters tokenWaiterHeap
+	seq     uint64
+}
+
+var keepaScheduler = newRequestScheduler()
+
+// newRequestScheduler creates an empty scheduler
+func newRequestScheduler() *requestScheduler {
+	s := &requestScheduler{}
+	s.turn = sync.NewCond(&s.mu)
+	return s
+}
+
+// enter queues a request with the given priority
+func (s *requestScheduler) enter(priority int) *tokenWaiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	waiter := &tokenWaiter{priority: priority, seq: s.seq}
+	heap.Push(&s.waiters, waiter)
+	s.turn.Broadcast()
+	return waiter
+}
+
+// awaitTurn blocks until the waiter is the most urgent queued request
+func (s *requestScheduler) awaitTurn(waiter *tokenWaiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.waiters[0] != waiter {
+		s.turn.Wait()
+	}
+}
+
+// leave removes the waiter from the queue and wakes the others
+func (s *requestScheduler) leave(waiter *tokenWaiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	heap.Remove(&s.waiters, waiter.index)
+	s.turn.Broadcast()
+}
+
+// queued counts the waiting requests by priority name
+func (s *requestScheduler) queued() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(priorityNames))
+	for _, name := range priorityNames {
+		counts[name] = 0
+	}
+	for _, waiter := range s.waiters {
+		counts[priorityNames[waiter.priority]]++
+	}
+	return counts
+}
+
+// requestPriorityFor returns the priority of Product Requests made for a request ID:
+// tasks are bulk work, any other ID belongs to a request a caller is waiting on
+func requestPriorityFor(requestID string) int {
+	if _, ok := tasks.get(requestID); ok {
+		return PriorityBulk
+	}
+	return PriorityInteractive
+}
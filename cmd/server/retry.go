@@ -0,0 +1,134 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"time"
+)
+
+// Dependencies with their own retry policy
+const (
+	DependencyKeepa     = "keepa"
+	DependencyRedis     = "redis"
+	DependencyFirestore = "firestore"
+	DependencyWebhook   = "webhook"
+	DependencyPubSub    = "pubsub"
+)
+
+// defaultRetryPolicies are used for dependencies missing from RETRY_POLICIES
+var defaultRetryPolicies = map[string]keepa.RetryPolicy{
+	DependencyKeepa: keepa.DefaultRetryPolicy,
+	DependencyRedis: {
+		MaxAttempts: 3, InitialBackoff: "50ms", MaxBackoff: "1s", Backoff: "exponential", Jitter: 0.2,
+		RetryOn: []string{keepa.RetryOnNetwork, keepa.RetryOnTimeout},
+	},
+	DependencyFirestore: {
+		MaxAttempts: 4, InitialBackoff: "200ms", MaxBackoff: "10s", Backoff: "exponential", Jitter: 0.3,
+		RetryOn: []string{keepa.RetryOnUnavailable, keepa.RetryOnTimeout, keepa.RetryOnRateLimited},
+	},
+	DependencyWebhook: {
+		MaxAttempts: 5, InitialBackoff: "1s", MaxBackoff: "1m", Backoff: "exponential", Jitter: 0.5,
+		RetryOn: []string{keepa.RetryOnNetwork, keepa.RetryOnTimeout, keepa.RetryOnServerError, keepa.RetryOnRateLimited},
+	},
+	DependencyPubSub: {
+		MaxAttempts: 3, InitialBackoff: "1s", MaxBackoff: "30s", Backoff: "exponential", Jitter: 0.3,
+		RetryOn: []string{keepa.RetryOnUnavailable, keepa.RetryOnTimeout, keepa.RetryOnRateLimited},
+	},
+}
+
+// retryPolicies is loaded once at startup from RETRY_POLICIES or RETRY_POLICIES_FILE,
+// a JSON object keyed by dependency name
+var retryPolicies = loadRetryPolicies()
+
+// loadRetryPolicies merges configured policies over the defaults
+func loadRetryPolicies() map[string]keepa.RetryPolicy {
+	policies := make(map[string]keepa.RetryPolicy, len(defaultRetryPolicies))
+	for name, policy := range defaultRetryPolicies {
+		policies[name] = policy
+	}
+
+	data := []byte(getEnv("RETRY_POLICIES", ""))
+	if path := getEnv("RETRY_POLICIES_FILE", ""); len(data) == 0 && path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error("Failed to read retry policies file", "path", path, "error", err)
+			return policies
+		}
+		data = fileData
+	}
+	if len(data) == 0 {
+		return policies
+	}
+
+	var configured map[string]keepa.RetryPolicy
+	if err := json.Unmarshal(data, &configured); err != nil {
+		logger.Error("Failed to parse retry policies", "error", err)
+		return policies
+	}
+	for name, policy := range configured {
+		if policy.MaxAttempts < 1 {
+			logger.Warn("Ignoring retry policy: maxAttempts must be at least 1", "dependency", name)
+			continue
+		}
+		policies[name] = policy
+	}
+	return policies
+}
+
+// retryPolicyFor returns the policy of a dependency
+func retryPolicyFor(dependency string) keepa.RetryPolicy {
+	if policy, ok := retryPolicies[dependency]; ok {
+		return policy
+	}
+	return keepa.RetryPolicy{MaxAttempts: 1}
+}
+
+// withRetry calls fn until it succeeds, returns a non-retryable error, the
+// dependency's attempts or elapsed time are exhausted or ctx is done
+func withRetry(ctx context.Context, dependency string, fn func() error) error {
+	policy := retryPolicyFor(dependency)
+	startedAt := time.Now()
+	var err error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if !policy.Retries(retryErrorClass(err)) {
+			break
+		}
+		wait := policy.Delay(attempt)
+		if !policy.AllowsRetry(attempt, startedAt, wait) {
+			break
+		}
+
+		logger.WarnContext(ctx, "Retrying call after error", "dependency", dependency, "attempt", attempt, "max_attempts", policy.MaxAttempts, "wait_seconds", wait.Seconds(), "error", err)
+		if waitErr := tokenWaits.sleepContext(ctx, WaitReasonRetryBackoff, dependency, wait); waitErr != nil {
+			return fmt.Errorf("%v (retry aborted: %v)", err, waitErr)
+		}
+	}
+	return err
+}
+
+// retryErrorClass classifies err for retry decisions, adding gRPC status codes to
+// the classes known to the Keepa client
+func retryErrorClass(err error) string {
+	if class := keepa.ErrorClass(err); class != "" {
+		return class
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.Aborted:
+			return keepa.RetryOnUnavailable
+		case codes.DeadlineExceeded:
+			return keepa.RetryOnTimeout
+		case codes.ResourceExhausted:
+			return keepa.RetryOnRateLimited
+		}
+	}
+	return ""
+}
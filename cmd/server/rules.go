@@ -0,0 +1,242 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// RuleCondition compares a product metric against a constant, e.g. offerCount < 20
+type RuleCondition struct {
+	Metric string  `json:"metric"`
+	Op     string  `json:"op"` // "<", "<=", ">", ">=", "==", "!="
+	Value  float64 `json:"value"`
+}
+
+// InclusionRule decides whether a part of the simplified output is kept.
+// Target is "product" (drop the whole product) or "offers" (drop the offer list).
+type InclusionRule struct {
+	Target string          `json:"target"`
+	When   []RuleCondition `json:"when"`
+}
+
+// ComputedField adds an extra field to the simplified product. When Metric is
+// set the field holds that metric's value, otherwise it holds the result of When.
+type ComputedField struct {
+	Name   string          `json:"name"`
+	Metric string          `json:"metric,omitempty"`
+	When   []RuleCondition `json:"when,omitempty"`
+}
+
+// SimplificationRules holds the configurable rules evaluated during simplification
+type SimplificationRules struct {
+	Include  []InclusionRule `json:"include"`
+	Computed []ComputedField `json:"computed"`
+}
+
+// simplificationRules holds the rules of SIMPLIFY_RULES or SIMPLIFY_RULES_FILE. They are
+// loaded at startup and replaced on config reloads, see loadSimplificationRules.
+var simplificationRules atomic.Pointer[SimplificationRules]
+
+// loadSimplificationRules replaces the rules with those of the current configuration.
+// Invalid rules are an error, so a typo cannot silently turn off simplification.
+func loadSimplificationRules() error {
+	rules, err := parseSimplificationRules(func(key string) string { return getEnv(key, "") })
+	if err != nil {
+		return err
+	}
+	simplificationRules.Store(rules)
+	return nil
+}
+
+// parseSimplificationRules reads the rules from the inline JSON of SIMPLIFY_RULES or
+// the JSON file of SIMPLIFY_RULES_FILE, looking the variables up with env
+func parseSimplificationRules(env func(key string) string) (*SimplificationRules, error) {
+	rules := &SimplificationRules{}
+
+	data := []byte(env("SIMPLIFY_RULES"))
+	if path := env("SIMPLIFY_RULES_FILE"); len(data) == 0 && path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read simplification rules file %s: %v", path, err)
+		}
+		data = fileData
+	}
+	if len(data) == 0 {
+		return rules, nil
+	}
+
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse simplification rules: %v", err)
+	}
+	if err := rules.validate(); err != nil {
+		return nil, fmt.Errorf("invalid simplification rules: %v", err)
+	}
+	return rules, nil
+}
+
+// validate checks that every rule references a known metric, operator and target
+func (rules *SimplificationRules) validate() error {
+	checkConditions := func(conditions []RuleCondition) error {
+		for _, cond := range conditions {
+			if _, ok := productMetricFuncs[cond.Metric]; !ok {
+				return fmt.Errorf("unknown metric %q", cond.Metric)
+			}
+			if _, err := compareMetric(0, cond.Op, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, rule := range rules.Include {
+		if rule.Target != "product" && rule.Target != "offers" {
+			return fmt.Errorf("unknown inclusion target %q", rule.Target)
+		}
+		if err := checkConditions(rule.When); err != nil {
+			return err
+		}
+	}
+	for _, field := range rules.Computed {
+		if field.Name == "" {
+			return fmt.Errorf("computed field without name")
+		}
+		if field.Metric != "" {
+			if _, ok := productMetricFuncs[field.Metric]; !ok {
+				return fmt.Errorf("unknown metric %q", field.Metric)
+			}
+		}
+		if err := checkConditions(field.When); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply evaluates the rules against a product, mutating the simplified output.
+// It returns false when the product should be dropped entirely.
+func (rules *SimplificationRules) apply(product *keepa.Product, simplified *SimplifiedProduct) bool {
+	if rules == nil || (len(rules.Include) == 0 && len(rules.Computed) == 0) {
+		return true
+	}
+
+	for _, rule := range rules.Include {
+		if evaluateConditions(product, rule.When) {
+			continue
+		}
+		switch rule.Target {
+		case "product":
+			return false
+		case "offers":
+			simplified.Offers = nil
+		}
+	}
+
+	for _, field := range rules.Computed {
+		if simplified.Computed == nil {
+			simplified.Computed = make(map[string]interface{})
+		}
+		if field.Metric != "" {
+			simplified.Computed[field.Name] = productMetricFuncs[field.Metric](product)
+			continue
+		}
+		simplified.Computed[field.Name] = evaluateConditions(product, field.When)
+	}
+	return true
+}
+
+// evaluateConditions returns true when all conditions hold
+func evaluateConditions(product *keepa.Product, conditions []RuleCondition) bool {
+	for _, cond := range conditions {
+		metricFunc, ok := productMetricFuncs[cond.Metric]
+		if !ok {
+			return false
+		}
+		result, err := compareMetric(metricFunc(product), cond.Op, cond.Value)
+		if err != nil || !result {
+			return false
+		}
+	}
+	return true
+}
+
+// compareMetric applies a comparison operator
+func compareMetric(left float64, op string, right float64) (bool, error) {
+	switch op {
+	case "<":
+		return left < right, nil
+	case "<=":
+		return left <= right, nil
+	case ">":
+		return left > right, nil
+	case ">=":
+		return left >= right, nil
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+	return false, fmt.Errorf("unknown operator %q", op)
+}
+
+// productMetricFuncs lists the metrics rules can refer to
+var productMetricFuncs = map[string]func(product *keepa.Product) float64{
+	"offerCount": func(product *keepa.Product) float64 {
+		return float64(len(product.Offers))
+	},
+	"fbaOfferCount": func(product *keepa.Product) float64 {
+		count := 0
+		for _, offer := range product.Offers {
+			if offer.IsFBA {
+				count++
+			}
+		}
+		return float64(count)
+	},
+	"amazonOffer": func(product *keepa.Product) float64 {
+		for _, offer := range product.Offers {
+			if offer.IsAmazon {
+				return 1
+			}
+		}
+		return 0
+	},
+	"buyBoxPrice": func(product *keepa.Product) float64 {
+		return float64(product.Stats.BuyBoxPrice)
+	},
+	"salesRank": func(product *keepa.Product) float64 {
+		// Index 3 of the stats arrays is the SALES (rank) series
+		if len(product.Stats.Current) > 3 {
+			return float64(product.Stats.Current[3])
+		}
+		return -1
+	},
+	"monthlySold": func(product *keepa.Product) float64 {
+		return float64(product.MonthlySold)
+	},
+	"referralFeePercent": func(product *keepa.Product) float64 {
+		return referralFeePercent(product)
+	},
+	"pickAndPackFee": func(product *keepa.Product) float64 {
+		return float64(product.FbaFees.PickAndPackFee)
+	},
+	"margin": func(product *keepa.Product) float64 {
+		// Percentage of the buy box price left after referral and FBA fees
+		price := float64(product.Stats.BuyBoxPrice)
+		if price <= 0 {
+			return 0
+		}
+		fees := price*referralFeePercent(product)/100 + float64(product.FbaFees.PickAndPackFee)
+		return (price - fees) / price * 100
+	},
+}
+
+// referralFeePercent prefers the precise percentage and falls back to the integer one
+func referralFeePercent(product *keepa.Product) float64 {
+	if product.ReferralFeePercentage > 0 {
+		return product.ReferralFeePercentage
+	}
+	return float64(product.ReferralFeePercent)
+}
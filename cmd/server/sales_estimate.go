@@ -0,0 +1,130 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepatime"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// OfferSalesEstimate is the estimated sales of one offer
+type OfferSalesEstimate struct {
+	SellerID   string `json:"sellerId" firestore:"sellerId"`
+	UnitsSold  int    `json:"unitsSold" firestore:"unitsSold"`
+	Decrements int    `json:"decrements" firestore:"decrements"` // Stock decreases counted as sales
+	Ignored    int    `json:"ignored" firestore:"ignored"`       // Decreases too large to be sales, e.g. removed stock
+}
+
+// SalesEstimate estimates the units sold of a product from the stock decreases of its offers
+type SalesEstimate struct {
+	WindowDays int                  `json:"windowDays" firestore:"windowDays"`
+	UnitsSold  int                  `json:"unitsSold" firestore:"unitsSold"`
+	Offers     []OfferSalesEstimate `json:"offers" firestore:"offers"`
+	ComputedAt time.Time            `json:"computedAt" firestore:"computedAt"`
+}
+
+// salesEstimateSettings returns the default window (SALES_ESTIMATE_WINDOW_DAYS) and the
+// largest single decrease counted as sales (SALES_ESTIMATE_MAX_DROP)
+func salesEstimateSettings() (int, int) {
+	windowDays, err := strconv.Atoi(getEnv("SALES_ESTIMATE_WINDOW_DAYS", "30"))
+	if err != nil || windowDays <= 0 {
+		windowDays = 30
+	}
+	maxDrop, err := strconv.Atoi(getEnv("SALES_ESTIMATE_MAX_DROP", "20"))
+	if err != nil || maxDrop <= 0 {
+		maxDrop = 20
+	}
+	return windowDays, maxDrop
+}
+
+// estimateSales sums the stock decreases of every offer within the last windowDays.
+// Increases are restocks and ignored; decreases above maxDrop are treated as stock
+// being pulled rather than sold. Returns nil when no offer has a stock history.
+func estimateSales(product *SimplifiedProduct, windowDays, maxDrop int, now time.Time) *SalesEstimate {
+	since := now.UTC().AddDate(0, 0, -windowDays)
+	estimate := &SalesEstimate{WindowDays: windowDays, Offers: []OfferSalesEstimate{}, ComputedAt: now.UTC()}
+	hasHistory := false
+
+	for _, offer := range product.Offers {
+		if len(offer.StockCSV) < 2 {
+			continue
+		}
+		hasHistory = true
+
+		// The keys sort chronologically, see storedTimeLayout
+		keys := make([]string, 0, len(offer.StockCSV))
+		for key := range offer.StockCSV {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		offerEstimate := OfferSalesEstimate{SellerID: offer.SellerID}
+		for i := 1; i < len(keys); i++ {
+			t, err := keepatime.ParseKey(keys[i])
+			if err != nil || t.Before(since) {
+				continue
+			}
+			drop := offer.StockCSV[keys[i-1]] - offer.StockCSV[keys[i]]
+			if drop <= 0 {
+				continue
+			}
+			if drop > maxDrop {
+				offerEstimate.Ignored++
+				continue
+			}
+			offerEstimate.UnitsSold += drop
+			offerEstimate.Decrements++
+		}
+		if offerEstimate.Decrements > 0 || offerEstimate.Ignored > 0 {
+			estimate.Offers = append(estimate.Offers, offerEstimate)
+			estimate.UnitsSold += offerEstimate.UnitsSold
+		}
+	}
+	if !hasHistory {
+		return nil
+	}
+	sort.Slice(estimate.Offers, func(i, j int) bool {
+		return estimate.Offers[i].UnitsSold > estimate.Offers[j].UnitsSold
+	})
+	return estimate
+}
+
+// handleSalesEstimate estimates the units sold of a stored product from its offers'
+// stock histories. ?days overrides SALES_ESTIMATE_WINDOW_DAYS.
+func handleSalesEstimate(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	windowDays, maxDrop := salesEstimateSettings()
+	if days := c.Query("days"); days != "" {
+		parsed, err := strconv.Atoi(days)
+		if err != nil || parsed <= 0 {
+			respondError(c, http.StatusBadRequest, "Invalid days")
+			return
+		}
+		windowDays = parsed
+	}
+
+	response, source, err := loadProduct(c.Request.Context(), domain, asin)
+	if err != nil || len(response.Products) == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+		return
+	}
+	estimate := estimateSales(&response.Products[0], windowDays, maxDrop, time.Now())
+	if estimate == nil {
+		respondError(c, http.StatusUnprocessableEntity, fmt.Sprintf("Product %s has no stock history, fetch it with KEEPA_STOCK=1", asin))
+		return
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"asin":     asin,
+		"domain":   domain,
+		"source":   source,
+		"estimate": estimate,
+	}))
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Firestore collections of the scheduler; runs are a subcollection of each schedule
+const (
+	SchedulesCollection    = "schedules"
+	ScheduleRunsCollection = "runs"
+)
+
+// Statuses of a schedule run
+const (
+	ScheduleRunStarted   = "started"
+	ScheduleRunSkipped   = "skipped" // The task of the previous run was still active
+	ScheduleRunCompleted = "completed"
+	ScheduleRunFailed    = "failed"
+)
+
+// maxScheduleRuns caps the runs returned by GET /schedules/:id/runs
+const maxScheduleRuns = 100
+
+// Schedule starts a fetch task with a POST /keepa body whenever its cron expression fires
+type Schedule struct {
+	ID           string                 `json:"id" firestore:"-"`
+	Name         string                 `json:"name,omitempty" firestore:"name"`
+	Cron         string                 `json:"cron" firestore:"cron"`                           // Standard 5-field expression or a descriptor such as @daily
+	TimeZone     string                 `json:"timeZone,omitempty" firestore:"timeZone"`         // IANA zone the expression is evaluated in, UTC by default
+	Enabled      bool                   `json:"enabled" firestore:"enabled"`                     // Disabled schedules are kept but never run
+	Request      map[string]interface{} `json:"request" firestore:"request"`                     // POST /keepa body, built into a task spec on every run
+	NextRunAt    time.Time              `json:"nextRunAt" firestore:"nextRunAt"`                 // Next firing time
+	LastRunAt    *time.Time             `json:"lastRunAt,omitempty" firestore:"lastRunAt"`       // Last firing time, also when the run was skipped
+	ActiveTaskID string                 `json:"activeTaskId,omitempty" firestore:"activeTaskId"` // Task of the last run until it finishes
+	CreatedAt    time.Time              `json:"createdAt" firestore:"createdAt"`
+}
+
+// ScheduleRun is one firing of a schedule, stored in its runs subcollection
+type ScheduleRun struct {
+	ID             string     `json:"id" firestore:"-"`
+	ScheduledAt    time.Time  `json:"scheduledAt" firestore:"scheduledAt"` // Firing time of the cron expression
+	StartedAt      time.Time  `json:"startedAt" firestore:"startedAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty" firestore:"finishedAt"`
+	Status         string     `json:"status" firestore:"status"`
+	TaskID         string     `json:"taskId,omitempty" firestore:"taskId"`
+	Error          string     `json:"error,omitempty" firestore:"error"` // Failure or skip reason
+	TokensConsumed int        `json:"tokensConsumed,omitempty" firestore:"tokensConsumed"`
+}
+
+// scheduleParser accepts standard cron expressions and descriptors such as @hourly
+var scheduleParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// nextRun returns the first firing time of a schedule after t
+func (s *Schedule) nextRun(t time.Time) (time.Time, error) {
+	location, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timeZone: %v", err)
+	}
+	expression, err := scheduleParser.Parse(s.Cron)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron: %v", err)
+	}
+	return expression.Next(t.In(location)).UTC(), nil
+}
+
+// fetchSpec builds the task spec of the schedule's request. The request is copied,
+// since building the spec consumes its keys.
+func (s *Schedule) fetchSpec(ctx context.Context) (*FetchTaskSpec, string, error) {
+	request := make(map[string]interface{}, len(s.Request))
+	for key, value := range s.Request {
+		request[key] = value
+	}
+	return buildFetchSpec(ctx, request, "")
+}
+
+// scheduleRef returns the document of a schedule of a tenant, "" for the deployment itself
+func scheduleRef(tenantID, scheduleID string) *firestore.DocumentRef {
+	return tenantCollectionByID(tenantID, SchedulesCollection).Doc(scheduleID)
+}
+
+// startSchedules runs the due schedules every SCHEDULE_POLL_INTERVAL (1m). Every
+// instance polls; a transaction makes sure only one of them starts each run.
+func (client *KeepaClient) startSchedules() {
+	interval := envDuration("SCHEDULE_POLL_INTERVAL", time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := client.runDueSchedules(ctx); err != nil {
+				client.Logger.Error("Failed to run due schedules", "error", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// runDueSchedules starts a run of every enabled schedule whose next run is due, those
+// of the tenants included
+func (client *KeepaClient) runDueSchedules(ctx context.Context) error {
+	iter := firestoreClient.CollectionGroup(SchedulesCollection).
+		Where("enabled", "==", true).
+		Where("nextRunAt", "<=", time.Now().UTC()).
+		Documents(ctx)
+	defer iter.Stop()
+	for {
+		snapshot, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query due schedules: %v", err)
+		}
+		if err := client.runSchedule(ctx, snapshot.Ref); err != nil {
+			client.Logger.ErrorContext(ctx, "Failed to run schedule", "schedule_id", snapshot.Ref.ID, "error", err)
+		}
+	}
+}
+
+// runSchedule claims the due run of a schedule and starts its task. The run is skipped
+// while the task of the previous run is still pending or running, so slow scans never
+// overlap. A missed firing, e.g. during a deployment, runs once when it is noticed.
+// Schedules of a disabled tenant do not run.
+func (client *KeepaClient) runSchedule(ctx context.Context, ref *firestore.DocumentRef) error {
+	if id := tenantOfRef(ref); id != "" {
+		tenant, err := tenants.byID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if tenant == nil || tenant.Disabled {
+			return nil
+		}
+		ctx = withTenant(ctx, tenant)
+	}
+	var schedule Schedule
+	var run ScheduleRun
+	claimed := false
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		snapshot, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		schedule = Schedule{}
+		if err := snapshot.DataTo(&schedule); err != nil {
+			return err
+		}
+		schedule.ID = ref.ID
+		now := time.Now().UTC()
+		if !schedule.Enabled || schedule.NextRunAt.After(now) {
+			return nil // Claimed by another instance
+		}
+		next, err := schedule.nextRun(now)
+		if err != nil {
+			return err
+		}
+
+		run = ScheduleRun{ScheduledAt: schedule.NextRunAt, StartedAt: now, Status: ScheduleRunStarted}
+		activeTaskID := schedule.ActiveTaskID
+		if activeTaskID != "" && taskActive(ctx, activeTaskID) {
+			run.Status = ScheduleRunSkipped
+			run.Error = fmt.Sprintf("task %s of the previous run is still active", activeTaskID)
+		} else {
+			run.TaskID = generateTaskID()
+			activeTaskID = run.TaskID
+		}
+		run.ID = run.TaskID
+		if run.ID == "" {
+			run.ID = strconv.FormatInt(now.UnixNano(), 10)
+		}
+		claimed = true
+		if err := tx.Create(ref.Collection(ScheduleRunsCollection).Doc(run.ID), run); err != nil {
+			return err
+		}
+		return tx.Update(ref, []firestore.Update{
+			{Path: "nextRunAt", Value: next},
+			{Path: "lastRunAt", Value: now},
+			{Path: "activeTaskId", Value: activeTaskID},
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to claim schedule run: %v", err)
+	}
+	if !claimed {
+		return nil
+	}
+	if run.Status == ScheduleRunSkipped {
+		client.Logger.WarnContext(ctx, "Skipped schedule run", "schedule_id", schedule.ID, "reason", run.Error)
+		return nil
+	}
+
+	spec, callbackURL, err := schedule.fetchSpec(ctx)
+	if err != nil {
+		// No task was created, so nothing else finishes the run
+		err = fmt.Errorf("invalid request: %v", err)
+		finishScheduleRun(Task{ID: run.TaskID, ScheduleID: schedule.ID, TenantID: tenantID(ctx), Status: "failed", Error: err.Error()})
+		return err
+	}
+	// A full queue fails the task, which finishes the run
+	if !client.startFetchTask(ctx, run.TaskID, spec, callbackURL, schedule.ID) {
+		return fmt.Errorf("task queue is full")
+	}
+	client.Logger.InfoContext(ctx, "Started schedule run", "schedule_id", schedule.ID, LogKeyTaskID, run.TaskID)
+	return nil
+}
+
+// taskActive reports whether a task is pending or running, reading tasks of other
+// instances from Firestore
+func taskActive(ctx context.Context, taskID string) bool {
+	task, ok := tasks.get(taskID)
+	if !ok {
+		stored, err := loadTask(ctx, taskID)
+		if err != nil || stored == nil {
+			return false
+		}
+		task = *stored
+	}
+	return task.Status == "pending" || task.Status == "running"
+}
+
+// finishScheduleRun records the outcome of a scheduled task in its run and releases
+// the schedule for the next run
+func finishScheduleRun(task Task) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Now().UTC()
+	updates := []firestore.Update{
+		{Path: "finishedAt", Value: now},
+		{Path: "status", Value: ScheduleRunCompleted},
+		{Path: "error", Value: task.Error},
+	}
+	if task.Status == "failed" {
+		updates[1].Value = ScheduleRunFailed
+	}
+	if task.Summary != nil {
+		updates = append(updates, firestore.Update{Path: "tokensConsumed", Value: task.Summary.TokensConsumed})
+	}
+
+	ref := scheduleRef(task.TenantID, task.ScheduleID)
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil // The schedule was deleted while its task ran
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Update(ref.Collection(ScheduleRunsCollection).Doc(task.ID), updates); err != nil {
+			return err
+		}
+		if active, _ := snapshot.DataAt("activeTaskId"); active == task.ID {
+			return tx.Update(ref, []firestore.Update{{Path: "activeTaskId", Value: ""}})
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to record schedule run", "schedule_id", task.ScheduleID, LogKeyTaskID, task.ID, "error", err)
+	}
+}
+
+// ScheduleRequest is the body of POST /schedules
+type ScheduleRequest struct {
+	Name     string                 `json:"name"`
+	Cron     string                 `json:"cron" binding:"required"`
+	TimeZone string                 `json:"timeZone"`
+	Enabled  *bool                  `json:"enabled"` // true when omitted
+	Request  map[string]interface{} `json:"request" binding:"required"`
+}
+
+// handleCreateSchedule stores a schedule after validating its cron expression, time
+// zone and request, which takes the same body as POST /keepa
+func handleCreateSchedule(c *gin.Context) {
+	var req ScheduleRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	now := time.Now().UTC()
+	schedule := Schedule{
+		Name:      req.Name,
+		Cron:      req.Cron,
+		TimeZone:  req.TimeZone,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+		Request:   req.Request,
+		CreatedAt: now,
+	}
+	next, err := schedule.nextRun(now)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	schedule.NextRunAt = next
+	if _, _, err := schedule.fetchSpec(c.Request.Context()); err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	ref, _, err := tenantCollection(c.Request.Context(), SchedulesCollection).Add(c.Request.Context(), schedule)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to store schedule: %v", err))
+		return
+	}
+	schedule.ID = ref.ID
+	logger.InfoContext(c.Request.Context(), "Created schedule", "schedule_id", schedule.ID, "cron", schedule.Cron, "next_run_at", next)
+	c.JSON(http.StatusCreated, schedule)
+}
+
+// handleListSchedules returns all schedules, oldest first
+func handleListSchedules(c *gin.Context) {
+	snapshots, err := tenantCollection(c.Request.Context(), SchedulesCollection).OrderBy("createdAt", firestore.Asc).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list schedules: %v", err))
+		return
+	}
+	schedules := make([]Schedule, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var schedule Schedule
+		if err := snapshot.DataTo(&schedule); err != nil {
+			logger.WarnContext(c.Request.Context(), "Skipping undecodable schedule", "schedule_id", snapshot.Ref.ID, "error", err)
+			continue
+		}
+		schedule.ID = snapshot.Ref.ID
+		schedules = append(schedules, schedule)
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules, "count": len(schedules)})
+}
+
+// handleGetSchedule returns a schedule
+func handleGetSchedule(c *gin.Context) {
+	snapshot, err := scheduleRef(tenantID(c.Request.Context()), c.Param("id")).Get(c.Request.Context())
+	if status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Schedule not found")
+		return
+	}
+	var schedule Schedule
+	if err == nil {
+		err = snapshot.DataTo(&schedule)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to read schedule: %v", err))
+		return
+	}
+	schedule.ID = snapshot.Ref.ID
+	c.JSON(http.StatusOK, schedule)
+}
+
+// handleScheduleRuns returns the latest runs of a schedule, newest first
+func handleScheduleRuns(c *gin.Context) {
+	snapshots, err := scheduleRef(tenantID(c.Request.Context()), c.Param("id")).Collection(ScheduleRunsCollection).
+		OrderBy("startedAt", firestore.Desc).
+		Limit(maxScheduleRuns).
+		Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list schedule runs: %v", err))
+		return
+	}
+	runs := make([]ScheduleRun, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var run ScheduleRun
+		if err := snapshot.DataTo(&run); err != nil {
+			continue
+		}
+		run.ID = snapshot.Ref.ID
+		runs = append(runs, run)
+	}
+	c.JSON(http.StatusOK, gin.H{"scheduleId": c.Param("id"), "runs": runs, "count": len(runs)})
+}
+
+// handleDeleteSchedule deletes a schedule and its run history. A task already started
+// by the schedule keeps running.
+func handleDeleteSchedule(c *gin.Context) {
+	ctx := c.Request.Context()
+	ref := scheduleRef(tenantID(c.Request.Context()), c.Param("id"))
+	if _, err := ref.Get(ctx); status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Schedule not found")
+		return
+	}
+
+	// Subcollections survive the deletion of their parent
+	runs, err := ref.Collection(ScheduleRunsCollection).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list schedule runs: %v", err))
+		return
+	}
+	writer := firestoreClient.BulkWriter(ctx)
+	jobs := make([]*firestore.BulkWriterJob, 0, len(runs)+1)
+	for _, runRef := range append(runs, ref) {
+		job, err := writer.Delete(runRef)
+		if err != nil {
+			writer.End()
+			respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to delete schedule: %v", err))
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	writer.End()
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to delete schedule: %v", err))
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"id": ref.ID, "deleted": true, "runsDeleted": len(runs)})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchemaDriftEntry describes a Keepa response field our models do not decode
+type SchemaDriftEntry struct {
+	Field     string    `json:"field"` // Dotted path, e.g. "product.stats.newField"
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// schemaDriftDetector compares raw Keepa product JSON against our structs
+type schemaDriftDetector struct {
+	enabled bool
+	mu      sync.Mutex
+	unknown map[string]*SchemaDriftEntry
+	known   map[string]map[string]bool
+}
+
+// schemaDrift is enabled with KEEPA_SCHEMA_DRIFT=1; it costs one extra decode per response
+var schemaDrift = &schemaDriftDetector{
+	enabled: getEnv("KEEPA_SCHEMA_DRIFT", "0") == "1",
+	unknown: make(map[string]*SchemaDriftEntry),
+	known: map[string]map[string]bool{
+		"product":       jsonFieldNames(reflect.TypeOf(keepa.Product{})),
+		"product.stats": jsonFieldNames(reflect.TypeOf(keepa.ProductStats{})),
+		"product.offer": jsonFieldNames(reflect.TypeOf(keepa.Offer{})),
+	},
+}
+
+// jsonFieldNames returns the JSON keys a struct type decodes
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+// inspect records product, stats and offer keys of a raw response that we drop
+func (d *schemaDriftDetector) inspect(body []byte) {
+	if !d.enabled {
+		return
+	}
+
+	var raw struct {
+		Products []map[string]json.RawMessage `json:"products"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return
+	}
+
+	for _, product := range raw.Products {
+		d.check("product", product)
+		if statsJSON, ok := product["stats"]; ok {
+			var stats map[string]json.RawMessage
+			if json.Unmarshal(statsJSON, &stats) == nil {
+				d.check("product.stats", stats)
+			}
+		}
+		if offersJSON, ok := product["offers"]; ok {
+			var offers []map[string]json.RawMessage
+			if json.Unmarshal(offersJSON, &offers) == nil {
+				for _, offer := range offers {
+					d.check("product.offer", offer)
+				}
+			}
+		}
+	}
+}
+
+// check records every key of object that is unknown at path
+func (d *schemaDriftDetector) check(path string, object map[string]json.RawMessage) {
+	known := d.known[path]
+	now := time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range object {
+		if known[key] {
+			continue
+		}
+		field := path + "." + key
+		entry, ok := d.unknown[field]
+		if !ok {
+			entry = &SchemaDriftEntry{Field: field, FirstSeen: now}
+			d.unknown[field] = entry
+			logger.Warn("Schema drift: Keepa returned a field which is not decoded", "field", field)
+		}
+		entry.Count++
+		entry.LastSeen = now
+	}
+}
+
+// report lists all unknown fields seen so far, sorted by path
+func (d *schemaDriftDetector) report() []SchemaDriftEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := make([]SchemaDriftEntry, 0, len(d.unknown))
+	for _, entry := range d.unknown {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Field < entries[j].Field
+	})
+	return entries
+}
+
+// handleSchemaDrift returns the Keepa fields our models silently drop
+func handleSchemaDrift(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": schemaDrift.enabled,
+		"fields":  schemaDrift.report(),
+	})
+}
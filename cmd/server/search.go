@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// SearchRedisKeyPrefix prefixes the cached ASIN lists of keyword searches
+const SearchRedisKeyPrefix = "keepa:search:"
+
+// maxSearchPage is the last result page of a keyword search; Keepa returns up to 10 pages
+const maxSearchPage = 9
+
+// SearchRequest is the body of POST /keepa/search
+type SearchRequest struct {
+	Term     string `json:"term" binding:"required"`
+	Domain   string `json:"domain"`
+	Page     int    `json:"page"`
+	UseCache bool   `json:"use_cache"`
+}
+
+// ProductSearch searches products by keyword and returns one page of up to 10
+// simplified products, in Keepa's relevance order
+func (client *KeepaClient) ProductSearch(ctx context.Context, domain, term string, page int) ([]SimplifiedProduct, error) {
+	apiKey := keepaAPIKey(ctx)
+	stats := getEnv("KEEPA_STATS", "90")
+	history := getEnv("KEEPA_HISTORY", "1")
+	url := fmt.Sprintf("https://api.keepa.com/search?domain=%s&key=%s&type=product&term=%s&page=%d&stats=%s&history=%s",
+		domain, apiKey, neturl.QueryEscape(term), page, stats, history)
+
+	// A search result page costs 10 tokens
+	apiResp, err := client.doRequest(ctx, url, 10, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Product Search", "domain", domain, "products", len(apiResp.Products), "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	products := make([]SimplifiedProduct, 0, len(apiResp.Products))
+	for _, product := range apiResp.Products {
+		simplifiedProduct, include := simplifyProduct(&product, defaultProductFields)
+		if !include {
+			continue
+		}
+		products = append(products, simplifiedProduct)
+	}
+	enriched := make([]*SimplifiedProduct, len(products))
+	for i := range products {
+		enriched[i] = &products[i]
+	}
+	client.enrichCategories(ctx, domain, apiResp.Products, enriched)
+	return products, nil
+}
+
+// searchCacheKey identifies a search result page of the tenant of ctx
+func searchCacheKey(ctx context.Context, domain, term string, page int) string {
+	return tenantRedisKey(ctx, fmt.Sprintf("%s%s:%d:%s", SearchRedisKeyPrefix, domain, page, strings.ToLower(term)))
+}
+
+// cachedSearch returns the products of a cached search page. It fails when the page
+// or any of its products is no longer cached.
+func cachedSearch(ctx context.Context, domain, key string) ([]SimplifiedProduct, error) {
+	var data []byte
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		data, err = redisClient.Get(ctx, key).Bytes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var asins []string
+	if err := json.Unmarshal(data, &asins); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal search from Redis: %v", err)
+	}
+
+	cached, misses, err := getProductsFromRedis(ctx, domain, asins)
+	if err != nil {
+		return nil, err
+	}
+	if len(misses) > 0 {
+		return nil, fmt.Errorf("product %s not found in Redis", misses[0])
+	}
+	products := make([]SimplifiedProduct, 0, len(asins))
+	for _, asin := range asins {
+		products = append(products, cached[asin].Products...)
+	}
+	return products, nil
+}
+
+// cacheSearch stores the products of a search page in Redis and the page's ASIN list
+// under its search key
+func cacheSearch(ctx context.Context, domain, key string, products []SimplifiedProduct) error {
+	asins := make([]string, 0, len(products))
+	for _, product := range products {
+		asins = append(asins, product.Asin)
+		response := &SimplifiedResponse{Products: []SimplifiedProduct{product}}
+		if err := saveProductToRedis(ctx, domain, product.Asin, response); err != nil {
+			return fmt.Errorf("failed to cache product %s: %v", product.Asin, err)
+		}
+	}
+	data, _ := json.Marshal(asins)
+	return withRetry(ctx, DependencyRedis, func() error {
+		return redisClient.Set(ctx, key, data, cacheTTL(CacheTypeSearch)).Err()
+	})
+}
+
+// handleProductSearch searches products by keyword. The products are cached in Redis
+// like Product Request results; with use_cache a cached page is served without tokens.
+func (client *KeepaClient) handleProductSearch(c *gin.Context) {
+	var request SearchRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	request.Term = strings.TrimSpace(request.Term)
+	if request.Term == "" {
+		respondError(c, http.StatusBadRequest, "term is required")
+		return
+	}
+	if request.Page < 0 || request.Page > maxSearchPage {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("page must be between 0 and %d", maxSearchPage))
+		return
+	}
+	domain, err := parseDomain(request.Domain)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid domain: %v", err))
+		return
+	}
+	request.Domain = domain
+
+	ctx := c.Request.Context()
+	key := searchCacheKey(ctx, request.Domain, request.Term, request.Page)
+	cached := false
+	var products []SimplifiedProduct
+	if request.UseCache {
+		if hit, err := cachedSearch(ctx, request.Domain, key); err == nil {
+			products, cached = hit, true
+		}
+	}
+	if !cached {
+		var err error
+		products, err = client.ProductSearch(ctx, request.Domain, request.Term, request.Page)
+		if err != nil {
+			respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+			return
+		}
+		if err := cacheSearch(ctx, request.Domain, key, products); err != nil {
+			logger.WarnContext(ctx, "Failed to cache search", "term", request.Term, "error", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"term":     request.Term,
+		"domain":   request.Domain,
+		"page":     request.Page,
+		"products": timeFormatterFor(c).products(products),
+		"cached":   cached,
+	}))
+}
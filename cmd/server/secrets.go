@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretKeys are the credentials read from Secret Manager. Each is stored as the
+// secret named after the key in lower case with dashes, e.g. keepa-api-key.
+var secretKeys = []string{
+	"KEEPA_API_KEY",
+	"KEEPA_NOTIFICATION_TOKEN",
+	"CALLBACK_SIGNING_SECRET",
+	"REDIS_PASSWORD",
+	"REDIS_SENTINEL_PASSWORD",
+	"SMTP_PASSWORD",
+	"AUTH_API_KEYS",
+}
+
+// secretStore holds the latest versions of the secrets
+type secretStore struct {
+	mu      sync.RWMutex
+	values  map[string]string
+	service *secretmanager.Service // nil when SECRET_MANAGER_PROJECT is unset
+	project string
+}
+
+// secrets is the process-wide secret store
+var secrets = &secretStore{values: make(map[string]string)}
+
+// secret returns the Secret Manager value of key, falling back to the environment
+// variable key and then to defaultValue, so local runs need no Secret Manager
+func secret(key, defaultValue string) string {
+	secrets.mu.RLock()
+	value, ok := secrets.values[key]
+	secrets.mu.RUnlock()
+	if ok {
+		return value
+	}
+	return getEnv(key, defaultValue)
+}
+
+// secretID returns the secret name of key
+func secretID(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// startSecrets loads the secrets of SECRET_MANAGER_PROJECT and refreshes them every
+// SECRET_REFRESH_INTERVAL (5m), so rotated versions apply without a restart. Secrets
+// that do not exist fall back to the environment. Without a project it does nothing.
+func startSecrets(ctx context.Context) {
+	project := getEnv("SECRET_MANAGER_PROJECT", "")
+	if project == "" {
+		return
+	}
+	service, err := secretmanager.NewService(ctx)
+	if err != nil {
+		logger.Error("Failed to create Secret Manager client, using environment credentials", "error", err)
+		return
+	}
+	secrets.service = service
+	secrets.project = project
+	secrets.refresh(ctx)
+
+	go func() {
+		ticker := time.NewTicker(envDuration("SECRET_REFRESH_INTERVAL", 5*time.Minute))
+		defer ticker.Stop()
+		for range ticker.C {
+			secrets.refresh(context.Background())
+		}
+	}()
+}
+
+// refresh reads the latest version of every secret. A secret that fails to load keeps
+// its previous value.
+func (s *secretStore) refresh(ctx context.Context) {
+	for _, key := range secretKeys {
+		value, err := s.access(ctx, key)
+		var apiErr *googleapi.Error
+		switch {
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			continue
+		case err != nil:
+			logger.WarnContext(ctx, "Failed to load secret", "secret", secretID(key), "error", err)
+			continue
+		}
+		s.mu.Lock()
+		previous, loaded := s.values[key]
+		s.values[key] = value
+		s.mu.Unlock()
+		if !loaded {
+			logger.InfoContext(ctx, "Loaded secret", "secret", secretID(key))
+		} else if previous != value {
+			logger.InfoContext(ctx, "Secret rotated", "secret", secretID(key))
+		}
+	}
+}
+
+// access reads the latest version of the secret of key
+func (s *secretStore) access(ctx context.Context, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	name := fmt.Sprintf("projects/%s/secrets/%s/versions/latest", s.project, secretID(key))
+	version, err := s.service.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(version.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode secret %s: %v", secretID(key), err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
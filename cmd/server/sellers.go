@@ -0,0 +1,269 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SellerRedisKeyPrefix prefixes cached sellers, keyed by domain and seller ID
+const SellerRedisKeyPrefix = "keepa:seller:"
+
+// Indexes of keepa.Seller.Csv
+const (
+	sellerCsvRating      = 0
+	sellerCsvRatingCount = 1
+)
+
+// SimplifiedSeller is a seller with its rating history and storefront. FBAOffers and
+// FBMOffers count the seller's offers on storefront products we have cached.
+type SimplifiedSeller struct {
+	SellerID           string         `json:"sellerId"`
+	Name               string         `json:"name"`
+	BusinessName       string         `json:"businessName,omitempty"`
+	Domain             string         `json:"domain"`
+	IsScammer          bool           `json:"isScammer"`
+	HasFBA             bool           `json:"hasFBA"`
+	CurrentRating      int            `json:"currentRating"`
+	CurrentRatingCount int            `json:"currentRatingCount"`
+	RatingsLast30Days  int            `json:"ratingsLast30Days"`
+	RatingHistory      map[string]int `json:"ratingHistory,omitempty"`
+	RatingCountHistory map[string]int `json:"ratingCountHistory,omitempty"`
+	StorefrontASINs    []string       `json:"storefrontAsins,omitempty"`
+	StorefrontCount    int            `json:"storefrontCount"`
+	FBAOffers          int            `json:"fbaOffers"`
+	FBMOffers          int            `json:"fbmOffers"`
+	TrackedSince       time.Time      `json:"trackedSince"`
+	FetchedAt          time.Time      `json:"fetchedAt"`
+}
+
+// SellerLookup fetches a seller, including its storefront ASINs when storefront is set
+func (client *KeepaClient) SellerLookup(ctx context.Context, domain, sellerID string, storefront bool) (*keepa.Seller, error) {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/seller?domain=%s&key=%s&seller=%s", domain, apiKey, sellerID)
+
+	// A seller request costs 1 token, the storefront 9 more
+	requiredTokens := 1
+	if storefront {
+		url += "&storefront=1"
+		requiredTokens += 9
+	}
+	apiResp, err := client.doRequest(ctx, url, requiredTokens, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Logger.InfoContext(ctx, "Seller Lookup", "seller_id", sellerID, "tokens_consumed", apiResp.TokensConsumed, LogKeyTokensLeft, apiResp.TokensLeft)
+	seller, ok := apiResp.Sellers[sellerID]
+	if !ok {
+		return nil, fmt.Errorf("seller %s not found", sellerID)
+	}
+	return &seller, nil
+}
+
+// simplifySeller converts a Keepa seller, keying the rating histories by stored timestamps
+func simplifySeller(domain string, seller *keepa.Seller) *SimplifiedSeller {
+	simplified := &SimplifiedSeller{
+		SellerID:           seller.SellerID,
+		Name:               seller.SellerName,
+		BusinessName:       seller.BusinessName,
+		Domain:             domain,
+		IsScammer:          seller.IsScammer,
+		HasFBA:             seller.HasFBA,
+		CurrentRating:      seller.CurrentRating,
+		CurrentRatingCount: seller.CurrentRatingCount,
+		RatingsLast30Days:  seller.RatingsLast30Days,
+		StorefrontASINs:    seller.AsinList,
+		TrackedSince:       keepatime.ToTime(seller.TrackedSince),
+		FetchedAt:          time.Now().UTC(),
+	}
+	if len(seller.Csv) > sellerCsvRating {
+		simplified.RatingHistory = keepatime.History(seller.Csv[sellerCsvRating])
+	}
+	if len(seller.Csv) > sellerCsvRatingCount {
+		simplified.RatingCountHistory = keepatime.History(seller.Csv[sellerCsvRatingCount])
+	}
+	if n := len(seller.TotalStorefrontAsins); n >= 2 {
+		simplified.StorefrontCount = seller.TotalStorefrontAsins[n-1]
+	} else {
+		simplified.StorefrontCount = len(seller.AsinList)
+	}
+	return simplified
+}
+
+// countSellerOffers counts the seller's FBA and FBM offers on the storefront products
+// of its domain cached in Redis, reading at most SELLER_OFFER_SCAN_LIMIT products
+func countSellerOffers(ctx context.Context, seller *SimplifiedSeller) error {
+	limit, _ := strconv.Atoi(getEnv("SELLER_OFFER_SCAN_LIMIT", "200"))
+	asins := seller.StorefrontASINs
+	if len(asins) > limit {
+		asins = asins[:limit]
+	}
+	if len(asins) == 0 {
+		return nil
+	}
+	cached, _, err := getProductsFromRedis(ctx, seller.Domain, asins)
+	if err != nil && len(cached) == 0 {
+		return err
+	}
+	for _, response := range cached {
+		for _, product := range response.Products {
+			for _, offer := range product.Offers {
+				if offer.SellerID != seller.SellerID || !offer.IsLive {
+					continue
+				}
+				if offer.IsFBA {
+					seller.FBAOffers++
+				} else {
+					seller.FBMOffers++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sellerCacheKey returns the Redis key of a seller cached by the tenant of ctx
+func sellerCacheKey(ctx context.Context, domain, sellerID string) string {
+	return tenantRedisKey(ctx, SellerRedisKeyPrefix+domain+":"+sellerID)
+}
+
+// getSellerFromRedis reads a cached seller
+func getSellerFromRedis(ctx context.Context, domain, sellerID string) (*SimplifiedSeller, error) {
+	var data []byte
+	err := withRetry(ctx, DependencyRedis, func() error {
+		var err error
+		data, err = redisClient.Get(ctx, sellerCacheKey(ctx, domain, sellerID)).Bytes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var seller SimplifiedSeller
+	if err := json.Unmarshal(data, &seller); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal seller from Redis: %v", err)
+	}
+	return &seller, nil
+}
+
+// saveSellerToRedis caches a seller for the seller TTL
+func saveSellerToRedis(ctx context.Context, seller *SimplifiedSeller) error {
+	data, _ := json.Marshal(seller)
+	return withRetry(ctx, DependencyRedis, func() error {
+		return redisClient.Set(ctx, sellerCacheKey(ctx, seller.Domain, seller.SellerID), data, cacheTTL(CacheTypeSeller)).Err()
+	})
+}
+
+// handleSellerLookup returns a seller, served from Redis unless ?refresh=true.
+// ?storefront=false skips the storefront ASINs and saves 9 tokens.
+func (client *KeepaClient) handleSellerLookup(c *gin.Context) {
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	sellerID := c.Param("sellerId")
+	storefront := c.DefaultQuery("storefront", "true") == "true"
+	ctx := c.Request.Context()
+
+	seller, err := getSellerFromRedis(ctx, domain, sellerID)
+	cached := err == nil && c.Query("refresh") != "true" && (!storefront || seller.StorefrontASINs != nil)
+	if !cached {
+		keepaSeller, err := client.SellerLookup(ctx, domain, sellerID, storefront)
+		if err != nil {
+			respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+			return
+		}
+		seller = simplifySeller(domain, keepaSeller)
+		if err := countSellerOffers(ctx, seller); err != nil {
+			logger.WarnContext(ctx, "Failed to count offers of seller", "seller_id", sellerID, "error", err)
+		}
+		if err := saveSellerToRedis(ctx, seller); err != nil {
+			logger.WarnContext(ctx, "Failed to cache seller", "seller_id", sellerID, "error", err)
+		}
+	}
+
+	formatter := timeFormatterFor(c)
+	response := *seller
+	response.RatingHistory = formatter.reformatKeys(seller.RatingHistory)
+	response.RatingCountHistory = formatter.reformatKeys(seller.RatingCountHistory)
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{"seller": response, "cached": cached}))
+}
+
+// StorefrontRequest is the body of POST /keepa/storefront
+type StorefrontRequest struct {
+	SellerID      string `json:"sellerId" binding:"required"`
+	Domain        string `json:"domain"`
+	FetchProducts bool   `json:"fetch_products"` // Queue a storefront task running the ASINs through the product pipeline
+	Limit         int    `json:"limit"`          // Fetch at most this many ASINs, 0 for all
+	UseCache      bool   `json:"use_cache"`
+}
+
+// handleStorefront harvests the storefront ASINs of a seller and optionally queues
+// a storefront task fetching their products
+func (client *KeepaClient) handleStorefront(c *gin.Context) {
+	var request StorefrontRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	domain, err := parseDomain(request.Domain)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid domain: %v", err))
+		return
+	}
+	request.Domain = domain
+
+	keepaSeller, err := client.SellerLookup(c.Request.Context(), request.Domain, request.SellerID, true)
+	if err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	seller := simplifySeller(request.Domain, keepaSeller)
+	if err := countSellerOffers(c.Request.Context(), seller); err != nil {
+		logger.WarnContext(c.Request.Context(), "Failed to count offers of seller", "seller_id", seller.SellerID, "error", err)
+	}
+	if err := saveSellerToRedis(c.Request.Context(), seller); err != nil {
+		logger.WarnContext(c.Request.Context(), "Failed to cache seller", "seller_id", seller.SellerID, "error", err)
+	}
+
+	asins := seller.StorefrontASINs
+	if request.Limit > 0 && len(asins) > request.Limit {
+		asins = asins[:request.Limit]
+	}
+	if !request.FetchProducts || len(asins) == 0 {
+		c.JSON(http.StatusOK, withQuotaWarning(gin.H{"sellerId": seller.SellerID, "domain": request.Domain, "asins": asins}))
+		return
+	}
+
+	taskID := generateTaskID()
+	client.Logger.InfoContext(c.Request.Context(), "Created storefront task", LogKeyTaskID, taskID, "asins", len(asins), "seller_id", seller.SellerID)
+
+	tasks.create(c.Request.Context(), taskID, TaskKindStorefront)
+	tasks.update(taskID, func(task *Task) {
+		task.SellerID = seller.SellerID
+		task.Domain = request.Domain
+		task.UseCache = request.UseCache
+	})
+	tasks.addASINs(taskID, asins)
+
+	useCache := request.UseCache
+	if !enqueueTask(func() { client.runASINTask(taskID, asins, useCache) }) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{
+		"task_id":          taskID,
+		"status":           "pending",
+		"sellerId":         seller.SellerID,
+		"domain":           request.Domain,
+		"asins":            asins,
+		"estimated_tokens": calculateProductRequestTokens(len(asins)),
+	}))
+}
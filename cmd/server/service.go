@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// ServiceError is a failure of the operations shared by the REST and the gRPC API,
+// described like a Problem so either API can answer it
+type ServiceError struct {
+	Status     int    // HTTP status
+	Code       string // Problem code
+	Detail     string
+	RetryAfter time.Duration // Set for failures worth retrying later
+}
+
+func (e *ServiceError) Error() string {
+	return e.Detail
+}
+
+// newServiceError describes a failure with the default code of status
+func newServiceError(status int, detail string) *ServiceError {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = CodeInternal
+	}
+	return &ServiceError{Status: status, Code: code, Detail: detail}
+}
+
+// respondServiceError answers err as a problem. Other errors are failed Keepa calls
+// and answer as respondKeepaError does, 502 by default.
+func respondServiceError(c *gin.Context, err error, extra ...gin.H) {
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	if serviceErr.RetryAfter > 0 {
+		setRetryAfter(c, serviceErr.RetryAfter.Seconds())
+	}
+	respondProblem(c, serviceErr.Status, serviceErr.Code, serviceErr.Detail, extra...)
+}
+
+// parseFetchSpecs builds the task specs of a POST /keepa body, one per domain when
+// the body lists "domains", otherwise a single one, and its callback URL
+func parseFetchSpecs(ctx context.Context, requestData map[string]interface{}, fieldsQuery string) ([]*FetchTaskSpec, string, error) {
+	bodies, err := splitDomains(requestData)
+	if err != nil {
+		return nil, "", newServiceError(http.StatusBadRequest, err.Error())
+	}
+	specs := make([]*FetchTaskSpec, 0, len(bodies))
+	var callbackURL string
+	for _, body := range bodies {
+		spec, url, err := buildFetchSpec(ctx, body, fieldsQuery)
+		if err != nil {
+			return nil, "", &ServiceError{Status: http.StatusBadRequest, Code: CodeInvalidQuery, Detail: err.Error()}
+		}
+		specs = append(specs, spec)
+		callbackURL = url
+	}
+	return specs, callbackURL, nil
+}
+
+// StartedTask is a task started for a POST /keepa body
+type StartedTask struct {
+	Domain          string `json:"domain"`
+	TaskID          string `json:"task_id"`
+	Status          string `json:"status"`
+	EstimatedTokens int    `json:"estimated_tokens,omitempty"`
+	Replayed        bool   `json:"replayed,omitempty"` // The Idempotency-Key already named the task
+}
+
+// startFetchTasks starts a task per spec for the tenant of ctx. With an idempotency
+// key a repeated call returns the tasks of the first one; the key is claimed per
+// domain when there are several specs, so a retry only starts the missing tasks.
+// On failure it returns the tasks started so far along with the error.
+func (client *KeepaClient) startFetchTasks(ctx context.Context, specs []*FetchTaskSpec, callbackURL, idempotencyKey string) ([]StartedTask, error) {
+	started := make([]StartedTask, 0, len(specs))
+	for _, spec := range specs {
+		taskID := generateTaskID()
+		key := idempotencyKey
+		if key != "" && len(specs) > 1 {
+			key += ":" + spec.Domain
+		}
+		if key != "" {
+			existingID, err := claimIdempotencyKey(ctx, key, taskID)
+			if err != nil {
+				return started, newServiceError(http.StatusInternalServerError, err.Error())
+			}
+			if existingID != "" {
+				client.Logger.InfoContext(ctx, "Idempotency-Key already maps to a task", "idempotency_key", key, LogKeyTaskID, existingID)
+				task, ok, err := tasks.lookup(ctx, existingID)
+				if err != nil {
+					return started, newServiceError(http.StatusInternalServerError, err.Error())
+				}
+				if !ok {
+					return started, newServiceError(http.StatusConflict, fmt.Sprintf("Idempotency-Key is in use by task %s, which is not available", existingID))
+				}
+				started = append(started, StartedTask{Domain: spec.Domain, TaskID: task.ID, Status: task.Status, Replayed: true})
+				continue
+			}
+		}
+		if !client.startFetchTask(ctx, taskID, spec, callbackURL, "") {
+			if key != "" {
+				releaseIdempotencyKey(ctx, key)
+			}
+			return started, &ServiceError{Status: http.StatusServiceUnavailable, Code: CodeQueueFull, Detail: "Task queue is full, try again later"}
+		}
+		started = append(started, StartedTask{Domain: spec.Domain, TaskID: taskID, Status: "pending", EstimatedTokens: spec.maxTokens()})
+	}
+	if len(specs) > 1 {
+		client.Logger.InfoContext(ctx, "Started fetch tasks per domain", "domains", len(specs))
+	}
+	return started, nil
+}
+
+// getProduct returns a product of the tenant of ctx and where it was read from.
+// With refresh it is fetched from Keepa and stored, otherwise read from the caches.
+func (client *KeepaClient) getProduct(ctx context.Context, domain, asin string, refresh bool) (*SimplifiedResponse, string, error) {
+	if !refresh {
+		response, source, err := loadProduct(ctx, domain, asin)
+		if err != nil {
+			return nil, "", newServiceError(http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+		}
+		return response, source, nil
+	}
+	result, err := client.processASIN(ctx, generateTaskID(), domain, asin, false)
+	if result.Product == nil {
+		return nil, "", fmt.Errorf("Failed to refresh product %s: %w", asin, err)
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "Refreshed product was not stored", LogKeyASIN, asin, "error", err)
+	}
+	return result.Product, SourceKeepa, nil
+}
+
+// getTask returns a task visible to the tenant of ctx
+func getTask(ctx context.Context, taskID string) (Task, error) {
+	task, ok, err := tasks.lookup(ctx, taskID)
+	if err != nil {
+		return Task{}, newServiceError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		return Task{}, newServiceError(http.StatusNotFound, fmt.Sprintf("Task %s not found", taskID))
+	}
+	return task, nil
+}
+
+// watchTask subscribes to the events of a task and returns its current state. The
+// subscription starts before the task is read, so no event in between is missed.
+// Call unsubscribe once done.
+func watchTask(ctx context.Context, taskID string) (task Task, events chan TaskEvent, unsubscribe func(), err error) {
+	events, unsubscribe = taskEvents.subscribe(taskID)
+	task, err = getTask(ctx, taskID)
+	if err != nil {
+		unsubscribe()
+		return Task{}, nil, nil, err
+	}
+	return task, events, unsubscribe, nil
+}
+
+// taskFinished reports whether a task reached a final status
+func taskFinished(task *Task) bool {
+	return task.Status == "completed" || task.Status == "failed"
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// TokenBucketRedisKeyPrefix prefixes the shared token bucket, keyed by a hash of the API key
+const TokenBucketRedisKeyPrefix = "keepa:tokens:"
+
+// tokenBucketCapacity is the most tokens the Keepa bucket holds until Keepa reports otherwise
+const tokenBucketCapacity = 300
+
+// consumeTokensScript refills the bucket by the time passed since its last update and
+// takes ARGV[3] tokens when ARGV[3] plus the safety threshold ARGV[4] are available, like
+// keepa.TokenBucket.Consume, so a request costing 0 tokens is admitted above the threshold.
+// ARGV[1] is the refill rate per minute, ARGV[2] the capacity. Redis' clock is used so
+// instances with skewed clocks agree. Returns {taken, tokens left}.
+var consumeTokensScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local rate = tonumber(ARGV[1]) / 60000
+local capacity = tonumber(ARGV[2])
+local required = tonumber(ARGV[3])
+local threshold = tonumber(ARGV[4])
+
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+local updated = tonumber(redis.call('HGET', KEYS[1], 'updated'))
+if tokens == nil or updated == nil then
+	tokens = capacity
+	updated = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+
+local taken = 0
+if tokens >= required + threshold then
+	tokens = tokens - required
+	taken = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], 86400000)
+return {taken, math.floor(tokens)}
+`)
+
+// setTokensScript replaces the bucket with the balance Keepa reported
+var setTokensScript = redis.NewScript(`
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+redis.call('HSET', KEYS[1], 'tokens', ARGV[1], 'updated', now)
+redis.call('PEXPIRE', KEYS[1], 86400000)
+return 1
+`)
+
+// sharedTokenBucket keeps the token balance in Redis so all instances using the same
+// API key draw from one bucket
+type sharedTokenBucket struct {
+	key string
+}
+
+// newSharedTokenBucket returns the bucket of a Keepa API key, or nil when
+// KEEPA_SHARED_TOKENS is "false" and every instance keeps its own estimate. The mock
+// backend's balance is never shared, so it cannot overwrite the one of a real key.
+func newSharedTokenBucket(apiKey string) *sharedTokenBucket {
+	if getEnv("KEEPA_SHARED_TOKENS", "true") == "false" || keepaMode() == KeepaModeMock {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return &sharedTokenBucket{key: TokenBucketRedisKeyPrefix + hex.EncodeToString(sum[:8])}
+}
+
+// consume refills the bucket and takes requiredTokens if they and the threshold are
+// available. It returns the balance and whether the tokens were taken.
+func (b *sharedTokenBucket) consume(requiredTokens, threshold int, refillRate float64, capacity int) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	result, err := consumeTokensScript.Run(ctx, redisClient, []string{b.key}, refillRate, capacity, requiredTokens, threshold).Int64Slice()
+	if err != nil {
+		return 0, false, err
+	}
+	return int(result[1]), result[0] == 1, nil
+}
+
+// peek returns the refilled balance without taking tokens
+func (b *sharedTokenBucket) peek(refillRate float64, capacity int) (int, error) {
+	tokens, _, err := b.consume(0, 0, refillRate, capacity)
+	return tokens, err
+}
+
+// set replaces the balance with the one reported by Keepa
+func (b *sharedTokenBucket) set(tokensLeft int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return setTokensScript.Run(ctx, redisClient, []string{b.key}, tokensLeft).Err()
+}
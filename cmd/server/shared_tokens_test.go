@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestSharedTokenBucketConsume(t *testing.T) {
+	server := miniredis.RunT(t)
+	previous := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+	})
+
+	tests := []struct {
+		name      string
+		balance   int
+		required  int
+		threshold int
+		wantTaken bool
+		wantLeft  int
+	}{
+		{name: "zero cost above threshold", balance: 50, required: 0, threshold: 10, wantTaken: true, wantLeft: 50},
+		{name: "zero cost at threshold", balance: 10, required: 0, threshold: 10, wantTaken: true, wantLeft: 10},
+		{name: "zero cost below threshold", balance: 5, required: 0, threshold: 10, wantTaken: false, wantLeft: 5},
+		{name: "enough tokens", balance: 50, required: 20, threshold: 10, wantTaken: true, wantLeft: 30},
+		{name: "not enough tokens", balance: 25, required: 20, threshold: 10, wantTaken: false, wantLeft: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := &sharedTokenBucket{key: TokenBucketRedisKeyPrefix + "test"}
+			if err := bucket.set(tt.balance); err != nil {
+				t.Fatalf("set: %v", err)
+			}
+			// A refill rate of 0 keeps the balance independent of Redis' clock
+			left, taken, err := bucket.consume(tt.required, tt.threshold, 0, tokenBucketCapacity)
+			if err != nil {
+				t.Fatalf("consume: %v", err)
+			}
+			if taken != tt.wantTaken || left != tt.wantLeft {
+				t.Errorf("consume(%d, %d) = %d, %v; want %d, %v", tt.required, tt.threshold, left, taken, tt.wantLeft, tt.wantTaken)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"Keepa-api/pkg/keepatime"
+	"strconv"
+	"time"
+)
+
+// simplifyProduct maps the selected field groups of a Keepa product to the simplified
+// output format. The second return value reports whether the product passed the
+// configured inclusion rules and should be part of the output.
+func simplifyProduct(product *keepa.Product, fields productFields) (SimplifiedProduct, bool) {
+	rootCategory := strconv.Itoa(product.RootCategory)
+
+	// Create sales ranks map with timestamp as key and rank as value
+	salesRanks := make(map[string]int)
+	if fields.has(FieldSalesRanks) {
+		if history := keepatime.History(product.SalesRanks[rootCategory]); history != nil {
+			salesRanks = history
+		}
+	}
+
+	// Monthly sold history is a list of time/value pairs like the sales ranks
+	var monthlySoldHistory map[string]int
+	if fields.has(FieldMonthlySold) {
+		monthlySoldHistory = keepatime.History(product.MonthlySoldHistory)
+	}
+
+	simplifiedProduct := SimplifiedProduct{
+		Asin:         product.Asin,
+		Title:        product.Title,
+		Categories:   product.Categories,
+		CategoryPath: categoryTreePath(product.CategoryTree),
+		Brand:        product.Brand,
+		SalesRanks:   salesRanks,
+		FetchedAt:    time.Now().UTC(),
+		Fields:       fields.list(),
+	}
+
+	// availabilityAmazon is -1 when Amazon has no offer
+	simplifiedProduct.HasAmazonOffer = product.AvailabilityAmazon >= 0
+	simplifiedProduct.AmazonAvailability = amazonAvailabilities[product.AvailabilityAmazon]
+
+	if fields.has(FieldMonthlySold) {
+		simplifiedProduct.MonthlySold = product.MonthlySold
+		simplifiedProduct.MonthlySoldHistory = monthlySoldHistory
+	}
+	if fields.has(FieldFees) {
+		simplifiedProduct.ReferralFeePercent = referralFeePercent(product)
+		simplifiedProduct.PickAndPackFee = product.FbaFees.PickAndPackFee
+	}
+
+	// Keep the variation family
+	if fields.has(FieldVariations) {
+		simplifiedProduct.ParentAsin = product.ParentAsin
+		simplifiedProduct.Variations = simplifyVariations(product)
+	}
+
+	// Keep the sales rank drops and score the sales velocity
+	if fields.has(FieldVelocity) {
+		simplifiedProduct.Velocity = newSalesVelocity(&product.Stats)
+	}
+
+	// Keep the offer counts and the latest rating
+	if fields.has(FieldOfferCounts) {
+		simplifiedProduct.OfferCountFBA = product.Stats.OfferCountFBA
+		simplifiedProduct.OfferCountFBM = product.Stats.OfferCountFBM
+	}
+	if fields.has(FieldRating) {
+		if rating, ok := latestCsvValue(product.Csv, CsvRating); ok {
+			simplifiedProduct.Rating = float64(rating) / 10
+		}
+		if reviews, ok := latestCsvValue(product.Csv, CsvCountReviews); ok {
+			simplifiedProduct.ReviewCount = reviews
+		}
+	}
+
+	// Add buyBoxPrice if available
+	if product.Stats.BuyBoxPrice != 0 {
+		simplifiedProduct.BuyBoxPrice = product.Stats.BuyBoxPrice
+	}
+	if len(product.Stats.Avg30) > CsvBuyBoxShipping && product.Stats.Avg30[CsvBuyBoxShipping] > 0 {
+		simplifiedProduct.BuyBoxAvg30 = product.Stats.Avg30[CsvBuyBoxShipping]
+	}
+	if len(product.Stats.Avg90) > CsvBuyBoxShipping && product.Stats.Avg90[CsvBuyBoxShipping] > 0 {
+		simplifiedProduct.BuyBoxAvg90 = product.Stats.Avg90[CsvBuyBoxShipping]
+	}
+
+	// Decode the buy box ownership histories
+	if includeBuyBoxHistory() && fields.has(FieldBuyBoxHistory) {
+		now := time.Now()
+		simplifiedProduct.BuyBoxHistory = decodeBuyBoxHistory(product.BuyBoxSellerIDHistory, 2, now)
+		simplifiedProduct.BuyBoxUsedHistory = decodeBuyBoxHistory(product.BuyBoxUsedHistory, 4, now)
+		annotateBuyBoxHolders(simplifiedProduct.BuyBoxHistory, product.Offers)
+		annotateBuyBoxHolders(simplifiedProduct.BuyBoxUsedHistory, product.Offers)
+	}
+
+	// Decode the configured price histories
+	if fields.has(FieldPriceHistory) {
+		simplifiedProduct.PriceHistory = decodePriceHistory(product, priceHistoryTypes)
+	}
+
+	// LiveOffersOrder lists the indexes of offers that are currently live
+	liveOffers := make(map[int]bool, len(product.LiveOffersOrder))
+	for _, index := range product.LiveOffersOrder {
+		liveOffers[index] = true
+	}
+
+	// Add simplified offers
+	for i, offer := range product.Offers {
+		if !fields.has(FieldOffers) {
+			break
+		}
+		simplifiedOffer := SimplifiedOffer{
+			SellerID:        offer.SellerID,
+			Condition:       offer.Condition,
+			IsPrime:         offer.IsPrime,
+			IsAmazon:        offer.IsAmazon,
+			IsFBA:           offer.IsFBA,
+			IsLive:          len(product.LiveOffersOrder) == 0 || liveOffers[i],
+			IsWarehouseDeal: offer.IsWarehouseDeal,
+		}
+
+		// offerCSV is a list of [time, price, shipping] triples, the latest one last
+		if n := len(offer.OfferCSV); n >= 3 && n%3 == 0 {
+			simplifiedOffer.Price = offer.OfferCSV[n-2]
+			simplifiedOffer.Shipping = offer.OfferCSV[n-1]
+		}
+		if n := len(offer.StockCSV); n >= 2 && n%2 == 0 {
+			simplifiedOffer.StockEstimate = offer.StockCSV[n-1]
+		}
+
+		// Only include stockCSV if it's not empty
+		simplifiedOffer.StockCSV = keepatime.History(offer.StockCSV)
+
+		simplifiedProduct.Offers = append(simplifiedProduct.Offers, simplifiedOffer)
+	}
+
+	// Apply configured inclusion rules and computed fields
+	include := simplificationRules.Load().apply(product, &simplifiedProduct)
+	return simplifiedProduct, include
+}
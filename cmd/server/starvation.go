@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenStarvationMonitor raises alerts when Keepa tokens stay low for too long
+// or when token waits push a task past its deadline
+type tokenStarvationMonitor struct {
+	mu              sync.Mutex
+	lowSince        time.Time
+	alerted         bool
+	deadlineAlerted map[string]bool
+}
+
+// newTokenStarvationMonitor creates a monitor without alerts raised
+func newTokenStarvationMonitor() *tokenStarvationMonitor {
+	return &tokenStarvationMonitor{deadlineAlerted: make(map[string]bool)}
+}
+
+// starvationThresholds reads the tokens below which Keepa counts as starved
+// (TOKEN_ALERT_THRESHOLD) and how long starvation may last before alerting
+// (TOKEN_ALERT_AFTER_MINUTES). They are read on use, so reloads apply.
+func starvationThresholds() (int, time.Duration) {
+	threshold, _ := strconv.Atoi(getEnv("TOKEN_ALERT_THRESHOLD", "20"))
+	afterMinutes, _ := strconv.Atoi(getEnv("TOKEN_ALERT_AFTER_MINUTES", "30"))
+	return threshold, time.Duration(afterMinutes) * time.Minute
+}
+
+// observeTokens records the current token level and alerts once per starvation period
+func (m *tokenStarvationMonitor) observeTokens(tokensLeft int) {
+	if m == nil {
+		return
+	}
+	threshold, after := starvationThresholds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tokensLeft >= threshold {
+		if m.alerted {
+			go sendNotification("token_starvation_recovered", "info", "Keepa tokens recovered above threshold", map[string]interface{}{
+				"tokens_left": tokensLeft,
+				"threshold":   threshold,
+			})
+		}
+		m.lowSince = time.Time{}
+		m.alerted = false
+		return
+	}
+
+	if m.lowSince.IsZero() {
+		m.lowSince = time.Now()
+		return
+	}
+	if !m.alerted && time.Since(m.lowSince) >= after {
+		m.alerted = true
+		go sendNotification("token_starvation", "warning", "Keepa tokens have stayed below threshold", map[string]interface{}{
+			"tokens_left": tokensLeft,
+			"threshold":   threshold,
+			"low_since":   m.lowSince.UTC(),
+		})
+	}
+}
+
+// checkTaskDeadline projects when a task finishes given the remaining ASINs and the
+// current refill rate, alerting once per task when it will overrun the deadline
+func (m *tokenStarvationMonitor) checkTaskDeadline(taskID string, startedAt time.Time, remainingASINs, tokensLeft int, refillRate float64) {
+	if m == nil || refillRate <= 0 {
+		return
+	}
+	taskDeadline := envDuration("TASK_DEADLINE", 6*time.Hour)
+
+	shortfall := calculateProductRequestTokens(remainingASINs) - tokensLeft
+	if shortfall < 0 {
+		shortfall = 0
+	}
+	waitSeconds := float64(shortfall) * 60.0 / refillRate
+	projected := time.Now().Add(time.Duration(waitSeconds * float64(time.Second)))
+	deadline := startedAt.Add(taskDeadline)
+	if !projected.After(deadline) {
+		return
+	}
+
+	m.mu.Lock()
+	alreadyAlerted := m.deadlineAlerted[taskID]
+	m.deadlineAlerted[taskID] = true
+	m.mu.Unlock()
+	if alreadyAlerted {
+		return
+	}
+
+	go sendNotification("task_deadline_at_risk", "warning", "Task is projected to overrun its deadline due to token waits", map[string]interface{}{
+		"task_id":              taskID,
+		"remaining_asins":      remainingASINs,
+		"projected_completion": projected.UTC(),
+		"deadline":             deadline.UTC(),
+	})
+}
+
+// forgetTask drops per-task alert state once a task has finished
+func (m *tokenStarvationMonitor) forgetTask(taskID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.deadlineAlerted, taskID)
+	m.mu.Unlock()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Stock states of a product
+const (
+	StockUnknown    = ""
+	StockInStock    = "inStock"
+	StockOutOfStock = "outOfStock"
+)
+
+// amazonAvailabilities names the availabilityAmazon values of Keepa; -1 (no Amazon
+// offer) has no name
+var amazonAvailabilities = map[int]string{
+	0: "inStock",
+	1: "preorder",
+	2: "unknown",
+	3: "backorder",
+	4: "delayed",
+}
+
+// productStockState tells whether a product can be bought. Live offers decide when
+// they were mapped, then the offer counts, then Amazon's availability and the buy box.
+// Without offers or offer counts a product lacking both is unknown, not out of stock.
+func productStockState(p *SimplifiedProduct) string {
+	if p.mapsField(FieldOffers) && len(p.Offers) > 0 {
+		for _, offer := range p.Offers {
+			// A sold out offer keeps its last price with an estimate of 0 in its stock
+			// history; offers without a history count as in stock
+			if offer.IsLive && offer.Price > 0 && (offer.StockEstimate > 0 || len(offer.StockCSV) == 0) {
+				return StockInStock
+			}
+		}
+		return StockOutOfStock
+	}
+	if p.AmazonAvailability == "inStock" || p.BuyBoxPrice > 0 {
+		return StockInStock
+	}
+	if p.mapsField(FieldOfferCounts) {
+		if p.OfferCountFBA+p.OfferCountFBM > 0 {
+			return StockInStock
+		}
+		return StockOutOfStock
+	}
+	return StockUnknown
+}
+
+// mapsField reports whether a field group was mapped into the product
+func (p *SimplifiedProduct) mapsField(name string) bool {
+	return len(p.Fields) == 0 || containsString(p.Fields, name)
+}
+
+// stockTransition returns EventProductOutOfStock or EventProductBackInStock when the
+// stock state changed between two versions of a product, "" otherwise
+func stockTransition(previous, current *SimplifiedProduct) string {
+	if previous == nil {
+		return ""
+	}
+	before, after := productStockState(previous), productStockState(current)
+	switch {
+	case before == StockInStock && after == StockOutOfStock:
+		return EventProductOutOfStock
+	case before == StockOutOfStock && after == StockInStock:
+		return EventProductBackInStock
+	}
+	return ""
+}
+
+// stockTransitions counts the detected stock changes by event type
+var stockTransitions, _ = otel.Meter("Keepa-api").Int64Counter("keepa.stock.transitions",
+	metric.WithDescription("Products going out of stock or back in stock between two fetches, by event type"))
+
+// detectStockTransitions publishes an event for every product of current whose stock
+// state changed since previous
+func detectStockTransitions(ctx context.Context, taskID, domain string, previous, current *SimplifiedResponse) {
+	if previous == nil {
+		return
+	}
+	before := make(map[string]*SimplifiedProduct, len(previous.Products))
+	for i := range previous.Products {
+		before[previous.Products[i].Asin] = &previous.Products[i]
+	}
+	for i := range current.Products {
+		product := &current.Products[i]
+		transition := stockTransition(before[product.Asin], product)
+		if transition == "" {
+			continue
+		}
+		stockTransitions.Add(ctx, 1, metric.WithAttributes(attribute.String("event.type", transition)))
+		logger.InfoContext(ctx, "Stock changed", LogKeyASIN, product.Asin, "domain", domain, "event", transition)
+		pubsubEvents.publish(ctx, Event{Type: transition, TaskID: taskID, ASIN: product.Asin, Domain: domain})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sort"
+)
+
+// TaskSummary holds aggregate statistics of a finished task
+type TaskSummary struct {
+	Products             int            `json:"products"`
+	MinBuyBoxPrice       int            `json:"min_buy_box_price,omitempty"`
+	MaxBuyBoxPrice       int            `json:"max_buy_box_price,omitempty"`
+	AvgBuyBoxPrice       int            `json:"avg_buy_box_price,omitempty"`
+	MedianBuyBoxPrice    int            `json:"median_buy_box_price,omitempty"`
+	PriceDistribution    map[string]int `json:"price_distribution"` // Product count per buy box price bucket
+	AvgSalesRank         float64        `json:"avg_sales_rank,omitempty"`
+	BrandCounts          map[string]int `json:"brand_counts"`
+	AmazonPresentPercent float64        `json:"amazon_present_percent"`
+	TokensConsumed       int            `json:"tokens_consumed"`
+	CacheHits            int            `json:"cache_hits"`
+	CacheHitRate         float64        `json:"cache_hit_rate"`
+}
+
+// priceBuckets are the upper bounds (in cents) of the price distribution buckets
+var priceBuckets = []struct {
+	Label string
+	Upper int
+}{
+	{"<$10", 1000},
+	{"$10-25", 2500},
+	{"$25-50", 5000},
+	{"$50-100", 10000},
+	{"$100+", -1},
+}
+
+// taskSummaryAccumulator collects per-ASIN data while a task runs
+type taskSummaryAccumulator struct {
+	Products       int            `firestore:"products"`
+	Results        int            `firestore:"results"`
+	Prices         []int          `firestore:"prices"`
+	RankSum        float64        `firestore:"rankSum"`
+	RankCount      int            `firestore:"rankCount"`
+	Brands         map[string]int `firestore:"brands"`
+	AmazonPresent  int            `firestore:"amazonPresent"`
+	TokensConsumed int            `firestore:"tokensConsumed"`
+	CacheHits      int            `firestore:"cacheHits"`
+}
+
+// accumulator returns the task's summary accumulator, creating it on first use
+func (task *Task) accumulator() *taskSummaryAccumulator {
+	if task.SummaryData == nil {
+		task.SummaryData = &taskSummaryAccumulator{Brands: make(map[string]int)}
+	}
+	if task.SummaryData.Brands == nil {
+		task.SummaryData.Brands = make(map[string]int)
+	}
+	return task.SummaryData
+}
+
+// clone returns a deep copy of the accumulator
+func (acc *taskSummaryAccumulator) clone() *taskSummaryAccumulator {
+	if acc == nil {
+		return nil
+	}
+	copied := *acc
+	copied.Prices = append([]int(nil), acc.Prices...)
+	copied.Brands = make(map[string]int, len(acc.Brands))
+	for brand, count := range acc.Brands {
+		copied.Brands[brand] = count
+	}
+	return &copied
+}
+
+// add folds the result of one ASIN into the accumulator
+func (acc *taskSummaryAccumulator) add(result ASINResult) {
+	acc.Results++
+	acc.TokensConsumed += result.TokensConsumed
+	if result.CacheHit {
+		acc.CacheHits++
+	}
+	if result.Product == nil {
+		return
+	}
+
+	for _, product := range result.Product.Products {
+		acc.Products++
+		if product.BuyBoxPrice > 0 {
+			acc.Prices = append(acc.Prices, product.BuyBoxPrice)
+		}
+		if rank, ok := latestSalesRank(product.SalesRanks); ok {
+			acc.RankSum += float64(rank)
+			acc.RankCount++
+		}
+		if product.Brand != "" {
+			acc.Brands[product.Brand]++
+		}
+		for _, offer := range product.Offers {
+			if offer.IsAmazon {
+				acc.AmazonPresent++
+				break
+			}
+		}
+	}
+}
+
+// summarize computes the final task summary
+func (acc *taskSummaryAccumulator) summarize() *TaskSummary {
+	summary := &TaskSummary{
+		Products:          acc.Products,
+		PriceDistribution: make(map[string]int),
+		BrandCounts:       acc.Brands,
+		TokensConsumed:    acc.TokensConsumed,
+		CacheHits:         acc.CacheHits,
+	}
+	if acc.Results > 0 {
+		summary.CacheHitRate = float64(acc.CacheHits) / float64(acc.Results)
+	}
+	if acc.Products > 0 {
+		summary.AmazonPresentPercent = float64(acc.AmazonPresent) / float64(acc.Products) * 100
+	}
+	if acc.RankCount > 0 {
+		summary.AvgSalesRank = acc.RankSum / float64(acc.RankCount)
+	}
+
+	if len(acc.Prices) > 0 {
+		prices := append([]int(nil), acc.Prices...)
+		sort.Ints(prices)
+		total := 0
+		for _, price := range prices {
+			total += price
+			for _, bucket := range priceBuckets {
+				if bucket.Upper < 0 || price < bucket.Upper {
+					summary.PriceDistribution[bucket.Label]++
+					break
+				}
+			}
+		}
+		summary.MinBuyBoxPrice = prices[0]
+		summary.MaxBuyBoxPrice = prices[len(prices)-1]
+		summary.AvgBuyBoxPrice = total / len(prices)
+		summary.MedianBuyBoxPrice = prices[len(prices)/2]
+	}
+	return summary
+}
+
+// latestSalesRank returns the most recent rank of a salesRanks map. The keys are
+// stored in storedTimeLayout, which sorts chronologically.
+func latestSalesRank(salesRanks map[string]int) (int, bool) {
+	latestKey := ""
+	for key := range salesRanks {
+		if key > latestKey {
+			latestKey = key
+		}
+	}
+	if latestKey == "" {
+		return 0, false
+	}
+	return salesRanks[latestKey], true
+}
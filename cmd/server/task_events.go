@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"sync"
+	"time"
+)
+
+// Task event types pushed to GET /tasks/:id/stream
+const (
+	TaskEventProgress       = "progress" // Snapshot sent when a stream opens
+	TaskEventASINCompleted  = "asin_completed"
+	TaskEventASINFailed     = "asin_failed"
+	TaskEventChunkCompleted = "chunk_completed"
+	TaskEventFinished       = "finished"
+)
+
+// TaskEvent is a progress update of a running task
+type TaskEvent struct {
+	Type       string    `json:"type"`
+	TaskID     string    `json:"task_id"`
+	ASIN       string    `json:"asin,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Chunk      int       `json:"chunk,omitempty"`
+	Status     string    `json:"status"`
+	Progress   int       `json:"progress"`
+	Total      int       `json:"total"`
+	TokensLeft int       `json:"tokens_left"`
+	Time       time.Time `json:"time"`
+}
+
+// taskEventBus fans task events out to the open streams of each task
+type taskEventBus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan TaskEvent]bool
+}
+
+var taskEvents = &taskEventBus{subscribers: make(map[string]map[chan TaskEvent]bool)}
+
+// subscribe returns a channel receiving the events of a task and a function closing it
+func (b *taskEventBus) subscribe(taskID string) (chan TaskEvent, func()) {
+	events := make(chan TaskEvent, 64)
+	b.mu.Lock()
+	if b.subscribers[taskID] == nil {
+		b.subscribers[taskID] = make(map[chan TaskEvent]bool)
+	}
+	b.subscribers[taskID][events] = true
+	b.mu.Unlock()
+
+	return events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers[taskID], events)
+		if len(b.subscribers[taskID]) == 0 {
+			delete(b.subscribers, taskID)
+		}
+	}
+}
+
+// publish sends an event to every stream of the task. Slow streams miss events
+// rather than blocking the task runner.
+func (b *taskEventBus) publish(event TaskEvent) {
+	event.Time = time.Now().UTC()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers[event.TaskID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// newTaskEvent builds an event carrying the current progress of task
+func newTaskEvent(eventType string, task *Task) TaskEvent {
+	return TaskEvent{
+		Type:     eventType,
+		TaskID:   task.ID,
+		Status:   task.Status,
+		Progress: task.Progress,
+		Total:    task.Total,
+	}
+}
+
+// handleTaskStream pushes task progress as Server-Sent Events until the task
+// finishes or the client disconnects
+func (client *KeepaClient) handleTaskStream(c *gin.Context) {
+	task, events, unsubscribe, err := watchTask(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	client = client.forContext(c.Request.Context())
+	snapshot := newTaskEvent(TaskEventProgress, &task)
+	snapshot.TokensLeft = client.tokensLeft()
+	snapshot.Time = time.Now().UTC()
+	c.SSEvent(snapshot.Type, snapshot)
+	if taskFinished(&task) {
+		c.SSEvent(TaskEventFinished, newTaskEvent(TaskEventFinished, &task))
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			return true
+		case event := <-events:
+			event.TokensLeft = client.tokensLeft()
+			c.SSEvent(event.Type, event)
+			return event.Type != TaskEventFinished
+		}
+	})
+}
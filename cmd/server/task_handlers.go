@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// handleListTasks lists the tasks of the calling tenant from Firestore, newest first,
+// filtered by status, creation date range (from/to, RFC 3339) and category, with
+// cursor pagination
+func handleListTasks(c *gin.Context) {
+	filter := taskListFilter{
+		TenantID: tenantID(c.Request.Context()),
+		Status:   c.Query("status"),
+		Category: c.Query("category"),
+	}
+	for _, param := range []struct {
+		name   string
+		target *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid %s: %v", param.name, err))
+			return
+		}
+		*param.target = parsed
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		respondError(c, http.StatusBadRequest, "limit must be between 1 and 100")
+		return
+	}
+
+	var cursor *taskCursor
+	if value := c.Query("cursor"); value != "" {
+		if cursor, err = decodeTaskCursor(value); err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	matches, nextCursor, err := listTasks(c.Request.Context(), filter, cursor, limit)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tasks": matches, "next_cursor": nextCursor})
+}
+
+// handleGetTask returns the state of a task
+func handleGetTask(c *gin.Context) {
+	task, err := getTask(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondServiceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// handleTaskResults returns the products of all task chunks completed after the
+// "after" chunk index, so consumers can read results while a scan is running.
+// The velocity parameters of parseVelocityFilter, e.g. ?minDrops90=30, filter the products.
+// ?format=ndjson streams the products as newline-delimited JSON instead.
+func handleTaskResults(c *gin.Context) {
+	taskID := c.Param("id")
+	task, ok, err := tasks.lookup(c.Request.Context(), taskID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskID))
+		return
+	}
+
+	after := -1
+	if value := c.Query("after"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("Invalid after: %v", err))
+			return
+		}
+		after = parsed
+	}
+	filter, err := parseVelocityFilter(c.Request.URL.Query())
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var chunks []TaskChunk
+	var asins []string
+	for _, chunk := range task.Chunks {
+		if chunk.Index <= after {
+			continue
+		}
+		chunks = append(chunks, chunk)
+		asins = append(asins, chunk.ASINs...)
+	}
+	if c.Query("format") == "ndjson" {
+		streamTaskResults(c, task.productDomain(), asins, filter)
+		return
+	}
+
+	products, err := getProductsFromFirestore(c.Request.Context(), task.productDomain(), asins)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	products = filter.apply(products)
+
+	nextAfter := after
+	if len(chunks) > 0 {
+		nextAfter = chunks[len(chunks)-1].Index
+	}
+
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"task_id":    task.ID,
+		"status":     task.Status,
+		"progress":   task.Progress,
+		"total":      task.Total,
+		"chunks":     chunks,
+		"products":   timeFormatterFor(c).products(products),
+		"next_after": nextAfter,
+		"complete":   task.Status == "completed" || task.Status == "failed",
+	}))
+}
+
+// resultBatchSize is the number of product documents read per batch when streaming results
+const resultBatchSize = 100
+
+// readResultBatches reads the products of asins of a domain from Firestore in batches
+// and passes each batch to handle before reading the next one, so a slow consumer
+// slows the reads down instead of filling memory. It stops when handle returns false or the
+// request context ends.
+func readResultBatches(ctx context.Context, domain string, asins []string, handle func([]SimplifiedProduct) bool) error {
+	for start := 0; start < len(asins); start += resultBatchSize {
+		if ctx.Err() != nil {
+			return nil
+		}
+		products, err := getProductsFromFirestore(ctx, domain, asins[start:min(start+resultBatchSize, len(asins))])
+		if err != nil {
+			return err
+		}
+		if !handle(products) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// streamTaskResults writes the products of asins as one JSON object per line. A
+// failure after the response started ends the stream with a problem line.
+func streamTaskResults(c *gin.Context, domain string, asins []string, filter velocityFilter) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	formatter := timeFormatterFor(c)
+	err := readResultBatches(c.Request.Context(), domain, asins, func(products []SimplifiedProduct) bool {
+		for _, product := range formatter.products(filter.apply(products)) {
+			if err := encoder.Encode(product); err != nil {
+				// The client went away
+				return false
+			}
+		}
+		c.Writer.Flush()
+		return true
+	})
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to stream task results", "error", err)
+		encoder.Encode(newProblem(c, http.StatusInternalServerError, CodeInternal, err.Error()))
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"maps"
+	"os"
+	"time"
+)
+
+// TasksCollection stores task state so tasks survive restarts
+const TasksCollection = "tasks"
+
+// Subcollections of a task document, holding the parts of a task that grow with it
+const (
+	TaskASINsCollection  = "asins"  // Progress per ASIN, see TaskASIN
+	TaskPagesCollection  = "pages"  // Finder pages of a fetch task, see TaskPage
+	TaskChunksCollection = "chunks" // Completed chunks, see TaskChunk
+)
+
+// Statuses of a TaskASIN
+const (
+	TaskASINPending   = "pending"
+	TaskASINProcessed = "processed"
+	TaskASINFailed    = "failed"
+)
+
+// TaskASIN is the progress of one ASIN of a task, a document of its asins subcollection
+type TaskASIN struct {
+	ASIN   string `firestore:"asin"`
+	Index  int    `firestore:"index"` // Position in Task.ASINs
+	Status string `firestore:"status"`
+	Class  string `firestore:"class,omitempty"` // Failure class of a failed ASIN
+	Error  string `firestore:"error,omitempty"`
+}
+
+// taskASINWrite is a pending write of a TaskASIN. A result only merges the status
+// fields into the document written when the ASIN was added.
+type taskASINWrite struct {
+	entry  TaskASIN
+	result bool
+}
+
+// queue adds the write to writer
+func (w taskASINWrite) queue(writer *firestore.BulkWriter, taskRef *firestore.DocumentRef) (*firestore.BulkWriterJob, error) {
+	ref := taskRef.Collection(TaskASINsCollection).Doc(w.entry.ASIN)
+	if !w.result {
+		return writer.Set(ref, w.entry)
+	}
+	return writer.Set(ref, map[string]interface{}{
+		"asin":   w.entry.ASIN,
+		"status": w.entry.Status,
+		"class":  w.entry.Class,
+		"error":  w.entry.Error,
+	}, firestore.MergeAll)
+}
+
+// taskWrites are the changes of the subcollections of a task not written to Firestore
+// yet. Writes of the same ASIN are combined.
+type taskWrites struct {
+	asins  map[string]taskASINWrite
+	pages  []TaskPage
+	chunks []TaskChunk
+}
+
+// addASIN queues the document of a new ASIN
+func (w *taskWrites) addASIN(entry TaskASIN) {
+	if w.asins == nil {
+		w.asins = make(map[string]taskASINWrite)
+	}
+	w.asins[entry.ASIN] = taskASINWrite{entry: entry}
+}
+
+// setResult queues the outcome of an ASIN, failure set when it failed
+func (w *taskWrites) setResult(asin, status string, failure *TaskFailure) {
+	if w.asins == nil {
+		w.asins = make(map[string]taskASINWrite)
+	}
+	write, ok := w.asins[asin]
+	if !ok {
+		write = taskASINWrite{entry: TaskASIN{ASIN: asin}, result: true}
+	}
+	write.entry.Status, write.entry.Class, write.entry.Error = status, "", ""
+	if failure != nil {
+		write.entry.Class, write.entry.Error = failure.Class, failure.Error
+	}
+	w.asins[asin] = write
+}
+
+// addProgress queues all ASINs, pages and chunks of a task, e.g. to move the progress
+// of a task stored before the subcollections existed into them
+func (w *taskWrites) addProgress(task *Task) {
+	processed := make(map[string]bool, len(task.Processed))
+	for _, asin := range task.Processed {
+		processed[asin] = true
+	}
+	failures := make(map[string]*TaskFailure, len(task.Failures))
+	for i := range task.Failures {
+		failures[task.Failures[i].ASIN] = &task.Failures[i]
+	}
+	for i, asin := range task.ASINs {
+		w.addASIN(TaskASIN{ASIN: asin, Index: i, Status: TaskASINPending})
+		switch {
+		case failures[asin] != nil:
+			w.setResult(asin, TaskASINFailed, failures[asin])
+		case processed[asin]:
+			w.setResult(asin, TaskASINProcessed, nil)
+		}
+	}
+	w.pages = append(w.pages, task.Pages...)
+	w.chunks = append(w.chunks, task.Chunks...)
+}
+
+// requeue puts the writes of a failed flush in front of the newer writes in w
+func (w *taskWrites) requeue(failed *taskWrites) {
+	for asin, write := range failed.asins {
+		newer, ok := w.asins[asin]
+		switch {
+		case !ok:
+			if w.asins == nil {
+				w.asins = make(map[string]taskASINWrite)
+			}
+			w.asins[asin] = write
+		case newer.result && !write.result:
+			// The document of the ASIN may not exist yet, keep its index
+			write.entry.Status, write.entry.Class, write.entry.Error = newer.entry.Status, newer.entry.Class, newer.entry.Error
+			w.asins[asin] = write
+		}
+	}
+	w.pages = append(failed.pages, w.pages...)
+	w.chunks = append(failed.chunks, w.chunks...)
+}
+
+// taskPageDocID returns the document ID of a finder page in the pages subcollection
+func taskPageDocID(category string, page int) string {
+	return fmt.Sprintf("%s_%05d", category, page)
+}
+
+// taskChunkDocID returns the document ID of a chunk, sorting in chunk order
+func taskChunkDocID(index int) string {
+	return fmt.Sprintf("%06d", index)
+}
+
+// taskDocument returns a copy of the fields of a task stored in its document
+func taskDocument(task *Task) Task {
+	doc := *task
+	doc.known = nil
+	doc.ASINs, doc.Processed, doc.Failures, doc.Pages, doc.Chunks = nil, nil, nil, nil, nil
+	doc.SummaryData = task.SummaryData.clone()
+	doc.ErrorCounts = maps.Clone(task.ErrorCounts)
+	doc.CategoryProgress = maps.Clone(task.CategoryProgress)
+	return doc
+}
+
+// flush writes the changed tasks to Firestore with one BulkWriter: the task documents
+// and the new documents of their subcollections. The writes of a task that failed are
+// kept for the next flush, so a Firestore outage delays persistence instead of
+// losing it.
+func (s *taskStore) flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]*taskWrites)
+	docs := make(map[string]Task, len(dirty))
+	for taskID := range dirty {
+		if task, ok := s.tasks[taskID]; ok {
+			docs[taskID] = taskDocument(task)
+		}
+	}
+	s.mu.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	writer := firestoreClient.BulkWriter(ctx)
+	jobs := make(map[string][]*firestore.BulkWriterJob, len(dirty))
+	failed := make(map[string]bool)
+	var firstErr error
+	for taskID, writes := range dirty {
+		doc, ok := docs[taskID]
+		if !ok {
+			continue
+		}
+		queued := func(job *firestore.BulkWriterJob, err error) {
+			if err != nil {
+				failed[taskID] = true
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			jobs[taskID] = append(jobs[taskID], job)
+		}
+		ref := firestoreClient.Collection(TasksCollection).Doc(taskID)
+		for _, write := range writes.asins {
+			queued(write.queue(writer, ref))
+		}
+		for _, page := range writes.pages {
+			queued(writer.Set(ref.Collection(TaskPagesCollection).Doc(taskPageDocID(page.Category, page.Page)), page))
+		}
+		for _, chunk := range writes.chunks {
+			queued(writer.Set(ref.Collection(TaskChunksCollection).Doc(taskChunkDocID(chunk.Index)), chunk))
+		}
+		queued(writer.Set(ref, doc))
+	}
+	writer.End()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for taskID, writes := range dirty {
+		for _, job := range jobs[taskID] {
+			if _, err := job.Results(); err != nil {
+				failed[taskID] = true
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if _, ok := s.tasks[taskID]; ok && failed[taskID] {
+			s.changed(taskID).requeue(writes)
+		} else if _, ok := docs[taskID]; ok {
+			delete(s.unsaved, taskID)
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to save %d tasks to Firestore: %v", len(failed), firstErr)
+	}
+	return nil
+}
+
+// startPersisting flushes the task changes every TASK_PERSIST_INTERVAL (2s), so a
+// busy task writes its document about once per interval instead of once per ASIN. It
+// also renews the leases of the running tasks and evicts finished ones.
+func (s *taskStore) startPersisting() {
+	interval := envDuration("TASK_PERSIST_INTERVAL", 2*time.Second)
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			s.renewLeases(ctx)
+			if err := s.flush(ctx); err != nil {
+				logger.Error("Failed to persist tasks, retrying with the next flush", "error", err)
+			}
+			s.evictFinished()
+			cancel()
+		}
+	}()
+}
+
+// instanceID identifies this instance as the owner of the tasks it runs
+var instanceID = newInstanceID()
+
+// newInstanceID returns the host name with a random suffix, unique across restarts
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "instance"
+	}
+	return host + "-" + newRequestID()
+}
+
+// taskLease returns how long an instance holds a task without renewing its lease,
+// configured by TASK_LEASE (2m). Other instances resume a task once its lease expired.
+func taskLease() time.Duration {
+	return envDuration("TASK_LEASE", 2*time.Minute)
+}
+
+// owns reports whether the task is held in memory by this instance
+func (s *taskStore) owns(taskID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.tasks[taskID]
+	return ok
+}
+
+// renewLeases extends the leases of the unfinished tasks of this instance once a
+// quarter of the lease has passed. A task whose lease was taken over by another
+// instance is dropped from memory, so this instance stops writing its state.
+func (s *taskStore) renewLeases(ctx context.Context) {
+	lease := taskLease()
+	s.mu.RLock()
+	var due []string
+	for taskID, task := range s.tasks {
+		if !taskFinished(task) && time.Until(task.LeaseExpiresAt) < lease*3/4 {
+			due = append(due, taskID)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, taskID := range due {
+		expiresAt := time.Now().UTC().Add(lease)
+		owned, err := extendTaskLease(ctx, taskID, expiresAt)
+		if err != nil {
+			logger.Warn("Failed to renew task lease", LogKeyTaskID, taskID, "error", err)
+			continue
+		}
+		s.mu.Lock()
+		if task, ok := s.tasks[taskID]; ok && owned {
+			task.LeaseExpiresAt = expiresAt
+		} else if !owned {
+			delete(s.tasks, taskID)
+			delete(s.dirty, taskID)
+			delete(s.unsaved, taskID)
+		}
+		s.mu.Unlock()
+		if !owned {
+			logger.Error("Task was taken over by another instance, no longer persisting it", LogKeyTaskID, taskID)
+		}
+	}
+}
+
+// extendTaskLease moves the lease of a task of this instance to expiresAt, reporting
+// false when another instance owns the task now. A task not written yet is owned.
+func extendTaskLease(ctx context.Context, taskID string, expiresAt time.Time) (bool, error) {
+	ref := firestoreClient.Collection(TasksCollection).Doc(taskID)
+	owned := false
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			owned = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		owner, _ := doc.DataAt("owner")
+		owned = owner == instanceID
+		if !owned {
+			return nil
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "leaseExpiresAt", Value: expiresAt}})
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to renew the lease of task %s: %v", taskID, err)
+	}
+	return owned, nil
+}
+
+// claimTask takes over an unfinished task whose lease expired in a transaction, so
+// only one instance resumes it. It returns nil when the task finished or another
+// instance holds it.
+func claimTask(ctx context.Context, taskID string) (*Task, legacyTaskProgress, error) {
+	ref := firestoreClient.Collection(TasksCollection).Doc(taskID)
+	var claimed *Task
+	var legacy legacyTaskProgress
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		task, progress, err := decodeTask(doc)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if taskFinished(task) || task.LeaseExpiresAt.After(now) {
+			return nil
+		}
+		task.Owner, task.LeaseExpiresAt = instanceID, now.Add(taskLease())
+		claimed, legacy = task, progress
+		return tx.Update(ref, []firestore.Update{
+			{Path: "owner", Value: task.Owner},
+			{Path: "leaseExpiresAt", Value: task.LeaseExpiresAt},
+		})
+	})
+	if err != nil {
+		return nil, legacy, fmt.Errorf("failed to claim task %s: %v", taskID, err)
+	}
+	return claimed, legacy, nil
+}
+
+// legacyTaskProgress is the progress stored in task documents before it moved to the
+// subcollections
+type legacyTaskProgress struct {
+	ASINs     []string      `firestore:"asins"`
+	Processed []string      `firestore:"processed"`
+	Failures  []TaskFailure `firestore:"failures"`
+	Pages     []TaskPage    `firestore:"pages"`
+	Chunks    []TaskChunk   `firestore:"chunks"`
+}
+
+// decodeTask decodes a task document and the progress it may hold from before the
+// subcollections existed
+func decodeTask(doc *firestore.DocumentSnapshot) (*Task, legacyTaskProgress, error) {
+	var task Task
+	var legacy legacyTaskProgress
+	if err := doc.DataTo(&task); err != nil {
+		return nil, legacy, fmt.Errorf("failed to decode task %s: %v", doc.Ref.ID, err)
+	}
+	if err := doc.DataTo(&legacy); err != nil {
+		return nil, legacy, fmt.Errorf("failed to decode task %s: %v", doc.Ref.ID, err)
+	}
+	return &task, legacy, nil
+}
+
+// loadTask reads a task from Firestore with its chunks, returning nil when it does not
+// exist. The per-ASIN progress and the finder pages are read by loadTaskProgress.
+func loadTask(ctx context.Context, taskID string) (*Task, error) {
+	doc, err := firestoreClient.Collection(TasksCollection).Doc(taskID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task %s from Firestore: %v", taskID, err)
+	}
+	task, legacy, err := decodeTask(doc)
+	if err != nil {
+		return nil, err
+	}
+	if task.Chunks, err = loadTaskChunks(ctx, taskID); err != nil {
+		return nil, err
+	}
+	if len(task.Chunks) == 0 {
+		task.Chunks = legacy.Chunks
+	}
+	return task, nil
+}
+
+// loadTaskChunks reads the chunks of a task in order
+func loadTaskChunks(ctx context.Context, taskID string) ([]TaskChunk, error) {
+	iter := firestoreClient.Collection(TasksCollection).Doc(taskID).Collection(TaskChunksCollection).Documents(ctx)
+	defer iter.Stop()
+
+	var chunks []TaskChunk
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunks of task %s from Firestore: %v", taskID, err)
+		}
+		var chunk TaskChunk
+		if err := doc.DataTo(&chunk); err != nil {
+			return nil, fmt.Errorf("failed to decode chunk %s of task %s: %v", doc.Ref.ID, taskID, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// loadTaskProgress reads the ASINs, processed ASINs, failures, finder pages and chunks
+// of a task to be resumed. A task stored before the subcollections existed takes its
+// progress from legacy; it reports true then, so the progress can be written to the
+// subcollections.
+func loadTaskProgress(ctx context.Context, task *Task, legacy legacyTaskProgress) (bool, error) {
+	ref := firestoreClient.Collection(TasksCollection).Doc(task.ID)
+	asinDocs, err := ref.Collection(TaskASINsCollection).OrderBy("index", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return false, fmt.Errorf("failed to read ASINs of task %s from Firestore: %v", task.ID, err)
+	}
+	pageDocs, err := ref.Collection(TaskPagesCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return false, fmt.Errorf("failed to read finder pages of task %s from Firestore: %v", task.ID, err)
+	}
+	if task.Chunks, err = loadTaskChunks(ctx, task.ID); err != nil {
+		return false, err
+	}
+
+	task.ASINs, task.Processed, task.Failures, task.Pages = nil, nil, nil, nil
+	for _, doc := range asinDocs {
+		var entry TaskASIN
+		if err := doc.DataTo(&entry); err != nil {
+			return false, fmt.Errorf("failed to decode ASIN %s of task %s: %v", doc.Ref.ID, task.ID, err)
+		}
+		task.ASINs = append(task.ASINs, entry.ASIN)
+		switch entry.Status {
+		case TaskASINProcessed:
+			task.Processed = append(task.Processed, entry.ASIN)
+		case TaskASINFailed:
+			task.Processed = append(task.Processed, entry.ASIN)
+			task.Failures = append(task.Failures, TaskFailure{ASIN: entry.ASIN, Class: entry.Class, Error: entry.Error})
+		}
+	}
+	for _, doc := range pageDocs {
+		var page TaskPage
+		if err := doc.DataTo(&page); err != nil {
+			return false, fmt.Errorf("failed to decode finder page %s of task %s: %v", doc.Ref.ID, task.ID, err)
+		}
+		task.Pages = append(task.Pages, page)
+	}
+
+	if len(task.ASINs) == 0 && len(task.Pages) == 0 && len(task.Chunks) == 0 && len(legacy.ASINs) > 0 {
+		task.ASINs, task.Processed, task.Failures = legacy.ASINs, legacy.Processed, legacy.Failures
+		task.Pages, task.Chunks = legacy.Pages, legacy.Chunks
+		return true, nil
+	}
+	return false, nil
+}
+
+// lookup returns a copy of the task state. Tasks of this instance are read from
+// memory, all others from Firestore on every call, so their progress is current; they
+// come without the per-ASIN progress of the asins subcollection. Tasks of other
+// tenants than the one of ctx are not found.
+func (s *taskStore) lookup(ctx context.Context, taskID string) (Task, bool, error) {
+	if task, ok := s.get(taskID); ok {
+		if task.TenantID != tenantID(ctx) {
+			return Task{}, false, nil
+		}
+		return task, true, nil
+	}
+	task, err := loadTask(ctx, taskID)
+	if err != nil || task == nil || task.TenantID != tenantID(ctx) {
+		return Task{}, false, err
+	}
+	return *task, true, nil
+}
+
+// taskListFilter selects the tasks of a tenant listed by GET /tasks. Zero fields
+// match all tasks.
+type taskListFilter struct {
+	TenantID string
+	Status   string
+	Category string    // Root category scanned by the task
+	From     time.Time // Earliest creation time
+	To       time.Time // Latest creation time
+}
+
+// taskCursor is the position after the last task of a page: its creation time and
+// ID, which breaks ties
+type taskCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+// encode returns the opaque cursor string
+func (cursor *taskCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeTaskCursor parses a cursor returned by a previous page
+func decodeTaskCursor(value string) (*taskCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var cursor taskCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" || cursor.CreatedAt.IsZero() {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// listTasks reads a page of the tasks matching filter from Firestore, newest first,
+// starting after cursor. It returns the cursor of the next page, empty on the last
+// one. The listed tasks come without their ASINs and chunks.
+func listTasks(ctx context.Context, filter taskListFilter, cursor *taskCursor, limit int) ([]Task, string, error) {
+	query := firestoreClient.Collection(TasksCollection).Where("tenantId", "==", filter.TenantID)
+	if filter.Status != "" {
+		query = query.Where("status", "==", filter.Status)
+	}
+	if filter.Category != "" {
+		query = query.Where("categories", "array-contains", filter.Category)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("createdAt", ">=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("createdAt", "<=", filter.To)
+	}
+	query = query.OrderBy("createdAt", firestore.Desc).OrderBy(firestore.DocumentID, firestore.Desc)
+	if cursor != nil {
+		query = query.StartAfter(cursor.CreatedAt, cursor.ID)
+	}
+
+	// One task more than requested tells whether there is a next page
+	docs, err := query.Limit(limit + 1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query tasks from Firestore: %v", err)
+	}
+	result := make([]Task, 0, min(len(docs), limit))
+	for _, doc := range docs[:min(len(docs), limit)] {
+		task, _, err := decodeTask(doc)
+		if err != nil {
+			return nil, "", err
+		}
+		result = append(result, *task)
+	}
+	nextCursor := ""
+	if len(docs) > limit {
+		last := result[limit-1]
+		nextCursor = (&taskCursor{CreatedAt: last.CreatedAt, ID: last.ID}).encode()
+	}
+	return result, nextCursor, nil
+}
+
+// finishedTaskRetention is how long a finished task stays in memory after its final
+// state was written, for callbacks and clients polling this instance
+const finishedTaskRetention = time.Minute
+
+// evictFinished drops the finished tasks whose final state was written from memory.
+// Later lookups read them from Firestore.
+func (s *taskStore) evictFinished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for taskID, task := range s.tasks {
+		if _, dirty := s.dirty[taskID]; dirty {
+			continue
+		}
+		if task.FinishedAt != nil && time.Since(*task.FinishedAt) > finishedTaskRetention {
+			delete(s.tasks, taskID)
+		}
+	}
+}
+
+// resumeTasks claims the pending and running tasks whose lease expired, e.g. because
+// the instance running them stopped, and queues them again. Fetch tasks continue at
+// the recorded page of each category, skipping the ASINs already processed.
+func (client *KeepaClient) resumeTasks(ctx context.Context) error {
+	iter := firestoreClient.Collection(TasksCollection).Where("status", "in", []string{"pending", "running"}).Documents(ctx)
+	defer iter.Stop()
+
+	var expired []string
+	now := time.Now()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query unfinished tasks from Firestore: %v", err)
+		}
+		leaseExpiresAt, _ := doc.DataAt("leaseExpiresAt")
+		if expiresAt, ok := leaseExpiresAt.(time.Time); ok && expiresAt.After(now) {
+			continue
+		}
+		if !tasks.owns(doc.Ref.ID) {
+			expired = append(expired, doc.Ref.ID)
+		}
+	}
+
+	for _, taskID := range expired {
+		task, legacy, err := claimTask(ctx, taskID)
+		if err != nil {
+			client.Logger.Warn("Skipping task that failed to be claimed", LogKeyTaskID, taskID, "error", err)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+		// The lease expires again when the progress cannot be read, so a later scan retries
+		migrated, err := loadTaskProgress(ctx, task, legacy)
+		if err != nil {
+			client.Logger.Warn("Skipping task that failed to load", LogKeyTaskID, taskID, "error", err)
+			continue
+		}
+
+		tasks.mu.Lock()
+		tasks.tasks[task.ID] = task
+		if migrated {
+			tasks.changed(task.ID).addProgress(task)
+		}
+		tasks.mu.Unlock()
+
+		var run func()
+		switch {
+		case task.Kind == TaskKindFetch && task.Spec != nil:
+			spec := task.Spec
+			run = func() { client.runFetchTask(taskID, spec) }
+		case task.Kind == TaskKindASINs || task.Kind == TaskKindStorefront:
+			asins, useCache := append([]string(nil), task.ASINs...), task.UseCache
+			run = func() { client.runASINTask(taskID, asins, useCache) }
+		default:
+			tasks.finish(taskID, fmt.Errorf("task of kind %q cannot be resumed", task.Kind))
+			continue
+		}
+
+		if !enqueueTask(run) {
+			tasks.finish(taskID, fmt.Errorf("task queue is full"))
+			continue
+		}
+		client.Logger.Info("Resumed task", LogKeyTaskID, taskID, "kind", task.Kind, "progress", task.Progress, "total", task.Total)
+	}
+	return nil
+}
+
+// watchTaskLeases resumes tasks of instances that stopped, checking every half lease
+func (client *KeepaClient) watchTaskLeases() {
+	for range time.Tick(taskLease() / 2) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := client.resumeTasks(ctx); err != nil {
+			client.Logger.Error("Failed to resume tasks", "error", err)
+		}
+		cancel()
+	}
+}
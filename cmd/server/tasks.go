@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per-ASIN failure classes recorded in Task.ErrorCounts
+const (
+	ErrClassTokenExhausted = "token_exhausted"
+	ErrClassKeepa          = "keepa_error"
+	ErrClassParse          = "parse_error"
+	ErrClassCache          = "cache_error"
+	ErrClassStore          = "store_error"
+	ErrClassTimeout        = "timeout"
+	ErrClassCircuitOpen    = "circuit_open" // Keepa calls suspended by the circuit breaker
+)
+
+// TaskError attaches a failure class to an error
+type TaskError struct {
+	Class string
+	Err   error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// newTaskError wraps err with a failure class
+func newTaskError(class string, err error) error {
+	return &TaskError{Class: class, Err: err}
+}
+
+// classifyError returns the failure class of err, defaulting to keepa_error
+func classifyError(err error) string {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrClassTimeout
+	}
+	return ErrClassKeepa
+}
+
+// Task kinds, deciding how a task is resumed after a restart
+const (
+	TaskKindFetch      = "fetch"      // Product Finder scan described by Task.Spec
+	TaskKindASINs      = "asins"      // Explicit ASIN list, e.g. a refresh
+	TaskKindStorefront = "storefront" // Storefront ASINs of a seller, resumed like TaskKindASINs
+)
+
+// TaskFailure records why a single ASIN failed
+type TaskFailure struct {
+	ASIN  string `json:"asin" firestore:"asin"`
+	Class string `json:"class" firestore:"class"`
+	Error string `json:"error" firestore:"error"`
+}
+
+// TaskChunk is a completed finder page whose products are available for reading
+type TaskChunk struct {
+	Index       int       `json:"index" firestore:"index"`
+	Category    string    `json:"category,omitempty" firestore:"category"`
+	Page        int       `json:"page" firestore:"page"`
+	ASINs       []string  `json:"asins" firestore:"asins"` // Successfully stored ASINs of this page
+	CompletedAt time.Time `json:"completed_at" firestore:"completedAt"`
+}
+
+// CategoryProgress tracks the scan of one root category of a fetch task
+type CategoryProgress struct {
+	Status         string `json:"status" firestore:"status"` // "pending", "running", "completed", "failed"
+	Page           int    `json:"page" firestore:"page"`     // Next finder page to fetch
+	PagesCompleted int    `json:"pages_completed" firestore:"pagesCompleted"`
+	ASINs          int    `json:"asins" firestore:"asins"`        // ASINs found, including ones also found in other categories
+	NewASINs       int    `json:"new_asins" firestore:"newASINs"` // ASINs not found in another category before
+	Error          string `json:"error,omitempty" firestore:"error"`
+}
+
+// TaskPage is a finder page collected by a fetch task
+type TaskPage struct {
+	Category string   `json:"category" firestore:"category"`
+	Page     int      `json:"page" firestore:"page"`
+	ASINs    []string `json:"asins" firestore:"asins"`
+}
+
+// newCategoryProgress returns the initial progress of the categories of a fetch task
+func newCategoryProgress(categories []string) map[string]CategoryProgress {
+	progress := make(map[string]CategoryProgress, len(categories))
+	for _, category := range categories {
+		progress[category] = CategoryProgress{Status: "pending"}
+	}
+	return progress
+}
+
+// taskStore keeps task state in memory. Changes are written to Firestore in batches,
+// see flush: the task document holds the counters and cursors, the ASINs, finder
+// pages and chunks are documents of its subcollections.
+type taskStore struct {
+	mu      sync.RWMutex
+	tasks   map[string]*Task
+	dirty   map[string]*taskWrites // Changes not written to Firestore yet, by task
+	unsaved map[string]bool        // Created tasks whose document was not written yet
+	flushMu sync.Mutex             // Serializes flushes so writes land in update order
+}
+
+var tasks = &taskStore{tasks: make(map[string]*Task), dirty: make(map[string]*taskWrites), unsaved: make(map[string]bool)}
+
+// create registers a new pending task of the given kind for the tenant and caller of ctx
+func (s *taskStore) create(ctx context.Context, taskID, kind string) *Task {
+	task := &Task{
+		ID:        taskID,
+		Kind:      kind,
+		Status:    "pending",
+		TenantID:  tenantID(ctx),
+		CreatedBy: callerFrom(ctx),
+		CreatedAt: time.Now().UTC(),
+		Owner:     instanceID,
+	}
+	task.LeaseExpiresAt = task.CreatedAt.Add(taskLease())
+	s.mu.Lock()
+	s.tasks[taskID] = task
+	s.unsaved[taskID] = true
+	s.changed(taskID)
+	s.mu.Unlock()
+	return task
+}
+
+// unsavedActiveOf counts the pending and running tasks of a caller created on this
+// instance whose document was not written yet, so Firestore does not count them
+func (s *taskStore) unsavedActiveOf(caller string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	active := 0
+	for taskID := range s.unsaved {
+		if task, ok := s.tasks[taskID]; ok && task.CreatedBy == caller && !taskFinished(task) {
+			active++
+		}
+	}
+	return active
+}
+
+// changed marks the task document for the next flush and returns the pending writes
+// of its subcollections. The caller must hold mu.
+func (s *taskStore) changed(taskID string) *taskWrites {
+	writes, ok := s.dirty[taskID]
+	if !ok {
+		writes = &taskWrites{}
+		s.dirty[taskID] = writes
+	}
+	return writes
+}
+
+// get returns a copy of the task state
+func (s *taskStore) get(taskID string) (Task, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return Task{}, false
+	}
+	return copyTask(task), true
+}
+
+// copyTask returns a deep copy of a task that is safe to use outside the store lock
+func copyTask(task *Task) Task {
+	snapshot := *task
+	snapshot.known = nil
+	snapshot.ASINs = append([]string(nil), task.ASINs...)
+	snapshot.Processed = append([]string(nil), task.Processed...)
+	snapshot.Failures = append([]TaskFailure(nil), task.Failures...)
+	snapshot.Chunks = append([]TaskChunk(nil), task.Chunks...)
+	snapshot.Pages = append([]TaskPage(nil), task.Pages...)
+	snapshot.SummaryData = task.SummaryData.clone()
+	snapshot.ErrorCounts = make(map[string]int, len(task.ErrorCounts))
+	for class, count := range task.ErrorCounts {
+		snapshot.ErrorCounts[class] = count
+	}
+	if task.CategoryProgress != nil {
+		snapshot.CategoryProgress = make(map[string]CategoryProgress, len(task.CategoryProgress))
+		for category, progress := range task.CategoryProgress {
+			snapshot.CategoryProgress[category] = progress
+		}
+	}
+	return snapshot
+}
+
+// update applies fn to the task under the store lock. The change is written to
+// Firestore by the next flush.
+func (s *taskStore) update(taskID string, fn func(task *Task)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return
+	}
+	fn(task)
+	task.UpdatedAt = time.Now().UTC()
+	s.changed(taskID)
+}
+
+// start marks a queued task as running
+func (s *taskStore) start(taskID string) {
+	s.update(taskID, func(task *Task) {
+		task.Status = "running"
+		pubsubEvents.publishTask(EventTaskStarted, task)
+	})
+}
+
+// knownASINs returns the set of the task's ASINs. It is built on first use, e.g. after
+// the task was loaded from Firestore, and kept up to date by appendASIN.
+func (task *Task) knownASINs() map[string]struct{} {
+	if task.known == nil {
+		task.known = make(map[string]struct{}, len(task.ASINs))
+		for _, asin := range task.ASINs {
+			task.known[asin] = struct{}{}
+		}
+	}
+	return task.known
+}
+
+// appendASIN adds an ASIN to the task and queues its document
+func (task *Task) appendASIN(writes *taskWrites, asin string) {
+	writes.addASIN(TaskASIN{ASIN: asin, Index: len(task.ASINs), Status: TaskASINPending})
+	task.ASINs = append(task.ASINs, asin)
+	if task.known != nil {
+		task.known[asin] = struct{}{}
+	}
+}
+
+// addASINs extends the task with newly discovered ASINs
+func (s *taskStore) addASINs(taskID string, asins []string) {
+	s.update(taskID, func(task *Task) {
+		writes := s.changed(taskID)
+		for _, asin := range asins {
+			task.appendASIN(writes, asin)
+		}
+		task.Total += len(asins)
+	})
+}
+
+// addPage records a finder page of a fetch task and extends the task with the
+// ASINs not seen on an earlier page, which it returns
+func (s *taskStore) addPage(taskID, category string, page int, asins []string) (newASINs []string) {
+	s.update(taskID, func(task *Task) {
+		known := task.knownASINs()
+		writes := s.changed(taskID)
+		for _, asin := range asins {
+			if _, ok := known[asin]; !ok {
+				task.appendASIN(writes, asin)
+				newASINs = append(newASINs, asin)
+			}
+		}
+		task.Total += len(newASINs)
+		taskPage := TaskPage{Category: category, Page: page, ASINs: asins}
+		task.Pages = append(task.Pages, taskPage)
+		writes.pages = append(writes.pages, taskPage)
+
+		if task.CategoryProgress == nil {
+			task.CategoryProgress = make(map[string]CategoryProgress)
+		}
+		progress := task.CategoryProgress[category]
+		progress.Status = "running"
+		progress.Page = page + 1
+		progress.PagesCompleted++
+		progress.ASINs += len(asins)
+		progress.NewASINs += len(newASINs)
+		task.CategoryProgress[category] = progress
+	})
+	return newASINs
+}
+
+// finishCategory marks the scan of a category completed, or failed when err is set
+func (s *taskStore) finishCategory(taskID, category string, err error) {
+	s.update(taskID, func(task *Task) {
+		if task.CategoryProgress == nil {
+			task.CategoryProgress = make(map[string]CategoryProgress)
+		}
+		progress := task.CategoryProgress[category]
+		progress.Status = "completed"
+		if err != nil {
+			progress.Status = "failed"
+			progress.Error = err.Error()
+		}
+		task.CategoryProgress[category] = progress
+	})
+}
+
+// addTokens books tokens consumed by a task outside of per-ASIN requests
+func (s *taskStore) addTokens(taskID string, tokens int) {
+	s.update(taskID, func(task *Task) {
+		task.accumulator().TokensConsumed += tokens
+	})
+}
+
+// recordResult advances task progress, classifying err when the ASIN failed. Failed
+// ASINs are dead-lettered in Firestore; retry tasks update the dead letter list of
+// the task they retry.
+func (s *taskStore) recordResult(taskID, asin string, result ASINResult, err error) {
+	var failure *TaskFailure
+	deadLetterTaskID := taskID
+	defer func() {
+		if failure != nil {
+			saveFailedASIN(deadLetterTaskID, *failure)
+		} else if deadLetterTaskID != taskID {
+			deleteFailedASIN(deadLetterTaskID, asin)
+		}
+	}()
+
+	s.update(taskID, func(task *Task) {
+		if task.RetryOf != "" {
+			deadLetterTaskID = task.RetryOf
+		}
+		task.Progress++
+		task.Processed = append(task.Processed, asin)
+		if warning := quota.warning(); warning.moreSevere(task.QuotaWarning) {
+			task.QuotaWarning = warning
+		}
+		task.accumulator().add(result)
+		writes := s.changed(taskID)
+		if err == nil {
+			writes.setResult(asin, TaskASINProcessed, nil)
+			event := newTaskEvent(TaskEventASINCompleted, task)
+			event.ASIN = asin
+			taskEvents.publish(event)
+			return
+		}
+		class := classifyError(err)
+		if task.ErrorCounts == nil {
+			task.ErrorCounts = make(map[string]int)
+		}
+		task.ErrorCounts[class]++
+		failure = &TaskFailure{ASIN: asin, Class: class, Error: err.Error()}
+		task.Failures = append(task.Failures, *failure)
+		writes.setResult(asin, TaskASINFailed, failure)
+
+		event := newTaskEvent(TaskEventASINFailed, task)
+		event.ASIN, event.Class, event.Error = asin, class, err.Error()
+		taskEvents.publish(event)
+	})
+}
+
+// completeChunk marks a finder page as fully processed so its results can be read
+func (s *taskStore) completeChunk(taskID, category string, page int, asins []string) {
+	s.update(taskID, func(task *Task) {
+		failed := make(map[string]bool)
+		for _, failure := range task.Failures {
+			failed[failure.ASIN] = true
+		}
+		chunk := TaskChunk{
+			Index:       len(task.Chunks),
+			Category:    category,
+			Page:        page,
+			CompletedAt: time.Now().UTC(),
+		}
+		for _, asin := range asins {
+			if !failed[asin] {
+				chunk.ASINs = append(chunk.ASINs, asin)
+			}
+		}
+		task.Chunks = append(task.Chunks, chunk)
+		writes := s.changed(taskID)
+		writes.chunks = append(writes.chunks, chunk)
+
+		event := newTaskEvent(TaskEventChunkCompleted, task)
+		event.Chunk = chunk.Index
+		taskEvents.publish(event)
+	})
+}
+
+// taskQueue holds tasks waiting for a free task runner
+var taskQueue chan func()
+
+// startTaskRunners starts TASK_RUNNERS goroutines executing queued tasks and the
+// periodic flush of their state to Firestore
+func startTaskRunners() {
+	runners, _ := strconv.Atoi(getEnv("TASK_RUNNERS", "2"))
+	if runners < 1 {
+		runners = 1
+	}
+	queueSize, _ := strconv.Atoi(getEnv("TASK_QUEUE_SIZE", "100"))
+	taskQueue = make(chan func(), queueSize)
+	for i := 0; i < runners; i++ {
+		go func() {
+			for run := range taskQueue {
+				run()
+			}
+		}()
+	}
+	tasks.startPersisting()
+}
+
+// notifyTaskFinished sends task_completed, or task_failed as a warning
+func notifyTaskFinished(task Task) {
+	details := map[string]interface{}{
+		"task_id":     task.ID,
+		"kind":        task.Kind,
+		"progress":    task.Progress,
+		"total":       task.Total,
+		"results_url": taskResultsURL(task.ID),
+	}
+	if task.ScheduleID != "" {
+		details["schedule_id"] = task.ScheduleID
+	}
+	if task.Status == "failed" {
+		details["error"] = task.Error
+		sendNotification("task_failed", "warning", fmt.Sprintf("Task %s failed: %s", task.ID, task.Error), details)
+		return
+	}
+	sendNotification("task_completed", "info", fmt.Sprintf("Task %s completed, %d of %d items", task.ID, task.Progress, task.Total), details)
+}
+
+// enqueueTask queues a task for background execution, returning false when the queue is full
+func enqueueTask(run func()) bool {
+	select {
+	case taskQueue <- run:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish marks the task completed, or failed when taskErr is set, and posts the
+// outcome to the task's callback URL and the notification destinations
+func (s *taskStore) finish(taskID string, taskErr error) {
+	defer func() {
+		task, ok := s.get(taskID)
+		if ok && task.CallbackURL != "" {
+			go sendTaskCallback(task)
+		}
+		if ok {
+			go notifyTaskFinished(task)
+		}
+		if ok && task.ScheduleID != "" {
+			go finishScheduleRun(task)
+		}
+	}()
+	s.update(taskID, func(task *Task) {
+		now := time.Now().UTC()
+		task.FinishedAt = &now
+		task.Status = "completed"
+		task.Summary = task.accumulator().summarize()
+		if taskErr != nil {
+			task.Status = "failed"
+			task.Error = taskErr.Error()
+		}
+
+		event := newTaskEvent(TaskEventFinished, task)
+		event.Error = task.Error
+		taskEvents.publish(event)
+		pubsubEvents.publishTask(EventTaskCompleted, task)
+	})
+
+	// Write the final state right away rather than with the next periodic flush
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.flush(ctx); err != nil {
+		logger.Error("Failed to persist finished task, retrying with the next flush", LogKeyTaskID, taskID, "error", err)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantsCollection is the tenant registry. The data of a tenant lives in
+// subcollections of its document, see tenantCollection.
+const TenantsCollection = "tenants"
+
+// TenantKeyHeader carries the access key of the calling tenant. Requests without it
+// act as the deployment itself, with KEEPA_API_KEY and the top-level collections.
+const TenantKeyHeader = "X-Tenant-Key"
+
+// tenantIDPattern restricts tenant IDs, which end up in Firestore paths and Redis keys
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,39}$`)
+
+// Tenant is a team with its own Keepa key, token bucket and data
+type Tenant struct {
+	ID            string    `json:"id" firestore:"-"`
+	Name          string    `json:"name" firestore:"name"`
+	KeepaAPIKey   string    `json:"-" firestore:"keepaApiKey"`
+	AccessKeyHash string    `json:"-" firestore:"accessKeyHash"` // SHA-256 of the TenantKeyHeader value
+	Disabled      bool      `json:"disabled" firestore:"disabled"`
+	CreatedAt     time.Time `json:"createdAt" firestore:"createdAt"`
+}
+
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx acting for tenant, which adds it to the log lines
+func withTenant(ctx context.Context, tenant *Tenant) context.Context {
+	ctx = context.WithValue(ctx, tenantKey{}, tenant)
+	return withLogAttrs(ctx, slog.String("tenant_id", tenant.ID))
+}
+
+// tenantFrom returns the tenant of ctx, nil for the deployment itself
+func tenantFrom(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// tenantID returns the ID of the tenant of ctx, "" for the deployment itself
+func tenantID(ctx context.Context) string {
+	if tenant := tenantFrom(ctx); tenant != nil {
+		return tenant.ID
+	}
+	return ""
+}
+
+// keepaAPIKey returns the Keepa key of the tenant of ctx, the KEEPA_API_KEY secret for
+// the deployment itself
+func keepaAPIKey(ctx context.Context) string {
+	if tenant := tenantFrom(ctx); tenant != nil {
+		return tenant.KeepaAPIKey
+	}
+	return secret("KEEPA_API_KEY", "")
+}
+
+// tenantCollection returns a collection of the tenant of ctx
+func tenantCollection(ctx context.Context, name string) *firestore.CollectionRef {
+	return tenantCollectionByID(tenantID(ctx), name)
+}
+
+// tenantCollectionByID returns a collection of a tenant: the top-level collection for
+// the deployment itself, a subcollection of the tenant's document otherwise
+func tenantCollectionByID(tenantID, name string) *firestore.CollectionRef {
+	if tenantID == "" {
+		return firestoreClient.Collection(name)
+	}
+	return firestoreClient.Collection(TenantsCollection).Doc(tenantID).Collection(name)
+}
+
+// tenantOfRef returns the ID of the tenant a document belongs to, "" for documents of
+// the top-level collections
+func tenantOfRef(ref *firestore.DocumentRef) string {
+	if owner := ref.Parent.Parent; owner != nil && owner.Parent.ID == TenantsCollection {
+		return owner.ID
+	}
+	return ""
+}
+
+// tenantRedisKey moves a key of the keepa: namespace below the tenant of ctx
+func tenantRedisKey(ctx context.Context, key string) string {
+	id := tenantID(ctx)
+	if id == "" {
+		return key
+	}
+	return CacheKeyNamespace + "tenant:" + id + ":" + strings.TrimPrefix(key, CacheKeyNamespace)
+}
+
+// hashAccessKey returns the stored form of a tenant access key
+func hashAccessKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// tenantRegistry caches tenants by access key hash and ID for TENANT_CACHE_TTL (1m),
+// so disabling a tenant takes effect within that time. Unknown keys are not cached, so
+// the cache only grows with the tenants; failedAuthLimit bounds their lookups.
+type tenantRegistry struct {
+	mu      sync.Mutex
+	entries map[string]tenantEntry
+}
+
+type tenantEntry struct {
+	tenant   *Tenant
+	loadedAt time.Time
+}
+
+// tenants is the process-wide tenant registry
+var tenants = &tenantRegistry{entries: make(map[string]tenantEntry)}
+
+// byAccessKey returns the tenant of an access key, nil when no tenant has it
+func (r *tenantRegistry) byAccessKey(ctx context.Context, key string) (*Tenant, error) {
+	hash := hashAccessKey(key)
+	return r.cached("key:"+hash, func() (*Tenant, error) {
+		snapshots, err := firestoreClient.Collection(TenantsCollection).Where("accessKeyHash", "==", hash).Limit(1).Documents(ctx).GetAll()
+		if err != nil || len(snapshots) == 0 {
+			return nil, err
+		}
+		return decodeTenant(snapshots[0])
+	})
+}
+
+// byID returns a tenant, nil when it does not exist
+func (r *tenantRegistry) byID(ctx context.Context, id string) (*Tenant, error) {
+	return r.cached("id:"+id, func() (*Tenant, error) {
+		snapshot, err := firestoreClient.Collection(TenantsCollection).Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return decodeTenant(snapshot)
+	})
+}
+
+// cached returns the entry of key, loading it when it is missing or expired
+func (r *tenantRegistry) cached(key string, load func() (*Tenant, error)) (*Tenant, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[key]
+	r.mu.Unlock()
+	if ok && time.Since(entry.loadedAt) < envDuration("TENANT_CACHE_TTL", time.Minute) {
+		return entry.tenant, nil
+	}
+	tenant, err := load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant: %v", err)
+	}
+	r.mu.Lock()
+	if tenant != nil {
+		r.entries[key] = tenantEntry{tenant: tenant, loadedAt: time.Now()}
+	} else {
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+	return tenant, nil
+}
+
+// forget drops the cached entries of a tenant
+func (r *tenantRegistry) forget(tenant *Tenant) {
+	r.mu.Lock()
+	delete(r.entries, "id:"+tenant.ID)
+	delete(r.entries, "key:"+tenant.AccessKeyHash)
+	r.mu.Unlock()
+}
+
+// decodeTenant reads a tenant document
+func decodeTenant(snapshot *firestore.DocumentSnapshot) (*Tenant, error) {
+	var tenant Tenant
+	if err := snapshot.DataTo(&tenant); err != nil {
+		return nil, fmt.Errorf("failed to decode tenant %s: %v", snapshot.Ref.ID, err)
+	}
+	tenant.ID = snapshot.Ref.ID
+	return &tenant, nil
+}
+
+// tenantMiddleware resolves the tenant of the TenantKeyHeader and makes the request act
+// for it. Unknown or disabled keys are rejected, and tenants cannot reach /admin.
+func tenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(TenantKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if !allowAuthAttempt(c) {
+			return
+		}
+		tenant, err := tenants.byAccessKey(c.Request.Context(), key)
+		if err != nil {
+			respondError(c, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if tenant == nil || tenant.Disabled {
+			recordFailedAuth(c)
+			respondError(c, http.StatusUnauthorized, "Invalid tenant key")
+			return
+		}
+		if strings.HasPrefix(c.Request.URL.Path, "/admin/") {
+			respondError(c, http.StatusForbidden, "Admin endpoints are not available to tenants")
+			return
+		}
+		c.Request = c.Request.WithContext(withTenant(c.Request.Context(), tenant))
+		c.Next()
+	}
+}
+
+// withTaskTenant returns a copy of ctx acting for the tenant of a task. A tenant that
+// cannot be read keeps its ID but no Keepa key, so its task fails instead of spending
+// the deployment's tokens or writing to the deployment's collections.
+func withTaskTenant(ctx context.Context, taskID string) context.Context {
+	task, ok := tasks.get(taskID)
+	if !ok || task.TenantID == "" {
+		return ctx
+	}
+	tenant, err := tenants.byID(ctx, task.TenantID)
+	if err != nil || tenant == nil {
+		logger.ErrorContext(ctx, "Failed to resolve the tenant of a task", LogKeyTaskID, taskID, "tenant_id", task.TenantID, "error", err)
+		tenant = &Tenant{ID: task.TenantID}
+	}
+	return withTenant(ctx, tenant)
+}
+
+// tenantClients holds the Keepa client of every tenant seen, keyed by tenant ID
+var tenantClients sync.Map
+
+// forContext returns the Keepa client of the tenant of ctx, which has its own token
+// bucket and starvation monitor since each tenant spends its own Keepa key.
+// Requests of the deployment itself use client.
+func (client *KeepaClient) forContext(ctx context.Context) *KeepaClient {
+	tenant := tenantFrom(ctx)
+	if tenant == nil || client.Tenant != nil {
+		return client
+	}
+	if cached, ok := tenantClients.Load(tenant.ID); ok {
+		if tenantClient := cached.(*KeepaClient); tenantClient.Tenant.KeepaAPIKey == tenant.KeepaAPIKey {
+			return tenantClient
+		}
+	}
+	tokens := keepa.NewTokenBucket(tokenBucketCapacity, tokenBucketCapacity, 5.0, time.Now())
+	tenantLogger := client.Logger.With("tenant_id", tenant.ID)
+	tenantClient := &KeepaClient{
+		Tokens:          tokens,
+		SafetyThreshold: client.SafetyThreshold,
+		Logger:          tenantLogger,
+		Starvation:      newTokenStarvationMonitor(),
+		Shared:          newSharedTokenBucket(tenant.KeepaAPIKey),
+		API:             newKeepaAPI(client.API.HTTP, tenantLogger, tokens),
+		Tenant:          tenant,
+	}
+	tenantClients.Store(tenant.ID, tenantClient)
+	return tenantClient
+}
+
+// forTask returns the Keepa client of the tenant of a task
+func (client *KeepaClient) forTask(taskID string) *KeepaClient {
+	return client.forContext(withTaskTenant(context.Background(), taskID))
+}
+
+// TenantRequest is the body of POST /admin/tenants
+type TenantRequest struct {
+	ID          string `json:"id" binding:"required"`
+	Name        string `json:"name"`
+	KeepaAPIKey string `json:"keepaApiKey" binding:"required"`
+}
+
+// handleCreateTenant registers a tenant and returns its access key, which is only
+// shown once. The tenant's Keepa notifications are pointed at this service.
+func (client *KeepaClient) handleCreateTenant(c *gin.Context) {
+	var req TenantRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !tenantIDPattern.MatchString(req.ID) {
+		respondError(c, http.StatusBadRequest, "id must be 1 to 40 lowercase letters, digits or dashes")
+		return
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to generate an access key: %v", err))
+		return
+	}
+	accessKey := "kt_" + hex.EncodeToString(secret)
+	tenant := &Tenant{
+		ID:            req.ID,
+		Name:          req.Name,
+		KeepaAPIKey:   strings.TrimSpace(req.KeepaAPIKey),
+		AccessKeyHash: hashAccessKey(accessKey),
+		CreatedAt:     time.Now().UTC(),
+	}
+	_, err := firestoreClient.Collection(TenantsCollection).Doc(tenant.ID).Create(c.Request.Context(), tenant)
+	if status.Code(err) == codes.AlreadyExists {
+		respondError(c, http.StatusConflict, fmt.Sprintf("Tenant %s already exists", tenant.ID))
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to store tenant: %v", err))
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "Created tenant", "tenant_id", tenant.ID)
+
+	go func() {
+		if err := client.registerTrackingWebhook(withTenant(context.Background(), tenant)); err != nil {
+			client.Logger.Error("Failed to register the tracking webhook of a tenant", "tenant_id", tenant.ID, "error", err)
+		}
+	}()
+	c.JSON(http.StatusCreated, gin.H{"tenant": tenant, "accessKey": accessKey})
+}
+
+// handleListTenants returns the tenants without their keys
+func handleListTenants(c *gin.Context) {
+	snapshots, err := firestoreClient.Collection(TenantsCollection).OrderBy("createdAt", firestore.Asc).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list tenants: %v", err))
+		return
+	}
+	list := make([]*Tenant, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		tenant, err := decodeTenant(snapshot)
+		if err != nil {
+			logger.WarnContext(c.Request.Context(), "Skipping undecodable tenant", "tenant_id", snapshot.Ref.ID, "error", err)
+			continue
+		}
+		list = append(list, tenant)
+	}
+	c.JSON(http.StatusOK, gin.H{"tenants": list, "count": len(list)})
+}
+
+// handleDisableTenant rejects the access key of a tenant from now on. Its data is
+// kept; running tasks finish.
+func handleDisableTenant(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenant, err := tenants.byID(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if tenant == nil {
+		respondError(c, http.StatusNotFound, "Tenant not found")
+		return
+	}
+	_, err = firestoreClient.Collection(TenantsCollection).Doc(tenant.ID).Update(ctx, []firestore.Update{{Path: "disabled", Value: true}})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to disable tenant: %v", err))
+		return
+	}
+	tenants.forget(tenant)
+	logger.InfoContext(ctx, "Disabled tenant", "tenant_id", tenant.ID)
+	c.JSON(http.StatusOK, gin.H{"id": tenant.ID, "disabled": true})
+}
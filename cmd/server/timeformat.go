@@ -0,0 +1,244 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepatime"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones of consumers on hosts without a zoneinfo database
+)
+
+// Timestamp formats API consumers can choose from
+const (
+	TimeFormatISO8601     = "iso8601"      // RFC 3339 in the consumer's timezone, UTC by default
+	TimeFormatEpochMillis = "epoch_millis" // Milliseconds since the Unix epoch
+	TimeFormatLocalized   = "localized"    // localizedLayout in the consumer's timezone
+)
+
+// localizedLayout keeps the UTC offset, so the repeated hour when daylight saving time
+// ends yields distinct timestamps
+const localizedLayout = time.DateTime + " -07:00"
+
+// Query parameters overriding the timestamp preference for one request
+const (
+	TimeFormatParam = "timeFormat"
+	TimezoneParam   = "timezone"
+)
+
+// timeFormatAliases are further accepted names of the formats
+var timeFormatAliases = map[string]string{
+	"rfc3339": TimeFormatISO8601,
+	"epoch":   TimeFormatEpochMillis,
+}
+
+// storedTimeLayout is the layout of the salesRanks and stockCSV keys in Redis and
+// Firestore, see keepatime.Layout
+const storedTimeLayout = keepatime.Layout
+
+// TimeFormatConfig is the timestamp preference of one API key
+type TimeFormatConfig struct {
+	Format   string `json:"format"`
+	Timezone string `json:"timezone"` // IANA name, e.g. "Europe/Berlin"
+}
+
+// timeFormatter renders timestamps in a consumer's preferred format
+type timeFormatter struct {
+	format   string
+	location *time.Location
+}
+
+// apiKeyTimeFormats maps API key IDs to their preference, loaded from
+// API_KEY_TIME_FORMATS, a JSON object keyed by the ID listed by GET /admin/api-keys or
+// the SHA-256 hex of the key. Keys without an entry use DEFAULT_TIME_FORMAT and
+// DEFAULT_TIMEZONE.
+var apiKeyTimeFormats = loadAPIKeyTimeFormats()
+
+// loadAPIKeyTimeFormats parses API_KEY_TIME_FORMATS
+func loadAPIKeyTimeFormats() map[string]TimeFormatConfig {
+	formats := make(map[string]TimeFormatConfig)
+	data := getEnv("API_KEY_TIME_FORMATS", "")
+	if data == "" {
+		return formats
+	}
+	var entries map[string]TimeFormatConfig
+	if err := json.Unmarshal([]byte(data), &entries); err != nil {
+		logger.Error("Failed to parse API_KEY_TIME_FORMATS", "error", err)
+		return formats
+	}
+	for id, config := range entries {
+		id = strings.ToLower(id)
+		if _, err := hex.DecodeString(id); err != nil || (len(id) != 12 && len(id) != 64) {
+			logger.Warn("Ignoring API_KEY_TIME_FORMATS entry not keyed by an API key ID or hash")
+			continue
+		}
+		formats[id[:12]] = config
+	}
+	return formats
+}
+
+// requestAPIKeyID returns the ID of the API key of the request, empty without one. The
+// authenticated key is used, else the APIKeyHeader when authentication is disabled.
+func requestAPIKeyID(c *gin.Context) string {
+	if principal := principalFrom(c.Request.Context()); principal != nil {
+		if principal.Method == AuthMethodAPIKey {
+			return principal.ID
+		}
+		return ""
+	}
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		return apiKeyID(hashAccessKey(key))
+	}
+	return ""
+}
+
+// parseTimeFormat returns the format named by value, reporting whether it is known
+func parseTimeFormat(value string) (string, bool) {
+	value = strings.ToLower(value)
+	if alias, ok := timeFormatAliases[value]; ok {
+		return alias, true
+	}
+	switch value {
+	case TimeFormatISO8601, TimeFormatEpochMillis, TimeFormatLocalized:
+		return value, true
+	}
+	return "", false
+}
+
+// newTimeFormatter builds a formatter, falling back to localized UTC for unknown settings
+func newTimeFormatter(config TimeFormatConfig) timeFormatter {
+	formatter := timeFormatter{format: TimeFormatLocalized, location: time.UTC}
+	if format, ok := parseTimeFormat(config.Format); ok {
+		formatter.format = format
+	}
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			logger.Warn("Unknown timezone, using UTC", "timezone", config.Timezone, "error", err)
+		} else {
+			formatter.location = location
+		}
+	}
+	return formatter
+}
+
+// timeFormatterFor returns the formatter of the request: ?timeFormat and ?timezone,
+// else the preference of its API key, else the defaults
+func timeFormatterFor(c *gin.Context) timeFormatter {
+	config, ok := apiKeyTimeFormats[requestAPIKeyID(c)]
+	if !ok {
+		config = TimeFormatConfig{
+			Format:   getEnv("DEFAULT_TIME_FORMAT", TimeFormatLocalized),
+			Timezone: getEnv("DEFAULT_TIMEZONE", "UTC"),
+		}
+	}
+	if format := c.Query(TimeFormatParam); format != "" {
+		config.Format = format
+	}
+	if timezone := c.Query(TimezoneParam); timezone != "" {
+		config.Timezone = timezone
+	}
+	return newTimeFormatter(config)
+}
+
+// timeFormatMiddleware answers 400 for an unknown ?timeFormat or ?timezone, which
+// timeFormatterFor would otherwise ignore
+func timeFormatMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if format := c.Query(TimeFormatParam); format != "" {
+			if _, ok := parseTimeFormat(format); !ok {
+				respondError(c, http.StatusBadRequest, fmt.Sprintf("Unknown %s %q, use %s, %s or %s", TimeFormatParam, format, TimeFormatISO8601, TimeFormatEpochMillis, TimeFormatLocalized))
+				return
+			}
+		}
+		if timezone := c.Query(TimezoneParam); timezone != "" {
+			if _, err := time.LoadLocation(timezone); err != nil {
+				respondError(c, http.StatusBadRequest, fmt.Sprintf("Unknown %s %q, use an IANA name such as Europe/Berlin", TimezoneParam, timezone))
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// key formats t for use as a JSON object key
+func (f timeFormatter) key(t time.Time) string {
+	switch f.format {
+	case TimeFormatEpochMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case TimeFormatISO8601:
+		return t.In(f.location).Format(time.RFC3339)
+	}
+	return t.In(f.location).Format(localizedLayout)
+}
+
+// value formats t for use as a JSON value; epoch millis stay numeric
+func (f timeFormatter) value(t time.Time) interface{} {
+	if f.format == TimeFormatEpochMillis {
+		return t.UnixMilli()
+	}
+	return f.key(t)
+}
+
+// reformatKeys rewrites a map keyed by stored timestamps. Every format keeps the
+// instant, so distinct timestamps stay distinct keys.
+func (f timeFormatter) reformatKeys(values map[string]int) map[string]int {
+	if values == nil {
+		return nil
+	}
+	formatted := make(map[string]int, len(values))
+	for key, value := range values {
+		t, err := keepatime.ParseKey(key)
+		if err != nil {
+			formatted[key] = value
+			continue
+		}
+		formatted[f.key(t)] = value
+	}
+	return formatted
+}
+
+// products returns copies of products with salesRanks, monthlySoldHistory and stockCSV keys in the consumer's format
+func (f timeFormatter) products(products []SimplifiedProduct) []SimplifiedProduct {
+	formatted := make([]SimplifiedProduct, len(products))
+	for i, product := range products {
+		product.SalesRanks = f.reformatKeys(product.SalesRanks)
+		product.MonthlySoldHistory = f.reformatKeys(product.MonthlySoldHistory)
+		offers := make([]SimplifiedOffer, len(product.Offers))
+		for j, offer := range product.Offers {
+			offer.StockCSV = f.reformatKeys(offer.StockCSV)
+			offers[j] = offer
+		}
+		product.Offers = offers
+		formatted[i] = product
+	}
+	return formatted
+}
+
+// buyBoxTimeline renders an ownership timeline with formatted from/to timestamps
+func (f timeFormatter) buyBoxTimeline(timeline []BuyBoxOwnership) []gin.H {
+	formatted := make([]gin.H, 0, len(timeline))
+	for _, ownership := range timeline {
+		entry := gin.H{
+			"sellerId":        ownership.SellerID,
+			"from":            f.value(ownership.From),
+			"to":              f.value(ownership.To),
+			"durationMinutes": ownership.DurationMinutes,
+		}
+		if ownership.Condition != 0 {
+			entry["condition"] = ownership.Condition
+		}
+		if ownership.IsAmazon {
+			entry["isAmazon"] = true
+		}
+		if ownership.IsFBA {
+			entry["isFBA"] = true
+		}
+		formatted = append(formatted, entry)
+	}
+	return formatted
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// handleTokens returns the live token bucket of the calling tenant. With the shared
+// bucket enabled, tokensLeft is the balance shared by all instances.
+func (client *KeepaClient) handleTokens(c *gin.Context) {
+	client = client.forContext(c.Request.Context())
+	state := client.Tokens.State(time.Now())
+	shared := client.Shared != nil
+	if shared {
+		if tokens, err := client.Shared.peek(state.RefillRate, state.Capacity); err == nil {
+			state.TokensLeft = tokens
+		} else {
+			shared = false
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tokens":          state,
+		"shared":          shared,
+		"safetyThreshold": client.SafetyThreshold,
+		"queued":          keepaScheduler.queued(),
+		"circuit":         keepaBreaker.snapshot(),
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TokenUsageCollection holds the consumed Keepa tokens aggregated per hour, endpoint,
+// task and category. Every tenant has its own, see tenantCollection.
+const TokenUsageCollection = "token_usage"
+
+// defaultReportPeriod is the period of GET /reports/tokens without from
+const defaultReportPeriod = 30 * 24 * time.Hour
+
+// TokenUsage is the consumption of one endpoint, task and category in one hour
+type TokenUsage struct {
+	Hour     time.Time `json:"hour" firestore:"hour"`
+	Endpoint string    `json:"endpoint" firestore:"endpoint"`           // Keepa API path, e.g. "/product"
+	TaskID   string    `json:"taskId,omitempty" firestore:"taskId"`     // Empty for requests outside of tasks
+	Category string    `json:"category,omitempty" firestore:"category"` // Root category, empty when not attributable
+	Tokens   int64     `json:"tokens" firestore:"tokens"`
+	Requests int64     `json:"requests" firestore:"requests"`
+}
+
+// tokenUsageScope attributes the Keepa requests made with a context to a task and category
+type tokenUsageScope struct {
+	taskID   string
+	category string
+}
+
+type tokenUsageScopeKey struct{}
+
+// withTokenUsageScope returns a copy of ctx whose Keepa requests are booked on the task
+// and category. It also adds them to the log lines of ctx.
+func withTokenUsageScope(ctx context.Context, taskID, category string) context.Context {
+	ctx = context.WithValue(ctx, tokenUsageScopeKey{}, tokenUsageScope{taskID: taskID, category: category})
+	var attrs []slog.Attr
+	if taskID != "" {
+		attrs = append(attrs, slog.String(LogKeyTaskID, taskID))
+	}
+	if category != "" {
+		attrs = append(attrs, slog.String(LogKeyCategory, category))
+	}
+	return withLogAttrs(ctx, attrs...)
+}
+
+// tokenUsageKey identifies one aggregate
+type tokenUsageKey struct {
+	tenantID string
+	hour     time.Time
+	endpoint string
+	taskID   string
+	category string
+}
+
+// docRef returns the Firestore document of the aggregate in the collection of its tenant
+func (k tokenUsageKey) docRef() *firestore.DocumentRef {
+	sum := sha256.Sum256([]byte(k.endpoint + "|" + k.taskID + "|" + k.category))
+	return tenantCollectionByID(k.tenantID, TokenUsageCollection).Doc(k.hour.Format("2006010215") + "_" + hex.EncodeToString(sum[:8]))
+}
+
+// tokenUsageRecorder aggregates consumed tokens in memory and periodically adds them
+// to the Firestore aggregates, so a busy task does not write once per request
+type tokenUsageRecorder struct {
+	mu      sync.Mutex
+	pending map[tokenUsageKey]*TokenUsage
+}
+
+var tokenUsage = &tokenUsageRecorder{pending: make(map[tokenUsageKey]*TokenUsage)}
+
+// record books the tokens of one Keepa request on the scope of ctx
+func (r *tokenUsageRecorder) record(ctx context.Context, endpoint string, tokens int) {
+	scope, _ := ctx.Value(tokenUsageScopeKey{}).(tokenUsageScope)
+	key := tokenUsageKey{
+		tenantID: tenantID(ctx),
+		hour:     time.Now().UTC().Truncate(time.Hour),
+		endpoint: endpoint,
+		taskID:   scope.taskID,
+		category: scope.category,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(key, int64(tokens), 1)
+}
+
+// add increments an aggregate. The caller must hold mu.
+func (r *tokenUsageRecorder) add(key tokenUsageKey, tokens, requests int64) {
+	usage, ok := r.pending[key]
+	if !ok {
+		usage = &TokenUsage{Hour: key.hour, Endpoint: key.endpoint, TaskID: key.taskID, Category: key.category}
+		r.pending[key] = usage
+	}
+	usage.Tokens += tokens
+	usage.Requests += requests
+}
+
+// flush adds the pending aggregates to Firestore. Aggregates that failed to write
+// are kept for the next flush.
+func (r *tokenUsageRecorder) flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[tokenUsageKey]*TokenUsage)
+	r.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	writer := firestoreClient.BulkWriter(ctx)
+	jobs := make(map[tokenUsageKey]*firestore.BulkWriterJob, len(pending))
+	var firstErr error
+	for key, usage := range pending {
+		job, err := writer.Set(key.docRef(), map[string]interface{}{
+			"hour":     usage.Hour,
+			"endpoint": usage.Endpoint,
+			"taskId":   usage.TaskID,
+			"category": usage.Category,
+			"tokens":   firestore.Increment(usage.Tokens),
+			"requests": firestore.Increment(usage.Requests),
+		}, firestore.MergeAll)
+		if err != nil {
+			firstErr = err
+			continue
+		}
+		jobs[key] = job
+	}
+	writer.End()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, usage := range pending {
+		job, queued := jobs[key]
+		if queued {
+			if _, err := job.Results(); err == nil {
+				continue
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+		r.add(key, usage.Tokens, usage.Requests)
+	}
+	if firstErr != nil {
+		return fmt.Errorf("failed to save token usage to Firestore: %v", firstErr)
+	}
+	return nil
+}
+
+// start flushes the aggregates every interval, configured by TOKEN_USAGE_FLUSH_INTERVAL (1m)
+func (r *tokenUsageRecorder) start() {
+	interval := envDuration("TOKEN_USAGE_FLUSH_INTERVAL", time.Minute)
+	go func() {
+		for range time.Tick(interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := r.flush(ctx); err != nil {
+				logger.Error("Failed to flush token usage", "error", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// TokenUsageTotal is the consumption of one group of a report
+type TokenUsageTotal struct {
+	Key      string `json:"key"`
+	Tokens   int64  `json:"tokens"`
+	Requests int64  `json:"requests"`
+}
+
+// TokenUsageReport summarizes the consumption of a period
+type TokenUsageReport struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Tokens     int64             `json:"tokens"`
+	Requests   int64             `json:"requests"`
+	ByEndpoint []TokenUsageTotal `json:"byEndpoint"`
+	ByCategory []TokenUsageTotal `json:"byCategory"` // Key "" holds requests without a category
+	ByTask     []TokenUsageTotal `json:"byTask"`     // Key "" holds requests outside of tasks
+	ByDay      []TokenUsageTotal `json:"byDay"`      // UTC days, chronological
+}
+
+// tokenUsageTotals accumulates the totals of one grouping
+type tokenUsageTotals map[string]*TokenUsageTotal
+
+func (totals tokenUsageTotals) add(key string, usage TokenUsage) {
+	total, ok := totals[key]
+	if !ok {
+		total = &TokenUsageTotal{Key: key}
+		totals[key] = total
+	}
+	total.Tokens += usage.Tokens
+	total.Requests += usage.Requests
+}
+
+// sorted returns the totals by descending tokens, or by key when byKey is set
+func (totals tokenUsageTotals) sorted(byKey bool) []TokenUsageTotal {
+	list := make([]TokenUsageTotal, 0, len(totals))
+	for _, total := range totals {
+		list = append(list, *total)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if byKey || list[i].Tokens == list[j].Tokens {
+			return list[i].Key < list[j].Key
+		}
+		return list[i].Tokens > list[j].Tokens
+	})
+	return list
+}
+
+// loadTokenUsageReport sums the aggregates of the tenant of ctx of the hours in [from, to)
+func loadTokenUsageReport(ctx context.Context, from, to time.Time) (*TokenUsageReport, error) {
+	report := &TokenUsageReport{From: from, To: to}
+	byEndpoint, byCategory, byTask, byDay := tokenUsageTotals{}, tokenUsageTotals{}, tokenUsageTotals{}, tokenUsageTotals{}
+
+	iter := tenantCollection(ctx, TokenUsageCollection).
+		Where("hour", ">=", from.Truncate(time.Hour)).
+		Where("hour", "<", to).
+		Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token usage from Firestore: %v", err)
+		}
+		var usage TokenUsage
+		if err := doc.DataTo(&usage); err != nil {
+			return nil, fmt.Errorf("failed to decode token usage %s: %v", doc.Ref.ID, err)
+		}
+		report.Tokens += usage.Tokens
+		report.Requests += usage.Requests
+		byEndpoint.add(usage.Endpoint, usage)
+		byCategory.add(usage.Category, usage)
+		byTask.add(usage.TaskID, usage)
+		byDay.add(usage.Hour.UTC().Format(time.DateOnly), usage)
+	}
+
+	report.ByEndpoint = byEndpoint.sorted(false)
+	report.ByCategory = byCategory.sorted(false)
+	report.ByTask = byTask.sorted(false)
+	report.ByDay = byDay.sorted(true)
+	return report, nil
+}
+
+// parseReportTime parses an RFC 3339 timestamp or a UTC date
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// handleTokenReport summarizes the tokens the calling tenant consumed between ?from
+// (default 30 days before to) and ?to (default now), both RFC 3339 timestamps or
+// dates. Usage is aggregated per hour, so from is rounded down to the hour.
+func handleTokenReport(c *gin.Context) {
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := parseReportTime(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid to, expected an RFC 3339 timestamp or YYYY-MM-DD")
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultReportPeriod)
+	if value := c.Query("from"); value != "" {
+		parsed, err := parseReportTime(value)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "Invalid from, expected an RFC 3339 timestamp or YYYY-MM-DD")
+			return
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		respondError(c, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	// Include this instance's pending usage
+	if err := tokenUsage.flush(c.Request.Context()); err != nil {
+		logger.WarnContext(c.Request.Context(), "Failed to flush token usage before the report", "error", err)
+	}
+
+	report, err := loadTokenUsageReport(c.Request.Context(), from, to)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Reasons for pausing outbound calls
+const (
+	WaitReasonInsufficientTokens = "insufficient_tokens" // Local token estimate below the request cost
+	WaitReasonRateLimited        = "rate_limited"        // Keepa answered 429
+	WaitReasonCircuitOpen        = "circuit_open"        // Calls to the dependency are suspended
+	WaitReasonRetryBackoff       = "retry_backoff"       // Backoff between retries of a failed call
+)
+
+// recentTokenWaits is the number of individual waits kept for GET /keepa/token-waits
+const recentTokenWaits = 100
+
+// TokenWait is one recorded pause
+type TokenWait struct {
+	Reason     string    `json:"reason"`
+	Dependency string    `json:"dependency"`
+	StartedAt  time.Time `json:"started_at"`
+	Planned    float64   `json:"planned_seconds"`
+	Duration   float64   `json:"duration_seconds"`
+}
+
+// TokenWaitStats aggregates the waits of one reason
+type TokenWaitStats struct {
+	Count        int     `json:"count"`
+	TotalSeconds float64 `json:"total_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"`
+}
+
+// tokenWaitRecorder keeps wait statistics in memory and reports every wait as an
+// OpenTelemetry span and histogram sample. Spans and metrics are exported by the
+// globally installed providers and are no-ops otherwise.
+type tokenWaitRecorder struct {
+	mu       sync.Mutex
+	byReason map[string]*TokenWaitStats
+	recent   []TokenWait
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+}
+
+var tokenWaits = newTokenWaitRecorder()
+
+// newTokenWaitRecorder creates the recorder with its OpenTelemetry instruments
+func newTokenWaitRecorder() *tokenWaitRecorder {
+	duration, _ := otel.Meter("Keepa-api").Float64Histogram("keepa.wait.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time spent pausing outbound calls, by reason"))
+	return &tokenWaitRecorder{
+		byReason: make(map[string]*TokenWaitStats),
+		tracer:   otel.Tracer("Keepa-api"),
+		duration: duration,
+	}
+}
+
+// start opens a span for a pause of the planned duration. The returned function
+// ends the span and records the measured duration.
+func (r *tokenWaitRecorder) start(reason, dependency string, planned time.Duration) func() {
+	attrs := []attribute.KeyValue{
+		attribute.String("wait.reason", reason),
+		attribute.String("wait.dependency", dependency),
+	}
+	ctx, span := r.tracer.Start(context.Background(), "wait."+reason,
+		trace.WithAttributes(append(attrs, attribute.Float64("wait.planned_seconds", planned.Seconds()))...))
+	startedAt := time.Now()
+
+	return func() {
+		elapsed := time.Since(startedAt)
+		span.End()
+		r.duration.Record(ctx, elapsed.Seconds(), metric.WithAttributes(attrs...))
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		stats, ok := r.byReason[reason]
+		if !ok {
+			stats = &TokenWaitStats{}
+			r.byReason[reason] = stats
+		}
+		stats.Count++
+		stats.TotalSeconds += elapsed.Seconds()
+		if elapsed.Seconds() > stats.MaxSeconds {
+			stats.MaxSeconds = elapsed.Seconds()
+		}
+		r.recent = append(r.recent, TokenWait{
+			Reason:     reason,
+			Dependency: dependency,
+			StartedAt:  startedAt.UTC(),
+			Planned:    planned.Seconds(),
+			Duration:   elapsed.Seconds(),
+		})
+		if len(r.recent) > recentTokenWaits {
+			r.recent = r.recent[len(r.recent)-recentTokenWaits:]
+		}
+	}
+}
+
+// sleep pauses for d and records the wait
+func (r *tokenWaitRecorder) sleep(reason, dependency string, d time.Duration) {
+	end := r.start(reason, dependency, d)
+	time.Sleep(d)
+	end()
+}
+
+// sleepContext pauses for d like sleep, returning ctx's error if it is done first
+func (r *tokenWaitRecorder) sleepContext(ctx context.Context, reason, dependency string, d time.Duration) error {
+	end := r.start(reason, dependency, d)
+	defer end()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// report returns copies of the per-reason statistics and the recent waits
+func (r *tokenWaitRecorder) report() (map[string]TokenWaitStats, []TokenWait) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	byReason := make(map[string]TokenWaitStats, len(r.byReason))
+	for reason, stats := range r.byReason {
+		byReason[reason] = *stats
+	}
+	return byReason, append([]TokenWait(nil), r.recent...)
+}
+
+// handleTokenWaits returns how long outbound calls were paused and why
+func handleTokenWaits(c *gin.Context) {
+	byReason, recent := tokenWaits.report()
+	c.JSON(http.StatusOK, gin.H{"by_reason": byReason, "recent": recent, "queued": keepaScheduler.queued()})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrackedProductsCollection holds the ASINs we track on Keepa
+const TrackedProductsCollection = "tracked_products"
+
+// notificationTypeAPI is the index of push notifications in keepa.Tracking.NotificationType
+const notificationTypeAPI = 5
+
+// TrackedProduct is a Keepa tracker we created
+type TrackedProduct struct {
+	ASIN           string                    `json:"asin" firestore:"asin"`
+	Domain         int                       `json:"domain" firestore:"domain"`
+	Thresholds     []keepa.TrackingThreshold `json:"thresholds" firestore:"thresholds"`
+	UpdateInterval int                       `json:"update_interval" firestore:"updateInterval"`
+	CreatedAt      time.Time                 `json:"created_at" firestore:"createdAt"`
+	LastNotifiedAt time.Time                 `json:"last_notified_at,omitempty" firestore:"lastNotifiedAt,omitempty"`
+	Notifications  int                       `json:"notifications" firestore:"notifications"`
+}
+
+// TrackingRequest is the body of POST /keepa/tracking
+type TrackingRequest struct {
+	ASINs          []string                  `json:"asins" binding:"required"`
+	Domain         int                       `json:"domain"`
+	Thresholds     []keepa.TrackingThreshold `json:"thresholds"`      // Empty notifies on any change of the tracked price types
+	UpdateInterval int                       `json:"update_interval"` // Hours between Keepa updates, default 1
+	TTL            int                       `json:"ttl"`             // Hours until the tracker expires, 0 for never
+}
+
+// TrackProduct creates or replaces the Keepa tracker of an ASIN with push notifications enabled
+func (client *KeepaClient) TrackProduct(ctx context.Context, tracking keepa.Tracking) error {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/tracking?key=%s&type=add", apiKey)
+
+	notificationType := make([]bool, notificationTypeAPI+1)
+	notificationType[notificationTypeAPI] = true
+	body := map[string]interface{}{
+		"asin":             tracking.Asin,
+		"mainDomainId":     tracking.MainDomainID,
+		"ttl":              tracking.TTL,
+		"expireNotify":     tracking.ExpireNotify,
+		"thresholdValues":  tracking.ThresholdValues,
+		"notificationType": notificationType,
+		"updateInterval":   tracking.UpdateInterval,
+		"metaData":         tracking.MetaData,
+	}
+
+	// Tracking requests do not consume tokens
+	apiResp, err := client.doRequest(ctx, url, 0, "POST", body)
+	if err != nil {
+		return err
+	}
+	if len(apiResp.Trackings) == 0 {
+		return fmt.Errorf("Keepa did not confirm the tracker of ASIN %s", tracking.Asin)
+	}
+	client.Logger.InfoContext(ctx, "Added tracker", LogKeyASIN, tracking.Asin)
+	return nil
+}
+
+// UntrackProduct removes the Keepa tracker of an ASIN
+func (client *KeepaClient) UntrackProduct(ctx context.Context, asin string) error {
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/tracking?key=%s&type=remove&asin=%s", apiKey, asin)
+	if _, err := client.doRequest(ctx, url, 0, "GET", nil); err != nil {
+		return err
+	}
+	client.Logger.InfoContext(ctx, "Removed tracker", LogKeyASIN, asin)
+	return nil
+}
+
+// registerTrackingWebhook points Keepa's push notifications at POST /keepa/notifications.
+// It does nothing unless PUBLIC_BASE_URL and KEEPA_NOTIFICATION_TOKEN are set.
+func (client *KeepaClient) registerTrackingWebhook(ctx context.Context) error {
+	baseURL := strings.TrimRight(getEnv("PUBLIC_BASE_URL", ""), "/")
+	token := secret("KEEPA_NOTIFICATION_TOKEN", "")
+	if baseURL == "" || token == "" {
+		return nil
+	}
+	webhook := baseURL + "/keepa/notifications?token=" + neturl.QueryEscape(token)
+	if id := tenantID(ctx); id != "" {
+		webhook += "&tenant=" + neturl.QueryEscape(id)
+	}
+	apiKey := keepaAPIKey(ctx)
+	url := fmt.Sprintf("https://api.keepa.com/tracking?key=%s&type=webhook&url=%s", apiKey, neturl.QueryEscape(webhook))
+	if _, err := client.doRequest(ctx, url, 0, "GET", nil); err != nil {
+		return fmt.Errorf("failed to register tracking webhook: %v", err)
+	}
+	client.Logger.InfoContext(ctx, "Registered tracking webhook", "url", baseURL+"/keepa/notifications")
+	return nil
+}
+
+// trackedProductRef returns the Firestore document of an ASIN tracked by the tenant of ctx
+func trackedProductRef(ctx context.Context, asin string) *firestore.DocumentRef {
+	return tenantCollection(ctx, TrackedProductsCollection).Doc(asin)
+}
+
+// handleCreateTracking creates Keepa trackers for ASINs and records them in Firestore
+func (client *KeepaClient) handleCreateTracking(c *gin.Context) {
+	var request TrackingRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	if request.Domain == 0 {
+		request.Domain, _ = strconv.Atoi(getEnv("KEEPA_DOMAIN", "1"))
+	}
+	if request.UpdateInterval <= 0 {
+		request.UpdateInterval = 1
+	}
+	asins, err := validateASINs(request.ASINs)
+	if err != nil {
+		respondInvalidBody(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	tracked := make([]string, 0, len(asins))
+	failed := make(map[string]string)
+	for _, asin := range asins {
+		err := client.TrackProduct(ctx, keepa.Tracking{
+			Asin:            asin,
+			MainDomainID:    request.Domain,
+			TTL:             request.TTL,
+			ThresholdValues: request.Thresholds,
+			UpdateInterval:  request.UpdateInterval,
+		})
+		if err != nil {
+			failed[asin] = err.Error()
+			continue
+		}
+		product := TrackedProduct{
+			ASIN:           asin,
+			Domain:         request.Domain,
+			Thresholds:     request.Thresholds,
+			UpdateInterval: request.UpdateInterval,
+			CreatedAt:      time.Now().UTC(),
+		}
+		err = withRetry(ctx, DependencyFirestore, func() error {
+			_, err := trackedProductRef(ctx, asin).Set(ctx, product)
+			return err
+		})
+		if err != nil {
+			failed[asin] = fmt.Sprintf("tracker created but not recorded: %v", err)
+			continue
+		}
+		tracked = append(tracked, asin)
+	}
+
+	statusCode := http.StatusOK
+	if len(tracked) == 0 {
+		statusCode = http.StatusBadGateway
+	}
+	c.JSON(statusCode, gin.H{"tracked": tracked, "failed": failed})
+}
+
+// handleDeleteTracking removes the Keepa tracker of an ASIN
+func (client *KeepaClient) handleDeleteTracking(c *gin.Context) {
+	asin := c.Param("asin")
+	if err := client.UntrackProduct(c.Request.Context(), asin); err != nil {
+		respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+		return
+	}
+	ctx := c.Request.Context()
+	err := withRetry(ctx, DependencyFirestore, func() error {
+		_, err := trackedProductRef(ctx, asin).Delete(ctx)
+		return err
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Tracker removed but not deleted from Firestore: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"asin": asin, "tracked": false})
+}
+
+// handleKeepaNotification receives Keepa push notifications. The request must carry
+// KEEPA_NOTIFICATION_TOKEN as ?token=, and ?tenant= for the trackers of a tenant.
+// Notifications of tracked ASINs queue a task that re-fetches the product of the
+// notified domain into Redis and Firestore.
+func (client *KeepaClient) handleKeepaNotification(c *gin.Context) {
+	token := secret("KEEPA_NOTIFICATION_TOKEN", "")
+	if token == "" {
+		respondProblem(c, http.StatusServiceUnavailable, CodeNotConfigured, "Notifications are not configured")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(token)) != 1 {
+		respondError(c, http.StatusUnauthorized, "Invalid notification token")
+		return
+	}
+
+	if id := c.Query("tenant"); id != "" {
+		tenant, err := tenants.byID(c.Request.Context(), id)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if tenant == nil || tenant.Disabled {
+			c.JSON(http.StatusOK, gin.H{"tenant": id, "ignored": true})
+			return
+		}
+		c.Request = c.Request.WithContext(withTenant(c.Request.Context(), tenant))
+	}
+
+	var notification keepa.Notification
+	if !bindJSON(c, &notification) {
+		return
+	}
+	if notification.Asin == "" {
+		respondError(c, http.StatusBadRequest, "Notification without ASIN")
+		return
+	}
+
+	// Keepa retries failed deliveries, so notifications we ignore are still acknowledged
+	ctx := c.Request.Context()
+	_, err := trackedProductRef(ctx, notification.Asin).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		logger.InfoContext(c.Request.Context(), "Ignoring notification for untracked ASIN", LogKeyASIN, notification.Asin)
+		c.JSON(http.StatusOK, gin.H{"asin": notification.Asin, "ignored": true})
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	_, err = trackedProductRef(ctx, notification.Asin).Update(ctx, []firestore.Update{
+		{Path: "lastNotifiedAt", Value: time.Now().UTC()},
+		{Path: "notifications", Value: firestore.Increment(1)},
+	})
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to record notification", LogKeyASIN, notification.Asin, "error", err)
+	}
+
+	// The notification names the domain whose price changed, the tracker its main domain
+	domain := strconv.Itoa(notification.NotificationDomainID)
+	if notification.NotificationDomainID <= 0 {
+		domain = strconv.Itoa(notification.DomainID)
+	}
+	if _, known := keepaDomains[domain]; !known {
+		domain = defaultDomain()
+	}
+
+	taskID := generateTaskID()
+	asins := []string{notification.Asin}
+	tasks.create(ctx, taskID, TaskKindASINs)
+	tasks.update(taskID, func(task *Task) { task.Domain = domain })
+	tasks.addASINs(taskID, asins)
+	if !enqueueTask(func() { client.runASINTask(taskID, asins, false) }) {
+		tasks.finish(taskID, fmt.Errorf("task queue is full"))
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+	client.Logger.InfoContext(c.Request.Context(), "Tracking notification queued", LogKeyASIN, notification.Asin, "domain", domain, "cause", notification.TrackingNotificationCause, LogKeyTaskID, taskID)
+	c.JSON(http.StatusOK, gin.H{"asin": notification.Asin, "domain": domain, "task_id": taskID})
+}
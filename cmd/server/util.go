@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+)
+
+// getEnv returns the environment variable key, else its value in CONFIG_FILE, else
+// defaultValue. Settings are read on use, so most apply on the next config reload.
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	if value, ok := configs.value(key); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// calculateProductFinderTokens calculates token consumption for Product Finder
+func calculateProductFinderTokens(numASINs int) int {
+	baseCost := 10                     // Base cost
+	extraCost := (numASINs + 99) / 100 // 1 extra token per 100 ASINs
+	return baseCost + extraCost
+}
+
+// calculateProductRequestTokens calculates token consumption for Product Request with
+// the KEEPA_* parameters (worst case), see productRequestTokens
+func calculateProductRequestTokens(numASINs int) int {
+	var defaults *ProductOptions
+	return numASINs * defaults.tokensPerASIN()
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
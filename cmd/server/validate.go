@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRejectedRows caps the rejected rows listed in a response
+const maxRejectedRows = 100
+
+// asinPattern matches an ASIN or ISBN-10 after upper-casing
+var asinPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// RejectedRow is an entry of a batch that was rejected before any Keepa call
+type RejectedRow struct {
+	Row   int    `json:"row"` // 1-based position in the list or line number in an upload
+	Value string `json:"value"`
+	Error string `json:"error"`
+}
+
+// RejectedRowsError rejects a batch listing invalid entries
+type RejectedRowsError struct {
+	Rows  []RejectedRow // At most maxRejectedRows rows
+	Total int           // Rejected rows including the ones not listed
+}
+
+func (e *RejectedRowsError) Error() string {
+	if e.Total == 1 {
+		return fmt.Sprintf("row %d (%q): %s", e.Rows[0].Row, e.Rows[0].Value, e.Rows[0].Error)
+	}
+	return fmt.Sprintf("%d rows are invalid, first row %d (%q): %s", e.Total, e.Rows[0].Row, e.Rows[0].Value, e.Rows[0].Error)
+}
+
+// add records a rejected row
+func (e *RejectedRowsError) add(row int, value, reason string) {
+	e.Total++
+	if len(e.Rows) < maxRejectedRows {
+		e.Rows = append(e.Rows, RejectedRow{Row: row, Value: value, Error: reason})
+	}
+}
+
+// normalizeASIN trims and upper-cases an ASIN. It returns why the ASIN cannot be sent
+// to Keepa, empty when it is valid.
+func normalizeASIN(value string) (string, string) {
+	asin := strings.ToUpper(strings.TrimSpace(value))
+	switch {
+	case asin == "":
+		return "", "missing ASIN"
+	case utf8.RuneCountInString(asin) != 10:
+		return asin, fmt.Sprintf("not a valid ASIN, expected 10 characters, got %d", utf8.RuneCountInString(asin))
+	case !asinPattern.MatchString(asin):
+		return asin, "not a valid ASIN, expected 10 letters or digits"
+	}
+	return asin, ""
+}
+
+// validateASINs normalizes a list of ASINs and drops repeated ones. The error is a
+// *RejectedRowsError when any entry is invalid.
+func validateASINs(values []string) ([]string, error) {
+	var asins []string
+	seen := make(map[string]bool, len(values))
+	rejected := &RejectedRowsError{}
+	for i, value := range values {
+		asin, reason := normalizeASIN(value)
+		if reason != "" {
+			rejected.add(i+1, value, reason)
+			continue
+		}
+		if !seen[asin] {
+			seen[asin] = true
+			asins = append(asins, asin)
+		}
+	}
+	if rejected.Total > 0 {
+		return nil, rejected
+	}
+	return asins, nil
+}
+
+// respondRejectedRows answers 400 listing the rejected rows of a batch
+func respondRejectedRows(c *gin.Context, detail string, rejected *RejectedRowsError) {
+	respondProblem(c, http.StatusBadRequest, CodeInvalidRequest, detail, gin.H{"rejected": rejected.Total, "errors": rejected.Rows})
+}
+
+// respondInvalidBody answers 400 for a request body that failed validation, listing
+// the rejected rows if there are any
+func respondInvalidBody(c *gin.Context, err error) {
+	if rejected, ok := err.(*RejectedRowsError); ok {
+		respondRejectedRows(c, fmt.Sprintf("%d ASINs are invalid", rejected.Total), rejected)
+		return
+	}
+	respondError(c, http.StatusBadRequest, err.Error())
+}
+
+// asinParamMiddleware normalizes the :asin path parameter of a route and answers 400
+// when it is not a valid ASIN
+func asinParamMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for i, param := range c.Params {
+			if param.Key != "asin" {
+				continue
+			}
+			asin, reason := normalizeASIN(param.Value)
+			if reason != "" {
+				respondError(c, http.StatusBadRequest, fmt.Sprintf("%q is %s", param.Value, reason))
+				return
+			}
+			c.Params[i].Value = asin
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Variation families are stored as a parent document with one child document per variation
+const (
+	VariationFamiliesCollection = "variation_families"
+	VariationChildrenCollection = "children"
+)
+
+// VariationFamily is the Firestore document linking the variations of a parent ASIN
+type VariationFamily struct {
+	ParentAsin string    `json:"parentAsin" firestore:"parentAsin"`
+	ChildASINs []string  `json:"childAsins" firestore:"childAsins"`
+	UpdatedAt  time.Time `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// VariationChild is a child document of a variation family
+type VariationChild struct {
+	Asin       string            `json:"asin" firestore:"asin"`
+	Attributes map[string]string `json:"attributes,omitempty" firestore:"attributes"`
+	UpdatedAt  time.Time         `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// FamilyMember is one variation in the aggregated family view
+type FamilyMember struct {
+	Asin        string            `json:"asin"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	BuyBoxPrice int               `json:"buyBoxPrice,omitempty"`
+	SalesRank   int               `json:"salesRank,omitempty"`
+	MonthlySold int               `json:"monthlySold,omitempty"`
+	Velocity    float64           `json:"velocity,omitempty"`
+	Stored      bool              `json:"stored"` // Whether product data of the variation is available
+}
+
+// simplifyVariations lists the variation family of a product. Child ASINs carry the
+// attributes of all siblings; parent ASINs only list their children in variationCSV.
+func simplifyVariations(product *keepa.Product) []SimplifiedVariation {
+	variations := make([]SimplifiedVariation, 0, len(product.Variations))
+	seen := make(map[string]bool)
+	for _, variation := range product.Variations {
+		if variation.Asin == "" || seen[variation.Asin] {
+			continue
+		}
+		seen[variation.Asin] = true
+		entry := SimplifiedVariation{Asin: variation.Asin}
+		if len(variation.Attributes) > 0 {
+			entry.Attributes = make(map[string]string, len(variation.Attributes))
+			for _, attribute := range variation.Attributes {
+				entry.Attributes[attribute.Dimension] = attribute.Value
+			}
+		}
+		variations = append(variations, entry)
+	}
+	for _, asin := range strings.Split(product.VariationCSV, ",") {
+		if asin = strings.TrimSpace(asin); asin != "" && !seen[asin] {
+			seen[asin] = true
+			variations = append(variations, SimplifiedVariation{Asin: asin})
+		}
+	}
+	if len(variations) == 0 {
+		return nil
+	}
+	return variations
+}
+
+// saveVariationFamily stores the parent document and one child document per variation
+func saveVariationFamily(ctx context.Context, domain, parentAsin string, variations []SimplifiedVariation) error {
+	now := time.Now().UTC()
+	parentRef := tenantCollection(ctx, VariationFamiliesCollection).Doc(productDocID(domain, parentAsin))
+	family := VariationFamily{ParentAsin: parentAsin, UpdatedAt: now}
+	for _, variation := range variations {
+		family.ChildASINs = append(family.ChildASINs, variation.Asin)
+	}
+
+	writer := firestoreClient.BulkWriter(ctx)
+	if _, err := writer.Set(parentRef, family); err != nil {
+		writer.End()
+		return fmt.Errorf("failed to queue variation family %s for Firestore: %v", parentAsin, err)
+	}
+	for _, variation := range variations {
+		child := VariationChild{Asin: variation.Asin, Attributes: variation.Attributes, UpdatedAt: now}
+		if _, err := writer.Set(parentRef.Collection(VariationChildrenCollection).Doc(variation.Asin), child); err != nil {
+			writer.End()
+			return fmt.Errorf("failed to queue variation %s for Firestore: %v", variation.Asin, err)
+		}
+	}
+	writer.End()
+	return nil
+}
+
+// loadVariationFamily reads the stored children of a parent ASIN
+func loadVariationFamily(ctx context.Context, domain, parentAsin string) ([]SimplifiedVariation, error) {
+	docs, err := tenantCollection(ctx, VariationFamiliesCollection).Doc(productDocID(domain, parentAsin)).
+		Collection(VariationChildrenCollection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read variation family %s from Firestore: %v", parentAsin, err)
+	}
+	variations := make([]SimplifiedVariation, 0, len(docs))
+	for _, doc := range docs {
+		var child VariationChild
+		if err := doc.DataTo(&child); err != nil {
+			return nil, fmt.Errorf("failed to decode variation %s: %v", doc.Ref.ID, err)
+		}
+		variations = append(variations, SimplifiedVariation{Asin: child.Asin, Attributes: child.Attributes})
+	}
+	return variations, nil
+}
+
+// expandVariationFamily fetches every variation of a family from Keepa, stores the
+// products and links them under the parent in Firestore
+func (client *KeepaClient) expandVariationFamily(ctx context.Context, domain, parentAsin string, variations []SimplifiedVariation) (map[string]*SimplifiedProduct, error) {
+	asins := make([]string, 0, len(variations))
+	for _, variation := range variations {
+		asins = append(asins, variation.Asin)
+	}
+	responses, err := client.ProductRequestBatch(ctx, domain, asins, defaultProductFields, nil, PriorityInteractive)
+	if err != nil && len(responses) == 0 {
+		return nil, err
+	}
+
+	requestID := "variations-" + parentAsin
+	products := make(map[string]*SimplifiedProduct, len(responses))
+	for asin, response := range responses {
+		if storeErr := client.storeProduct(ctx, requestID, domain, asin, response, nil); storeErr != nil {
+			client.Logger.WarnContext(ctx, "Failed to store variation", LogKeyTaskID, requestID, LogKeyASIN, asin, "error", storeErr)
+		}
+		if len(response.Products) > 0 {
+			products[asin] = &response.Products[0]
+		}
+	}
+	if saveErr := saveVariationFamily(ctx, domain, parentAsin, variations); saveErr != nil {
+		return products, saveErr
+	}
+	return products, err
+}
+
+// handleVariationFamily returns the variation family of a stored product. With
+// ?expandVariations=true all variations are fetched from Keepa, stored and linked
+// under the parent; otherwise the stored family is returned. ?domain= selects the
+// marketplace.
+func (client *KeepaClient) handleVariationFamily(c *gin.Context) {
+	ctx := c.Request.Context()
+	domain, ok := requestDomain(c)
+	if !ok {
+		return
+	}
+	asin := c.Param("asin")
+	expand := c.Query("expandVariations") == "true"
+
+	response, _, err := loadProduct(ctx, domain, asin)
+	if err != nil || len(response.Products) == 0 {
+		respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s not found", asin))
+		return
+	}
+	product := response.Products[0]
+	parentAsin := product.ParentAsin
+	if parentAsin == "" {
+		parentAsin = product.Asin
+	}
+
+	var variations []SimplifiedVariation
+	products := make(map[string]*SimplifiedProduct)
+	if expand {
+		variations = product.Variations
+		if len(variations) == 0 && product.ParentAsin != "" {
+			// The parent lists its children in variationCSV
+			if parent, err := client.ProductRequest(ctx, domain, product.ParentAsin); err == nil && len(parent.Products) > 0 {
+				variations = parent.Products[0].Variations
+			}
+		}
+		if len(variations) == 0 {
+			respondError(c, http.StatusNotFound, fmt.Sprintf("Product %s has no variations", asin))
+			return
+		}
+		products, err = client.expandVariationFamily(ctx, domain, parentAsin, variations)
+		if err != nil {
+			client.Logger.WarnContext(ctx, "Failed to expand variations", LogKeyASIN, parentAsin, "error", err)
+			if len(products) == 0 {
+				respondKeepaError(c, err, http.StatusBadGateway, err.Error())
+				return
+			}
+		}
+	} else {
+		variations, err = loadVariationFamily(ctx, domain, parentAsin)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(variations) == 0 {
+			variations = product.Variations
+		}
+		asins := make([]string, 0, len(variations))
+		for _, variation := range variations {
+			asins = append(asins, variation.Asin)
+		}
+		stored, err := getProductsFromFirestore(ctx, domain, asins)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for i := range stored {
+			products[stored[i].Asin] = &stored[i]
+		}
+	}
+
+	members, totalMonthlySold := aggregateFamily(variations, products)
+	c.JSON(http.StatusOK, withQuotaWarning(gin.H{
+		"asin":             asin,
+		"domain":           domain,
+		"parentAsin":       parentAsin,
+		"expanded":         expand,
+		"variations":       members,
+		"totalMonthlySold": totalMonthlySold,
+	}))
+}
+
+// aggregateFamily builds the family view, best selling variation first
+func aggregateFamily(variations []SimplifiedVariation, products map[string]*SimplifiedProduct) ([]FamilyMember, int) {
+	members := make([]FamilyMember, 0, len(variations))
+	totalMonthlySold := 0
+	for _, variation := range variations {
+		member := FamilyMember{Asin: variation.Asin, Attributes: variation.Attributes}
+		if product, ok := products[variation.Asin]; ok {
+			member.Stored = true
+			member.BuyBoxPrice = product.BuyBoxPrice
+			member.SalesRank, _ = latestSalesRank(product.SalesRanks)
+			member.MonthlySold = product.MonthlySold
+			if product.Velocity != nil {
+				member.Velocity = product.Velocity.Score
+			}
+			totalMonthlySold += product.MonthlySold
+		}
+		members = append(members, member)
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].MonthlySold > members[j].MonthlySold
+	})
+	return members, totalMonthlySold
+}
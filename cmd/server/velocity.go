@@ -0,0 +1,129 @@
+package main
+
+import (
+	"Keepa-api/pkg/keepa"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// SalesVelocity holds the sales rank drop counts of a product. A drop of the sales
+// rank usually means a sale, so the counts approximate the number of sales.
+type SalesVelocity struct {
+	SalesRankDrops30   int     `json:"salesRankDrops30"`
+	SalesRankDrops90   int     `json:"salesRankDrops90"`
+	SalesRankDrops180  int     `json:"salesRankDrops180"`
+	SalesRankDrops365  int     `json:"salesRankDrops365"`
+	MonthlySoldDelta90 int     `json:"monthlySoldDeltaPercent90"` // Change of monthlySold over 90 days in percent
+	Score              float64 `json:"score"`
+}
+
+// newSalesVelocity computes the velocity of a product from its stats. The score is
+// the estimated number of sales per month, weighting recent windows higher, adjusted
+// by the monthlySold trend. Returns nil when Keepa has no drop data for any window.
+func newSalesVelocity(stats *keepa.ProductStats) *SalesVelocity {
+	velocity := &SalesVelocity{
+		SalesRankDrops30:   stats.SalesRankDrops30,
+		SalesRankDrops90:   stats.SalesRankDrops90,
+		SalesRankDrops180:  stats.SalesRankDrops180,
+		SalesRankDrops365:  stats.SalesRankDrops365,
+		MonthlySoldDelta90: stats.DeltaPercent90MonthlySold,
+	}
+
+	// Keepa reports -1 for windows without data; those windows drop out of the weighting
+	windows := []struct {
+		drops  int
+		months float64
+		weight float64
+	}{
+		{velocity.SalesRankDrops30, 1, 0.4},
+		{velocity.SalesRankDrops90, 3, 0.3},
+		{velocity.SalesRankDrops180, 6, 0.2},
+		{velocity.SalesRankDrops365, 12, 0.1},
+	}
+	var perMonth, weights float64
+	for _, window := range windows {
+		if window.drops < 0 {
+			continue
+		}
+		perMonth += float64(window.drops) / window.months * window.weight
+		weights += window.weight
+	}
+	if weights == 0 {
+		return nil
+	}
+	perMonth /= weights
+
+	// A growing monthlySold raises the score by up to 50%, a shrinking one lowers it
+	trend := math.Max(-50, math.Min(50, float64(velocity.MonthlySoldDelta90)))
+	velocity.Score = math.Round(perMonth*(1+trend/200)*10) / 10
+	return velocity
+}
+
+// velocityFilter selects products by velocity, parsed from the read API parameters
+// minDrops30, minDrops90, minDrops180, minDrops365 and minVelocity
+type velocityFilter struct {
+	minDrops    [4]int
+	minVelocity float64
+	active      bool
+}
+
+// parseVelocityFilter reads the velocity parameters of a request
+func parseVelocityFilter(query url.Values) (velocityFilter, error) {
+	var filter velocityFilter
+	for i, name := range []string{"minDrops30", "minDrops90", "minDrops180", "minDrops365"} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		filter.minDrops[i] = parsed
+		filter.active = true
+	}
+	if value := query.Get("minVelocity"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid minVelocity: %v", err)
+		}
+		filter.minVelocity = parsed
+		filter.active = true
+	}
+	return filter, nil
+}
+
+// matches reports whether a product passes the filter; products without velocity
+// data fail every active filter
+func (f velocityFilter) matches(product *SimplifiedProduct) bool {
+	if !f.active {
+		return true
+	}
+	v := product.Velocity
+	if v == nil {
+		return false
+	}
+	drops := [4]int{v.SalesRankDrops30, v.SalesRankDrops90, v.SalesRankDrops180, v.SalesRankDrops365}
+	for i, min := range f.minDrops {
+		if min > 0 && drops[i] < min {
+			return false
+		}
+	}
+	return v.Score >= f.minVelocity
+}
+
+// apply returns the products passing the filter
+func (f velocityFilter) apply(products []SimplifiedProduct) []SimplifiedProduct {
+	if !f.active {
+		return products
+	}
+	filtered := make([]SimplifiedProduct, 0, len(products))
+	for i := range products {
+		if f.matches(&products[i]) {
+			filtered = append(filtered, products[i])
+		}
+	}
+	return filtered
+}
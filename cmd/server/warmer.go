@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// HotProductsRedisKeyPrefix prefixes the sorted sets of product read counts, keyed by
+// domain. Scores decay on every warming run, so they favour recent reads.
+const HotProductsRedisKeyPrefix = "keepa:hot:"
+
+// maxHotProducts caps the members of a read count set; the least read are trimmed
+const maxHotProducts = 10000
+
+// hotProductsKey returns the read count set of a domain
+func hotProductsKey(domain string) string {
+	return HotProductsRedisKeyPrefix + domain
+}
+
+// recordProductRead counts an interactive read of a product for the cache warmer. The
+// count is written in the background and lost when Redis fails. Reads of tenants are
+// not counted, as the warmer only spends the deployment's tokens.
+func recordProductRead(ctx context.Context, domain, asin string) {
+	if tenantID(ctx) != "" {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := redisClient.ZIncrBy(ctx, hotProductsKey(domain), 1, asin).Err(); err != nil {
+			logger.DebugContext(ctx, "Failed to count product read", LogKeyASIN, asin, "error", err)
+		}
+	}()
+}
+
+// cacheWarmer refreshes the most read products before their cache entries expire, so
+// interactive lookups hit the cache instead of waiting for Keepa
+type cacheWarmer struct {
+	client    *KeepaClient
+	domains   []string      // Domains warmed, in order
+	topN      int           // Most read products considered per run and domain
+	ahead     time.Duration // Entries expiring within this are refreshed
+	minTokens int           // Tokens left for interactive lookups, never spent on warming
+	decay     float64       // Factor applied to the read counts after every run
+}
+
+// registerCacheWarmer schedules the warmer every CACHE_WARM_INTERVAL, disabled by
+// default. It is configured by:
+//
+//	CACHE_WARM_DOMAINS     comma-separated domains warmed (KEEPA_DOMAIN)
+//	CACHE_WARM_TOP_N       most read products considered per run and domain (200)
+//	CACHE_WARM_AHEAD       refresh entries expiring within this (2h)
+//	CACHE_WARM_MIN_TOKENS  tokens left for interactive lookups (200)
+//	CACHE_WARM_DECAY       percent of the read counts kept after a run (50)
+func (client *KeepaClient) registerCacheWarmer(scheduler *budgetScheduler) {
+	interval := envDuration("CACHE_WARM_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	domains, err := parseDomains(getEnv("CACHE_WARM_DOMAINS", defaultDomain()))
+	if err != nil || len(domains) == 0 {
+		client.Logger.Error("Cache warmer disabled, invalid CACHE_WARM_DOMAINS", "error", err)
+		return
+	}
+	warmer := &cacheWarmer{
+		client:    client,
+		domains:   domains,
+		topN:      envInt("CACHE_WARM_TOP_N", 200),
+		ahead:     envDuration("CACHE_WARM_AHEAD", 2*time.Hour),
+		minTokens: envInt("CACHE_WARM_MIN_TOKENS", 200),
+		decay:     float64(envInt("CACHE_WARM_DECAY", 50)) / 100,
+	}
+	scheduler.register(&RecurringJob{
+		Name:     "cache-warmer",
+		Priority: PriorityLow,
+		Interval: interval,
+		// Usually only part of the top products expire within one interval
+		Estimate: func() int { return calculateProductRequestTokens(warmer.topN*len(warmer.domains)) / 4 },
+		Run: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			defer cancel()
+			return warmer.run(ctx)
+		},
+	})
+}
+
+// run warms every domain in turn, so the first domains get the tokens when they are
+// short, and returns the first failure
+func (w *cacheWarmer) run(ctx context.Context) error {
+	var firstErr error
+	for _, domain := range w.domains {
+		if err := w.warm(ctx, domain); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// warm refreshes the expiring products among the most read ones of a domain, as many
+// as the tokens above minTokens pay for, most read first, then decays the read counts
+func (w *cacheWarmer) warm(ctx context.Context, domain string) error {
+	key := hotProductsKey(domain)
+	asins, err := redisClient.ZRevRange(ctx, key, 0, int64(w.topN-1)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read hot products: %v", err)
+	}
+	expiring, err := w.expiring(ctx, domain, asins)
+	if err != nil {
+		return err
+	}
+
+	affordable := (w.client.availableTokens() - w.minTokens) / calculateProductRequestTokens(1)
+	if affordable < 0 {
+		affordable = 0
+	}
+	skipped := 0
+	if len(expiring) > affordable {
+		skipped = len(expiring) - affordable
+		expiring = expiring[:affordable]
+	}
+	refreshed := 0
+	if len(expiring) > 0 {
+		refreshed, err = w.refresh(ctx, domain, expiring)
+	}
+	w.client.Logger.InfoContext(ctx, "Cache warming finished", "domain", domain, "hot", len(asins), "refreshed", refreshed, "skipped", skipped)
+	if decayErr := w.decayReads(ctx, key); decayErr != nil {
+		w.client.Logger.WarnContext(ctx, "Failed to decay product reads", "error", decayErr)
+	}
+	return err
+}
+
+// expiring returns the ASINs whose cache entry is missing or expires within ahead
+func (w *cacheWarmer) expiring(ctx context.Context, domain string, asins []string) ([]string, error) {
+	ttls := make([]*redis.DurationCmd, len(asins))
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, asin := range asins {
+			ttls[i] = pipe.PTTL(ctx, productCacheKey(ctx, domain, asin))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache TTLs: %v", err)
+	}
+	var expiring []string
+	for i, asin := range asins {
+		// PTTL is -2 for a missing key and -1 for a key without expiry
+		if ttl := ttls[i].Val(); ttl == -2 || (ttl >= 0 && ttl < w.ahead) {
+			expiring = append(expiring, asin)
+		}
+	}
+	return expiring, nil
+}
+
+// refresh fetches products from Keepa and stores them like a task would, returning how
+// many were refreshed
+func (w *cacheWarmer) refresh(ctx context.Context, domain string, asins []string) (int, error) {
+	products, requestErr := w.client.ProductRequestBatch(ctx, domain, asins, defaultProductFields, nil, PriorityBulk)
+	store := newProductBatchWriter(ctx, "", domain)
+	for _, asin := range asins {
+		product, ok := products[asin]
+		if !ok {
+			continue
+		}
+		w.client.cacheProduct(ctx, "", domain, asin, product)
+		store.add(asin, product, nil)
+	}
+	for asin, err := range store.flush() {
+		w.client.Logger.WarnContext(ctx, "Failed to store warmed product", LogKeyASIN, asin, "domain", domain, "error", err)
+	}
+	if requestErr != nil {
+		return len(products), fmt.Errorf("failed to refresh hot products of domain %s: %v", domain, requestErr)
+	}
+	return len(products), nil
+}
+
+// decayReads scales the read counts by decay and trims the set to maxHotProducts
+func (w *cacheWarmer) decayReads(ctx context.Context, key string) error {
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZInterStore(ctx, key, &redis.ZStore{Keys: []string{key}, Weights: []float64{w.decay}})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "(0.5")
+		pipe.ZRemRangeByRank(ctx, key, 0, -maxHotProducts-1)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WatchlistsCollection stores the watchlists
+const WatchlistsCollection = "watchlists"
+
+// Watchlist is a named set of products, either explicit ASINs or brands scanned with
+// the Product Finder. Tasks and schedules reference it with "watchlist" in a POST
+// /keepa body, so they always fetch its current members.
+type Watchlist struct {
+	ID        string    `json:"id" firestore:"-"`
+	Name      string    `json:"name" firestore:"name"`
+	ASINs     []string  `json:"asins,omitempty" firestore:"asins"`
+	Brands    []string  `json:"brands,omitempty" firestore:"brands"`
+	CreatedAt time.Time `json:"createdAt" firestore:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" firestore:"updatedAt"`
+}
+
+// WatchlistRequest is the body of POST /watchlists and PUT /watchlists/:id
+type WatchlistRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	ASINs  []string `json:"asins"`
+	Brands []string `json:"brands"`
+}
+
+// watchlist builds a watchlist from the request, normalizing and checking its members.
+// WATCHLIST_MAX_ASINS (10000) caps the ASINs.
+func (req *WatchlistRequest) watchlist() (*Watchlist, error) {
+	asins, err := validateASINs(req.ASINs)
+	if err != nil {
+		return nil, err
+	}
+	watchlist := &Watchlist{
+		Name:   strings.TrimSpace(req.Name),
+		ASINs:  asins,
+		Brands: uniqueValues(req.Brands),
+	}
+	if len(watchlist.ASINs) == 0 && len(watchlist.Brands) == 0 {
+		return nil, fmt.Errorf("asins or brands is required")
+	}
+	if len(watchlist.ASINs) > 0 && len(watchlist.Brands) > 0 {
+		return nil, fmt.Errorf("use either asins or brands")
+	}
+	if maxASINs := envInt("WATCHLIST_MAX_ASINS", 10000); len(watchlist.ASINs) > maxASINs {
+		return nil, fmt.Errorf("a watchlist holds at most %d ASINs", maxASINs)
+	}
+	return watchlist, nil
+}
+
+// uniqueValues trims values and drops empty and repeated ones
+func uniqueValues(values []string) []string {
+	var unique []string
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value != "" && !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// watchlistRef returns the document of a watchlist of the tenant of ctx
+func watchlistRef(ctx context.Context, watchlistID string) *firestore.DocumentRef {
+	return tenantCollection(ctx, WatchlistsCollection).Doc(watchlistID)
+}
+
+// loadWatchlist reads a watchlist, failing when it does not exist
+func loadWatchlist(ctx context.Context, watchlistID string) (*Watchlist, error) {
+	snapshot, err := watchlistRef(ctx, watchlistID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("watchlist %s not found", watchlistID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watchlist %s: %v", watchlistID, err)
+	}
+	var watchlist Watchlist
+	if err := snapshot.DataTo(&watchlist); err != nil {
+		return nil, fmt.Errorf("failed to decode watchlist %s: %v", watchlistID, err)
+	}
+	watchlist.ID = snapshot.Ref.ID
+	return &watchlist, nil
+}
+
+// applyWatchlist replaces the selection of a POST /keepa body with the members of the
+// watchlist it names. Brands become the finder's brand filter; ASINs are returned to
+// be processed without a finder scan, so the body must not select anything else.
+func applyWatchlist(ctx context.Context, watchlistID string, requestData map[string]interface{}) ([]string, error) {
+	watchlist, err := loadWatchlist(ctx, watchlistID)
+	if err != nil {
+		return nil, err
+	}
+	if len(watchlist.Brands) > 0 {
+		if _, ok := requestData["brand"]; ok {
+			return nil, fmt.Errorf("use either watchlist or brand")
+		}
+		requestData["brand"] = watchlist.Brands
+		return nil, nil
+	}
+	if len(requestData) > 0 {
+		return nil, fmt.Errorf("the ASIN watchlist %s takes no finder query", watchlistID)
+	}
+	return watchlist.ASINs, nil
+}
+
+// handleCreateWatchlist stores a watchlist
+func handleCreateWatchlist(c *gin.Context) {
+	var req WatchlistRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	watchlist, err := req.watchlist()
+	if err != nil {
+		respondInvalidBody(c, err)
+		return
+	}
+	watchlist.CreatedAt = time.Now().UTC()
+	watchlist.UpdatedAt = watchlist.CreatedAt
+
+	ref, _, err := tenantCollection(c.Request.Context(), WatchlistsCollection).Add(c.Request.Context(), watchlist)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to store watchlist: %v", err))
+		return
+	}
+	watchlist.ID = ref.ID
+	logger.InfoContext(c.Request.Context(), "Created watchlist", "watchlist_id", watchlist.ID, "asins", len(watchlist.ASINs), "brands", len(watchlist.Brands))
+	c.JSON(http.StatusCreated, watchlist)
+}
+
+// handleListWatchlists returns all watchlists, oldest first
+func handleListWatchlists(c *gin.Context) {
+	snapshots, err := tenantCollection(c.Request.Context(), WatchlistsCollection).OrderBy("createdAt", firestore.Asc).Documents(c.Request.Context()).GetAll()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to list watchlists: %v", err))
+		return
+	}
+	watchlists := make([]Watchlist, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		var watchlist Watchlist
+		if err := snapshot.DataTo(&watchlist); err != nil {
+			logger.WarnContext(c.Request.Context(), "Skipping undecodable watchlist", "watchlist_id", snapshot.Ref.ID, "error", err)
+			continue
+		}
+		watchlist.ID = snapshot.Ref.ID
+		watchlists = append(watchlists, watchlist)
+	}
+	c.JSON(http.StatusOK, gin.H{"watchlists": watchlists, "count": len(watchlists)})
+}
+
+// handleGetWatchlist returns a watchlist
+func handleGetWatchlist(c *gin.Context) {
+	snapshot, err := watchlistRef(c.Request.Context(), c.Param("id")).Get(c.Request.Context())
+	if status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Watchlist not found")
+		return
+	}
+	var watchlist Watchlist
+	if err == nil {
+		err = snapshot.DataTo(&watchlist)
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to read watchlist: %v", err))
+		return
+	}
+	watchlist.ID = snapshot.Ref.ID
+	c.JSON(http.StatusOK, watchlist)
+}
+
+// handleUpdateWatchlist replaces the name and members of a watchlist
+func handleUpdateWatchlist(c *gin.Context) {
+	var req WatchlistRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	watchlist, err := req.watchlist()
+	if err != nil {
+		respondInvalidBody(c, err)
+		return
+	}
+	watchlist.ID = c.Param("id")
+	watchlist.UpdatedAt = time.Now().UTC()
+
+	_, err = watchlistRef(c.Request.Context(), watchlist.ID).Update(c.Request.Context(), []firestore.Update{
+		{Path: "name", Value: watchlist.Name},
+		{Path: "asins", Value: watchlist.ASINs},
+		{Path: "brands", Value: watchlist.Brands},
+		{Path: "updatedAt", Value: watchlist.UpdatedAt},
+	})
+	if status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Watchlist not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to update watchlist: %v", err))
+		return
+	}
+	logger.InfoContext(c.Request.Context(), "Updated watchlist", "watchlist_id", watchlist.ID, "asins", len(watchlist.ASINs), "brands", len(watchlist.Brands))
+	handleGetWatchlist(c)
+}
+
+// handleDeleteWatchlist deletes a watchlist. Schedules referencing it fail their next
+// runs until they are changed.
+func handleDeleteWatchlist(c *gin.Context) {
+	ctx := c.Request.Context()
+	ref := watchlistRef(ctx, c.Param("id"))
+	if _, err := ref.Get(ctx); status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Watchlist not found")
+		return
+	}
+	if _, err := ref.Delete(ctx); err != nil {
+		respondError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to delete watchlist: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": ref.ID, "deleted": true})
+}
+
+// handleRefreshWatchlist starts a task fetching the members of a watchlist now. The
+// optional body takes the task settings of POST /keepa, e.g. include, options,
+// categories or callback_url.
+func (client *KeepaClient) handleRefreshWatchlist(c *gin.Context) {
+	requestData := make(map[string]interface{})
+	if c.Request.ContentLength != 0 && !bindJSON(c, &requestData) {
+		return
+	}
+	if _, ok := requestData["watchlist"]; ok {
+		respondError(c, http.StatusBadRequest, "The watchlist is given by the path")
+		return
+	}
+	if _, err := watchlistRef(c.Request.Context(), c.Param("id")).Get(c.Request.Context()); status.Code(err) == codes.NotFound {
+		respondError(c, http.StatusNotFound, "Watchlist not found")
+		return
+	}
+	requestData["watchlist"] = c.Param("id")
+	spec, callbackURL, err := buildFetchSpec(c.Request.Context(), requestData, c.Query("fields"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	taskID := generateTaskID()
+	if !client.startFetchTask(c.Request.Context(), taskID, spec, callbackURL, "") {
+		respondProblem(c, http.StatusServiceUnavailable, CodeQueueFull, "Task queue is full, try again later")
+		return
+	}
+	client.Logger.InfoContext(c.Request.Context(), "Refreshing watchlist", "watchlist_id", spec.Watchlist, LogKeyTaskID, taskID)
+	c.JSON(http.StatusAccepted, withQuotaWarning(gin.H{"task_id": taskID, "status": "pending", "watchlist": spec.Watchlist, "estimated_tokens": spec.maxTokens()}))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// xlsxContentType is the media type of XLSX workbooks
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxStaticParts are the package parts of a workbook with a single sheet, written
+// before the sheet itself
+var xlsxStaticParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Products" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxWriter streams a single-sheet XLSX workbook row by row. Strings are written
+// inline rather than to a shared string table, so no row is kept in memory.
+type xlsxWriter struct {
+	archive *zip.Writer
+	sheet   *bufio.Writer
+	rows    int
+}
+
+// newXLSXWriter writes the workbook parts and opens the sheet
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	archive := zip.NewWriter(w)
+	for _, part := range xlsxStaticParts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+	f, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sheet := bufio.NewWriter(f)
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return &xlsxWriter{archive: archive, sheet: sheet}, nil
+}
+
+// xlsxColumn returns the letters of a zero-based column index, e.g. 27 is "AB"
+func xlsxColumn(index int) string {
+	name := ""
+	for index++; index > 0; index = (index - 1) / 26 {
+		name = string(rune('A'+(index-1)%26)) + name
+	}
+	return name
+}
+
+// writeRow appends a row. Cells may be strings, ints, float64 or nil for an empty cell.
+func (w *xlsxWriter) writeRow(cells []interface{}) error {
+	w.rows++
+	fmt.Fprintf(w.sheet, `<row r="%d">`, w.rows)
+	for i, cell := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(w.rows)
+		switch value := cell.(type) {
+		case nil:
+		case int:
+			fmt.Fprintf(w.sheet, `<c r="%s"><v>%d</v></c>`, ref, value)
+		case float64:
+			fmt.Fprintf(w.sheet, `<c r="%s"><v>%s</v></c>`, ref, strconv.FormatFloat(value, 'f', -1, 64))
+		default:
+			fmt.Fprintf(w.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(w.sheet, []byte(fmt.Sprint(value)))
+			w.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := w.sheet.WriteString(`</row>`)
+	return err
+}
+
+// flush writes the buffered rows to the underlying writer
+func (w *xlsxWriter) flush() error {
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.archive.Flush()
+}
+
+// close finishes the sheet and the archive
+func (w *xlsxWriter) close() error {
+	w.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.archive.Close()
+}
@@ -0,0 +1,5 @@
+// Package graph holds the GraphQL API of the service, generated from schema.graphqls by
+// gqlgen. The server implements ResolverRoot.
+package graph
+
+//go:generate go run github.com/99designs/gqlgen generate
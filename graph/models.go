@@ -0,0 +1,59 @@
+package graph
+
+import (
+	"time"
+)
+
+// Product is a stored product. Prices are in cents, nil when unknown.
+type Product struct {
+	Asin               string
+	Domain             *string // Nil for products stored before domains were tracked
+	Title              string
+	Brand              string
+	Categories         []string
+	CategoryPath       *string
+	ParentAsin         *string
+	BuyBoxPrice        *int
+	BuyBoxAvg30        *int
+	BuyBoxAvg90        *int
+	HasAmazonOffer     bool
+	AmazonAvailability *string
+	MonthlySold        *int
+	OfferCountFBA      int
+	OfferCountFBM      int
+	Rating             *float64
+	ReviewCount        *int
+	FetchedAt          time.Time                // Zero when unknown
+	SalesRanks         map[string]int           // Keyed by keepatime.Layout
+	PriceHistory       map[string][]*PricePoint // By csv type name, e.g. NEW
+}
+
+// PricePoint is one entry of a price history
+type PricePoint struct {
+	Time     time.Time
+	Cents    int
+	Shipping *int
+}
+
+// Snapshot is a stored version of a product
+type Snapshot struct {
+	Time    time.Time
+	Product *Product
+}
+
+// Task is a task of the calling tenant
+type Task struct {
+	ID          string
+	Kind        string
+	Domain      *string
+	Status      string
+	Error       *string
+	Progress    int
+	Total       int
+	Categories  []string
+	ErrorCounts []*ErrorCount
+	ScheduleID  *string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
@@ -0,0 +1,6 @@
+//go:build tools
+
+package graph
+
+// gqlgen is run by go generate, this import keeps it in go.mod
+import _ "github.com/99designs/gqlgen"
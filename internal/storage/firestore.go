@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/auth"
+	"fmt"
+)
+
+// Firebase holds the Firestore and Auth clients of a project
+type Firebase struct {
+	Firestore *firestore.Client
+	Auth      *auth.Client // Verifies ID tokens, nil when it could not be initialized
+}
+
+// NewFirebase connects to Firestore and Firebase Auth of projectID. The Auth error is
+// returned along with the clients, since Firestore works without it.
+func NewFirebase(ctx context.Context, projectID string) (*Firebase, error) {
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: projectID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Firebase: %v", err)
+	}
+	firestoreClient, err := app.Firestore(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Firestore client: %v", err)
+	}
+	clients := &Firebase{Firestore: firestoreClient}
+	if clients.Auth, err = app.Auth(ctx); err != nil {
+		return clients, fmt.Errorf("failed to initialize Firebase Auth: %v", err)
+	}
+	return clients, nil
+}
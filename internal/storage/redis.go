@@ -0,0 +1,164 @@
+// Package storage connects to the stores of the service: Redis for the product cache
+// and shared state, Firestore for tasks and products.
+package storage
+
+import (
+	memorystore "cloud.google.com/go/redis/apiv1"
+	"cloud.google.com/go/redis/apiv1/redispb"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"time"
+)
+
+// Redis deployments
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeCluster    = "cluster"
+	RedisModeSentinel   = "sentinel"
+)
+
+// RedisPool is the connection pool size of a Redis mode
+type RedisPool struct {
+	Size    int
+	MinIdle int
+}
+
+// RedisPoolDefaults are the pool sizes per mode. A cluster client keeps a pool per
+// node, so its pools are smaller than the single pool of the other modes.
+var RedisPoolDefaults = map[string]RedisPool{
+	RedisModeStandalone: {Size: 10, MinIdle: 2},
+	RedisModeCluster:    {Size: 5, MinIdle: 1},
+	RedisModeSentinel:   {Size: 10, MinIdle: 2},
+}
+
+// RedisOptions configures NewRedis
+type RedisOptions struct {
+	Mode             string
+	Addrs            []string      // The instance, the cluster seed nodes or the sentinels
+	DB               int           // Ignored in cluster mode
+	Password         func() string // Authenticates to the data nodes, read for every new connection except in sentinel mode
+	SentinelMaster   string
+	SentinelPassword string
+	Pool             RedisPool
+	TLSConfig        *tls.Config
+}
+
+// NewRedis creates the Redis client of a mode. All modes satisfy
+// redis.UniversalClient, so callers do not depend on the deployment.
+func NewRedis(opts RedisOptions) redis.UniversalClient {
+	password := opts.Password
+	if password == nil {
+		password = func() string { return "" }
+	}
+	credentials := func() (string, string) {
+		return "", password()
+	}
+
+	switch opts.Mode {
+	case RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:               opts.Addrs,
+			CredentialsProvider: credentials,
+			PoolSize:            opts.Pool.Size, // Per node
+			MinIdleConns:        opts.Pool.MinIdle,
+			DialTimeout:         5 * time.Second,
+			ReadTimeout:         3 * time.Second,
+			WriteTimeout:        3 * time.Second,
+			PoolTimeout:         4 * time.Second,
+			TLSConfig:           opts.TLSConfig,
+		})
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.SentinelMaster,
+			SentinelAddrs:    opts.Addrs,
+			SentinelPassword: opts.SentinelPassword,
+			Password:         password(), // Failover clients take no credentials provider
+			DB:               opts.DB,
+			PoolSize:         opts.Pool.Size,
+			MinIdleConns:     opts.Pool.MinIdle,
+			DialTimeout:      5 * time.Second,
+			ReadTimeout:      3 * time.Second,
+			WriteTimeout:     3 * time.Second,
+			PoolTimeout:      4 * time.Second,
+			TLSConfig:        opts.TLSConfig,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:                opts.Addrs[0],
+			CredentialsProvider: credentials,
+			DB:                  opts.DB,
+			PoolSize:            opts.Pool.Size,    // 连接池大小
+			MinIdleConns:        opts.Pool.MinIdle, // 最小空闲连接数
+			DialTimeout:         5 * time.Second,   // 连接超时
+			ReadTimeout:         3 * time.Second,   // 读取超时
+			WriteTimeout:        3 * time.Second,   // 写入超时
+			PoolTimeout:         4 * time.Second,   // 获取连接的超时时间
+			TLSConfig:           opts.TLSConfig,
+		})
+	}
+}
+
+// RedisTLSConfig trusts the CA in caFile or, when it is empty, the server CA of the
+// Memorystore instance named projects/*/locations/*/instances/*
+func RedisTLSConfig(ctx context.Context, caFile, instanceName string) (*tls.Config, error) {
+	var pem []byte
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the Redis CA file: %v", err)
+		}
+		pem = data
+	} else {
+		adminClient, err := memorystore.NewCloudRedisClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the Memorystore client: %v", err)
+		}
+		defer adminClient.Close()
+
+		instance, err := adminClient.GetInstance(ctx, &redispb.GetInstanceRequest{Name: instanceName})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the Memorystore instance: %v", err)
+		}
+		caCerts := instance.GetServerCaCerts()
+		if len(caCerts) == 0 {
+			return nil, fmt.Errorf("the Memorystore instance has no server CA")
+		}
+		pem = []byte(caCerts[0].Cert)
+	}
+
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in the Redis CA")
+	}
+	return &tls.Config{RootCAs: caCertPool}, nil
+}
+
+// GetMany reads several keys in one round trip, returning nil for missing keys.
+// Keys of a cluster live in different slots, which MGET rejects, so the cluster client
+// pipelines one GET per key instead; the pipeline is split per node.
+func GetMany(ctx context.Context, client redis.UniversalClient, keys []string) ([]interface{}, error) {
+	if _, cluster := client.(*redis.ClusterClient); !cluster {
+		return client.MGet(ctx, keys...).Result()
+	}
+	commands := make([]*redis.StringCmd, len(keys))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			commands[i] = pipe.Get(ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, command := range commands {
+		if value, err := command.Result(); err == nil {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
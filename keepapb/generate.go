@@ -0,0 +1,4 @@
+// Package keepapb holds the gRPC API of the service, generated from keepa.proto
+package keepapb
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../keepapb/keepa.proto
@@ -0,0 +1,200 @@
+// Package keepa is a client of the Keepa API: the response models, the error payloads,
+// a local estimate of the token balance and retries of transient failures.
+package keepa
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BaseURL is the root of all Keepa endpoints
+const BaseURL = "https://api.keepa.com"
+
+// ErrRateLimited is returned when Keepa answers 429 for lack of tokens
+var ErrRateLimited = errors.New("Keepa rate limited the request")
+
+// ErrMalformedResponse is returned when a response body cannot be decoded
+var ErrMalformedResponse = errors.New("Malformed Keepa response")
+
+// Client sends requests to the Keepa API
+type Client struct {
+	HTTP   *http.Client // Replaceable to mock the API
+	Logger *slog.Logger
+	Tokens *TokenBucket // Updated from the token state of every response
+	Retry  RetryPolicy  // Used by Do
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client requests are sent with
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.HTTP = httpClient
+	}
+}
+
+// WithLogger sets the logger of the client
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.Logger = logger
+	}
+}
+
+// WithTokenBucket sets the token estimate the client keeps up to date
+func WithTokenBucket(tokens *TokenBucket) Option {
+	return func(c *Client) {
+		c.Tokens = tokens
+	}
+}
+
+// WithRetryPolicy sets how Do retries failed requests
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.Retry = policy
+	}
+}
+
+// NewClient creates a client. Without options it uses http.DefaultClient, discards
+// logs, starts with a full bucket of 300 tokens refilling 5 per minute and retries
+// with DefaultRetryPolicy.
+func NewClient(opts ...Option) *Client {
+	client := &Client{
+		HTTP:   http.DefaultClient,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Tokens: NewTokenBucket(300, 300, 5.0, time.Now()),
+		Retry:  DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+// Reply is the outcome of one Keepa request
+type Reply struct {
+	StatusCode int
+	Body       []byte    // Raw body, capped at 64 KiB for failed requests
+	Response   *Response // Decoded body, nil when Keepa answered with another status than 200 or 429
+}
+
+// Send sends one request without retrying it. body is encoded as JSON when not nil.
+// The response is requested gzipped, as product responses with offers take megabytes,
+// and Body holds it decompressed. A reply is returned whenever Keepa answered. The error is an *Error when Keepa
+// rejected the request and is classified with RetryableError when a retry may succeed.
+func (c *Client) Send(ctx context.Context, method, url string, body interface{}) (*Reply, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Setting the header turns off the transparent decompression of http.Transport
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, &RetryableError{Class: ErrorClass(err), Err: fmt.Errorf("HTTP request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+	reply := &Reply{StatusCode: resp.StatusCode}
+
+	var respBody io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		decompressor, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return reply, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+		}
+		defer decompressor.Close()
+		respBody = decompressor
+	}
+
+	// Rejected requests carry an error payload naming the reason
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusTooManyRequests {
+		reply.Body, _ = io.ReadAll(io.LimitReader(respBody, 64<<10))
+		var statusErr error = fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+		if keepaErr := ParseError(resp.StatusCode, reply.Body); keepaErr != nil {
+			statusErr = keepaErr
+		}
+		return reply, HTTPStatusError(resp.StatusCode, statusErr)
+	}
+
+	if reply.Body, err = io.ReadAll(respBody); err != nil {
+		return reply, fmt.Errorf("Failed to read response body: %v", err)
+	}
+	var apiResp Response
+	if err := json.Unmarshal(reply.Body, &apiResp); err != nil {
+		return reply, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+	reply.Response = &apiResp
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return reply, HTTPStatusError(resp.StatusCode, ErrRateLimited)
+	}
+	if apiResp.Error != nil {
+		return reply, NewError(resp.StatusCode, *apiResp.Error)
+	}
+	return reply, nil
+}
+
+// Do sends a request, retrying it as the retry policy allows. Rate limited requests
+// wait for the refill Keepa announced before the policy's backoff.
+func (c *Client) Do(ctx context.Context, method, url string, body interface{}) (*Response, error) {
+	startedAt := time.Now()
+	for attempt := 1; ; attempt++ {
+		reply, err := c.Send(ctx, method, url, body)
+		if reply != nil && reply.Response != nil {
+			c.UpdateTokens(reply.Response)
+		}
+		if err == nil {
+			return reply.Response, nil
+		}
+
+		wait := c.Retry.Delay(attempt)
+		if errors.Is(err, ErrRateLimited) && reply.Response.RefillIn > 0 {
+			wait += time.Duration(reply.Response.RefillIn) * time.Millisecond
+		}
+		if ctx.Err() != nil || !c.Retry.Retries(ErrorClass(err)) || !c.Retry.AllowsRetry(attempt, startedAt, wait) {
+			return nil, err
+		}
+		c.Logger.WarnContext(ctx, "Retrying Keepa request after error", "attempt", attempt, "wait_seconds", wait.Seconds(), "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%v (retry aborted: %v)", err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// UpdateTokens replaces the token estimate with the state reported by a response and
+// learns the refill rate of the plan from it. It reports whether the rate changed.
+func (c *Client) UpdateTokens(apiResp *Response) bool {
+	at := time.Now()
+	if apiResp.Timestamp > 0 {
+		at = time.UnixMilli(apiResp.Timestamp)
+	}
+	learned := c.Tokens.Learn(apiResp.RefillRate, apiResp.TokensLeft)
+	c.Tokens.Set(apiResp.TokensLeft, at)
+	return learned
+}
@@ -0,0 +1,72 @@
+package keepa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrorPayload is the "error" member Keepa sets when it rejects a request
+type ErrorPayload struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	Details string `json:"details,omitempty"`
+}
+
+// Kinds of Keepa errors, matched with errors.Is against an *Error
+var (
+	ErrInvalidKey      = errors.New("Keepa rejected the API key")
+	ErrPaymentRequired = errors.New("Keepa requires a payment")
+	ErrInvalidQuery    = errors.New("Keepa rejected the request parameters")
+)
+
+// Error is an error payload Keepa answered with
+type Error struct {
+	StatusCode int
+	Payload    ErrorPayload
+	kind       error // One of the Err* errors, nil when the type is not known
+}
+
+func (e *Error) Error() string {
+	message := e.Payload.Message
+	if message == "" {
+		message = http.StatusText(e.StatusCode)
+	}
+	if e.Payload.Details != "" {
+		message += ": " + e.Payload.Details
+	}
+	return fmt.Sprintf("Keepa error %s (status %d): %s", e.Payload.Type, e.StatusCode, message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// NewError maps an error payload to its kind by the HTTP status and the error type
+func NewError(statusCode int, payload ErrorPayload) *Error {
+	errorType := strings.ToLower(payload.Type)
+	var kind error
+	switch {
+	case statusCode == http.StatusPaymentRequired || strings.Contains(errorType, "payment"):
+		kind = ErrPaymentRequired
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || strings.Contains(errorType, "key"):
+		kind = ErrInvalidKey
+	case statusCode == http.StatusBadRequest || statusCode == http.StatusMethodNotAllowed ||
+		strings.Contains(errorType, "invalid") || strings.Contains(errorType, "rejected") || strings.Contains(errorType, "parameter"):
+		kind = ErrInvalidQuery
+	}
+	return &Error{StatusCode: statusCode, Payload: payload, kind: kind}
+}
+
+// ParseError returns the error of a response body, nil when it has no error payload
+func ParseError(statusCode int, body []byte) *Error {
+	var response struct {
+		Error *ErrorPayload `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Error == nil {
+		return nil
+	}
+	return NewError(statusCode, *response.Error)
+}
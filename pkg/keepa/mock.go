@@ -0,0 +1,241 @@
+package keepa
+
+import (
+	"Keepa-api/pkg/keepatime"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockOptions configures a MockTransport
+type MockOptions struct {
+	FixturesDir   string        // Recorded payloads, empty to generate every response
+	Latency       time.Duration // Added to every response
+	LatencyJitter time.Duration // Random extra latency up to this duration
+	RateLimitRate float64       // Fraction of requests answered 429 regardless of the balance
+	RefillRate    int           // Tokens per minute of the simulated plan, the bucket holds an hour of it
+}
+
+// MockTransport answers Keepa requests without contacting api.keepa.com, so tests
+// spend no tokens. Responses come from recorded payloads in FixturesDir:
+//
+//	product/<ASIN>.json  a product object, served by /product for that ASIN
+//	<endpoint>.json      a whole response of the endpoint, e.g. query.json or deal.json
+//
+// Products without a fixture are generated from their ASIN and endpoints without one
+// answer an empty response. Every response carries the token state of a simulated
+// bucket; requests are answered 429 while it is empty.
+type MockTransport struct {
+	opts   MockOptions
+	tokens *TokenBucket
+
+	mu  sync.Mutex // Guards the balance between refill and spending
+	rng *rand.Rand
+}
+
+// NewMockTransport creates a transport starting with a full bucket
+func NewMockTransport(opts MockOptions) *MockTransport {
+	if opts.RefillRate <= 0 {
+		opts.RefillRate = 1000
+	}
+	capacity := opts.RefillRate * 60
+	return &MockTransport{
+		opts:   opts,
+		tokens: NewTokenBucket(capacity, capacity, float64(opts.RefillRate), time.Now()),
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// RoundTrip answers req from the fixtures after the configured latency
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	startedAt := time.Now()
+	if err := m.sleep(req); err != nil {
+		return nil, err
+	}
+
+	endpoint := strings.Trim(path.Base(req.URL.Path), "/")
+	body, products, err := m.fixture(endpoint, req)
+	if err != nil {
+		return m.respond(req, http.StatusInternalServerError, map[string]interface{}{
+			"error": ErrorPayload{Type: "mockFixture", Message: err.Error()},
+		}), nil
+	}
+
+	cost := products
+	if cost < 1 {
+		cost = 1
+	}
+	tokensLeft, allowed := m.spend(cost)
+	state := map[string]interface{}{
+		"timestamp":          time.Now().UnixMilli(),
+		"tokensLeft":         tokensLeft,
+		"refillIn":           int(m.tokens.TimeUntil(1).Milliseconds()),
+		"refillRate":         m.opts.RefillRate,
+		"tokenFlowReduction": 0,
+		"processingTimeInMs": int(time.Since(startedAt).Milliseconds()),
+	}
+	if !allowed {
+		state["tokensConsumed"] = 0
+		return m.respond(req, http.StatusTooManyRequests, state), nil
+	}
+	for key, value := range state {
+		body[key] = value
+	}
+	body["tokensConsumed"] = cost
+	return m.respond(req, http.StatusOK, body), nil
+}
+
+// sleep waits for the configured latency or until the request is canceled
+func (m *MockTransport) sleep(req *http.Request) error {
+	latency := m.opts.Latency
+	if m.opts.LatencyJitter > 0 {
+		m.mu.Lock()
+		latency += time.Duration(m.rng.Int63n(int64(m.opts.LatencyJitter)))
+		m.mu.Unlock()
+	}
+	if latency <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// spend takes cost tokens unless the bucket is empty or a 429 is injected. Keepa
+// accepts a request while the balance is positive, so the balance may go negative.
+func (m *MockTransport) spend(cost int) (int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	balance, _ := m.tokens.Refill(now)
+	if balance <= 0 || (m.opts.RateLimitRate > 0 && m.rng.Float64() < m.opts.RateLimitRate) {
+		return balance, false
+	}
+	m.tokens.Set(balance-cost, now)
+	return balance - cost, true
+}
+
+// fixture returns the response body of an endpoint and the number of products in it
+func (m *MockTransport) fixture(endpoint string, req *http.Request) (map[string]interface{}, int, error) {
+	body := map[string]interface{}{}
+	if data, err := m.readFixture(endpoint + ".json"); err != nil {
+		return nil, 0, err
+	} else if data != nil {
+		if err := json.Unmarshal(data, &body); err != nil {
+			return nil, 0, fmt.Errorf("invalid fixture %s.json: %v", endpoint, err)
+		}
+	}
+	if endpoint != "product" {
+		products, _ := body["products"].([]interface{})
+		return body, len(products), nil
+	}
+
+	// Serve the requested ASINs, recorded ones first
+	query := req.URL.Query()
+	asins := query.Get("asin")
+	if asins == "" {
+		asins = query.Get("code")
+	}
+	recorded := map[string]json.RawMessage{}
+	if list, ok := body["products"].([]interface{}); ok {
+		for _, product := range list {
+			if fields, ok := product.(map[string]interface{}); ok {
+				asin, _ := fields["asin"].(string)
+				recorded[asin], _ = json.Marshal(fields)
+			}
+		}
+	}
+	var products []json.RawMessage
+	for _, asin := range strings.Split(asins, ",") {
+		if asin = strings.TrimSpace(asin); asin == "" {
+			continue
+		}
+		data, err := m.readFixture(filepath.Join("product", filepath.Base(asin)+".json"))
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case data != nil:
+			products = append(products, data)
+		case recorded[asin] != nil:
+			products = append(products, recorded[asin])
+		default:
+			products = append(products, mockProduct(asin, query.Get("domain")))
+		}
+	}
+	body["products"] = products
+	return body, len(products), nil
+}
+
+// readFixture returns the content of a fixture file, nil when it does not exist
+func (m *MockTransport) readFixture(name string) ([]byte, error) {
+	if m.opts.FixturesDir == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(m.opts.FixturesDir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// mockProduct generates a product for an ASIN without a fixture
+func mockProduct(asin, domain string) json.RawMessage {
+	domainID := 1
+	fmt.Sscanf(domain, "%d", &domainID)
+	data, _ := json.Marshal(map[string]interface{}{
+		"asin":        asin,
+		"domainId":    domainID,
+		"title":       "Mock product " + asin,
+		"productType": 0,
+		"lastUpdate":  keepatime.Now(),
+	})
+	return data
+}
+
+// respond encodes body as the response to req, gzipped when the request accepts it
+// like Keepa does
+func (m *MockTransport) respond(req *http.Request, statusCode int, body interface{}) *http.Response {
+	data, _ := json.Marshal(body)
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(data)
+		writer.Close()
+		data = compressed.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	return &http.Response{
+		StatusCode:    statusCode,
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
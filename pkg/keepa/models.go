@@ -1,44 +1,144 @@
-package main
+package keepa
 
-import (
-	"log"
-	"time"
-)
+// Response is the body of every Keepa API response. Besides the token state, only the
+// members of the called endpoint are set.
+type Response struct {
+	Timestamp          int64               `json:"timestamp"`
+	TokensLeft         int                 `json:"tokensLeft"`
+	RefillIn           int                 `json:"refillIn"`
+	RefillRate         int                 `json:"refillRate"`
+	TokenFlowReduction float64             `json:"tokenFlowReduction"`
+	TokensConsumed     int                 `json:"tokensConsumed"`
+	ProcessingTimeInMs int                 `json:"processingTimeInMs"`
+	AsinList           []string            `json:"asinList"`
+	Products           []Product           `json:"products"`
+	TotalResults       int                 `json:"totalResults"`
+	Categories         map[string]Category `json:"categories"`
+	Deals              *Deals              `json:"deals"`
+	BestSellersList    *BestSellers        `json:"bestSellersList"`
+	Sellers            map[string]Seller   `json:"sellers"`
+	Trackings          []Tracking          `json:"trackings"`
+	LightningDeals     []LightningDeal     `json:"lightningDeals"`
+	Error              *ErrorPayload       `json:"error"` // Set when Keepa rejected the request
+}
+
+// LightningDeal is a lightning deal of the lightningdeal endpoint
+type LightningDeal struct {
+	DomainID        int    `json:"domainId"`
+	LastUpdate      int    `json:"lastUpdate"` // Keepa time
+	Asin            string `json:"asin"`
+	Title           string `json:"title"`
+	SellerName      string `json:"sellerName"`
+	SellerID        string `json:"sellerId"`
+	DealID          string `json:"dealId"`
+	DealPrice       int    `json:"dealPrice"`
+	CurrentPrice    int    `json:"currentPrice"`
+	IsPrimeEligible bool   `json:"isPrimeEligible"`
+	IsFBA           bool   `json:"isFulfilledByAmazon"`
+	DealState       string `json:"dealState"` // AVAILABLE, UPCOMING, WAITLIST, SOLDOUT, WAITLISTFULL, EXPIRED or SUPPRESSED
+	StartTime       int    `json:"startTime"` // Keepa time
+	EndTime         int    `json:"endTime"`   // Keepa time
+	PercentClaimed  int    `json:"percentClaimed"`
+	RootCat         int64  `json:"rootCat"`
+}
+
+// Tracking is a product tracker of the tracking endpoint
+type Tracking struct {
+	Asin             string              `json:"asin"`
+	CreateDate       int                 `json:"createDate"` // Keepa time
+	TTL              int                 `json:"ttl"`        // Hours until the tracker expires, 0 for never
+	ExpireNotify     bool                `json:"expireNotify"`
+	MainDomainID     int                 `json:"mainDomainId"`
+	ThresholdValues  []TrackingThreshold `json:"thresholdValues"`
+	NotificationType []bool              `json:"notificationType"` // Indexed by notification channel, 5 is API push
+	UpdateInterval   int                 `json:"updateInterval"`   // Hours between product updates
+	MetaData         string              `json:"metaData"`
+}
 
-// Task represents the state of a task
-type Task struct {
-	ID         string     `json:"id"`
-	Status     string     `json:"status"` // "pending", "completed", "failed"
-	ASINs      []string   `json:"asins,omitempty"`
-	Products   []string   `json:"products,omitempty"` // Stores historical data for each ASIN
-	Error      string     `json:"error,omitempty"`
-	CreatedAt  time.Time  `json:"created_at"`
-	FinishedAt *time.Time `json:"finished_at,omitempty"`
-	Progress   int        `json:"progress"` // Number of ASINs processed so far
-	Total      int        `json:"total"`    // Total number of ASINs to process
+// TrackingThreshold notifies when a price type crosses a value
+type TrackingThreshold struct {
+	ThresholdValue int  `json:"thresholdValue"`
+	Domain         int  `json:"domain"`
+	CsvType        int  `json:"csvType"`
+	IsDrop         bool `json:"isDrop"`
 }
 
-// KeepaClient represents a Keepa API client
-type KeepaClient struct {
-	TokensLeft      int
-	RefillRate      float64
-	SafetyThreshold int
-	MaxRetries      int
-	Logger          *log.Logger
-	LastTimestamp   int64 // Last request timestamp for precise token recovery calculation
+// Notification is a tracking notification pushed by Keepa
+type Notification struct {
+	Asin                      string `json:"asin"`
+	Title                     string `json:"title"`
+	CreateDate                int    `json:"createDate"` // Keepa time
+	DomainID                  int    `json:"domainId"`
+	NotificationDomainID      int    `json:"notificationDomainId"`
+	CsvType                   int    `json:"csvType"`
+	TrackingNotificationCause int    `json:"trackingNotificationCause"`
+	CurrentPrices             []int  `json:"currentPrices"`
+	MetaData                  string `json:"metaData"`
 }
 
-type APIResponse struct {
-	Timestamp          int64          `json:"timestamp"`
-	TokensLeft         int            `json:"tokensLeft"`
-	RefillIn           int            `json:"refillIn"`
-	RefillRate         int            `json:"refillRate"`
-	TokenFlowReduction float64        `json:"tokenFlowReduction"`
-	TokensConsumed     int            `json:"tokensConsumed"`
-	ProcessingTimeInMs int            `json:"processingTimeInMs"`
-	AsinList           []string       `json:"asinList"`
-	Products           []KeepaProduct `json:"products"`
-	TotalResults       int            `json:"totalResults"`
+// Seller is a seller object of the seller endpoint. Csv index 0 is the rating
+// history in percent, index 1 the rating count history, both as time/value pairs.
+type Seller struct {
+	SellerID             string   `json:"sellerId"`
+	SellerName           string   `json:"sellerName"`
+	DomainID             int      `json:"domainId"`
+	Csv                  [][]int  `json:"csv"`
+	TrackedSince         int      `json:"trackedSince"` // Keepa time
+	LastUpdate           int      `json:"lastUpdate"`   // Keepa time
+	IsScammer            bool     `json:"isScammer"`
+	HasFBA               bool     `json:"hasFBA"`
+	CurrentRating        int      `json:"currentRating"`
+	CurrentRatingCount   int      `json:"currentRatingCount"`
+	RatingsLast30Days    int      `json:"ratingsLast30Days"`
+	TotalStorefrontAsins []int    `json:"totalStorefrontAsins"` // Time/count pairs
+	AsinList             []string `json:"asinList"`             // Storefront ASINs, only with storefront=1
+	BusinessName         string   `json:"businessName"`
+}
+
+// BestSellers is the best sellers list of a category, ordered by sales rank
+type BestSellers struct {
+	DomainID   int      `json:"domainId"`
+	LastUpdate int      `json:"lastUpdate"` // Keepa time
+	CategoryID int64    `json:"categoryId"`
+	AsinList   []string `json:"asinList"`
+}
+
+// Deals is the result of a deal request
+type Deals struct {
+	Deals         []Deal   `json:"dr"`
+	CategoryIDs   []int64  `json:"categoryIds"`
+	CategoryNames []string `json:"categoryNames"`
+	CategoryCount []int    `json:"categoryCount"`
+}
+
+// Deal is a product whose price recently changed. Price arrays are indexed
+// by price type; delta and avg are indexed by date range first.
+type Deal struct {
+	Asin               string  `json:"asin"`
+	Title              string  `json:"title"`
+	RootCat            int64   `json:"rootCat"`
+	Categories         []int64 `json:"categories"`
+	Image              []byte  `json:"image"`
+	Current            []int   `json:"current"`
+	Delta              [][]int `json:"delta"`
+	DeltaPercent       [][]int `json:"deltaPercent"`
+	Avg                [][]int `json:"avg"`
+	CreationDate       int     `json:"creationDate"` // Keepa time
+	LastUpdate         int     `json:"lastUpdate"`   // Keepa time
+	LightningEnd       int     `json:"lightningEnd"`
+	WarehouseCondition int     `json:"warehouseCondition"`
+}
+
+// Category represents a node of the Keepa category tree
+type Category struct {
+	DomainID        int     `json:"domainId" firestore:"domainId"`
+	CatID           int64   `json:"catId" firestore:"catId"`
+	Name            string  `json:"name" firestore:"name"`
+	ContextFreeName string  `json:"contextFreeName" firestore:"contextFreeName"`
+	Children        []int64 `json:"children" firestore:"children"`
+	Parent          int64   `json:"parent" firestore:"parent"`
+	HighestRank     int     `json:"highestRank" firestore:"highestRank"`
+	ProductCount    int     `json:"productCount" firestore:"productCount"`
 }
 
 // Offer represents a single marketplace offer
@@ -172,8 +272,8 @@ type ProductStats struct {
 	BuyBoxUsedStats                map[string]BuyBoxSellerStats `json:"buyBoxUsedStats"`
 }
 
-// AutoGenerated is the main product data structure
-type KeepaProduct struct {
+// Product is a product object of the product and finder endpoints
+type Product struct {
 	Csv                             []interface{}      `json:"csv"`
 	Categories                      []int64            `json:"categories"`
 	ImagesCSV                       string             `json:"imagesCSV"`
@@ -270,27 +370,3 @@ type KeepaProduct struct {
 	ReferralFeePercent              int                `json:"referralFeePercent"`
 	ReferralFeePercentage           float64            `json:"referralFeePercentage"`
 }
-
-// Create simplified response with only the needed fields
-type SimplifiedOffer struct {
-	SellerID  string         `json:"sellerId"`
-	Condition int            `json:"condition"`
-	IsPrime   bool           `json:"isPrime"`
-	IsAmazon  bool           `json:"isAmazon"`
-	IsFBA     bool           `json:"isFBA"`
-	StockCSV  map[string]int `json:"stockCSV,omitempty"`
-}
-
-type SimplifiedProduct struct {
-	Asin        string            `json:"asin"`
-	Title       string            `json:"title"`
-	Categories  []int64           `json:"categories"`
-	Brand       string            `json:"brand"`
-	BuyBoxPrice int               `json:"buyBoxPrice,omitempty"`
-	SalesRanks  map[string]int    `json:"salesRanks,omitempty"`
-	Offers      []SimplifiedOffer `json:"offers,omitempty"`
-}
-
-type SimplifiedResponse struct {
-	Products []SimplifiedProduct `json:"products"`
-}
@@ -0,0 +1,130 @@
+package keepa
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Retryable error classes a policy can opt into
+const (
+	RetryOnNetwork     = "network"      // Connection errors
+	RetryOnTimeout     = "timeout"      // Deadlines and I/O timeouts
+	RetryOnRateLimited = "rate_limited" // HTTP 429 or gRPC ResourceExhausted
+	RetryOnServerError = "server_error" // HTTP 5xx
+	RetryOnUnavailable = "unavailable"  // gRPC Unavailable/Aborted
+)
+
+// RetryPolicy controls how calls to one dependency are retried
+type RetryPolicy struct {
+	MaxAttempts    int      `json:"maxAttempts"`    // Total attempts including the first one
+	InitialBackoff string   `json:"initialBackoff"` // Duration, e.g. "500ms"
+	MaxBackoff     string   `json:"maxBackoff"`
+	Backoff        string   `json:"backoff"`    // "exponential", "linear" or "constant"
+	Jitter         float64  `json:"jitter"`     // Random +/- fraction applied to every backoff
+	RetryOn        []string `json:"retryOn"`    // Retryable error classes
+	MaxElapsed     string   `json:"maxElapsed"` // Duration after which no retry is started, empty for no limit
+}
+
+// DefaultRetryPolicy retries Keepa requests that were rate limited or failed for
+// transient reasons
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4, InitialBackoff: "1s", MaxBackoff: "5m", Backoff: "exponential", Jitter: 0.2,
+	RetryOn:    []string{RetryOnRateLimited, RetryOnNetwork, RetryOnTimeout, RetryOnServerError},
+	MaxElapsed: "10m",
+}
+
+// Retries reports whether the policy retries errors of the given class
+func (p RetryPolicy) Retries(class string) bool {
+	return class != "" && slices.Contains(p.RetryOn, class)
+}
+
+// AllowsRetry reports whether a retry waiting wait may start after the given attempt
+// of a call that started at startedAt
+func (p RetryPolicy) AllowsRetry(attempt int, startedAt time.Time, wait time.Duration) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	maxElapsed, err := time.ParseDuration(p.MaxElapsed)
+	if err != nil || maxElapsed <= 0 {
+		return true
+	}
+	return time.Since(startedAt)+wait <= maxElapsed
+}
+
+// Delay returns the wait before the given retry (1 for the first retry)
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	initial, err := time.ParseDuration(p.InitialBackoff)
+	if err != nil {
+		initial = time.Second
+	}
+
+	wait := initial
+	switch p.Backoff {
+	case "constant":
+	case "linear":
+		wait = initial * time.Duration(retry)
+	default:
+		wait = time.Duration(float64(initial) * math.Pow(2, float64(retry-1)))
+	}
+
+	if maxBackoff, err := time.ParseDuration(p.MaxBackoff); err == nil && maxBackoff > 0 && wait > maxBackoff {
+		wait = maxBackoff
+	}
+	if p.Jitter > 0 {
+		wait = time.Duration(float64(wait) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return wait
+}
+
+// RetryableError tags an error with its retry class
+type RetryableError struct {
+	Class string
+	Err   error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPStatusError returns an error classified by the HTTP status code. Only transient
+// server errors are retryable; e.g. 501 Not Implemented will not change on a retry.
+func HTTPStatusError(statusCode int, err error) error {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return &RetryableError{Class: RetryOnRateLimited, Err: err}
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return &RetryableError{Class: RetryOnServerError, Err: err}
+	case http.StatusGatewayTimeout:
+		return &RetryableError{Class: RetryOnTimeout, Err: err}
+	}
+	return err
+}
+
+// ErrorClass classifies err for retry decisions, returning "" for permanent errors
+func ErrorClass(err error) string {
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		return retryable.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return RetryOnTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return RetryOnTimeout
+		}
+		return RetryOnNetwork
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package keepa
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a local estimate of the Keepa token balance. Tokens refill at
+// refillRate per minute up to capacity. It is safe for concurrent use.
+type TokenBucket struct {
+	mu         sync.Mutex
+	tokens     float64 // Fractions accumulate until a whole token is recovered
+	capacity   int
+	refillRate float64 // Tokens per minute
+	updatedAt  time.Time
+}
+
+// NewTokenBucket creates a bucket holding tokens at now
+func NewTokenBucket(tokens, capacity int, refillRate float64, now time.Time) *TokenBucket {
+	return &TokenBucket{tokens: float64(tokens), capacity: capacity, refillRate: refillRate, updatedAt: now}
+}
+
+// refill adds the tokens recovered since the last update. The caller must hold mu.
+func (b *TokenBucket) refill(now time.Time) float64 {
+	elapsed := now.Sub(b.updatedAt)
+	if elapsed <= 0 {
+		return 0
+	}
+	recovered := elapsed.Minutes() * b.refillRate
+	b.tokens = math.Min(float64(b.capacity), b.tokens+recovered)
+	b.updatedAt = now
+	return recovered
+}
+
+// Refill adds the tokens recovered until now and returns the balance and the tokens recovered
+func (b *TokenBucket) Refill(now time.Time) (int, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	recovered := b.refill(now)
+	return int(b.tokens), recovered
+}
+
+// Consume refills the bucket and takes n tokens if n plus threshold are available. It
+// returns the balance and whether the tokens were taken.
+func (b *TokenBucket) Consume(n, threshold int, now time.Time) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < float64(n+threshold) {
+		return int(b.tokens), false
+	}
+	b.tokens -= float64(n)
+	return int(b.tokens), true
+}
+
+// Set replaces the balance with the one Keepa reported at the given time
+func (b *TokenBucket) Set(tokens int, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = float64(tokens)
+	b.updatedAt = at
+}
+
+// Tokens returns the balance without refilling
+func (b *TokenBucket) Tokens() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.tokens)
+}
+
+// RefillRate returns the tokens recovered per minute
+func (b *TokenBucket) RefillRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refillRate
+}
+
+// Capacity returns the most tokens the bucket holds
+func (b *TokenBucket) Capacity() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.capacity
+}
+
+// Learn adopts the refill rate Keepa reported. Unused tokens expire after an hour,
+// so the bucket holds 60 minutes of refill, or more if Keepa reports a higher balance.
+// It returns whether the rate or capacity changed.
+func (b *TokenBucket) Learn(refillRate, tokensLeft int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := false
+	if refillRate > 0 && float64(refillRate) != b.refillRate {
+		b.refillRate = float64(refillRate)
+		b.capacity = refillRate * 60
+		changed = true
+	}
+	if tokensLeft > b.capacity {
+		b.capacity = tokensLeft
+		changed = true
+	}
+	return changed
+}
+
+// TokenBucketState is a snapshot of a TokenBucket
+type TokenBucketState struct {
+	TokensLeft int       `json:"tokensLeft"`
+	Capacity   int       `json:"capacity"`
+	RefillRate float64   `json:"refillRate"` // Tokens per minute
+	FullIn     float64   `json:"fullInSeconds"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// State refills the bucket and returns its state
+func (b *TokenBucket) State(now time.Time) TokenBucketState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	state := TokenBucketState{
+		TokensLeft: int(b.tokens),
+		Capacity:   b.capacity,
+		RefillRate: b.refillRate,
+		UpdatedAt:  b.updatedAt,
+	}
+	if missing := float64(b.capacity) - b.tokens; missing > 0 && b.refillRate > 0 {
+		state.FullIn = missing / b.refillRate * 60
+	}
+	return state
+}
+
+// TimeUntil returns how long it takes to recover n tokens
+func (b *TokenBucket) TimeUntil(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 || b.refillRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / b.refillRate * float64(time.Minute))
+}
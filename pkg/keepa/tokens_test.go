@@ -0,0 +1,102 @@
+package keepa
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runConcurrently calls fn(i) for i in [0, n) from n goroutines and waits for them
+func runConcurrently(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			fn(i)
+		}()
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestTokenBucketConcurrentConsume(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := NewTokenBucket(1000, 1200, 20, now)
+
+	// Twice as many tokens are requested as there are, at the same instant so
+	// nothing refills: exactly the balance is taken
+	var taken atomic.Int64
+	runConcurrently(50, func(int) {
+		for j := 0; j < 40; j++ {
+			if _, ok := bucket.Consume(1, 0, now); ok {
+				taken.Add(1)
+			}
+		}
+	})
+	if taken.Load() != 1000 {
+		t.Errorf("took %d tokens, want 1000", taken.Load())
+	}
+	if got := bucket.Tokens(); got != 0 {
+		t.Errorf("Tokens() = %d, want 0", got)
+	}
+}
+
+func TestTokenBucketConcurrentRefill(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := NewTokenBucket(100, 1200, 20, start)
+
+	// Every goroutine refills up to the same instant, so only one of them recovers
+	// the 10 minutes of tokens
+	later := start.Add(10 * time.Minute)
+	var recovered float64
+	var mu sync.Mutex
+	runConcurrently(50, func(int) {
+		_, r := bucket.Refill(later)
+		mu.Lock()
+		recovered += r
+		mu.Unlock()
+	})
+	if recovered != 200 {
+		t.Errorf("recovered %v tokens, want 200", recovered)
+	}
+	if got := bucket.Tokens(); got != 300 {
+		t.Errorf("Tokens() = %d, want 300", got)
+	}
+}
+
+func TestTokenBucketConcurrentMixed(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := NewTokenBucket(0, 1200, 20, start)
+	end := start.Add(time.Minute)
+
+	// Consumers, refills and balance updates interleave; once all are done the
+	// last update wins and the bucket refills at the learned rate
+	runConcurrently(60, func(i int) {
+		switch i % 3 {
+		case 0:
+			for j := 0; j < 20; j++ {
+				bucket.Consume(1, 0, start.Add(time.Duration(j)*time.Second))
+			}
+		case 1:
+			for j := 0; j < 20; j++ {
+				bucket.Refill(start.Add(time.Duration(j) * time.Second))
+				bucket.State(start.Add(time.Duration(j) * time.Second))
+			}
+		case 2:
+			bucket.Learn(60, 500)
+			bucket.Set(500, start)
+		}
+	})
+	bucket.Set(500, start)
+	balance, _ := bucket.Consume(100, 0, end)
+	if balance != 460 {
+		t.Errorf("balance = %d, want 460 (500 + 60 refilled - 100)", balance)
+	}
+	if got := bucket.Capacity(); got != 3600 {
+		t.Errorf("Capacity() = %d, want 3600", got)
+	}
+}
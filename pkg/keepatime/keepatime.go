@@ -0,0 +1,55 @@
+// Package keepatime converts Keepa time, the minutes since 2011-01-01 00:00 UTC used
+// by all Keepa histories and timestamps, and decodes the time/value pairs of histories.
+package keepatime
+
+import (
+	"time"
+)
+
+// epochOffset is the Unix time of the Keepa epoch in minutes
+const epochOffset = 21564000
+
+// Epoch is Keepa time 0
+var Epoch = time.Unix(epochOffset*60, 0).UTC()
+
+// Layout is the layout of decoded history keys. The keys are UTC and sort
+// chronologically.
+const Layout = time.DateTime
+
+// ToTime converts Keepa minutes to a UTC time
+func ToTime(keepaMinutes int) time.Time {
+	return time.Unix(int64(keepaMinutes+epochOffset)*60, 0).UTC()
+}
+
+// FromTime converts t to Keepa minutes, truncating seconds
+func FromTime(t time.Time) int {
+	return int(t.Unix()/60) - epochOffset
+}
+
+// Now returns the current Keepa time
+func Now() int {
+	return FromTime(time.Now())
+}
+
+// Key formats Keepa minutes as a history key
+func Key(keepaMinutes int) string {
+	return ToTime(keepaMinutes).Format(Layout)
+}
+
+// ParseKey parses a history key written by Key
+func ParseKey(key string) (time.Time, error) {
+	return time.ParseInLocation(Layout, key, time.UTC)
+}
+
+// History decodes a list of [time, value] pairs into a map keyed by Key. It returns
+// nil for an empty list or one of odd length.
+func History(csv []int) map[string]int {
+	if len(csv) == 0 || len(csv)%2 != 0 {
+		return nil
+	}
+	history := make(map[string]int, len(csv)/2)
+	for i := 0; i < len(csv); i += 2 {
+		history[Key(csv[i])] = csv[i+1]
+	}
+	return history
+}